@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// mountAdmin registers the operator endpoints under /api/admin. They are
+// not part of the versioned public API and need the admin API key.
+func (s *Server) mountAdmin() {
+	admin := s.router.PathPrefix("/api/admin").Subrouter()
+	admin.Use(s.requireAdmin)
+	s.routesAdmin(admin)
+}
+
+// routesAdmin registers the admin endpoints
+func (s *Server) routesAdmin(r *mux.Router) {
+	r.HandleFunc("/reconciliation", s.handleReconciliation).Methods("GET")
+	r.HandleFunc("/audit", s.handleAuditLog).Methods("GET")
+	r.HandleFunc("/audit/verify", s.handleAuditVerify).Methods("GET")
+}
+
+// requireAdmin passes only requests carrying the admin API key. Like
+// advertiser keys, only its SHA-256 is configured; with none the admin
+// API is off.
+func (s *Server) requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		expected := strings.ToLower(s.cfg().AdminAPIKeySHA256)
+		if expected == "" {
+			writeError(w, newAPIError(CodeUnauthorized, "admin API is disabled; set admin_api_key_sha256 to enable it", nil))
+			return
+		}
+
+		key := apiKeyFromRequest(r)
+		sum := sha256.Sum256([]byte(key))
+		if key == "" || subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(expected)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, newAPIError(CodeUnauthorized, "invalid or missing admin API key", nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
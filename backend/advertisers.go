@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// AdvertiserConfig grants one advertiser access to reports on its campaigns.
+// Only a hash of the API key is configured, so config files and
+// --print-config never contain usable keys.
+type AdvertiserConfig struct {
+	ID           string   `json:"id" yaml:"id"`
+	Name         string   `json:"name,omitempty" yaml:"name,omitempty"`
+	APIKeySHA256 string   `json:"api_key_sha256" yaml:"api_key_sha256"` // hex SHA-256 of the API key
+	Campaigns    []string `json:"campaigns" yaml:"campaigns"`           // ad IDs the advertiser pays for
+}
+
+var advertiserIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// validateAdvertisers checks the advertisers list for Config.Validate
+func validateAdvertisers(advertisers []AdvertiserConfig) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, a := range advertisers {
+		if !advertiserIDPattern.MatchString(a.ID) {
+			errs = append(errs, fmt.Errorf("advertisers[%d].id: %q must be 1-64 letters, digits, '-' or '_'", i, a.ID))
+		} else if seen[a.ID] {
+			errs = append(errs, fmt.Errorf("advertisers[%d].id: duplicate advertiser %q", i, a.ID))
+		}
+		seen[a.ID] = true
+
+		if b, err := hex.DecodeString(a.APIKeySHA256); err != nil || len(b) != sha256.Size {
+			errs = append(errs, fmt.Errorf("advertisers[%d].api_key_sha256: must be a hex SHA-256 digest", i))
+		}
+		if len(a.Campaigns) == 0 {
+			errs = append(errs, fmt.Errorf("advertisers[%d].campaigns: must list at least one ad ID", i))
+		}
+	}
+	return errs
+}
+
+// apiKeyFromRequest reads an API key from "Authorization: Bearer <key>" or X-API-Key
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if key, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(key)
+		}
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// authenticateAdvertiser returns the advertiser with id if key is its API key.
+// Unknown advertisers and wrong keys fail the same way so ids can't be probed.
+func (s *Server) authenticateAdvertiser(id, key string) (*AdvertiserConfig, bool) {
+	if key == "" {
+		return nil, false
+	}
+	sum := sha256.Sum256([]byte(key))
+	presented := hex.EncodeToString(sum[:])
+
+	for _, a := range s.cfg().Advertisers {
+		if a.ID != id {
+			continue
+		}
+		expected := strings.ToLower(a.APIKeySHA256)
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(expected)) == 1 {
+			copied := a
+			return &copied, true
+		}
+	}
+	return nil, false
+}
+
+type AdvertiserReportResponse struct {
+	AdvertiserID string           `json:"advertiser_id"`
+	Name         string           `json:"name,omitempty"`
+	ChainID      int64            `json:"chain_id"`
+	Interval     string           `json:"interval"`
+	From         time.Time        `json:"from"`
+	To           time.Time        `json:"to"`
+	Totals       CampaignTotals   `json:"totals"`
+	Campaigns    []CampaignReport `json:"campaigns"`
+}
+
+// handleAdvertiserReport returns per-campaign delivery and spend for an
+// advertiser, as JSON or CSV
+func (s *Server) handleAdvertiserReport(w http.ResponseWriter, r *http.Request) {
+	advertiser, ok := s.authenticateAdvertiser(mux.Vars(r)["id"], apiKeyFromRequest(r))
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="advertiser"`)
+		writeError(w, newAPIError(CodeUnauthorized, "invalid or missing API key", nil))
+		return
+	}
+
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	intervalName := q.Get("interval")
+	if intervalName == "" {
+		intervalName = "hour"
+	}
+	interval, ok := historyIntervals[intervalName]
+	if !ok {
+		writeError(w, newAPIError(CodeInvalidRequest, "interval must be hour or day", nil))
+		return
+	}
+
+	from, to, err := timeRange(r, 7*24*time.Hour)
+	if err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, err.Error(), nil))
+		return
+	}
+
+	campaigns := advertiser.Campaigns
+	if only := q.Get("campaign"); only != "" {
+		campaigns = nil
+		for _, adID := range advertiser.Campaigns {
+			if adID == only {
+				campaigns = []string{adID}
+			}
+		}
+		if campaigns == nil {
+			writeError(w, newAPIError(CodeNotFound, "campaign not found", nil))
+			return
+		}
+	}
+
+	response := AdvertiserReportResponse{
+		AdvertiserID: advertiser.ID,
+		Name:         advertiser.Name,
+		ChainID:      bc.ChainID(),
+		Interval:     intervalName,
+		From:         from,
+		To:           to,
+		Campaigns:    make([]CampaignReport, 0, len(campaigns)),
+	}
+	overall := newCampaignSum()
+	for _, adID := range campaigns {
+		rep, sum, err := s.campaigns.report(bc.ChainID(), adID, interval, from, to)
+		if err != nil {
+			writeError(w, asAPIError(err, CodeInternal))
+			return
+		}
+		response.Campaigns = append(response.Campaigns, rep)
+		overall.merge(sum)
+	}
+	response.Totals = overall.totals()
+
+	if wantsCSV(r) {
+		rows := [][]string{{"ad_id", "period_start", "period_end", "heartbeats", "unique_wallets", "watch_time_ms", "spend_eth", "spend_wei", "rejections", "fraud_rejections"}}
+		for _, c := range response.Campaigns {
+			for _, b := range c.Series {
+				var rejections int64
+				for _, n := range b.Rejections {
+					rejections += n
+				}
+				rows = append(rows, []string{
+					c.AdID,
+					b.Start.Format(time.RFC3339),
+					b.End.Format(time.RFC3339),
+					strconv.FormatInt(b.Heartbeats, 10),
+					strconv.Itoa(b.UniqueWallets),
+					strconv.FormatInt(b.WatchTimeMs, 10),
+					b.Spend,
+					b.SpendWei,
+					strconv.FormatInt(rejections, 10),
+					strconv.FormatInt(b.FraudRejections, 10),
+				})
+			}
+		}
+		writeCSV(w, fmt.Sprintf("report-%s-%d-%s.csv", advertiser.ID, bc.ChainID(), intervalName), rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// apiVersion is one set of REST routes, mounted under /api/<name>
+type apiVersion struct {
+	name   string
+	routes func(s *Server, r *mux.Router)
+}
+
+// apiVersions are served side by side. A new version gets its own routes
+// function, reusing the previous version's handlers for endpoints whose
+// shape didn't change, and its paths in openapi.json.
+var apiVersions = []apiVersion{
+	{name: "v1", routes: (*Server).routesV1},
+}
+
+// The unversioned /api routes are deprecated aliases of legacyAPIVersion and
+// are removed after legacyAPISunset
+const legacyAPIVersion = "v1"
+
+var (
+	legacyAPIDeprecated = time.Date(2026, time.October, 1, 0, 0, 0, 0, time.UTC)
+	legacyAPISunset     = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+)
+
+// routesV1 registers the v1 endpoints
+func (s *Server) routesV1(r *mux.Router) {
+	r.HandleFunc("/openapi.json", s.handleOpenAPI).Methods("GET")
+	r.HandleFunc("/health", s.handleHealth).Methods("GET")
+	r.HandleFunc("/stats", s.handleStats).Methods("GET")
+	r.HandleFunc("/balance/{address}", s.handleBalance).Methods("GET")
+	r.HandleFunc("/heartbeat", s.handleHeartbeat).Methods("POST")
+	r.HandleFunc("/reward/{id}", s.handleRewardStatus).Methods("GET")
+	r.HandleFunc("/treasury", s.handleTreasury).Methods("GET")
+	r.HandleFunc("/block/latest", s.handleLatestBlock).Methods("GET")
+	r.HandleFunc("/user/{address}/earnings", s.handleUserEarnings).Methods("GET")
+	r.HandleFunc("/user/{address}/earnings/history", s.handleEarningsHistory).Methods("GET")
+	r.HandleFunc("/user/{address}/earnings/summary", s.handleEarningsSummary).Methods("GET")
+	r.HandleFunc("/user/{address}/earnings/payouts", s.handleEarningsPayouts).Methods("GET")
+	r.HandleFunc("/session/start", s.handleSessionStart).Methods("POST")
+	r.HandleFunc("/session/{id}", s.handleSession).Methods("GET")
+	r.HandleFunc("/session/{id}/complete", s.handleSessionComplete).Methods("POST")
+	r.HandleFunc("/leaderboard", s.handleLeaderboard).Methods("GET")
+	r.HandleFunc("/leaderboard/opt-out", s.handleLeaderboardOptOut).Methods("POST")
+	r.HandleFunc("/referral/code", s.handleReferralCode).Methods("POST")
+	r.HandleFunc("/referral/bind", s.handleReferralBind).Methods("POST")
+	r.HandleFunc("/referral/{address}", s.handleReferralSummary).Methods("GET")
+	r.HandleFunc("/referral/{address}/payouts", s.handleReferralPayouts).Methods("GET")
+	r.HandleFunc("/advertiser/{id}/report", s.handleAdvertiserReport).Methods("GET")
+
+	// Server-Sent Events mirror of the WebSocket feed
+	r.HandleFunc("/events", s.handleEvents).Methods("GET")
+}
+
+// mountAPI registers every API version, then the deprecated unversioned aliases
+func (s *Server) mountAPI() {
+	// Versioned prefixes go first so /api doesn't swallow /api/v1/...
+	for _, v := range apiVersions {
+		sub := s.router.PathPrefix("/api/" + v.name).Subrouter()
+		sub.Use(validateRequest)
+		v.routes(s, sub)
+	}
+
+	for _, v := range apiVersions {
+		if v.name == legacyAPIVersion {
+			legacy := s.router.PathPrefix("/api").Subrouter()
+			legacy.Use(deprecatedAPI, validateRequest)
+			v.routes(s, legacy)
+		}
+	}
+}
+
+// deprecatedAPI marks responses from unversioned routes with Deprecation
+// (RFC 9745), Sunset (RFC 8594) and a Link to the versioned route
+func deprecatedAPI(next http.Handler) http.Handler {
+	deprecation := "@" + strconv.FormatInt(legacyAPIDeprecated.Unix(), 10)
+	sunset := legacyAPISunset.Format(http.TimeFormat)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Deprecation", deprecation)
+		h.Set("Sunset", sunset)
+		h.Set("Link", "<"+versionedPath(r.URL.Path)+`>; rel="successor-version"`)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// versionedPath maps an unversioned /api path to its legacyAPIVersion
+// equivalent; other paths are returned unchanged
+func versionedPath(path string) string {
+	rest, ok := strings.CutPrefix(path, "/api/")
+	if !ok {
+		return path
+	}
+	for _, v := range apiVersions {
+		if rest == v.name || strings.HasPrefix(rest, v.name+"/") {
+			return path
+		}
+	}
+	return "/api/" + legacyAPIVersion + "/" + rest
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AuditAction is a kind of value-moving action recorded in the audit log
+type AuditAction string
+
+const (
+	// A reward was accepted and queued for a wallet
+	AuditRewardAccrued AuditAction = "reward_accrued"
+	// A reward transaction was signed and sent, or failed to be
+	AuditTxSubmitted AuditAction = "tx_submitted"
+	// A reward transaction was mined, successfully or reverted
+	AuditTxMined AuditAction = "tx_mined"
+	// The backend called the contract as its owner
+	AuditContractCall AuditAction = "contract_call"
+	// A setting was changed on a running server
+	AuditConfigChanged AuditAction = "config_changed"
+)
+
+var auditActions = []AuditAction{
+	AuditRewardAccrued,
+	AuditTxSubmitted,
+	AuditTxMined,
+	AuditContractCall,
+	AuditConfigChanged,
+}
+
+const (
+	// Records kept when the audit log has no file
+	auditMemoryLimit = 100000
+
+	// Records returned by the JSON query at most; JSONL exports are unlimited
+	auditDefaultLimit = 1000
+	auditMaxLimit     = 10000
+)
+
+// auditGenesisHash is the prev_hash of the first record
+var auditGenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// AuditRecord is one entry of the audit log. Hash is the hex SHA-256 of
+// PrevHash, a newline and the record's JSON with Hash empty, so changing,
+// dropping or reordering any record breaks every hash after it. With an
+// audit HMAC key it is an HMAC-SHA256 instead, which can't be recomputed
+// by someone who can only write the file.
+type AuditRecord struct {
+	Seq       uint64      `json:"seq"`
+	Time      time.Time   `json:"time"`
+	Replica   string      `json:"replica"`
+	Action    AuditAction `json:"action"`
+	Actor     string      `json:"actor"`   // who: wallet:0x..., replica:<id> or operator
+	Trigger   string      `json:"trigger"` // what: http_heartbeat, reward_worker, sighup, ...
+	ChainID   int64       `json:"chain_id,omitempty"`
+	Wallet    string      `json:"wallet,omitempty"`
+	RewardID  string      `json:"reward_id,omitempty"`
+	TxHash    string      `json:"tx_hash,omitempty"`
+	AmountWei string      `json:"amount_wei,omitempty"`
+	Detail    string      `json:"detail,omitempty"`
+	Error     string      `json:"error,omitempty"`
+	PrevHash  string      `json:"prev_hash"`
+	Hash      string      `json:"hash"`
+}
+
+// computeHash returns the hash rec should carry, keyed by key if not nil
+func (rec AuditRecord) computeHash(key []byte) (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if key != nil {
+		h = hmac.New(sha256.New, key)
+	}
+	h.Write([]byte(rec.PrevHash + "\n"))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// auditLog is this replica's append-only, hash-chained audit trail. Records
+// are appended to a JSONL file, or kept in memory without one. Each replica
+// keeps its own chain; records name the replica that wrote them.
+type auditLog struct {
+	file    string
+	replica string
+	key     []byte // HMAC key for record hashes, nil for plain SHA-256
+
+	mu       sync.Mutex
+	seq      uint64 // of the last record
+	lastHash string
+	memory   []AuditRecord // when file is ""
+}
+
+// newAuditLog opens the audit log in file ("" = memory only), continuing
+// the chain from its last record. hmacKey ("" = none) keys record hashes.
+// A broken chain is logged, not fatal: the verify endpoint reports where it
+// breaks.
+func newAuditLog(file, replica, hmacKey string) (*auditLog, error) {
+	a := &auditLog{file: file, replica: replica, lastHash: auditGenesisHash}
+	if hmacKey != "" {
+		a.key = []byte(hmacKey)
+	}
+	if file == "" {
+		return a, nil
+	}
+
+	result, err := verifyAuditFile(file, a.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if !result.OK {
+		log.Printf("🚨 Audit log %s fails verification at seq %d: %s", file, result.BrokenAt, result.Error)
+	}
+	// Chain onto the last record even past a break, so seqs stay unique
+	if err := a.each(func(rec AuditRecord) bool {
+		a.seq, a.lastHash = rec.Seq, rec.Hash
+		return true
+	}); err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	if a.seq > 0 {
+		log.Printf("📜 Audit log %s continues after seq %d", file, a.seq)
+	}
+
+	// A crash mid-write leaves a torn last line; start on a fresh one
+	if f, err := os.OpenFile(file, os.O_RDWR, 0); err == nil {
+		defer f.Close()
+		buf := make([]byte, 1)
+		if info, err := f.Stat(); err == nil && info.Size() > 0 {
+			if _, err := f.ReadAt(buf, info.Size()-1); err == nil && buf[0] != '\n' {
+				f.WriteAt([]byte{'\n'}, info.Size())
+			}
+		}
+	}
+	return a, nil
+}
+
+// record chains rec onto the log, filling in its sequence, time, replica
+// and hashes. Failures are logged: auditing never blocks a payout.
+func (a *auditLog) record(rec AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	rec.Seq = a.seq + 1
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+	rec.Time = rec.Time.UTC().Truncate(time.Microsecond)
+	rec.Replica = a.replica
+	rec.PrevHash = a.lastHash
+	hash, err := rec.computeHash(a.key)
+	if err != nil {
+		metricAuditDropped.Inc(string(rec.Action))
+		log.Printf("⚠️ Failed to audit %s: %v", rec.Action, err)
+		return
+	}
+	rec.Hash = hash
+
+	if a.file == "" {
+		a.memory = append(a.memory, rec)
+		if len(a.memory) > auditMemoryLimit {
+			a.memory = append([]AuditRecord(nil), a.memory[len(a.memory)-auditMemoryLimit:]...)
+		}
+	} else if err := a.appendLocked(rec); err != nil {
+		metricAuditDropped.Inc(string(rec.Action))
+		log.Printf("⚠️ Failed to write %s to audit log: %v", rec.Action, err)
+		return
+	}
+	a.seq, a.lastHash = rec.Seq, rec.Hash
+	metricAuditRecords.Inc(string(rec.Action))
+}
+
+func (a *auditLog) appendLocked(rec AuditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(data, '\n'))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// each calls fn for every record, oldest first, until fn returns false.
+// Lines that don't parse are skipped; verify reports them.
+func (a *auditLog) each(fn func(AuditRecord) bool) error {
+	if a.file == "" {
+		a.mu.Lock()
+		records := a.memory
+		a.mu.Unlock()
+		for _, rec := range records {
+			if !fn(rec) {
+				return nil
+			}
+		}
+		return nil
+	}
+
+	return scanAuditFile(a.file, func(_ int, line []byte) bool {
+		var rec AuditRecord
+		if json.Unmarshal(line, &rec) != nil {
+			return true
+		}
+		return fn(rec)
+	})
+}
+
+// scanAuditFile calls fn with every non-empty line of file and its number.
+// A missing file is empty.
+func scanAuditFile(file string, fn func(n int, line []byte) bool) error {
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		if !fn(n, scanner.Bytes()) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// AuditVerification is the result of checking the audit log's hash chain
+type AuditVerification struct {
+	OK       bool   `json:"ok"`
+	Records  int    `json:"records"`
+	FirstSeq uint64 `json:"first_seq"`
+	LastSeq  uint64 `json:"last_seq"`
+	LastHash string `json:"last_hash"`
+	Keyed    bool   `json:"keyed"`               // hashes checked as HMACs with the audit key
+	BrokenAt uint64 `json:"broken_at,omitempty"` // seq where verification failed
+	Error    string `json:"error,omitempty"`
+}
+
+// auditChecker verifies records one at a time. The first record may follow
+// ones dropped from memory, so only its own hash is checked against it.
+type auditChecker struct {
+	key    []byte
+	result AuditVerification
+}
+
+func newAuditChecker(key []byte) *auditChecker {
+	return &auditChecker{key: key, result: AuditVerification{OK: true, LastHash: auditGenesisHash, Keyed: key != nil}}
+}
+
+func (c *auditChecker) check(rec AuditRecord) bool {
+	r := &c.result
+	fail := func(msg string) bool {
+		r.OK, r.BrokenAt, r.Error = false, rec.Seq, msg
+		return false
+	}
+
+	if r.Records == 0 {
+		r.FirstSeq = rec.Seq
+	} else {
+		if rec.Seq != r.LastSeq+1 {
+			return fail(fmt.Sprintf("seq %d follows %d", rec.Seq, r.LastSeq))
+		}
+		if rec.PrevHash != r.LastHash {
+			return fail("prev_hash does not match the previous record")
+		}
+	}
+	hash, err := rec.computeHash(c.key)
+	if err != nil {
+		return fail(err.Error())
+	}
+	if hash != rec.Hash {
+		return fail("hash does not match the record's contents")
+	}
+	r.Records++
+	r.LastSeq, r.LastHash = rec.Seq, rec.Hash
+	return true
+}
+
+// verifyAuditFile checks the hash chain of file from the genesis hash
+func verifyAuditFile(file string, key []byte) (AuditVerification, error) {
+	c := newAuditChecker(key)
+	err := scanAuditFile(file, func(n int, line []byte) bool {
+		var rec AuditRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			c.result.OK, c.result.BrokenAt = false, c.result.LastSeq+1
+			c.result.Error = fmt.Sprintf("line %d is not a record: %v", n, err)
+			return false
+		}
+		if c.result.Records == 0 && rec.PrevHash != auditGenesisHash {
+			c.result.OK, c.result.BrokenAt = false, rec.Seq
+			c.result.Error = "first record does not start from the genesis hash"
+			return false
+		}
+		return c.check(rec)
+	})
+	return c.result, err
+}
+
+// verify checks the whole log's hash chain
+func (a *auditLog) verify() (AuditVerification, error) {
+	if a.file != "" {
+		return verifyAuditFile(a.file, a.key)
+	}
+	c := newAuditChecker(a.key)
+	a.each(c.check)
+	return c.result, nil
+}
+
+// auditFilter selects records for a query
+type auditFilter struct {
+	wallet   string // lowercase; "" = any
+	actions  map[AuditAction]bool
+	from, to time.Time // zero = unbounded
+}
+
+func (f auditFilter) match(rec AuditRecord) bool {
+	if f.wallet != "" && strings.ToLower(rec.Wallet) != f.wallet {
+		return false
+	}
+	if len(f.actions) > 0 && !f.actions[rec.Action] {
+		return false
+	}
+	if !f.from.IsZero() && rec.Time.Before(f.from) {
+		return false
+	}
+	return f.to.IsZero() || rec.Time.Before(f.to)
+}
+
+// parseAuditFilter reads ?wallet=, ?action= (comma-separated), ?from= and ?to=
+func parseAuditFilter(r *http.Request) (auditFilter, *APIError) {
+	q := r.URL.Query()
+	var f auditFilter
+
+	if wallet := q.Get("wallet"); wallet != "" {
+		if !common.IsHexAddress(wallet) {
+			return f, newAPIError(CodeInvalidAddress, "invalid wallet address", nil)
+		}
+		f.wallet = strings.ToLower(wallet)
+	}
+	if raw := q.Get("action"); raw != "" {
+		f.actions = make(map[AuditAction]bool)
+		for _, name := range strings.Split(raw, ",") {
+			action := AuditAction(strings.TrimSpace(name))
+			if !isAuditAction(action) {
+				return f, newAPIError(CodeInvalidRequest, fmt.Sprintf("unknown action %q", name), nil)
+			}
+			f.actions[action] = true
+		}
+	}
+
+	var err error
+	if f.from, err = parseTimeParam(q.Get("from"), time.Time{}, false); err != nil {
+		return f, newAPIError(CodeInvalidRequest, "from: "+err.Error(), nil)
+	}
+	if f.to, err = parseTimeParam(q.Get("to"), time.Time{}, true); err != nil {
+		return f, newAPIError(CodeInvalidRequest, "to: "+err.Error(), nil)
+	}
+	if !f.from.IsZero() && !f.to.IsZero() && !f.from.Before(f.to) {
+		return f, newAPIError(CodeInvalidRequest, "from must be before to", nil)
+	}
+	return f, nil
+}
+
+func isAuditAction(action AuditAction) bool {
+	for _, a := range auditActions {
+		if a == action {
+			return true
+		}
+	}
+	return false
+}
+
+// AuditLogResponse is a page of audit records, oldest first
+type AuditLogResponse struct {
+	Records   []AuditRecord `json:"records"`
+	Count     int           `json:"count"`
+	Truncated bool          `json:"truncated"` // more records matched than limit
+}
+
+// handleAuditLog returns the audit records matching the filter, or all of
+// them as a JSONL download with ?format=jsonl
+func (s *Server) handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, apiErr := parseAuditFilter(r)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit-`+s.replicaID+`.jsonl"`)
+		enc := json.NewEncoder(w)
+		err := s.audit.each(func(rec AuditRecord) bool {
+			return !filter.match(rec) || enc.Encode(rec) == nil
+		})
+		if err != nil {
+			log.Printf("⚠️ Audit export failed: %v", err)
+		}
+		return
+	}
+
+	limit := auditDefaultLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > auditMaxLimit {
+			writeError(w, newAPIError(CodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", auditMaxLimit), nil))
+			return
+		}
+		limit = n
+	}
+
+	resp := AuditLogResponse{Records: []AuditRecord{}}
+	err := s.audit.each(func(rec AuditRecord) bool {
+		if !filter.match(rec) {
+			return true
+		}
+		if len(resp.Records) == limit {
+			resp.Truncated = true
+			return false
+		}
+		resp.Records = append(resp.Records, rec)
+		return true
+	})
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	resp.Count = len(resp.Records)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleAuditVerify checks the audit log's hash chain
+func (s *Server) handleAuditVerify(w http.ResponseWriter, r *http.Request) {
+	result, err := s.audit.verify()
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	if !result.OK {
+		log.Printf("🚨 Audit log fails verification at seq %d: %s", result.BrokenAt, result.Error)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -28,7 +28,8 @@ const RewardTreasuryABI = `[
 	{"inputs":[{"internalType":"address","name":"user","type":"address"}],"name":"getUserEarnings","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
 	{"inputs":[],"name":"rewardPerHeartbeat","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
 	{"inputs":[],"name":"totalRewardsDistributed","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
-	{"inputs":[],"name":"totalClaimsProcessed","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"}
+	{"inputs":[],"name":"totalClaimsProcessed","outputs":[{"internalType":"uint256","name":"","type":"uint256"}],"stateMutability":"view","type":"function"},
+	{"anonymous":false,"inputs":[{"indexed":true,"internalType":"address","name":"recipient","type":"address"},{"indexed":false,"internalType":"uint256","name":"amount","type":"uint256"},{"indexed":true,"internalType":"bytes32","name":"claimId","type":"bytes32"},{"indexed":false,"internalType":"uint256","name":"timestamp","type":"uint256"}],"name":"RewardClaimed","type":"event"}
 ]`
 
 // ContractStats holds treasury statistics
@@ -39,9 +40,21 @@ type ContractStats struct {
 	RewardRate       *big.Int
 }
 
+// RewardClaim is a RewardClaimed event emitted by the treasury
+type RewardClaim struct {
+	Recipient   string
+	Amount      *big.Int
+	ClaimID     string
+	Timestamp   time.Time
+	TxHash      string
+	BlockNumber uint64
+	LogIndex    uint
+}
+
 // BlockchainClient handles all blockchain interactions
 type BlockchainClient struct {
-	client          *ethclient.Client
+	client          instrumentedClient
+	disconnect      func()
 	config          *Config
 	privateKey      *ecdsa.PrivateKey
 	signerAddress   common.Address
@@ -51,17 +64,51 @@ type BlockchainClient struct {
 	nonceMux        sync.Mutex
 	currentNonce    uint64
 	connected       bool
+
+	// Set when the contract rejects every reward (empty treasury, wrong
+	// signer) so new heartbeats fail fast instead of queueing doomed txs
+	haltMux   sync.Mutex
+	haltErr   error
+	haltUntil time.Time
+
+	// Transactions sent as the contract's owner while setting the chain up,
+	// recorded in the audit log once the server starts
+	ownerCalls []ownerCall
 }
 
+// ownerCall is an administrative contract transaction
+type ownerCall struct {
+	detail string
+	txHash string
+	value  *big.Int
+	at     time.Time
+}
+
+// How long a treasury-wide revert blocks new heartbeats before retrying
+const payoutHaltDuration = 30 * time.Second
+
 // NewBlockchainClient creates a new blockchain client
 func NewBlockchainClient(config *Config) (*BlockchainClient, error) {
 	log.Printf("🔗 Connecting to blockchain at %s...", config.RPCEndpoint)
 
-	client, err := ethclient.Dial(config.RPCEndpoint)
+	rawClient, err := ethclient.Dial(config.RPCEndpoint)
 	if err != nil {
 		return nil, fmt.Errorf("failed to connect to RPC: %w", err)
 	}
 
+	bc, err := newBlockchainClient(config, rawClient, rawClient.Close)
+	if err != nil {
+		rawClient.Close()
+		return nil, err
+	}
+	return bc, nil
+}
+
+// newBlockchainClient sets up a client on an already connected backend;
+// disconnect is called by Close
+func newBlockchainClient(config *Config, backend chainBackend, disconnect func()) (*BlockchainClient, error) {
+	client := instrumentedClient{backend}
+
 	// Get chain ID
 	chainID, err := client.ChainID(context.Background())
 	if err != nil {
@@ -69,6 +116,20 @@ func NewBlockchainClient(config *Config) (*BlockchainClient, error) {
 	}
 	log.Printf("📊 Connected to chain ID: %s", chainID.String())
 
+	// Refuse to sign anything against a chain other than the selected network
+	if config.ChainID == 0 {
+		log.Printf("⚠️ No expected chain ID for network %q, skipping chain check", config.Network)
+	} else if chainID.Cmp(big.NewInt(config.ChainID)) != 0 {
+		hint := "set NETWORK (or --network) to the network this RPC serves"
+		if chainID.IsInt64() {
+			if names := networksForChainID(chainID.Int64()); len(names) > 0 {
+				hint = "set NETWORK=" + strings.Join(names, " or NETWORK=") + " (or --network) to use it"
+			}
+		}
+		return nil, fmt.Errorf("RPC endpoint %s is on chain %s, but network %q expects chain %d; %s",
+			redactURL(config.RPCEndpoint), chainID, config.Network, config.ChainID, hint)
+	}
+
 	// Parse private key
 	privateKeyHex := strings.TrimPrefix(config.SignerPrivateKey, "0x")
 	privateKey, err := crypto.HexToECDSA(privateKeyHex)
@@ -106,6 +167,7 @@ func NewBlockchainClient(config *Config) (*BlockchainClient, error) {
 
 	bc := &BlockchainClient{
 		client:        client,
+		disconnect:    disconnect,
 		config:        config,
 		privateKey:    privateKey,
 		signerAddress: signerAddress,
@@ -126,7 +188,7 @@ func NewBlockchainClient(config *Config) (*BlockchainClient, error) {
 
 // Close closes the blockchain client
 func (bc *BlockchainClient) Close() {
-	bc.client.Close()
+	bc.disconnect()
 	bc.connected = false
 }
 
@@ -140,10 +202,33 @@ func (bc *BlockchainClient) IsConnected() bool {
 	return err == nil
 }
 
+// SignerAddress returns the address rewards are signed from
+func (bc *BlockchainClient) SignerAddress() string {
+	return bc.signerAddress.Hex()
+}
+
+// ChainID returns the chain ID reported by the RPC endpoint
+func (bc *BlockchainClient) ChainID() int64 {
+	return bc.chainID.Int64()
+}
+
+// Network returns the network profile name this client was configured with
+func (bc *BlockchainClient) Network() string {
+	return bc.config.Network
+}
+
+// ContractAddress returns the RewardTreasury address, empty in direct-transfer mode
+func (bc *BlockchainClient) ContractAddress() string {
+	if bc.contractAddress == (common.Address{}) {
+		return ""
+	}
+	return bc.contractAddress.Hex()
+}
+
 // GetBalance returns the ETH balance of an address
 func (bc *BlockchainClient) GetBalance(address string) (*big.Int, error) {
 	if !common.IsHexAddress(address) {
-		return nil, errors.New("invalid address format")
+		return nil, fmt.Errorf("%w format", errInvalidAddress)
 	}
 
 	addr := common.HexToAddress(address)
@@ -160,6 +245,34 @@ func (bc *BlockchainClient) GetBlockNumber() (uint64, error) {
 	return bc.client.BlockNumber(context.Background())
 }
 
+// BlockTime returns the timestamp of a block
+func (bc *BlockchainClient) BlockTime(number uint64) (time.Time, error) {
+	header, err := bc.client.HeaderByNumber(context.Background(), new(big.Int).SetUint64(number))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to get block %d: %w", number, err)
+	}
+	return time.Unix(int64(header.Time), 0).UTC(), nil
+}
+
+// FirstBlockSince returns the first block at or after t, or head+1 if the
+// head itself is older. Block times only increase, so it binary searches.
+func (bc *BlockchainClient) FirstBlockSince(t time.Time, head uint64) (uint64, error) {
+	lo, hi := uint64(0), head+1
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		at, err := bc.BlockTime(mid)
+		if err != nil {
+			return 0, err
+		}
+		if at.Before(t) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
 // GetLatestBlock returns information about the latest block
 func (bc *BlockchainClient) GetLatestBlock() (*BlockInfo, error) {
 	block, err := bc.client.BlockByNumber(context.Background(), nil)
@@ -168,6 +281,7 @@ func (bc *BlockchainClient) GetLatestBlock() (*BlockInfo, error) {
 	}
 
 	return &BlockInfo{
+		ChainID:   bc.chainID.Int64(),
 		Number:    block.NumberU64(),
 		Hash:      block.Hash().Hex(),
 		Timestamp: time.Unix(int64(block.Time()), 0),
@@ -175,55 +289,50 @@ func (bc *BlockchainClient) GetLatestBlock() (*BlockInfo, error) {
 	}, nil
 }
 
-// ProcessReward sends a reward to a user via the smart contract
-func (bc *BlockchainClient) ProcessReward(recipient string, amount *big.Int) (string, error) {
+// ProcessReward sends a reward to a user via the smart contract and returns
+// the signed transaction. A zero claimID gets a unique one generated; the
+// contract rejects reused IDs.
+func (bc *BlockchainClient) ProcessReward(recipient string, amount *big.Int, claimID common.Hash) (*types.Transaction, error) {
 	if bc.contractAddress == (common.Address{}) {
 		// Fallback: Direct ETH transfer if no contract
 		return bc.sendDirectTransfer(recipient, amount)
 	}
 
-	return bc.sendContractReward(recipient, amount)
+	return bc.sendContractReward(recipient, amount, claimID)
 }
 
 // sendContractReward sends reward through the smart contract
-func (bc *BlockchainClient) sendContractReward(recipient string, amount *big.Int) (string, error) {
+func (bc *BlockchainClient) sendContractReward(recipient string, amount *big.Int, claimID common.Hash) (*types.Transaction, error) {
 	if !common.IsHexAddress(recipient) {
-		return "", errors.New("invalid recipient address")
+		return nil, fmt.Errorf("%w address", ErrInvalidRecipient)
 	}
 
 	recipientAddr := common.HexToAddress(recipient)
 
 	// Generate unique claim ID
-	claimID := crypto.Keccak256Hash(
-		recipientAddr.Bytes(),
-		amount.Bytes(),
-		big.NewInt(time.Now().UnixNano()).Bytes(),
-	)
+	if claimID == (common.Hash{}) {
+		claimID = crypto.Keccak256Hash(
+			recipientAddr.Bytes(),
+			amount.Bytes(),
+			big.NewInt(time.Now().UnixNano()).Bytes(),
+		)
+	}
 
 	// Pack the function call
 	data, err := bc.contractABI.Pack("processReward", recipientAddr, amount, claimID)
 	if err != nil {
-		return "", fmt.Errorf("failed to pack function call: %w", err)
+		return nil, fmt.Errorf("failed to pack function call: %w", err)
 	}
 
 	// Get gas price with 20% buffer to ensure transaction goes through
 	suggestedGasPrice, err := bc.client.SuggestGasPrice(context.Background())
 	if err != nil {
-		return "", fmt.Errorf("failed to get gas price: %w", err)
+		return nil, fmt.Errorf("failed to get gas price: %w", err)
 	}
 	// Add 20% buffer to gas price
 	gasPrice := new(big.Int).Mul(suggestedGasPrice, big.NewInt(120))
 	gasPrice = gasPrice.Div(gasPrice, big.NewInt(100))
 
-	// Always fetch fresh nonce from blockchain to avoid "replacement transaction underpriced" errors
-	bc.nonceMux.Lock()
-	nonce, err := bc.client.PendingNonceAt(context.Background(), bc.signerAddress)
-	if err != nil {
-		bc.nonceMux.Unlock()
-		return "", fmt.Errorf("failed to get nonce: %w", err)
-	}
-	bc.nonceMux.Unlock()
-
 	// Estimate gas
 	msg := ethereum.CallMsg{
 		From:     bc.signerAddress,
@@ -232,45 +341,35 @@ func (bc *BlockchainClient) sendContractReward(recipient string, amount *big.Int
 		Data:     data,
 	}
 
+	// Simulate first so a revert comes back with the contract's reason
+	// instead of a bare "execution reverted" from gas estimation
+	if err := bc.simulate(msg); err != nil {
+		return nil, err
+	}
+
 	gasLimit, err := bc.client.EstimateGas(context.Background(), msg)
 	if err != nil {
-		return "", fmt.Errorf("failed to estimate gas: %w", err)
+		return nil, fmt.Errorf("failed to estimate gas: %w", decodeRevert(err))
 	}
 
 	// Add 10% buffer to gas limit
 	gasLimit = gasLimit * 110 / 100
 
-	// Create transaction
-	tx := types.NewTransaction(
-		nonce,
-		bc.contractAddress,
-		big.NewInt(0), // No ETH value, contract handles transfer
-		gasLimit,
-		gasPrice,
-		data,
-	)
-
-	// Sign transaction
-	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(bc.chainID), bc.privateKey)
-	if err != nil {
-		return "", fmt.Errorf("failed to sign transaction: %w", err)
-	}
-
-	// Send transaction
-	err = bc.client.SendTransaction(context.Background(), signedTx)
+	// No ETH value, contract handles transfer
+	signedTx, err := bc.signAndSend(bc.contractAddress, big.NewInt(0), gasLimit, gasPrice, data)
 	if err != nil {
-		return "", fmt.Errorf("failed to send transaction: %w", err)
+		return nil, err
 	}
 
-	log.Printf("📤 Transaction sent: %s (nonce: %d, gasPrice: %s)", signedTx.Hash().Hex()[:16]+"...", nonce, gasPrice.String())
+	log.Printf("📤 Transaction sent: %s (nonce: %d, gasPrice: %s)", signedTx.Hash().Hex()[:16]+"...", signedTx.Nonce(), gasPrice.String())
 
-	return signedTx.Hash().Hex(), nil
+	return signedTx, nil
 }
 
 // sendDirectTransfer sends ETH directly (fallback when no contract)
-func (bc *BlockchainClient) sendDirectTransfer(recipient string, amount *big.Int) (string, error) {
+func (bc *BlockchainClient) sendDirectTransfer(recipient string, amount *big.Int) (*types.Transaction, error) {
 	if !common.IsHexAddress(recipient) {
-		return "", errors.New("invalid recipient address")
+		return nil, fmt.Errorf("%w address", ErrInvalidRecipient)
 	}
 
 	recipientAddr := common.HexToAddress(recipient)
@@ -278,45 +377,87 @@ func (bc *BlockchainClient) sendDirectTransfer(recipient string, amount *big.Int
 	// Get gas price with 20% buffer
 	suggestedGasPrice, err := bc.client.SuggestGasPrice(context.Background())
 	if err != nil {
-		return "", fmt.Errorf("failed to get gas price: %w", err)
+		return nil, fmt.Errorf("failed to get gas price: %w", err)
 	}
 	gasPrice := new(big.Int).Mul(suggestedGasPrice, big.NewInt(120))
 	gasPrice = gasPrice.Div(gasPrice, big.NewInt(100))
 
-	// Always fetch fresh nonce from blockchain
+	// Standard gas limit for ETH transfer
+	signedTx, err := bc.signAndSend(recipientAddr, amount, 21000, gasPrice, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("📤 Direct transfer sent: %s (nonce: %d)", signedTx.Hash().Hex()[:16]+"...", signedTx.Nonce())
+
+	return signedTx, nil
+}
+
+// simulate runs a transaction as an eth_call against the latest block and
+// returns a *RevertError if the contract would reject it
+func (bc *BlockchainClient) simulate(msg ethereum.CallMsg) error {
+	if _, err := bc.client.CallContract(context.Background(), msg, nil); err != nil {
+		return fmt.Errorf("reward simulation failed: %w", decodeRevert(err))
+	}
+	return nil
+}
+
+// haltPayouts rejects new rewards on this chain for payoutHaltDuration
+func (bc *BlockchainClient) haltPayouts(err error) {
+	bc.haltMux.Lock()
+	defer bc.haltMux.Unlock()
+
+	if bc.haltErr == nil {
+		log.Printf("⛔ Pausing rewards on chain %s for %s: %v", bc.chainID, payoutHaltDuration, err)
+	}
+	bc.haltErr = err
+	bc.haltUntil = time.Now().Add(payoutHaltDuration)
+}
+
+// payoutsHalted returns the error that paused payouts, or nil
+func (bc *BlockchainClient) payoutsHalted() error {
+	bc.haltMux.Lock()
+	defer bc.haltMux.Unlock()
+
+	if bc.haltErr != nil && time.Now().After(bc.haltUntil) {
+		bc.haltErr = nil
+	}
+	return bc.haltErr
+}
+
+// signAndSend assigns a nonce, signs and broadcasts a transaction. The nonce
+// lock is held until the node has accepted the transaction so concurrent
+// reward workers never reuse a nonce.
+func (bc *BlockchainClient) signAndSend(to common.Address, value *big.Int, gasLimit uint64, gasPrice *big.Int, data []byte) (*types.Transaction, error) {
 	bc.nonceMux.Lock()
+	defer bc.nonceMux.Unlock()
+
+	// Fetch fresh nonce from blockchain to avoid "replacement transaction underpriced"
+	// errors, but never go below what we've already handed out locally
 	nonce, err := bc.client.PendingNonceAt(context.Background(), bc.signerAddress)
 	if err != nil {
-		bc.nonceMux.Unlock()
-		return "", fmt.Errorf("failed to get nonce: %w", err)
+		return nil, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	if nonce < bc.currentNonce {
+		nonce = bc.currentNonce
 	}
-	bc.nonceMux.Unlock()
 
 	// Create transaction
-	tx := types.NewTransaction(
-		nonce,
-		recipientAddr,
-		amount,
-		21000, // Standard gas limit for ETH transfer
-		gasPrice,
-		nil,
-	)
+	tx := types.NewTransaction(nonce, to, value, gasLimit, gasPrice, data)
 
 	// Sign transaction
 	signedTx, err := types.SignTx(tx, types.NewEIP155Signer(bc.chainID), bc.privateKey)
 	if err != nil {
-		return "", fmt.Errorf("failed to sign transaction: %w", err)
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
 	}
 
 	// Send transaction
-	err = bc.client.SendTransaction(context.Background(), signedTx)
-	if err != nil {
-		return "", fmt.Errorf("failed to send transaction: %w", err)
+	if err := bc.client.SendTransaction(context.Background(), signedTx); err != nil {
+		return nil, fmt.Errorf("failed to send transaction: %w", err)
 	}
 
-	log.Printf("📤 Direct transfer sent: %s (nonce: %d)", signedTx.Hash().Hex()[:16]+"...", nonce)
-
-	return signedTx.Hash().Hex(), nil
+	bc.currentNonce = nonce + 1
+	return signedTx, nil
 }
 
 // GetContractStats retrieves treasury statistics from the contract
@@ -398,7 +539,7 @@ func (bc *BlockchainClient) GetUserEarnings(address string) (*big.Int, error) {
 	}
 
 	if !common.IsHexAddress(address) {
-		return nil, errors.New("invalid address format")
+		return nil, fmt.Errorf("%w format", errInvalidAddress)
 	}
 
 	addr := common.HexToAddress(address)
@@ -424,6 +565,96 @@ func (bc *BlockchainClient) GetUserEarnings(address string) (*big.Int, error) {
 	return earnings, nil
 }
 
+// FilterRewardClaims returns RewardClaimed events emitted in blocks from..to
+// inclusive. Direct-transfer mode has no contract and therefore no events.
+func (bc *BlockchainClient) FilterRewardClaims(from, to uint64) ([]RewardClaim, error) {
+	if bc.contractAddress == (common.Address{}) {
+		return nil, nil
+	}
+
+	event := bc.contractABI.Events["RewardClaimed"]
+	logs, err := bc.client.FilterLogs(context.Background(), ethereum.FilterQuery{
+		FromBlock: new(big.Int).SetUint64(from),
+		ToBlock:   new(big.Int).SetUint64(to),
+		Addresses: []common.Address{bc.contractAddress},
+		Topics:    [][]common.Hash{{event.ID}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to filter logs: %w", err)
+	}
+
+	claims := make([]RewardClaim, 0, len(logs))
+	for _, l := range logs {
+		if l.Removed || len(l.Topics) < 3 {
+			continue
+		}
+
+		var data struct {
+			Amount    *big.Int
+			Timestamp *big.Int
+		}
+		if err := bc.contractABI.UnpackIntoInterface(&data, "RewardClaimed", l.Data); err != nil {
+			return nil, fmt.Errorf("failed to decode RewardClaimed in %s: %w", l.TxHash.Hex(), err)
+		}
+
+		claims = append(claims, RewardClaim{
+			Recipient:   common.BytesToAddress(l.Topics[1].Bytes()).Hex(),
+			Amount:      data.Amount,
+			ClaimID:     l.Topics[2].Hex(),
+			Timestamp:   time.Unix(data.Timestamp.Int64(), 0),
+			TxHash:      l.TxHash.Hex(),
+			BlockNumber: l.BlockNumber,
+			LogIndex:    l.Index,
+		})
+	}
+	return claims, nil
+}
+
+// GetReceipt returns the receipt of a mined transaction, or nil if it is still pending
+func (bc *BlockchainClient) GetReceipt(txHash string) (*types.Receipt, error) {
+	receipt, err := bc.client.TransactionReceipt(context.Background(), common.HexToHash(txHash))
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get receipt: %w", err)
+	}
+	return receipt, nil
+}
+
+// GetTransaction returns a transaction the node knows, mined or pending, or
+// nil if it has never seen it or dropped it
+func (bc *BlockchainClient) GetTransaction(txHash string) (*types.Transaction, error) {
+	tx, _, err := bc.client.TransactionByHash(context.Background(), common.HexToHash(txHash))
+	if errors.Is(err, ethereum.NotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get transaction: %w", err)
+	}
+	return tx, nil
+}
+
+// ConfirmedNonce returns the signer's nonce in the latest block: every
+// nonce below it has been used by a mined transaction
+func (bc *BlockchainClient) ConfirmedNonce() (uint64, error) {
+	nonce, err := bc.client.NonceAt(context.Background(), bc.signerAddress, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// Rebroadcast sends an already signed transaction again. A node that still
+// has it in its pool is not an error.
+func (bc *BlockchainClient) Rebroadcast(tx *types.Transaction) error {
+	err := bc.client.SendTransaction(context.Background(), tx)
+	if err != nil && strings.Contains(strings.ToLower(err.Error()), "already known") {
+		return nil
+	}
+	return err
+}
+
 // WaitForTransaction waits for a transaction to be mined
 func (bc *BlockchainClient) WaitForTransaction(txHash string) (*types.Receipt, error) {
 	hash := common.HexToHash(txHash)
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// How long campaign history is kept for advertiser reports
+	campaignRetention = 400 * 24 * time.Hour
+
+	// Heartbeat intervals after which a wallet's next heartbeat on an ad
+	// starts a new viewing, credited at most one interval of watch time
+	campaignViewingGap = 2
+)
+
+// fraudCodes are the rejection codes counted as suspected fraud in reports
+var fraudCodes = map[string]bool{
+	CodeRateLimited: true,
+}
+
+// campaignHour is one hour of activity on one ad
+type campaignHour struct {
+	Heartbeats int64               `json:"heartbeats"`
+	WatchMs    int64               `json:"watch_ms"`
+	Spend      *big.Int            `json:"spend"`
+	Wallets    map[string]struct{} `json:"wallets"`
+	Rejections map[string]int64    `json:"rejections"` // by error code
+}
+
+// campaignStore aggregates heartbeats, spend and rejections per ad for
+// advertiser reports. Hours live in shared state so every replica reports
+// the same figures; a hash per ad indexes the hours recorded.
+type campaignStore struct {
+	state sharedState
+}
+
+func newCampaignStore(state sharedState) *campaignStore {
+	return &campaignStore{state: state}
+}
+
+func campaignHourKey(chainID int64, adID string, start int64) string {
+	return fmt.Sprintf("campaign:%d:%s:%d", chainID, adID, start)
+}
+
+// campaignLastSeenKey holds the time of wallet's last heartbeat on adID, in unix ms
+func campaignLastSeenKey(chainID int64, adID, wallet string) string {
+	return fmt.Sprintf("campaign-seen:%d:%s:%s", chainID, adID, wallet)
+}
+
+func campaignIndexKey(chainID int64, adID string) string {
+	return fmt.Sprintf("campaign-hours:%d:%s", chainID, adID)
+}
+
+// modify applies fn to adID's bucket containing t. Reports are best effort,
+// so failures are logged rather than failing the heartbeat.
+func (cs *campaignStore) modify(chainID int64, adID string, t time.Time, fn func(h *campaignHour)) {
+	start := t.Truncate(time.Hour).Unix()
+	err := cs.state.update(campaignHourKey(chainID, adID, start), campaignRetention, func(old []byte) ([]byte, error) {
+		h := &campaignHour{}
+		if old != nil {
+			if err := json.Unmarshal(old, h); err != nil {
+				return nil, err
+			}
+		}
+		if h.Spend == nil {
+			h.Spend = new(big.Int)
+		}
+		if h.Wallets == nil {
+			h.Wallets = make(map[string]struct{})
+		}
+		if h.Rejections == nil {
+			h.Rejections = make(map[string]int64)
+		}
+		fn(h)
+		return json.Marshal(h)
+	})
+	if err == nil {
+		err = cs.state.hset(campaignIndexKey(chainID, adID), strconv.FormatInt(start, 10), []byte("1"))
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to record activity on campaign %s: %v", adID, err)
+	}
+}
+
+// recordHeartbeat counts an accepted heartbeat and its reported watch time.
+// Clients can't claim more than the time since their previous heartbeat on
+// the ad, or one heartbeat interval (ms) when it has none.
+func (cs *campaignStore) recordHeartbeat(chainID int64, adID, wallet string, durationMs, intervalMs int64, at time.Time) {
+	if adID == "" {
+		return
+	}
+	wallet = strings.ToLower(wallet)
+
+	// Heartbeats further apart than this start a new viewing
+	gap := time.Duration(campaignViewingGap*intervalMs) * time.Millisecond
+	limit := intervalMs
+	err := cs.state.update(campaignLastSeenKey(chainID, adID, wallet), gap, func(old []byte) ([]byte, error) {
+		limit = intervalMs
+		if last, err := strconv.ParseInt(string(old), 10, 64); err == nil {
+			if elapsed := at.UnixMilli() - last; elapsed >= 0 && elapsed <= gap.Milliseconds() {
+				limit = elapsed
+			}
+		}
+		return []byte(strconv.FormatInt(at.UnixMilli(), 10)), nil
+	})
+	if err != nil {
+		log.Printf("⚠️ Failed to record activity on campaign %s: %v", adID, err)
+	}
+	if durationMs > limit {
+		durationMs = limit
+	}
+
+	cs.modify(chainID, adID, at, func(h *campaignHour) {
+		h.Heartbeats++
+		if durationMs > 0 {
+			h.WatchMs += durationMs
+		}
+		h.Wallets[wallet] = struct{}{}
+	})
+}
+
+// recordRejection counts a heartbeat refused with code
+func (cs *campaignStore) recordRejection(chainID int64, adID, code string, at time.Time) {
+	if adID == "" {
+		return
+	}
+	cs.modify(chainID, adID, at, func(h *campaignHour) {
+		h.Rejections[code]++
+	})
+}
+
+// recordSpend adds a confirmed reward to the campaign's spend
+func (cs *campaignStore) recordSpend(chainID int64, adID string, amount *big.Int, at time.Time) {
+	if adID == "" {
+		return
+	}
+	cs.modify(chainID, adID, at, func(h *campaignHour) {
+		h.Spend.Add(h.Spend, amount)
+	})
+}
+
+// hours returns adID's buckets starting in [from, to), by unix hour. Index
+// entries whose bucket has expired are dropped on the way.
+func (cs *campaignStore) hours(chainID int64, adID string, from, to time.Time) (map[int64]*campaignHour, error) {
+	index, err := cs.state.hgetall(campaignIndexKey(chainID, adID))
+	if err != nil {
+		return nil, err
+	}
+
+	hours := make(map[int64]*campaignHour)
+	for field := range index {
+		start, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			continue
+		}
+		t := time.Unix(start, 0)
+		if t.Before(from) || !t.Before(to) {
+			continue
+		}
+
+		data, ok, err := cs.state.get(campaignHourKey(chainID, adID, start))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			cs.state.hdel(campaignIndexKey(chainID, adID), field)
+			continue
+		}
+		h := &campaignHour{}
+		if err := json.Unmarshal(data, h); err != nil {
+			return nil, fmt.Errorf("campaign %s hour %d: %w", adID, start, err)
+		}
+		if h.Spend == nil {
+			h.Spend = new(big.Int)
+		}
+		hours[start] = h
+	}
+	return hours, nil
+}
+
+// CampaignTotals are a campaign's figures over a period
+type CampaignTotals struct {
+	UniqueWallets   int              `json:"unique_wallets"`
+	Heartbeats      int64            `json:"heartbeats"`
+	WatchTimeMs     int64            `json:"watch_time_ms"`
+	Spend           string           `json:"spend"`
+	SpendWei        string           `json:"spend_wei"`
+	Rejections      map[string]int64 `json:"rejections"` // by error code
+	FraudRejections int64            `json:"fraud_rejections"`
+}
+
+type CampaignBucket struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	CampaignTotals
+}
+
+type CampaignReport struct {
+	AdID   string           `json:"ad_id"`
+	Totals CampaignTotals   `json:"totals"`
+	Series []CampaignBucket `json:"series"`
+}
+
+// campaignSum accumulates hours into totals, counting each wallet once
+type campaignSum struct {
+	heartbeats int64
+	watchMs    int64
+	spend      *big.Int
+	wallets    map[string]struct{}
+	rejections map[string]int64
+}
+
+func newCampaignSum() *campaignSum {
+	return &campaignSum{
+		spend:      new(big.Int),
+		wallets:    make(map[string]struct{}),
+		rejections: make(map[string]int64),
+	}
+}
+
+func (s *campaignSum) add(h *campaignHour) {
+	s.heartbeats += h.Heartbeats
+	s.watchMs += h.WatchMs
+	s.spend.Add(s.spend, h.Spend)
+	for w := range h.Wallets {
+		s.wallets[w] = struct{}{}
+	}
+	for code, n := range h.Rejections {
+		s.rejections[code] += n
+	}
+}
+
+func (s *campaignSum) merge(o *campaignSum) {
+	s.heartbeats += o.heartbeats
+	s.watchMs += o.watchMs
+	s.spend.Add(s.spend, o.spend)
+	for w := range o.wallets {
+		s.wallets[w] = struct{}{}
+	}
+	for code, n := range o.rejections {
+		s.rejections[code] += n
+	}
+}
+
+func (s *campaignSum) totals() CampaignTotals {
+	t := CampaignTotals{
+		UniqueWallets: len(s.wallets),
+		Heartbeats:    s.heartbeats,
+		WatchTimeMs:   s.watchMs,
+		Spend:         weiToEther(s.spend),
+		SpendWei:      s.spend.String(),
+		Rejections:    make(map[string]int64, len(s.rejections)),
+	}
+	for code, n := range s.rejections {
+		t.Rejections[code] = n
+		if fraudCodes[code] {
+			t.FraudRejections += n
+		}
+	}
+	return t
+}
+
+// report builds totals and an interval-sized time series for adID within
+// [from, to). The returned sum covers the whole period, for combining
+// campaigns without double-counting wallets.
+func (cs *campaignStore) report(chainID int64, adID string, interval time.Duration, from, to time.Time) (CampaignReport, *campaignSum, error) {
+	hours, err := cs.hours(chainID, adID, from, to)
+	if err != nil {
+		return CampaignReport{}, nil, err
+	}
+
+	total := newCampaignSum()
+	buckets := make(map[int64]*campaignSum)
+	for start, h := range hours {
+		t := time.Unix(start, 0)
+		key := t.Truncate(interval).Unix()
+		b, ok := buckets[key]
+		if !ok {
+			b = newCampaignSum()
+			buckets[key] = b
+		}
+		b.add(h)
+		total.add(h)
+	}
+
+	rep := CampaignReport{AdID: adID, Totals: total.totals(), Series: make([]CampaignBucket, 0, len(buckets))}
+	for start, b := range buckets {
+		t := time.Unix(start, 0).UTC()
+		rep.Series = append(rep.Series, CampaignBucket{Start: t, End: t.Add(interval), CampaignTotals: b.totals()})
+	}
+	sort.Slice(rep.Series, func(i, j int) bool { return rep.Series[i].Start.Before(rep.Series[j].Start) })
+	return rep, total, nil
+}
+
+// campaignChain resolves the chain a heartbeat is counted on, 0 meaning the default
+func (s *Server) campaignChain(chainID int64) int64 {
+	if chainID == 0 {
+		return s.chains.primary().ChainID()
+	}
+	return chainID
+}
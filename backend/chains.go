@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+var errUnknownChain = errors.New("unknown chain")
+
+// ChainConfig is an additional chain served next to the primary one. Empty
+// fields fall back to the network's deployment file, then to the primary
+// chain's signer key.
+type ChainConfig struct {
+	Network          string `json:"network" yaml:"network"`
+	ChainID          int64  `json:"chain_id,omitempty" yaml:"chain_id,omitempty"`
+	RPCEndpoint      string `json:"rpc_endpoint,omitempty" yaml:"rpc_endpoint,omitempty"`
+	ContractAddress  string `json:"contract_address,omitempty" yaml:"contract_address,omitempty"`
+	SignerPrivateKey string `json:"signer_private_key,omitempty" yaml:"signer_private_key,omitempty"`
+	RewardSigner     string `json:"reward_signer,omitempty" yaml:"reward_signer,omitempty"`
+	DeploymentFile   string `json:"deployment_file,omitempty" yaml:"deployment_file,omitempty"`
+}
+
+// resolveChain builds the full configuration for an extra chain on top of the
+// primary one, layering defaults, deployment file and the chain's own settings
+func resolveChain(primary *Config, cc ChainConfig) (*Config, error) {
+	if cc.Network == "" {
+		return nil, errors.New("network: must not be empty")
+	}
+
+	path := cc.DeploymentFile
+	if path == "" {
+		path = deploymentPath(cc.Network)
+	}
+	var profile *networkProfile
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) && cc.ChainID != 0 {
+		// Chains deployed outside this repo's Hardhat setup are fully described inline
+		profile = &networkProfile{Name: cc.Network, File: path, ChainID: cc.ChainID}
+	} else if profile, err = loadNetworkProfile(cc.Network, path); err != nil {
+		return nil, err
+	}
+
+	config := *primary
+	config.Chains = nil
+	config.Network = cc.Network
+	config.DeploymentFile = path
+	config.ContractAddress = ""
+	config.RewardSigner = ""
+	profile.apply(&config)
+
+	if profile.RPCEndpoint == "" && cc.RPCEndpoint == "" {
+		return nil, errors.New("rpc_endpoint: required when the deployment file does not record one")
+	}
+
+	overrides := []struct {
+		value string
+		field *string
+	}{
+		{cc.RPCEndpoint, &config.RPCEndpoint},
+		{cc.ContractAddress, &config.ContractAddress},
+		{cc.SignerPrivateKey, &config.SignerPrivateKey},
+		{cc.RewardSigner, &config.RewardSigner},
+	}
+	for _, o := range overrides {
+		if o.value != "" {
+			*o.field = o.value
+		}
+	}
+	if cc.ChainID != 0 {
+		config.ChainID = cc.ChainID
+	}
+
+	if err := errors.Join(config.validateChain()...); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// chainRegistry holds one BlockchainClient per chain ID. It is filled at
+// startup and read-only afterwards.
+type chainRegistry struct {
+	clients map[int64]*BlockchainClient
+	order   []int64 // configuration order; the first chain is the default
+}
+
+func newChainRegistry() *chainRegistry {
+	return &chainRegistry{clients: make(map[int64]*BlockchainClient)}
+}
+
+// add registers a connected client under the chain ID its RPC reported
+func (r *chainRegistry) add(bc *BlockchainClient) error {
+	id := bc.ChainID()
+	if existing, ok := r.clients[id]; ok {
+		return fmt.Errorf("networks %q and %q both connect to chain %d", existing.Network(), bc.Network(), id)
+	}
+	r.clients[id] = bc
+	r.order = append(r.order, id)
+	return nil
+}
+
+// get returns the client for chainID, or the default chain when chainID is 0
+func (r *chainRegistry) get(chainID int64) (*BlockchainClient, error) {
+	if chainID == 0 {
+		return r.primary(), nil
+	}
+	bc, ok := r.clients[chainID]
+	if !ok {
+		return nil, fmt.Errorf("%w %d", errUnknownChain, chainID)
+	}
+	return bc, nil
+}
+
+// primary returns the default chain heartbeats are routed to
+func (r *chainRegistry) primary() *BlockchainClient {
+	return r.clients[r.order[0]]
+}
+
+// all returns every client in configuration order
+func (r *chainRegistry) all() []*BlockchainClient {
+	list := make([]*BlockchainClient, 0, len(r.order))
+	for _, id := range r.order {
+		list = append(list, r.clients[id])
+	}
+	return list
+}
+
+// Close disconnects every chain
+func (r *chainRegistry) Close() {
+	for _, bc := range r.clients {
+		bc.Close()
+	}
+}
+
+// connectChains dials the primary chain and every configured extra chain,
+// or starts the simulated chain in demo mode
+func connectChains(config *Config) (*chainRegistry, error) {
+	registry := newChainRegistry()
+
+	if config.demo {
+		bc, err := newSimulatedChain(config, demoBlockPeriod)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", demoNetwork, err)
+		}
+		registry.add(bc)
+		return registry, nil
+	}
+
+	configs := append([]*Config{config}, config.extraChains...)
+	for _, c := range configs {
+		bc, err := NewBlockchainClient(c)
+		if err != nil {
+			registry.Close()
+			return nil, fmt.Errorf("%s: %w", c.Network, err)
+		}
+		if err := registry.add(bc); err != nil {
+			bc.Close()
+			registry.Close()
+			return nil, err
+		}
+		log.Printf("⛓️ Serving %s (chain %d)", c.Network, bc.ChainID())
+	}
+
+	return registry, nil
+}
+
+// parseChainID reads an optional chain_id value; empty means the default chain
+func parseChainID(raw string) (int64, error) {
+	if raw == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id <= 0 {
+		return 0, fmt.Errorf("invalid chain_id %q", raw)
+	}
+	return id, nil
+}
+
+// chainFromRequest picks the chain named by the ?chain_id= query parameter,
+// writing a 400 and returning nil if it is malformed or not served here
+func (s *Server) chainFromRequest(w http.ResponseWriter, r *http.Request) *BlockchainClient {
+	id, err := parseChainID(r.URL.Query().Get("chain_id"))
+	if err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, err.Error(), nil))
+		return nil
+	}
+	bc, err := s.chains.get(id)
+	if err != nil {
+		writeError(w, asAPIError(err, CodeUnknownChain))
+		return nil
+	}
+	return bc
+}
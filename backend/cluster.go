@@ -0,0 +1,590 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"math/big"
+	"os"
+	"sort"
+	"time"
+)
+
+// Shared state keys and channels of the cluster
+const (
+	leaderKey            = "leader"   // ID of the replica holding the leader lease
+	replicasKey          = "replicas" // hash of ReplicaInfo by replica ID
+	clusterEventsChannel = "events"
+)
+
+const (
+	// How long a leader lease lasts unless renewed
+	leaderLeaseTTL = 15 * time.Second
+
+	// How often replicas renew the lease and announce themselves. A leader
+	// stops settling one interval before its lease runs out, so it never
+	// overlaps with the next leader.
+	clusterTickInterval = 5 * time.Second
+
+	// Replicas not heard from for this long are left out of cluster stats
+	replicaStaleAfter = 3 * clusterTickInterval
+
+	// How often the leader checks the shared queue when not woken
+	rewardPumpInterval = 100 * time.Millisecond
+
+	// How long a connection waits for the result of a reward it sent
+	resultWaitLimit = rewardRetention
+)
+
+// ReplicaInfo is one replica's entry in the cluster registry
+type ReplicaInfo struct {
+	ID                string    `json:"id"`
+	Leader            bool      `json:"leader"`
+	Draining          bool      `json:"draining"`
+	ActiveConnections int       `json:"active_connections"`
+	TotalHeartbeats   int64     `json:"total_heartbeats"`
+	TotalRewardsWei   string    `json:"total_rewards_wei"`
+	SeenAt            time.Time `json:"seen_at"`
+}
+
+// ClusterStats is the cluster part of /api/stats
+type ClusterStats struct {
+	ReplicaID string        `json:"replica_id"`       // replica that answered
+	Leader    string        `json:"leader,omitempty"` // replica signing settlement transactions
+	Shared    bool          `json:"shared"`           // whether state is shared through Redis
+	Replicas  []ReplicaInfo `json:"replicas"`
+}
+
+// clusterEvent is what one replica tells the others over pub/sub
+type clusterEvent struct {
+	Origin    string          `json:"origin"`
+	Topic     string          `json:"topic,omitempty"` // topic message, delivered to local subscribers
+	Type      string          `json:"type,omitempty"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Result    *rewardResult   `json:"result,omitempty"`    // settlement outcome of a reward
+	OptOut    string          `json:"opt_out,omitempty"`   // wallet whose leaderboard opt-out changed
+	Heartbeat *heartbeatEvent `json:"heartbeat,omitempty"` // heartbeat accepted by the origin
+	Reconcile bool            `json:"reconcile,omitempty"` // reconciliation asked of the leader
+}
+
+// rewardResult is the outcome of a reward submission. Every replica gets it,
+// so the one holding the heartbeat's connection can answer it directly.
+type rewardResult struct {
+	RewardID string                 `json:"reward_id"`
+	ChainID  int64                  `json:"chain_id"`
+	Wallet   string                 `json:"wallet_address"`
+	AdID     string                 `json:"ad_id,omitempty"`
+	Amount   string                 `json:"reward_wei"`
+	Success  bool                   `json:"success"`
+	Message  map[string]interface{} `json:"message"`
+}
+
+// pendingResult is a connection waiting for a reward's result
+type pendingResult struct {
+	client *wsClient
+	since  time.Time
+}
+
+// openSharedState connects to Redis if configured, else keeps state in process
+func openSharedState(cfg *Config) (sharedState, error) {
+	if cfg.RedisURL == "" {
+		return newMemoryState(), nil
+	}
+	return newRedisState(cfg.RedisURL)
+}
+
+// newReplicaID names a replica after its host, with a random suffix so
+// restarts and replicas on one host never collide
+func newReplicaID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "replica"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return host + "-" + hex.EncodeToString(b)
+}
+
+// isLeader reports whether this replica may settle rewards right now
+func (s *Server) isLeader() bool {
+	return time.Now().UnixNano() < s.leaseUntil.Load()
+}
+
+// clusterLoop keeps the leader lease and this replica's registry entry fresh
+func (s *Server) clusterLoop(ctx context.Context) {
+	ticker := time.NewTicker(clusterTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.clusterTick()
+		}
+	}
+}
+
+// clusterTick renews the leader lease or takes it when free, reacts to
+// leadership changes and announces this replica
+func (s *Server) clusterTick() {
+	s.clusterMux.Lock()
+	defer s.clusterMux.Unlock()
+
+	if s.resigned {
+		return
+	}
+
+	// A draining replica keeps the lease it has but never takes it
+	if s.leading || !s.draining.Load() {
+		s.renewLease()
+	}
+
+	switch leader := s.isLeader(); {
+	case leader && !s.leading:
+		s.leading = true
+		log.Printf("👑 Replica %s is now the leader", s.replicaID)
+		s.takeOverSettlement()
+	case !leader && s.leading:
+		s.leading = false
+		log.Printf("⚠️ Replica %s lost the leader lease", s.replicaID)
+		s.stepDown()
+	}
+
+	s.announceReplica()
+}
+
+// renewLease takes the leader lease if it is free and extends it if this
+// replica holds it. Callers hold clusterMux.
+func (s *Server) renewLease() {
+	now := time.Now()
+	held := false
+	err := s.state.update(leaderKey, leaderLeaseTTL, func(old []byte) ([]byte, error) {
+		held = old == nil || string(old) == s.replicaID
+		if !held {
+			return nil, errNoChange
+		}
+		return []byte(s.replicaID), nil
+	})
+	if err != nil {
+		log.Printf("⚠️ Failed to renew the leader lease: %v", err)
+		return
+	}
+	if held {
+		s.leaseUntil.Store(now.Add(leaderLeaseTTL - clusterTickInterval).UnixNano())
+	}
+}
+
+// resignLeadership gives the lease up for good and leaves the registry, so
+// another replica can take over without waiting for the lease to run out
+func (s *Server) resignLeadership() {
+	s.clusterMux.Lock()
+	defer s.clusterMux.Unlock()
+
+	s.resigned = true
+	if s.leading {
+		err := s.state.update(leaderKey, leaderLeaseTTL, func(old []byte) ([]byte, error) {
+			if string(old) != s.replicaID {
+				return nil, errNoChange
+			}
+			return nil, nil
+		})
+		if err != nil {
+			log.Printf("⚠️ Failed to release the leader lease: %v", err)
+		}
+		s.leaseUntil.Store(0)
+		s.leading = false
+	}
+	if err := s.state.hdel(replicasKey, s.replicaID); err != nil {
+		log.Printf("⚠️ Failed to leave the replica registry: %v", err)
+	}
+}
+
+// takeOverSettlement picks up the work of the previous leader: submitted
+// rewards go back to the receipt watcher, and rewards it took from the queue
+// but never finished are failed, since they may or may not have been sent.
+// Callers hold clusterMux.
+func (s *Server) takeOverSettlement() {
+	records, err := s.rewards.settling()
+	if err != nil {
+		log.Printf("⚠️ Failed to load unsettled rewards: %v", err)
+		return
+	}
+	queued, err := s.queuedRewardIDs()
+	if err != nil {
+		log.Printf("⚠️ Failed to load the reward queue: %v", err)
+		return
+	}
+
+	// Rewards are saved just before they are queued, so recent ones may be
+	// on their way into the queue rather than abandoned
+	cutoff := time.Now().Add(-clusterTickInterval)
+
+	tracked, abandoned := 0, 0
+	for _, rec := range records {
+		switch {
+		case rec.Status == RewardSubmitted:
+			if _, err := s.chains.get(rec.ChainID); err != nil {
+				log.Printf("⚠️ Not tracking reward %s: %v", rec.ID, err)
+				continue
+			}
+			copied := rec
+			s.rewards.track(&copied)
+			tracked++
+		case queued[rec.ID] || rec.UpdatedAt.After(cutoff):
+			// Still waiting for a worker
+		default:
+			copied := rec
+			s.rewards.track(&copied)
+			updated, _ := s.rewards.update(rec.ID, func(r *RewardRecord) {
+				r.Status = RewardFailed
+				r.Error = "settlement interrupted by a leader change"
+				r.ErrorCode = CodeInternal
+			})
+			s.updateReferralPayout(updated)
+			log.Printf("   ❓ in flight %s: %s wei to %s (%s, check the signer's pending transactions)", rec.ID, rec.RewardWei, rec.WalletAddress, rec.Kind)
+			abandoned++
+		}
+	}
+	if tracked+abandoned > 0 {
+		log.Printf("♻️ Took over %d submitted rewards; failed %d interrupted mid-submission", tracked, abandoned)
+	}
+	s.wakeRewardPump()
+}
+
+// stepDown hands rewards waiting for a worker back to the shared queue and
+// stops tracking receipts, which the next leader picks up. Callers hold
+// clusterMux.
+func (s *Server) stepDown() {
+	var leftover []*RewardRequest
+collect:
+	for {
+		select {
+		case req := <-s.rewardQueue:
+			leftover = append(leftover, req)
+		default:
+			break collect
+		}
+	}
+	for i := len(leftover) - 1; i >= 0; i-- {
+		s.requeueReward(leftover[i])
+	}
+	for _, rec := range s.rewards.unsettled() {
+		s.rewards.untrack(rec.ID)
+	}
+}
+
+// queuedRewardIDs returns the IDs of rewards in the shared queue
+func (s *Server) queuedRewardIDs() (map[string]bool, error) {
+	items, err := s.state.list(rewardQueueKey)
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]bool, len(items))
+	for _, data := range items {
+		var req RewardRequest
+		if json.Unmarshal(data, &req) == nil {
+			ids[req.ID] = true
+		}
+	}
+	return ids, nil
+}
+
+// requeueReward puts a reward this replica took but did not send back at the
+// front of the shared queue
+func (s *Server) requeueReward(req *RewardRequest) {
+	s.rewards.untrack(req.ID)
+	data, err := json.Marshal(req)
+	if err == nil {
+		err = s.state.pushFront(rewardQueueKey, data)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to requeue reward %s: %v", req.ID, err)
+	}
+}
+
+// wakeRewardPump tells the pump a reward was queued
+func (s *Server) wakeRewardPump() {
+	select {
+	case s.pumpWake <- struct{}{}:
+	default:
+	}
+}
+
+// rewardPump feeds rewards from the shared queue to the settlement workers
+// while this replica leads. A draining leader with durable state stops
+// taking new ones; they wait for the next leader.
+func (s *Server) rewardPump(ctx context.Context) {
+	ticker := time.NewTicker(rewardPumpInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-s.pumpWake:
+		}
+
+		if !s.isLeader() || (s.draining.Load() && s.state.durable()) {
+			continue
+		}
+		for len(s.rewardQueue) < cap(s.rewardQueue) && s.pumpReward() {
+		}
+	}
+}
+
+// pumpReward moves one reward from the shared queue to the workers,
+// reporting whether the queue may hold more
+func (s *Server) pumpReward() bool {
+	data, ok, err := s.state.pop(rewardQueueKey)
+	if err != nil {
+		log.Printf("⚠️ Failed to read the reward queue: %v", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	var req RewardRequest
+	if err := json.Unmarshal(data, &req); err != nil {
+		log.Printf("⚠️ Dropping corrupt queued reward: %v", err)
+		return true
+	}
+	rec, ok, err := s.rewards.lookup(req.ID)
+	if err != nil {
+		log.Printf("⚠️ Failed to load queued reward %s: %v", req.ID, err)
+		s.requeueReward(&req)
+		return false
+	}
+	if !ok || rec.Status != RewardQueued {
+		log.Printf("⚠️ Dropping queued reward %s: no queued record", req.ID)
+		return true
+	}
+
+	s.rewards.track(&rec)
+	s.rewardQueue <- &req
+	return true
+}
+
+// localReplicaInfo describes this replica for the registry
+func (s *Server) localReplicaInfo() ReplicaInfo {
+	s.clientsMux.RLock()
+	conns := len(s.clients)
+	s.clientsMux.RUnlock()
+
+	s.statsMux.RLock()
+	defer s.statsMux.RUnlock()
+
+	return ReplicaInfo{
+		ID:                s.replicaID,
+		Leader:            s.isLeader(),
+		Draining:          s.draining.Load(),
+		ActiveConnections: conns,
+		TotalHeartbeats:   s.stats.TotalHeartbeats,
+		TotalRewardsWei:   s.stats.TotalRewards.String(),
+		SeenAt:            time.Now().UTC(),
+	}
+}
+
+// announceReplica writes this replica's registry entry
+func (s *Server) announceReplica() {
+	data, err := json.Marshal(s.localReplicaInfo())
+	if err == nil {
+		err = s.state.hset(replicasKey, s.replicaID, data)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to announce replica: %v", err)
+	}
+}
+
+// replicas returns the live replicas, this one with current figures.
+// Entries gone stale are removed.
+func (s *Server) replicas() ([]ReplicaInfo, error) {
+	self := s.localReplicaInfo()
+	all, err := s.state.hgetall(replicasKey)
+	if err != nil {
+		return []ReplicaInfo{self}, err
+	}
+
+	list := []ReplicaInfo{self}
+	for id, data := range all {
+		if id == s.replicaID {
+			continue
+		}
+		var info ReplicaInfo
+		if err := json.Unmarshal(data, &info); err != nil || time.Since(info.SeenAt) > replicaStaleAfter {
+			s.state.hdel(replicasKey, id)
+			continue
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+// clusterTotals sums the counters of the live replicas
+func (s *Server) clusterTotals() (conns int, heartbeats int64, rewards *big.Int) {
+	list, err := s.replicas()
+	if err != nil {
+		log.Printf("⚠️ Failed to read the replica registry: %v", err)
+	}
+
+	rewards = new(big.Int)
+	for _, info := range list {
+		conns += info.ActiveConnections
+		heartbeats += info.TotalHeartbeats
+		if wei, ok := new(big.Int).SetString(info.TotalRewardsWei, 10); ok {
+			rewards.Add(rewards, wei)
+		}
+	}
+	return conns, heartbeats, rewards
+}
+
+// clusterStats describes the cluster for /api/stats
+func (s *Server) clusterStats() ClusterStats {
+	list, err := s.replicas()
+	if err != nil {
+		log.Printf("⚠️ Failed to read the replica registry: %v", err)
+	}
+	leader, _, _ := s.state.get(leaderKey)
+	return ClusterStats{
+		ReplicaID: s.replicaID,
+		Leader:    string(leader),
+		Shared:    s.state.durable(),
+		Replicas:  list,
+	}
+}
+
+// subscribeCluster delivers other replicas' events until ctx is done
+func (s *Server) subscribeCluster(ctx context.Context) {
+	s.state.subscribe(ctx, clusterEventsChannel, s.handleClusterEvent)
+}
+
+// publishCluster sends ev to the other replicas
+func (s *Server) publishCluster(ev clusterEvent) {
+	ev.Origin = s.replicaID
+	data, err := json.Marshal(ev)
+	if err == nil {
+		err = s.state.publish(clusterEventsChannel, data)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to publish cluster event: %v", err)
+	}
+}
+
+// handleClusterEvent acts on an event from another replica
+func (s *Server) handleClusterEvent(data []byte) {
+	var ev clusterEvent
+	if err := json.Unmarshal(data, &ev); err != nil {
+		log.Printf("⚠️ Ignoring malformed cluster event: %v", err)
+		return
+	}
+	if ev.Origin == s.replicaID {
+		return
+	}
+
+	switch {
+	case ev.Result != nil:
+		s.deliverRewardResult(*ev.Result)
+	case ev.OptOut != "":
+		go s.refreshLeaderboards()
+	case ev.Heartbeat != nil:
+		hb := ev.Heartbeat
+		s.earnings.recordHeartbeat(hb.ChainID, hb.Wallet, hb.AdID, hb.At)
+	case ev.Reconcile:
+		if s.isLeader() {
+			s.queueReconcile()
+		}
+	case ev.Topic != "":
+		s.deliver(ev.Topic, ev.Type, ev.Data, nil)
+	}
+}
+
+// broadcast publishes msg on topic to subscribers of every replica
+func (s *Server) broadcast(topic string, msg map[string]interface{}) {
+	msg["topic"] = topic
+	data, msgType, err := encodeEvent(msg)
+	if err != nil {
+		log.Printf("⚠️ Failed to encode %s event: %v", topic, err)
+		return
+	}
+	s.deliver(topic, msgType, data, nil)
+	s.publishCluster(clusterEvent{Topic: topic, Type: msgType, Data: data})
+}
+
+// broadcastRewardResult reports a submission on every replica
+func (s *Server) broadcastRewardResult(res rewardResult) {
+	s.deliverRewardResult(res)
+	s.publishCluster(clusterEvent{Result: &res})
+}
+
+// deliverRewardResult answers the connection that sent the reward's
+// heartbeat, if it is here, and notifies local subscribers
+func (s *Server) deliverRewardResult(res rewardResult) {
+	msg := make(map[string]interface{}, len(res.Message)+4)
+	for k, v := range res.Message {
+		msg[k] = v
+	}
+
+	client := s.takeResultClient(res.RewardID)
+	if client != nil {
+		amount, _ := new(big.Int).SetString(res.Amount, 10)
+
+		session := client.session
+		session.mu.Lock()
+		if res.Success && amount != nil {
+			session.TotalEarned.Add(session.TotalEarned, amount)
+		}
+		msg["heartbeats"] = session.Heartbeats
+		msg["total_earned"] = session.TotalEarned.String()
+		session.mu.Unlock()
+
+		if res.Success {
+			if bc, err := s.chains.get(res.ChainID); err == nil {
+				if balance, err := bc.GetBalance(res.Wallet); err == nil {
+					msg["balance"] = weiToEther(balance)
+					msg["balance_wei"] = balance.String()
+				}
+			}
+		}
+
+		client.sendJSON(msg)
+	}
+
+	s.publishRewardResult(res.Wallet, res.AdID, msg, client)
+}
+
+// awaitResult remembers that client wants the result of reward id
+func (s *Server) awaitResult(id string, client *wsClient, now time.Time) {
+	s.resultsMux.Lock()
+	defer s.resultsMux.Unlock()
+	s.results[id] = pendingResult{client: client, since: now}
+}
+
+// takeResultClient returns and forgets the connection awaiting reward id
+func (s *Server) takeResultClient(id string) *wsClient {
+	s.resultsMux.Lock()
+	defer s.resultsMux.Unlock()
+
+	p, ok := s.results[id]
+	if !ok {
+		return nil
+	}
+	delete(s.results, id)
+	return p.client
+}
+
+// pruneResultClients forgets connections whose rewards never settled
+func (s *Server) pruneResultClients(now time.Time) {
+	s.resultsMux.Lock()
+	defer s.resultsMux.Unlock()
+
+	for id, p := range s.results {
+		if now.Sub(p.since) > resultWaitLimit {
+			delete(s.results, id)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// Command loadgen simulates concurrent ad viewers against a ChainPay backend.
+// Each viewer opens a WebSocket with a generated wallet and heartbeats on the
+// schedule the frontend uses; at the end it reports throughput, latency
+// percentiles, reward success rate and failures by error class.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type options struct {
+	url        string
+	viewers    int
+	duration   time.Duration
+	rampUp     time.Duration
+	interval   time.Duration
+	adLength   time.Duration
+	maxBreak   time.Duration
+	adIDs      []string
+	chainID    int64
+	settleWait time.Duration
+	jsonOutput bool
+}
+
+func parseFlags(args []string) (*options, error) {
+	fs := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+
+	opts := &options{}
+	fs.StringVar(&opts.url, "url", "ws://localhost:8080/ws", "Backend WebSocket URL")
+	fs.IntVar(&opts.viewers, "viewers", 100, "Concurrent viewers, one WebSocket and wallet each")
+	fs.DurationVar(&opts.duration, "duration", time.Minute, "How long viewers send heartbeats, including ramp-up")
+	fs.DurationVar(&opts.rampUp, "ramp-up", 10*time.Second, "Spread viewer connections over this long")
+	fs.DurationVar(&opts.interval, "interval", 5*time.Second, "Heartbeat interval while watching (the frontend sends every 5s)")
+	fs.DurationVar(&opts.adLength, "ad-length", 30*time.Second, "How long each ad is watched")
+	fs.DurationVar(&opts.maxBreak, "max-break", 10*time.Second, "Longest pause between ads; each pause is random up to this")
+	ads := fs.String("ads", "ad-1,ad-2,ad-3", "Comma-separated ad IDs viewers pick from")
+	fs.Int64Var(&opts.chainID, "chain-id", 0, "Chain to earn on (0 = the backend's default)")
+	fs.DurationVar(&opts.settleWait, "settle-wait", 30*time.Second, "How long to wait for outstanding rewards after heartbeats stop")
+	fs.BoolVar(&opts.jsonOutput, "json", false, "Print the report as JSON")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	for _, id := range strings.Split(*ads, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			opts.adIDs = append(opts.adIDs, id)
+		}
+	}
+
+	switch {
+	case opts.viewers < 1:
+		return nil, fmt.Errorf("-viewers must be at least 1")
+	case opts.interval <= 0:
+		return nil, fmt.Errorf("-interval must be positive")
+	case opts.duration <= 0:
+		return nil, fmt.Errorf("-duration must be positive")
+	case opts.rampUp < 0 || opts.rampUp > opts.duration:
+		return nil, fmt.Errorf("-ramp-up must be between 0 and -duration")
+	case len(opts.adIDs) == 0:
+		return nil, fmt.Errorf("-ads must list at least one ad ID")
+	}
+	return opts, nil
+}
+
+func main() {
+	opts, err := parseFlags(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	// Ctrl-C ends the load phase early but still waits for settlement
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("🚀 Starting %d viewers against %s for %s", opts.viewers, opts.url, opts.duration)
+	report := run(ctx, opts)
+
+	if opts.jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			log.Fatalf("❌ Failed to write report: %v", err)
+		}
+		return
+	}
+	report.print(os.Stdout)
+}
+
+// run drives the viewers through the load phase, then waits up to
+// settleWait for their rewards to confirm or fail
+func run(ctx context.Context, opts *options) *Report {
+	rec := newRecorder()
+	start := time.Now()
+
+	loadCtx, endLoad := context.WithTimeout(ctx, opts.duration)
+	defer endLoad()
+
+	// Connections stay open after the load phase to receive settlements
+	connCtx, closeConns := context.WithCancel(context.Background())
+	defer closeConns()
+
+	done := make(chan struct{}, opts.viewers)
+	for i := 0; i < opts.viewers; i++ {
+		delay := time.Duration(0)
+		if opts.viewers > 1 {
+			delay = opts.rampUp * time.Duration(i) / time.Duration(opts.viewers-1)
+		}
+		v := newViewer(opts, rec)
+		go func() {
+			defer func() { done <- struct{}{} }()
+			v.run(loadCtx, connCtx, delay)
+		}()
+	}
+
+	progress := time.NewTicker(10 * time.Second)
+	defer progress.Stop()
+	for loadCtx.Err() == nil {
+		select {
+		case <-loadCtx.Done():
+		case <-progress.C:
+			log.Printf("📊 %s", rec.progress())
+		}
+	}
+	loadElapsed := time.Since(start)
+
+	log.Printf("⏳ Heartbeats stopped, waiting up to %s for %d rewards to settle", opts.settleWait, rec.pendingCount())
+	deadline := time.Now().Add(opts.settleWait)
+	for rec.pendingCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	closeConns()
+	for i := 0; i < opts.viewers; i++ {
+		<-done
+	}
+	return rec.report(opts, loadElapsed, time.Since(start))
+}
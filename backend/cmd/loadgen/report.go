@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// recorder collects results from every viewer
+type recorder struct {
+	mu sync.Mutex
+
+	connects        int
+	connectFailures map[string]int
+	connectLatency  []time.Duration
+	disconnects     map[string]int
+
+	heartbeatsSent     int
+	heartbeatsAcked    int
+	heartbeatsRejected map[string]int
+	ackLatency         []time.Duration
+	serverErrors       map[string]int
+
+	// Acked rewards awaiting an outcome, by reward ID, with their ack time
+	pending   map[string]time.Time
+	settled   map[string]bool // outcomes seen, in case one beats its ack
+	confirmed int
+	failures  map[string]int // by error code
+	settle    []time.Duration
+}
+
+func newRecorder() *recorder {
+	return &recorder{
+		connectFailures:    make(map[string]int),
+		disconnects:        make(map[string]int),
+		heartbeatsRejected: make(map[string]int),
+		serverErrors:       make(map[string]int),
+		pending:            make(map[string]time.Time),
+		settled:            make(map[string]bool),
+		failures:           make(map[string]int),
+	}
+}
+
+func (r *recorder) connected(latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connects++
+	r.connectLatency = append(r.connectLatency, latency)
+}
+
+func (r *recorder) connectFailed(class string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.connectFailures[class]++
+}
+
+func (r *recorder) disconnected(class string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.disconnects[class]++
+}
+
+func (r *recorder) serverError(code string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.serverErrors[code]++
+}
+
+func (r *recorder) heartbeatSent() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.heartbeatsSent++
+}
+
+func (r *recorder) heartbeatAcked(rewardID string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.heartbeatsAcked++
+	r.ackLatency = append(r.ackLatency, latency)
+	if rewardID != "" && !r.settled[rewardID] {
+		r.pending[rewardID] = time.Now()
+	}
+}
+
+func (r *recorder) heartbeatRejected(code string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.heartbeatsRejected[code]++
+	r.ackLatency = append(r.ackLatency, latency)
+}
+
+func (r *recorder) rewardConfirmed(rewardID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resolve(rewardID) {
+		r.confirmed++
+	}
+}
+
+func (r *recorder) rewardFailed(rewardID, code string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.resolve(rewardID) {
+		if code == "" {
+			code = "unknown"
+		}
+		r.failures[code]++
+	}
+}
+
+// resolve records the first outcome for rewardID, reporting false for
+// repeats. Must be called with r.mu held.
+func (r *recorder) resolve(rewardID string) bool {
+	if r.settled[rewardID] {
+		return false
+	}
+	r.settled[rewardID] = true
+	if ackedAt, ok := r.pending[rewardID]; ok {
+		r.settle = append(r.settle, time.Since(ackedAt))
+		delete(r.pending, rewardID)
+	}
+	return true
+}
+
+func (r *recorder) pendingCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.pending)
+}
+
+// progress is a one-line summary for periodic logging
+func (r *recorder) progress() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return fmt.Sprintf("%d connected, %d heartbeats sent, %d acked, %d rewards confirmed, %d failed, %d pending",
+		r.connects, r.heartbeatsSent, r.heartbeatsAcked, r.confirmed, sum(r.failures), len(r.pending))
+}
+
+// Latency summarises a set of durations in milliseconds
+type Latency struct {
+	Count int     `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P90   float64 `json:"p90_ms"`
+	P99   float64 `json:"p99_ms"`
+	Max   float64 `json:"max_ms"`
+}
+
+func newLatency(samples []time.Duration) Latency {
+	if len(samples) == 0 {
+		return Latency{}
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	// Nearest-rank percentile
+	at := func(p float64) float64 {
+		i := int(p*float64(len(sorted))+0.5) - 1
+		if i < 0 {
+			i = 0
+		}
+		if i >= len(sorted) {
+			i = len(sorted) - 1
+		}
+		return float64(sorted[i].Microseconds()) / 1000
+	}
+	return Latency{
+		Count: len(sorted),
+		P50:   at(0.50),
+		P90:   at(0.90),
+		P99:   at(0.99),
+		Max:   float64(sorted[len(sorted)-1].Microseconds()) / 1000,
+	}
+}
+
+// Report is the outcome of a load test run
+type Report struct {
+	URL             string         `json:"url"`
+	Viewers         int            `json:"viewers"`
+	LoadSeconds     float64        `json:"load_seconds"`  // heartbeats were sent for this long
+	TotalSeconds    float64        `json:"total_seconds"` // including waiting for settlement
+	Connected       int            `json:"connected"`
+	ConnectFailures map[string]int `json:"connect_failures"` // by class
+	ConnectLatency  Latency        `json:"connect_latency"`
+	Disconnects     map[string]int `json:"disconnects"` // unexpected, by class
+	ServerErrors    map[string]int `json:"server_errors"`
+
+	HeartbeatsSent     int            `json:"heartbeats_sent"`
+	HeartbeatsAcked    int            `json:"heartbeats_acked"`
+	HeartbeatsRejected map[string]int `json:"heartbeats_rejected"` // by error code
+	HeartbeatsPerSec   float64        `json:"heartbeats_per_sec"`  // acked, over the load phase
+	AckLatency         Latency        `json:"ack_latency"`
+
+	RewardsConfirmed int            `json:"rewards_confirmed"`
+	RewardsFailed    int            `json:"rewards_failed"`
+	RewardsPending   int            `json:"rewards_pending"` // no outcome by the end of the run
+	RewardsPerSec    float64        `json:"rewards_per_sec"` // confirmed, over the whole run
+	SuccessRate      float64        `json:"success_rate"`    // confirmed / acked heartbeats
+	TxFailures       map[string]int `json:"tx_failures"`     // by error code
+	SettleLatency    Latency        `json:"settle_latency"`  // ack to confirmation or failure
+}
+
+func (r *recorder) report(opts *options, load, total time.Duration) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rep := &Report{
+		URL:                opts.url,
+		Viewers:            opts.viewers,
+		LoadSeconds:        load.Seconds(),
+		TotalSeconds:       total.Seconds(),
+		Connected:          r.connects,
+		ConnectFailures:    r.connectFailures,
+		ConnectLatency:     newLatency(r.connectLatency),
+		Disconnects:        r.disconnects,
+		ServerErrors:       r.serverErrors,
+		HeartbeatsSent:     r.heartbeatsSent,
+		HeartbeatsAcked:    r.heartbeatsAcked,
+		HeartbeatsRejected: r.heartbeatsRejected,
+		AckLatency:         newLatency(r.ackLatency),
+		RewardsConfirmed:   r.confirmed,
+		RewardsFailed:      sum(r.failures),
+		RewardsPending:     len(r.pending),
+		TxFailures:         r.failures,
+		SettleLatency:      newLatency(r.settle),
+	}
+	if load > 0 {
+		rep.HeartbeatsPerSec = float64(r.heartbeatsAcked) / load.Seconds()
+	}
+	if total > 0 {
+		rep.RewardsPerSec = float64(r.confirmed) / total.Seconds()
+	}
+	if r.heartbeatsAcked > 0 {
+		rep.SuccessRate = float64(r.confirmed) / float64(r.heartbeatsAcked)
+	}
+	return rep
+}
+
+// print writes the report as an aligned table
+func (rep *Report) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	fmt.Fprintf(w, "\nLoad test against %s\n", rep.URL)
+	fmt.Fprintf(w, "Duration\t%.1fs load, %.1fs total\n", rep.LoadSeconds, rep.TotalSeconds)
+
+	fmt.Fprintf(w, "\nConnections\n")
+	fmt.Fprintf(w, "  connected\t%d of %d viewers\n", rep.Connected, rep.Viewers)
+	fmt.Fprintf(w, "  connect latency\t%s\n", rep.ConnectLatency)
+	printCounts(w, "  connect failed", rep.ConnectFailures)
+	printCounts(w, "  dropped", rep.Disconnects)
+	printCounts(w, "  server errors", rep.ServerErrors)
+
+	fmt.Fprintf(w, "\nHeartbeats\n")
+	fmt.Fprintf(w, "  sent\t%d\n", rep.HeartbeatsSent)
+	fmt.Fprintf(w, "  acked\t%d (%.1f/s)\n", rep.HeartbeatsAcked, rep.HeartbeatsPerSec)
+	fmt.Fprintf(w, "  answer latency\t%s\n", rep.AckLatency)
+	printCounts(w, "  rejected", rep.HeartbeatsRejected)
+
+	fmt.Fprintf(w, "\nRewards\n")
+	fmt.Fprintf(w, "  confirmed\t%d (%.1f/s)\n", rep.RewardsConfirmed, rep.RewardsPerSec)
+	fmt.Fprintf(w, "  failed\t%d\n", rep.RewardsFailed)
+	fmt.Fprintf(w, "  no outcome\t%d\n", rep.RewardsPending)
+	fmt.Fprintf(w, "  success rate\t%.2f%%\n", rep.SuccessRate*100)
+	fmt.Fprintf(w, "  settle latency\t%s\n", rep.SettleLatency)
+	printCounts(w, "  tx failures", rep.TxFailures)
+}
+
+func (l Latency) String() string {
+	if l.Count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("p50 %.0fms  p90 %.0fms  p99 %.0fms  max %.0fms", l.P50, l.P90, l.P99, l.Max)
+}
+
+// printCounts writes one line per class, largest first
+func printCounts(w io.Writer, label string, counts map[string]int) {
+	if len(counts) == 0 {
+		return
+	}
+	classes := make([]string, 0, len(counts))
+	for class := range counts {
+		classes = append(classes, class)
+	}
+	sort.Slice(classes, func(i, j int) bool {
+		if counts[classes[i]] != counts[classes[j]] {
+			return counts[classes[i]] > counts[classes[j]]
+		}
+		return classes[i] < classes[j]
+	})
+	for _, class := range classes {
+		fmt.Fprintf(w, "%s\t%d %s\n", label, counts[class], class)
+		label = ""
+	}
+}
+
+func sum(counts map[string]int) int {
+	total := 0
+	for _, n := range counts {
+		total += n
+	}
+	return total
+}
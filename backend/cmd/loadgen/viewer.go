@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+)
+
+// How long a viewer waits to connect or to write one message
+const (
+	dialTimeout  = 10 * time.Second
+	writeTimeout = 10 * time.Second
+)
+
+// viewer is one simulated user: a wallet watching ads over one WebSocket
+type viewer struct {
+	opts   *options
+	rec    *recorder
+	wallet string
+	rng    *mathrand.Rand
+
+	// Send times of heartbeats awaiting an ack or rejection. The server
+	// answers each connection's heartbeats in order.
+	mu       sync.Mutex
+	inFlight []time.Time
+
+	closing  atomic.Bool // set before the viewer hangs up itself
+	lostOnce sync.Once
+}
+
+func newViewer(opts *options, rec *recorder) *viewer {
+	var addr common.Address
+	rand.Read(addr[:])
+
+	var seed [8]byte
+	rand.Read(seed[:])
+
+	return &viewer{
+		opts:   opts,
+		rec:    rec,
+		wallet: addr.Hex(),
+		rng:    mathrand.New(mathrand.NewSource(int64(binary.LittleEndian.Uint64(seed[:])))),
+	}
+}
+
+// run connects after delay, watches ads until loadCtx ends and keeps the
+// connection open for settlement updates until connCtx ends
+func (v *viewer) run(loadCtx, connCtx context.Context, delay time.Duration) {
+	select {
+	case <-loadCtx.Done():
+		return
+	case <-time.After(delay):
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: dialTimeout}
+	start := time.Now()
+	conn, resp, err := dialer.DialContext(loadCtx, v.opts.url, nil)
+	if err != nil {
+		if loadCtx.Err() == nil {
+			v.rec.connectFailed(dialErrorClass(resp, err))
+		}
+		return
+	}
+	v.rec.connected(time.Since(start))
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		v.readLoop(conn)
+	}()
+	defer func() {
+		v.closing.Store(true)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "load test finished"),
+			time.Now().Add(time.Second))
+		conn.Close()
+		<-readDone
+	}()
+
+	if err := v.send(conn, map[string]interface{}{"type": "register", "wallet_address": v.wallet}); err != nil {
+		return
+	}
+	v.watch(loadCtx, conn)
+
+	select {
+	case <-connCtx.Done():
+	case <-readDone:
+	}
+}
+
+// watch plays ads back to back with random breaks, heartbeating every
+// interval (with some jitter, as browser timers drift) while an ad plays
+func (v *viewer) watch(ctx context.Context, conn *websocket.Conn) {
+	for ctx.Err() == nil {
+		adID := v.opts.adIDs[v.rng.Intn(len(v.opts.adIDs))]
+		adStart := time.Now()
+		last := adStart
+
+		for time.Since(adStart) < v.opts.adLength {
+			if !v.sleep(ctx, v.jitter(v.opts.interval)) {
+				return
+			}
+			now := time.Now()
+			err := v.send(conn, map[string]interface{}{
+				"type":        "heartbeat",
+				"ad_id":       adID,
+				"chain_id":    v.opts.chainID,
+				"duration_ms": now.Sub(last).Milliseconds(),
+			}, now)
+			if err != nil {
+				return
+			}
+			last = now
+		}
+
+		if v.opts.maxBreak > 0 && !v.sleep(ctx, time.Duration(v.rng.Int63n(int64(v.opts.maxBreak)))) {
+			return
+		}
+	}
+}
+
+// send writes msg; a heartbeat's sentAt is queued to time its answer
+func (v *viewer) send(conn *websocket.Conn, msg map[string]interface{}, sentAt ...time.Time) error {
+	if len(sentAt) > 0 {
+		v.mu.Lock()
+		v.inFlight = append(v.inFlight, sentAt[0])
+		v.mu.Unlock()
+		v.rec.heartbeatSent()
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := conn.WriteJSON(msg); err != nil {
+		v.lost("write: " + netErrorClass(err))
+		return err
+	}
+	return nil
+}
+
+// readLoop records the server's answers until the connection closes
+func (v *viewer) readLoop(conn *websocket.Conn) {
+	for {
+		var msg map[string]interface{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			var closeErr *websocket.CloseError
+			switch {
+			case v.closing.Load():
+			case errors.As(err, &closeErr):
+				v.lost(fmt.Sprintf("closed %d %s", closeErr.Code, closeErr.Text))
+			default:
+				v.lost("read: " + netErrorClass(err))
+			}
+			return
+		}
+
+		id, _ := msg["reward_id"].(string)
+		code, _ := msg["error_code"].(string)
+		switch msg["type"] {
+		case "heartbeat_ack":
+			v.rec.heartbeatAcked(id, v.answered())
+		case "heartbeat_rejected":
+			v.rec.heartbeatRejected(code, v.answered())
+		case "reward":
+			// Submission result; failures here never reach the chain
+			if success, _ := msg["success"].(bool); !success {
+				v.rec.rewardFailed(id, code)
+			}
+		case "reward_status":
+			switch msg["status"] {
+			case "confirmed":
+				v.rec.rewardConfirmed(id)
+			case "failed":
+				if code == "" {
+					code = "reverted"
+				}
+				v.rec.rewardFailed(id, code)
+			}
+		case "error":
+			c, _ := msg["code"].(string)
+			v.rec.serverError(c)
+		}
+	}
+}
+
+// lost records the connection dropping, once however it was noticed
+func (v *viewer) lost(class string) {
+	v.lostOnce.Do(func() { v.rec.disconnected(class) })
+}
+
+// answered pops the oldest unanswered heartbeat and returns its latency
+func (v *viewer) answered() time.Duration {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if len(v.inFlight) == 0 {
+		return 0
+	}
+	sentAt := v.inFlight[0]
+	v.inFlight = v.inFlight[1:]
+	return time.Since(sentAt)
+}
+
+// jitter returns d varied by up to ±10%
+func (v *viewer) jitter(d time.Duration) time.Duration {
+	return d + time.Duration((v.rng.Float64()*0.2-0.1)*float64(d))
+}
+
+// sleep waits for d, reporting false if ctx ended first
+func (v *viewer) sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// dialErrorClass names a failed connection attempt, by HTTP status when
+// the server refused the upgrade
+func dialErrorClass(resp *http.Response, err error) string {
+	if resp == nil {
+		return netErrorClass(err)
+	}
+	var body struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&body)
+	if body.Error.Code != "" {
+		return fmt.Sprintf("http %d %s", resp.StatusCode, body.Error.Code)
+	}
+	return fmt.Sprintf("http %d", resp.StatusCode)
+}
+
+// netErrorClass groups network errors into a few stable classes
+func netErrorClass(err error) string {
+	var netErr net.Error
+	msg := err.Error()
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case strings.Contains(msg, "connection refused"):
+		return "connection refused"
+	case strings.Contains(msg, "connection reset"):
+		return "connection reset"
+	case strings.Contains(msg, "broken pipe"):
+		return "broken pipe"
+	case strings.Contains(msg, "too many open files"):
+		return "too many open files"
+	default:
+		return "other"
+	}
+}
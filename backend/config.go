@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds application configuration.
+//
+// Values are layered, each source overriding the ones before it:
+//
+//  1. built-in defaults (local Hardhat node)
+//  2. the Hardhat deployment file of the selected network (chain ID, contract
+//     address, signer)
+//  3. the YAML config file given by --config or CONFIG_FILE
+//  4. environment variables
+//  5. command-line flags
+//
+// Fields marked hot-reloadable in configFields are re-read on SIGHUP; the rest
+// need a restart.
+type Config struct {
+	Network            string `json:"network" yaml:"network"`   // Deployment profile, e.g. localhost or sepolia
+	ChainID            int64  `json:"chain_id" yaml:"chain_id"` // Expected chain ID (0 = don't check)
+	RPCEndpoint        string `json:"rpc_endpoint" yaml:"rpc_endpoint"`
+	ContractAddress    string `json:"contract_address" yaml:"contract_address"`
+	SignerPrivateKey   string `json:"signer_private_key" yaml:"signer_private_key"`
+	RewardSigner       string `json:"reward_signer" yaml:"reward_signer"` // Address the contract expects rewards from
+	HTTPPort           string `json:"http_port" yaml:"http_port"`
+	DeploymentFile     string `json:"deployment_file" yaml:"deployment_file"`           // Hardhat deployment JSON (default deployments/<network>.json)
+	TreasuryArtifact   string `json:"treasury_artifact" yaml:"treasury_artifact"`       // Compiled RewardTreasury deployed in demo mode
+	RewardPerHeartbeat int64  `json:"reward_per_heartbeat" yaml:"reward_per_heartbeat"` // Wei
+	MaxConnsPerIP      int    `json:"max_conns_per_ip" yaml:"max_conns_per_ip"`         // WebSocket connections per client IP (0 = unlimited)
+	TrustedProxies     string `json:"trusted_proxies" yaml:"trusted_proxies"`           // Comma-separated IPs or CIDRs whose X-Forwarded-For is honoured ("" = none)
+	RewardWorkers      int    `json:"reward_workers" yaml:"reward_workers"`             // Concurrent reward settlement workers
+
+	MinHeartbeatIntervalMs int64 `json:"min_heartbeat_interval_ms" yaml:"min_heartbeat_interval_ms"` // Per-wallet heartbeat throttle (0 = off)
+	EarningsBackfillBlocks int64 `json:"earnings_backfill_blocks" yaml:"earnings_backfill_blocks"`   // RewardClaimed history indexed when none is stored (0 = the retention window)
+	AdLengthMs             int64 `json:"ad_length_ms" yaml:"ad_length_ms"`                           // Length of ads not listed under ads
+	CompletionBonus        int64 `json:"completion_bonus" yaml:"completion_bonus"`                   // Wei paid for a completed ad session (0 = none)
+
+	// Directory of the state files below given as relative paths. It must
+	// be on a persistent disk, or they are lost on every redeploy.
+	DataDir string `json:"data_dir" yaml:"data_dir"`
+
+	LeaderboardOptOutFile string `json:"leaderboard_opt_out_file" yaml:"leaderboard_opt_out_file"` // Wallets hidden from leaderboards ("" = memory only)
+
+	ReferralBonusPercent int    `json:"referral_bonus_percent" yaml:"referral_bonus_percent"` // Share of a referee's confirmed rewards paid to the referrer
+	ReferralMinPayout    int64  `json:"referral_min_payout" yaml:"referral_min_payout"`       // Wei a referrer must accrue before a bonus is sent
+	ReferralFile         string `json:"referral_file" yaml:"referral_file"`                   // Referral codes, bindings and bonuses ("" = memory only)
+
+	ShutdownTimeoutMs  int64  `json:"shutdown_timeout_ms" yaml:"shutdown_timeout_ms"`   // How long shutdown waits for queued and submitted rewards
+	PendingRewardsFile string `json:"pending_rewards_file" yaml:"pending_rewards_file"` // Rewards left unsettled at shutdown, resumed at startup ("" = dropped)
+
+	RedisURL  string `json:"redis_url" yaml:"redis_url"`   // State shared between replicas ("" = this process only)
+	ReplicaID string `json:"replica_id" yaml:"replica_id"` // Name of this replica in the cluster ("" = hostname plus a random suffix)
+
+	PayoutLedgerFile    string `json:"payout_ledger_file" yaml:"payout_ledger_file"`       // Confirmed payouts for reconciliation without Redis ("" = memory only)
+	ReconcileIntervalMs int64  `json:"reconcile_interval_ms" yaml:"reconcile_interval_ms"` // How often the leader reconciles payouts with the chain (0 = off)
+	AdminAPIKeySHA256   string `json:"admin_api_key_sha256" yaml:"admin_api_key_sha256"`   // hex SHA-256 of the admin API key ("" = admin API off)
+	AuditLogFile        string `json:"audit_log_file" yaml:"audit_log_file"`               // Hash-chained audit trail of value-moving actions ("" = memory only)
+	AuditHMACKey        string `json:"audit_hmac_key" yaml:"audit_hmac_key"`               // Key for HMAC audit hashes ("" = plain SHA-256)
+
+	// Extra chains served alongside the primary one (YAML only)
+	Chains []ChainConfig `json:"chains,omitempty" yaml:"chains,omitempty"`
+
+	// Rules pricing each heartbeat's reward (YAML only, hot-reloadable)
+	Pricing PricingConfig `json:"pricing" yaml:"pricing,omitempty"`
+
+	// Ads with their own length, completion bonus or bid (YAML only, hot-reloadable)
+	Ads []AdConfig `json:"ads,omitempty" yaml:"ads,omitempty"`
+
+	// Advertisers allowed to read campaign reports (YAML only, hot-reloadable)
+	Advertisers []AdvertiserConfig `json:"advertisers,omitempty" yaml:"advertisers,omitempty"`
+
+	extraChains []*Config // resolved Chains, filled by configLoader.load
+	demo        bool      // serve an in-process simulated chain, set by --demo
+}
+
+// defaultConfig returns the configuration for local development
+func defaultConfig() *Config {
+	return &Config{
+		Network:            "localhost",
+		RPCEndpoint:        "http://127.0.0.1:8545",
+		ContractAddress:    "",                                                                   // Will be loaded from deployment
+		SignerPrivateKey:   "0x59c6995e998f97a5a0044966f0945389dc9e86dae88c7a8412f4603b6b78690d", // Hardhat account #1
+		HTTPPort:           "8080",
+		TreasuryArtifact:   embeddedTreasuryArtifact,
+		RewardPerHeartbeat: 1000, // 1000 wei per heartbeat
+		MaxConnsPerIP:      10,
+		RewardWorkers:      4,
+
+		MinHeartbeatIntervalMs: 4000,   // Frontend sends one every 5 seconds
+		EarningsBackfillBlocks: 100000, // About two weeks on Sepolia
+		AdLengthMs:             30000,
+		CompletionBonus:        5000,
+
+		DataDir: "data",
+
+		LeaderboardOptOutFile: "leaderboard-opt-outs.json",
+
+		ReferralBonusPercent: 10,
+		ReferralMinPayout:    10000,
+		ReferralFile:         "referrals.json",
+
+		ShutdownTimeoutMs:  20000, // Leaves room within the usual 30 s SIGTERM grace period
+		PendingRewardsFile: "pending-rewards.json",
+
+		PayoutLedgerFile:    "payout-ledger.jsonl",
+		ReconcileIntervalMs: 600000,
+		AuditLogFile:        "audit-log.jsonl",
+	}
+}
+
+// configField describes one setting and how it is read from env and flags
+type configField struct {
+	key       string // YAML key
+	env       string // environment variable
+	flag      string // command-line flag, empty if not settable by flag
+	usage     string
+	hotReload bool
+	secret    bool
+	get       func(c *Config) string
+	set       func(c *Config, v string) error
+}
+
+func stringField(ptr func(c *Config) *string) (func(*Config) string, func(*Config, string) error) {
+	return func(c *Config) string { return *ptr(c) },
+		func(c *Config, v string) error { *ptr(c) = v; return nil }
+}
+
+func intField(ptr func(c *Config) *int) (func(*Config) string, func(*Config, string) error) {
+	return func(c *Config) string { return strconv.Itoa(*ptr(c)) },
+		func(c *Config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("not an integer: %q", v)
+			}
+			*ptr(c) = n
+			return nil
+		}
+}
+
+func int64Field(ptr func(c *Config) *int64) (func(*Config) string, func(*Config, string) error) {
+	return func(c *Config) string { return strconv.FormatInt(*ptr(c), 10) },
+		func(c *Config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return fmt.Errorf("not an integer: %q", v)
+			}
+			*ptr(c) = n
+			return nil
+		}
+}
+
+// configFields lists every setting in documentation order
+var configFields = func() []configField {
+	field := func(key, env, flagName, usage string, hot, secret bool, get func(*Config) string, set func(*Config, string) error) configField {
+		return configField{key: key, env: env, flag: flagName, usage: usage, hotReload: hot, secret: secret, get: get, set: set}
+	}
+
+	networkGet, networkSet := stringField(func(c *Config) *string { return &c.Network })
+	chainGet, chainSet := int64Field(func(c *Config) *int64 { return &c.ChainID })
+	rpcGet, rpcSet := stringField(func(c *Config) *string { return &c.RPCEndpoint })
+	contractGet, contractSet := stringField(func(c *Config) *string { return &c.ContractAddress })
+	keyGet, keySet := stringField(func(c *Config) *string { return &c.SignerPrivateKey })
+	rewardSignerGet, rewardSignerSet := stringField(func(c *Config) *string { return &c.RewardSigner })
+	portGet, portSet := stringField(func(c *Config) *string { return &c.HTTPPort })
+	deployGet, deploySet := stringField(func(c *Config) *string { return &c.DeploymentFile })
+	artifactGet, artifactSet := stringField(func(c *Config) *string { return &c.TreasuryArtifact })
+	rewardGet, rewardSet := int64Field(func(c *Config) *int64 { return &c.RewardPerHeartbeat })
+	connsGet, connsSet := intField(func(c *Config) *int { return &c.MaxConnsPerIP })
+	proxiesGet, proxiesSet := stringField(func(c *Config) *string { return &c.TrustedProxies })
+	workersGet, workersSet := intField(func(c *Config) *int { return &c.RewardWorkers })
+	intervalGet, intervalSet := int64Field(func(c *Config) *int64 { return &c.MinHeartbeatIntervalMs })
+	backfillGet, backfillSet := int64Field(func(c *Config) *int64 { return &c.EarningsBackfillBlocks })
+	adLengthGet, adLengthSet := int64Field(func(c *Config) *int64 { return &c.AdLengthMs })
+	bonusGet, bonusSet := int64Field(func(c *Config) *int64 { return &c.CompletionBonus })
+	dataDirGet, dataDirSet := stringField(func(c *Config) *string { return &c.DataDir })
+	optOutGet, optOutSet := stringField(func(c *Config) *string { return &c.LeaderboardOptOutFile })
+	referralPctGet, referralPctSet := intField(func(c *Config) *int { return &c.ReferralBonusPercent })
+	referralMinGet, referralMinSet := int64Field(func(c *Config) *int64 { return &c.ReferralMinPayout })
+	referralFileGet, referralFileSet := stringField(func(c *Config) *string { return &c.ReferralFile })
+	shutdownGet, shutdownSet := int64Field(func(c *Config) *int64 { return &c.ShutdownTimeoutMs })
+	pendingGet, pendingSet := stringField(func(c *Config) *string { return &c.PendingRewardsFile })
+	redisGet, redisSet := stringField(func(c *Config) *string { return &c.RedisURL })
+	replicaGet, replicaSet := stringField(func(c *Config) *string { return &c.ReplicaID })
+	ledgerGet, ledgerSet := stringField(func(c *Config) *string { return &c.PayoutLedgerFile })
+	reconcileGet, reconcileSet := int64Field(func(c *Config) *int64 { return &c.ReconcileIntervalMs })
+	adminKeyGet, adminKeySet := stringField(func(c *Config) *string { return &c.AdminAPIKeySHA256 })
+	auditGet, auditSet := stringField(func(c *Config) *string { return &c.AuditLogFile })
+	auditKeyGet, auditKeySet := stringField(func(c *Config) *string { return &c.AuditHMACKey })
+
+	return []configField{
+		field("network", "NETWORK", "network", "Network profile to load from the deployments directory", false, false, networkGet, networkSet),
+		field("chain_id", "CHAIN_ID", "chain-id", "Chain ID the RPC must report (0 = don't check)", false, false, chainGet, chainSet),
+		field("rpc_endpoint", "RPC_ENDPOINT", "rpc-endpoint", "Ethereum JSON-RPC URL", false, false, rpcGet, rpcSet),
+		field("contract_address", "CONTRACT_ADDRESS", "contract-address", "RewardTreasury contract address", false, false, contractGet, contractSet),
+		// Never accepted as a flag: command lines are visible to other local users
+		field("signer_private_key", "SIGNER_PRIVATE_KEY", "", "Private key used to sign rewards", false, true, keyGet, keySet),
+		field("reward_signer", "REWARD_SIGNER", "reward-signer", "Address the contract accepts rewards from", false, false, rewardSignerGet, rewardSignerSet),
+		field("http_port", "HTTP_PORT", "http-port", "HTTP listen port", false, false, portGet, portSet),
+		field("deployment_file", "DEPLOYMENT_FILE", "deployment-file", "Hardhat deployment JSON (default "+deploymentsDir+"/<network>.json)", false, false, deployGet, deploySet),
+		field("treasury_artifact", "TREASURY_ARTIFACT", "treasury-artifact", "Compiled RewardTreasury artifact deployed in demo mode (\"embedded\" = the built-in build, empty = direct transfers)", false, false, artifactGet, artifactSet),
+		field("reward_per_heartbeat", "REWARD_PER_HEARTBEAT", "reward-per-heartbeat", "Reward in wei per heartbeat", true, false, rewardGet, rewardSet),
+		field("max_conns_per_ip", "WS_MAX_CONNS_PER_IP", "max-conns-per-ip", "Streaming connections per client IP (0 = unlimited)", true, false, connsGet, connsSet),
+		field("trusted_proxies", "TRUSTED_PROXIES", "trusted-proxies", "Comma-separated IPs or CIDRs of proxies whose X-Forwarded-For is trusted (empty = none)", true, false, proxiesGet, proxiesSet),
+		field("reward_workers", "REWARD_WORKERS", "reward-workers", "Background reward settlement workers", false, false, workersGet, workersSet),
+		field("min_heartbeat_interval_ms", "MIN_HEARTBEAT_INTERVAL_MS", "min-heartbeat-interval-ms", "Minimum milliseconds between heartbeats per wallet (0 = off)", true, false, intervalGet, intervalSet),
+		field("earnings_backfill_blocks", "EARNINGS_BACKFILL_BLOCKS", "earnings-backfill-blocks", "Blocks of RewardClaimed history to index when shared state holds none (0 = all of the 400-day retention window)", false, false, backfillGet, backfillSet),
+		field("ad_length_ms", "AD_LENGTH_MS", "ad-length-ms", "Length in milliseconds of ads not listed under ads", true, false, adLengthGet, adLengthSet),
+		field("completion_bonus", "COMPLETION_BONUS", "completion-bonus", "Reward in wei for completing an ad session (0 = none)", true, false, bonusGet, bonusSet),
+		field("data_dir", "DATA_DIR", "data-dir", "Directory of state files given as relative paths (lost on redeploy unless on a persistent disk; REDIS_URL keeps all but the audit log in Redis)", false, false, dataDirGet, dataDirSet),
+		field("leaderboard_opt_out_file", "LEADERBOARD_OPT_OUT_FILE", "leaderboard-opt-out-file", "JSON file of wallets hidden from leaderboards without Redis (empty = memory only)", false, false, optOutGet, optOutSet),
+		field("referral_bonus_percent", "REFERRAL_BONUS_PERCENT", "referral-bonus-percent", "Percent of a referee's confirmed rewards paid to the referrer (0 = off)", true, false, referralPctGet, referralPctSet),
+		field("referral_min_payout", "REFERRAL_MIN_PAYOUT", "referral-min-payout", "Wei a referrer must accrue before a bonus is sent", true, false, referralMinGet, referralMinSet),
+		field("referral_file", "REFERRAL_FILE", "referral-file", "JSON file of referral codes, bindings and bonuses without Redis (empty = memory only)", false, false, referralFileGet, referralFileSet),
+		field("shutdown_timeout_ms", "SHUTDOWN_TIMEOUT_MS", "shutdown-timeout-ms", "Milliseconds shutdown waits for queued rewards to be sent and mined", true, false, shutdownGet, shutdownSet),
+		field("pending_rewards_file", "PENDING_REWARDS_FILE", "pending-rewards-file", "JSON file saving rewards unsettled at shutdown for the next start (empty = drop them)", false, false, pendingGet, pendingSet),
+		// Not a flag either: the URL may carry the Redis password
+		field("redis_url", "REDIS_URL", "", "redis:// or rediss:// URL of state shared by all replicas (empty = single replica)", false, true, redisGet, redisSet),
+		field("replica_id", "REPLICA_ID", "replica-id", "Name of this replica in the cluster (empty = hostname plus a random suffix)", false, false, replicaGet, replicaSet),
+		field("payout_ledger_file", "PAYOUT_LEDGER_FILE", "payout-ledger-file", "JSONL file of confirmed payouts for reconciliation when not using Redis (empty = memory only)", false, false, ledgerGet, ledgerSet),
+		field("reconcile_interval_ms", "RECONCILE_INTERVAL_MS", "reconcile-interval-ms", "Milliseconds between payout reconciliations on the leader (0 = off)", true, false, reconcileGet, reconcileSet),
+		field("admin_api_key_sha256", "ADMIN_API_KEY_SHA256", "admin-api-key-sha256", "Hex SHA-256 of the key for /api/admin (empty = admin API off)", true, false, adminKeyGet, adminKeySet),
+		field("audit_log_file", "AUDIT_LOG_FILE", "audit-log-file", "Append-only JSONL audit trail of value-moving actions (empty = memory only)", false, false, auditGet, auditSet),
+		// Not a flag: whoever knows the key can rewrite the audit chain
+		field("audit_hmac_key", "AUDIT_HMAC_KEY", "", "Secret keying audit record hashes as HMAC-SHA256 (empty = plain SHA-256)", false, true, auditKeyGet, auditKeySet),
+	}
+}()
+
+// configLoader rebuilds the layered configuration, at startup and on SIGHUP
+type configLoader struct {
+	configFile string
+	flags      map[string]string // flags set explicitly on the command line
+	demo       bool
+}
+
+// cliOptions are the parsed command-line arguments
+type cliOptions struct {
+	loader      *configLoader
+	printConfig bool
+	reconcile   bool // the reconcile subcommand: reconcile once and exit
+	jsonOutput  bool
+}
+
+// parseFlags reads command-line flags, after an optional "reconcile"
+// subcommand. Only flags the user actually set are kept, so unset flags
+// never mask env or file values.
+func parseFlags(args []string) (*cliOptions, error) {
+	reconcile := len(args) > 0 && args[0] == "reconcile"
+	name := "chainpay-backend"
+	if reconcile {
+		args = args[1:]
+		name += " reconcile"
+	}
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file (env CONFIG_FILE)")
+	printConfig := fs.Bool("print-config", false, "Print the effective configuration with secrets redacted and exit")
+	demo := fs.Bool("demo", false, "Run on an in-process simulated chain with RewardTreasury deployed, no RPC node needed")
+	var jsonOutput *bool
+	if reconcile {
+		jsonOutput = fs.Bool("json", false, "Print the reconciliation report as JSON")
+	}
+
+	values := make(map[string]*string)
+	for _, f := range configFields {
+		if f.flag == "" {
+			continue
+		}
+		values[f.flag] = fs.String(f.flag, "", fmt.Sprintf("%s (env %s)", f.usage, f.env))
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	loader := &configLoader{configFile: *configFile, flags: make(map[string]string), demo: *demo}
+	fs.Visit(func(f *flag.Flag) {
+		if v, ok := values[f.Name]; ok {
+			loader.flags[f.Name] = *v
+		}
+	})
+
+	opts := &cliOptions{loader: loader, printConfig: *printConfig, reconcile: reconcile}
+	if reconcile {
+		opts.jsonOutput = *jsonOutput
+	}
+	return opts, nil
+}
+
+// load builds and validates the configuration from every layer
+func (l *configLoader) load() (*Config, error) {
+	var fileData []byte
+	if l.configFile != "" {
+		data, err := os.ReadFile(l.configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		fileData = data
+	}
+
+	profile := &networkProfile{Name: demoNetwork, ChainID: simulatedChainID}
+	if !l.demo {
+		// The network and deployment file may come from any later layer, so
+		// resolve them first and then build the real configuration on top.
+		probe, err := l.build(fileData, nil)
+		if err != nil {
+			return nil, err
+		}
+		if probe.DeploymentFile == "" {
+			probe.DeploymentFile = deploymentPath(probe.Network)
+		}
+
+		if profile, err = loadNetworkProfile(probe.Network, probe.DeploymentFile); err != nil {
+			return nil, err
+		}
+	}
+
+	config, err := l.build(fileData, profile)
+	if err != nil {
+		return nil, err
+	}
+	if l.demo {
+		config.applyDemo()
+	}
+	config.resolveDataFiles()
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for i, cc := range config.Chains {
+		extra, err := resolveChain(config, cc)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("chains[%d] (%s): %w", i, cc.Network, err))
+			continue
+		}
+		config.extraChains = append(config.extraChains, extra)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// dataFiles returns the settings naming state files this process writes
+func (c *Config) dataFiles() []*string {
+	return []*string{&c.LeaderboardOptOutFile, &c.ReferralFile, &c.PendingRewardsFile, &c.PayoutLedgerFile, &c.AuditLogFile}
+}
+
+// resolveDataFiles puts state files given as relative paths under DataDir
+func (c *Config) resolveDataFiles() {
+	for _, file := range c.dataFiles() {
+		if *file != "" && !filepath.IsAbs(*file) {
+			*file = filepath.Join(c.DataDir, *file)
+		}
+	}
+}
+
+// makeDataDir creates the directories of the configured state files
+func (c *Config) makeDataDir() error {
+	for _, file := range c.dataFiles() {
+		if *file == "" {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(*file), 0o700); err != nil {
+			return fmt.Errorf("failed to create data directory: %w", err)
+		}
+	}
+	return nil
+}
+
+// build applies defaults, network profile, config file, env and flags in order
+func (l *configLoader) build(fileData []byte, profile *networkProfile) (*Config, error) {
+	config := defaultConfig()
+
+	if profile != nil {
+		config.DeploymentFile = profile.File
+		profile.apply(config)
+	}
+
+	if fileData != nil {
+		dec := yaml.NewDecoder(bytes.NewReader(fileData))
+		dec.KnownFields(true)
+		if err := dec.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("invalid config file %s: %w", l.configFile, err)
+		}
+	}
+
+	for _, f := range configFields {
+		if v := os.Getenv(f.env); v != "" {
+			if err := f.set(config, v); err != nil {
+				return nil, fmt.Errorf("%s: %w", f.env, err)
+			}
+		}
+	}
+
+	for _, f := range configFields {
+		if v, ok := l.flags[f.flag]; ok && f.flag != "" {
+			if err := f.set(config, v); err != nil {
+				return nil, fmt.Errorf("--%s: %w", f.flag, err)
+			}
+		}
+	}
+
+	return config, nil
+}
+
+// Validate checks every setting and reports all problems at once
+func (c *Config) Validate() error {
+	errs := c.validateChain()
+
+	if port, err := strconv.Atoi(c.HTTPPort); err != nil || port < 1 || port > 65535 {
+		errs = append(errs, fmt.Errorf("http_port: %q is not a port between 1 and 65535", c.HTTPPort))
+	}
+
+	if c.RewardPerHeartbeat <= 0 {
+		errs = append(errs, fmt.Errorf("reward_per_heartbeat: must be positive, got %d", c.RewardPerHeartbeat))
+	}
+	if c.MaxConnsPerIP < 0 {
+		errs = append(errs, fmt.Errorf("max_conns_per_ip: must not be negative, got %d", c.MaxConnsPerIP))
+	}
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted_proxies: %w", err))
+	}
+	if c.RewardWorkers < 1 || c.RewardWorkers > 64 {
+		errs = append(errs, fmt.Errorf("reward_workers: must be between 1 and 64, got %d", c.RewardWorkers))
+	}
+	if c.MinHeartbeatIntervalMs < 0 {
+		errs = append(errs, fmt.Errorf("min_heartbeat_interval_ms: must not be negative, got %d", c.MinHeartbeatIntervalMs))
+	}
+	if c.EarningsBackfillBlocks < 0 {
+		errs = append(errs, fmt.Errorf("earnings_backfill_blocks: must not be negative, got %d", c.EarningsBackfillBlocks))
+	}
+	if c.AdLengthMs <= 0 {
+		errs = append(errs, fmt.Errorf("ad_length_ms: must be positive, got %d", c.AdLengthMs))
+	}
+	if c.CompletionBonus < 0 {
+		errs = append(errs, fmt.Errorf("completion_bonus: must not be negative, got %d", c.CompletionBonus))
+	}
+	if c.ReferralBonusPercent < 0 || c.ReferralBonusPercent > 100 {
+		errs = append(errs, fmt.Errorf("referral_bonus_percent: must be between 0 and 100, got %d", c.ReferralBonusPercent))
+	}
+	if c.ReferralMinPayout < 1 {
+		errs = append(errs, fmt.Errorf("referral_min_payout: must be at least 1, got %d", c.ReferralMinPayout))
+	}
+	if c.ShutdownTimeoutMs < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout_ms: must not be negative, got %d", c.ShutdownTimeoutMs))
+	}
+	if c.ReconcileIntervalMs < 0 {
+		errs = append(errs, fmt.Errorf("reconcile_interval_ms: must not be negative, got %d", c.ReconcileIntervalMs))
+	}
+	if c.AdminAPIKeySHA256 != "" {
+		if b, err := hex.DecodeString(c.AdminAPIKeySHA256); err != nil || len(b) != sha256.Size {
+			errs = append(errs, errors.New("admin_api_key_sha256: must be a hex SHA-256 digest"))
+		}
+	}
+	if c.AuditHMACKey != "" && len(c.AuditHMACKey) < 32 {
+		errs = append(errs, fmt.Errorf("audit_hmac_key: must be at least 32 characters, got %d", len(c.AuditHMACKey)))
+	}
+	if c.RedisURL != "" {
+		if u, err := url.Parse(c.RedisURL); err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Host == "" {
+			errs = append(errs, errors.New("redis_url: must be a redis:// or rediss:// URL"))
+		}
+	}
+	errs = append(errs, validatePricing(c.Pricing)...)
+	errs = append(errs, validateAds(c.Ads)...)
+	errs = append(errs, validateAdvertisers(c.Advertisers)...)
+
+	return errors.Join(errs...)
+}
+
+// validateChain checks the settings each chain has its own copy of: the RPC,
+// contract, network and signer. Extra chains are checked with this alone, as
+// the rest is the primary chain's and already validated.
+func (c *Config) validateChain() []error {
+	var errs []error
+
+	if u, err := url.Parse(c.RPCEndpoint); err != nil || u.Host == "" {
+		errs = append(errs, fmt.Errorf("rpc_endpoint: %q is not a valid URL", c.RPCEndpoint))
+	} else if s := u.Scheme; s != "http" && s != "https" && s != "ws" && s != "wss" {
+		errs = append(errs, fmt.Errorf("rpc_endpoint: unsupported scheme %q", s))
+	}
+
+	if c.ContractAddress != "" {
+		if err := validateChecksumAddress(c.ContractAddress); err != nil {
+			errs = append(errs, fmt.Errorf("contract_address: %w", err))
+		}
+	}
+
+	if c.Network == "" {
+		errs = append(errs, errors.New("network: must not be empty"))
+	}
+	if c.ChainID < 0 {
+		errs = append(errs, fmt.Errorf("chain_id: must not be negative, got %d", c.ChainID))
+	}
+
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(c.SignerPrivateKey, "0x"))
+	if err != nil {
+		errs = append(errs, errors.New("signer_private_key: not a valid secp256k1 private key"))
+	}
+
+	if c.RewardSigner != "" {
+		if !common.IsHexAddress(c.RewardSigner) {
+			errs = append(errs, fmt.Errorf("reward_signer: %q is not a hex address", c.RewardSigner))
+		} else if key != nil && crypto.PubkeyToAddress(key.PublicKey) != common.HexToAddress(c.RewardSigner) {
+			// Every reward would revert with "caller is not reward signer"
+			errs = append(errs, fmt.Errorf("signer_private_key: belongs to %s, but the %s deployment expects reward signer %s",
+				crypto.PubkeyToAddress(key.PublicKey).Hex(), c.Network, common.HexToAddress(c.RewardSigner).Hex()))
+		}
+	}
+	return errs
+}
+
+// validateChecksumAddress accepts all-lowercase or all-uppercase hex
+// addresses, and mixed-case ones only if the EIP-55 checksum matches.
+func validateChecksumAddress(addr string) error {
+	if !common.IsHexAddress(addr) {
+		return fmt.Errorf("%q is not a hex address", addr)
+	}
+
+	hexPart := strings.TrimPrefix(strings.TrimPrefix(addr, "0x"), "0X")
+	if hexPart == strings.ToLower(hexPart) || hexPart == strings.ToUpper(hexPart) {
+		return nil
+	}
+	if common.HexToAddress(addr).Hex() != "0x"+hexPart {
+		return fmt.Errorf("%q fails EIP-55 checksum", addr)
+	}
+	return nil
+}
+
+// Redacted returns a copy safe to print or log: every field marked secret in
+// configFields is hidden, and credentials are stripped from RPC URLs
+func (c *Config) Redacted() *Config {
+	copied := *c
+	for _, f := range configFields {
+		if f.secret {
+			f.set(&copied, redactSecret(f.get(c)))
+		}
+	}
+	copied.RPCEndpoint = redactURL(copied.RPCEndpoint)
+
+	copied.Chains = make([]ChainConfig, len(c.Chains))
+	for i, cc := range c.Chains {
+		if cc.SignerPrivateKey != "" {
+			cc.SignerPrivateKey = "<redacted>"
+		}
+		cc.RPCEndpoint = redactURL(cc.RPCEndpoint)
+		copied.Chains[i] = cc
+	}
+	return &copied
+}
+
+// redactSecret hides a secret value, keeping only the scheme and host of URLs
+func redactSecret(v string) string {
+	if v == "" {
+		return ""
+	}
+	if u, err := url.Parse(v); err == nil && u.Host != "" {
+		return redactURL(v)
+	}
+	return "<redacted>"
+}
+
+// redactURL hides credentials and API-key paths such as Alchemy's /v2/<key>
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return raw
+	}
+	redacted := u.Scheme + "://"
+	if u.User != nil {
+		redacted += "<redacted>@"
+	}
+	redacted += u.Host
+	if u.Path != "" && u.Path != "/" {
+		redacted += "/<redacted>"
+	}
+	if u.RawQuery != "" {
+		redacted += "?<redacted>"
+	}
+	return redacted
+}
+
+// printConfig writes the redacted effective configuration as YAML
+func printConfig(w io.Writer, c *Config) error {
+	out, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// cfg returns the current configuration. Configs are never mutated after
+// publication; reloads swap in a new value.
+func (s *Server) cfg() *Config {
+	s.configMux.RLock()
+	defer s.configMux.RUnlock()
+	return s.config
+}
+
+// reloadOnSIGHUP reloads the configuration on every SIGHUP until ctx ends.
+// The handler is installed before it returns, so no signal is missed.
+func (s *Server) reloadOnSIGHUP(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Println("🔄 SIGHUP received, reloading configuration...")
+				s.reloadConfig()
+			}
+		}
+	}()
+}
+
+// reloadConfig re-reads every layer and applies the hot-reloadable settings.
+// Other changes are reported and ignored until restart.
+func (s *Server) reloadConfig() {
+	next, err := s.loader.load()
+	if err != nil {
+		log.Printf("⚠️ Config reload rejected: %v", err)
+		return
+	}
+
+	var changes []string // applied, for the audit log
+	s.configMux.Lock()
+	current := s.config
+	merged := *current
+	for _, f := range configFields {
+		old, updated := f.get(current), f.get(next)
+		if old == updated {
+			continue
+		}
+		if !f.hotReload {
+			log.Printf("⚠️ Config %s changed but requires a restart; keeping current value", f.key)
+			continue
+		}
+		f.set(&merged, updated)
+		if f.secret {
+			old, updated = redactSecret(old), redactSecret(updated)
+		}
+		log.Printf("🔄 Config %s: %s → %s", f.key, old, updated)
+		changes = append(changes, fmt.Sprintf("%s: %s → %s", f.key, old, updated))
+	}
+	if !reflect.DeepEqual(current.Chains, next.Chains) {
+		log.Println("⚠️ Config chains changed but requires a restart; keeping current chains")
+	}
+	if !reflect.DeepEqual(current.Pricing, next.Pricing) {
+		merged.Pricing = next.Pricing
+		log.Printf("🔄 Config pricing: %d tiers, %d time-of-day rules", len(next.Pricing.Tiers), len(next.Pricing.TimeOfDay))
+		changes = append(changes, fmt.Sprintf("pricing: %d tiers, %d time-of-day rules", len(next.Pricing.Tiers), len(next.Pricing.TimeOfDay)))
+	}
+	if !reflect.DeepEqual(current.Ads, next.Ads) {
+		merged.Ads = next.Ads
+		log.Printf("🔄 Config ads: %d configured", len(next.Ads))
+		changes = append(changes, fmt.Sprintf("ads: %d configured", len(next.Ads)))
+	}
+	if !reflect.DeepEqual(current.Advertisers, next.Advertisers) {
+		merged.Advertisers = next.Advertisers
+		log.Printf("🔄 Config advertisers: %d configured", len(next.Advertisers))
+		changes = append(changes, fmt.Sprintf("advertisers: %d configured", len(next.Advertisers)))
+	}
+	s.config = &merged
+	s.configMux.Unlock()
+
+	for _, change := range changes {
+		s.audit.record(AuditRecord{
+			Action:  AuditConfigChanged,
+			Actor:   "operator",
+			Trigger: "sighup",
+			Detail:  change,
+		})
+	}
+
+	log.Println("✅ Configuration reloaded")
+}
@@ -0,0 +1,1774 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// Advertiser used by the report tests
+const (
+	testAdvertiserID  = "acme"
+	testAdvertiserKey = "acme-secret-key"
+	testAdLength      = 400 // ms; short enough to complete a session in a test
+	testAdminKey      = "admin-secret-key"
+)
+
+// withTestAds adds a short ad, an advertiser paying for ad-1 and the admin
+// API key
+func withTestAds(c *Config) {
+	adminSum := sha256.Sum256([]byte(testAdminKey))
+	c.AdminAPIKeySHA256 = hex.EncodeToString(adminSum[:])
+
+	sum := sha256.Sum256([]byte(testAdvertiserKey))
+	c.Ads = []AdConfig{{ID: "short-ad", LengthMs: testAdLength}}
+	c.Advertisers = []AdvertiserConfig{{
+		ID:           testAdvertiserID,
+		Name:         "Acme",
+		APIKeySHA256: hex.EncodeToString(sum[:]),
+		Campaigns:    []string{"ad-1"},
+	}}
+}
+
+func newKeyedWallet(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, crypto.PubkeyToAddress(key.PublicKey).Hex()
+}
+
+// signText signs message the way a wallet's personal_sign does
+func signText(t *testing.T, key *ecdsa.PrivateKey, message string) string {
+	t.Helper()
+	sig, err := crypto.Sign(accounts.TextHash([]byte(message)), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig[crypto.RecoveryIDOffset] += 27
+	return hexutil.Encode(sig)
+}
+
+// call sends a request with an optional JSON body and returns the response
+// with its body read
+func call(t *testing.T, ts *testServer, method, path string, body interface{}, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+
+	var reader io.Reader
+	switch b := body.(type) {
+	case nil:
+	case string:
+		reader = strings.NewReader(b)
+	default:
+		data, err := json.Marshal(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, ts.URL+path, reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	return resp, data
+}
+
+// postJSON posts body and decodes the response into v, failing unless the
+// status is want
+func postJSON(t *testing.T, ts *testServer, path string, body, v interface{}, want int) {
+	t.Helper()
+	resp, data := call(t, ts, http.MethodPost, path, body, nil)
+	if resp.StatusCode != want {
+		t.Fatalf("POST %s: status %d, want %d: %s", path, resp.StatusCode, want, data)
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			t.Fatalf("POST %s: %v", path, err)
+		}
+	}
+}
+
+// expectError checks a response is the error envelope with status and code
+func expectError(t *testing.T, resp *http.Response, data []byte, status int, code string) {
+	t.Helper()
+	var body ErrorResponse
+	if err := json.Unmarshal(data, &body); err != nil {
+		t.Fatalf("%s %s: not an error envelope: %s", resp.Request.Method, resp.Request.URL.Path, data)
+	}
+	if resp.StatusCode != status || body.Error.Code != code || body.Success {
+		t.Errorf("%s %s: status %d code %q, want %d %q (%s)", resp.Request.Method, resp.Request.URL.Path,
+			resp.StatusCode, body.Error.Code, status, code, body.Error.Message)
+	}
+}
+
+// wsConn is a WebSocket client that reads messages in the background
+type wsConn struct {
+	conn     *websocket.Conn
+	messages chan map[string]interface{}
+	closeErr chan error // the error that ended the read loop
+}
+
+// dialWS connects to ts and consumes the welcome message
+func dialWS(t *testing.T, ts *testServer) (*wsConn, map[string]interface{}) {
+	t.Helper()
+
+	conn, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err != nil {
+		status := 0
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		t.Fatalf("WebSocket dial: %v (status %d)", err, status)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	c := &wsConn{
+		conn:     conn,
+		messages: make(chan map[string]interface{}, 100),
+		closeErr: make(chan error, 1),
+	}
+	go func() {
+		for {
+			var msg map[string]interface{}
+			if err := conn.ReadJSON(&msg); err != nil {
+				c.closeErr <- err
+				close(c.messages)
+				return
+			}
+			c.messages <- msg
+		}
+	}()
+
+	welcome := c.expect(t, "connected")
+	return c, welcome
+}
+
+func (c *wsConn) send(t *testing.T, msg map[string]interface{}) {
+	t.Helper()
+	if err := c.conn.WriteJSON(msg); err != nil {
+		t.Fatalf("WebSocket write: %v", err)
+	}
+}
+
+// next returns the next message that isn't a broadcast on a default topic
+func (c *wsConn) next(t *testing.T) map[string]interface{} {
+	t.Helper()
+	timeout := time.After(15 * time.Second)
+	for {
+		select {
+		case msg, ok := <-c.messages:
+			if !ok {
+				t.Fatalf("WebSocket closed: %v", <-c.closeErr)
+			}
+			if msg["type"] == "block" || msg["type"] == "new_block" {
+				continue
+			}
+			return msg
+		case <-timeout:
+			t.Fatal("timed out waiting for a WebSocket message")
+		}
+	}
+}
+
+// expect returns the next message, failing unless it has type msgType
+func (c *wsConn) expect(t *testing.T, msgType string) map[string]interface{} {
+	t.Helper()
+	msg := c.next(t)
+	if msg["type"] != msgType {
+		t.Fatalf("got WebSocket message %v, want type %q", msg, msgType)
+	}
+	return msg
+}
+
+// skipUntil discards messages until one has type msgType
+func (c *wsConn) skipUntil(t *testing.T, msgType string, match func(map[string]interface{}) bool) map[string]interface{} {
+	t.Helper()
+	for {
+		msg := c.next(t)
+		if msg["type"] == msgType && (match == nil || match(msg)) {
+			return msg
+		}
+	}
+}
+
+// routeCase is a request that exercises one route successfully. body is
+// called per request, so requests with one-time effects can be repeated.
+type routeCase struct {
+	path   string
+	body   func() interface{}
+	header http.Header
+	status int
+	stream bool // response never ends; only the headers are checked
+}
+
+func TestEveryRouteResponds(t *testing.T) {
+	ts := newDemoServer(t, "", withTestAds)
+	key, wallet := newKeyedWallet(t)
+
+	rewardID := sendHeartbeat(t, ts, wallet)
+	waitConfirmed(t, ts, rewardID)
+
+	var sess AdSession
+	postJSON(t, ts, "/api/v1/session/start", SessionStartRequest{WalletAddress: wallet, AdID: "short-ad"}, &sess, http.StatusCreated)
+
+	var code ReferralCodeResponse
+	postJSON(t, ts, "/api/v1/referral/code", ReferralCodeRequest{WalletAddress: wallet}, &code, http.StatusOK)
+
+	cases := map[string]routeCase{
+		"GET /openapi.json":                    {path: "/openapi.json"},
+		"GET /health":                          {path: "/health"},
+		"GET /stats":                           {path: "/stats"},
+		"GET /balance/{address}":               {path: "/balance/" + wallet},
+		"GET /reward/{id}":                     {path: "/reward/" + rewardID},
+		"GET /treasury":                        {path: "/treasury"},
+		"GET /block/latest":                    {path: "/block/latest"},
+		"GET /user/{address}/earnings":         {path: "/user/" + wallet + "/earnings"},
+		"GET /user/{address}/earnings/history": {path: "/user/" + wallet + "/earnings/history"},
+		"GET /user/{address}/earnings/summary": {path: "/user/" + wallet + "/earnings/summary"},
+		"GET /user/{address}/earnings/payouts": {path: "/user/" + wallet + "/earnings/payouts"},
+		"GET /session/{id}":                    {path: "/session/" + sess.ID},
+		"GET /leaderboard":                     {path: "/leaderboard"},
+		"GET /referral/{address}":              {path: "/referral/" + wallet},
+		"GET /referral/{address}/payouts":      {path: "/referral/" + wallet + "/payouts"},
+		"GET /events":                          {path: "/events", stream: true},
+		"GET /advertiser/{id}/report": {
+			path:   "/advertiser/" + testAdvertiserID + "/report",
+			header: http.Header{"Authorization": {"Bearer " + testAdvertiserKey}},
+		},
+		"GET /reconciliation": {
+			path:   "/reconciliation?run=true",
+			header: http.Header{"Authorization": {"Bearer " + testAdminKey}},
+			status: http.StatusAccepted,
+		},
+		"GET /audit": {
+			path:   "/audit?wallet=" + wallet,
+			header: http.Header{"Authorization": {"Bearer " + testAdminKey}},
+		},
+		"GET /audit/verify": {
+			path:   "/audit/verify",
+			header: http.Header{"Authorization": {"Bearer " + testAdminKey}},
+		},
+		"POST /heartbeat": {
+			path:   "/heartbeat",
+			body:   func() interface{} { return HeartbeatRequest{WalletAddress: newWallet(t), AdID: "ad-1"} },
+			status: http.StatusAccepted,
+		},
+		"POST /session/start": {
+			path: "/session/start",
+			// A new session abandons the wallet's previous one, so use another wallet
+			body:   func() interface{} { return SessionStartRequest{WalletAddress: newWallet(t), AdID: "short-ad"} },
+			status: http.StatusCreated,
+		},
+		"POST /session/{id}/complete": {
+			// Completing a fresh session is covered by TestSessionCompletionFlow
+			path:   "/session/" + sess.ID + "/complete",
+			body:   func() interface{} { return SessionCompleteRequest{WalletAddress: wallet} },
+			status: http.StatusConflict,
+		},
+		"POST /leaderboard/opt-out": {
+			path: "/leaderboard/opt-out",
+			body: func() interface{} {
+				ts := time.Now().Unix()
+				return LeaderboardOptOutRequest{
+					WalletAddress: wallet,
+					OptOut:        true,
+					Timestamp:     ts,
+					Signature:     signText(t, key, leaderboardOptOutMessage(wallet, true, ts)),
+				}
+			},
+		},
+		"POST /referral/code": {
+			path: "/referral/code",
+			body: func() interface{} { return ReferralCodeRequest{WalletAddress: wallet} },
+		},
+		"POST /referral/bind": {
+			path: "/referral/bind",
+			body: func() interface{} {
+				refereeKey, referee := newKeyedWallet(t)
+				ts := time.Now().Unix()
+				return ReferralBindRequest{
+					WalletAddress: referee,
+					ReferralCode:  code.Code,
+					Timestamp:     ts,
+					Signature:     signText(t, refereeKey, referralBindMessage(referee, code.Code, ts)),
+				}
+			},
+			status: http.StatusCreated,
+		},
+	}
+
+	run := func(t *testing.T, prefix string, rc routeCase, method string) *http.Response {
+		want := rc.status
+		if want == 0 {
+			want = http.StatusOK
+		}
+
+		if rc.stream {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			req, _ := http.NewRequestWithContext(ctx, method, ts.URL+prefix+rc.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", method, rc.path, err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != want || resp.Header.Get("Content-Type") != "text/event-stream" {
+				t.Errorf("%s %s: status %d, content type %q", method, prefix+rc.path, resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			return resp
+		}
+
+		var body interface{}
+		if rc.body != nil {
+			body = rc.body()
+		}
+		resp, data := call(t, ts, method, prefix+rc.path, body, rc.header)
+		if resp.StatusCode != want {
+			t.Errorf("%s %s: status %d, want %d: %s", method, prefix+rc.path, resp.StatusCode, want, data)
+		}
+		if !json.Valid(data) {
+			t.Errorf("%s %s: response is not JSON: %s", method, prefix+rc.path, data)
+		}
+		return resp
+	}
+
+	// Every route registered under /api must have a case, so new routes
+	// can't be added without coverage
+	seen := make(map[string]bool)
+	err := ts.server.router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		if route.GetHandler() == nil {
+			return nil // a PathPrefix holding a subrouter
+		}
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, _ := route.GetMethods()
+		method := http.MethodGet
+		if len(methods) > 0 {
+			method = methods[0]
+		}
+
+		var prefix string
+		switch {
+		case strings.HasPrefix(template, "/api/admin/"):
+			prefix = "/api/admin"
+		case strings.HasPrefix(template, "/api/v1/"):
+			prefix = "/api/v1"
+		case strings.HasPrefix(template, "/api/"):
+			prefix = "/api"
+		default:
+			seen[method+" "+template] = true
+			return nil
+		}
+		name := method + " " + strings.TrimPrefix(template, prefix)
+		rc, ok := cases[name]
+		if !ok {
+			t.Errorf("no test case for route %s %s", method, template)
+			return nil
+		}
+		seen[name] = true
+
+		t.Run(method+" "+template, func(t *testing.T) {
+			resp := run(t, prefix, rc, method)
+			if prefix == "/api" {
+				link := `</api/v1` + rc.path + `>; rel="successor-version"`
+				if resp.Header.Get("Deprecation") == "" || resp.Header.Get("Sunset") == "" || resp.Header.Get("Link") != link {
+					t.Errorf("legacy route %s missing deprecation headers: %v", template, resp.Header)
+				}
+			} else if resp.Header.Get("Deprecation") != "" {
+				t.Errorf("versioned route %s is marked deprecated", template)
+			}
+		})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name := range cases {
+		if !seen[name] {
+			t.Errorf("test case %s matches no route", name)
+		}
+	}
+
+	// Routes outside /api
+	if !seen["GET /metrics"] || !seen["GET /ws"] {
+		t.Fatalf("expected /metrics and /ws routes, saw %v", seen)
+	}
+	resp, data := call(t, ts, http.MethodGet, "/metrics", nil, nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(data, []byte("chainpay_")) {
+		t.Errorf("GET /metrics: status %d", resp.StatusCode)
+	}
+	dialWS(t, ts)
+}
+
+func TestHTTPErrorPaths(t *testing.T) {
+	ts := newDemoServer(t, "", withTestAds, func(c *Config) { c.MaxConnsPerIP = 1 })
+	key, wallet := newKeyedWallet(t)
+	_, other := newKeyedWallet(t)
+
+	var sess AdSession
+	postJSON(t, ts, "/api/v1/session/start", SessionStartRequest{WalletAddress: wallet, AdID: "short-ad"}, &sess, http.StatusCreated)
+
+	var code ReferralCodeResponse
+	postJSON(t, ts, "/api/v1/referral/code", ReferralCodeRequest{WalletAddress: other}, &code, http.StatusOK)
+
+	ts0 := time.Now().Unix()
+	cases := []struct {
+		name   string
+		method string
+		path   string
+		body   interface{}
+		header http.Header
+		status int
+		code   string
+	}{
+		{"heartbeat malformed body", "POST", "/api/v1/heartbeat", "{not json", nil, 400, CodeInvalidRequest},
+		{"heartbeat without wallet", "POST", "/api/v1/heartbeat", HeartbeatRequest{AdID: "ad-1"}, nil, 400, CodeInvalidAddress},
+		{"heartbeat bad wallet", "POST", "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: "0x1234", AdID: "ad-1"}, nil, 400, CodeInvalidAddress},
+		{"heartbeat unknown chain", "POST", "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: wallet, ChainID: 999}, nil, 400, CodeUnknownChain},
+		{"heartbeat malformed session", "POST", "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: wallet, SessionID: "missing"}, nil, 400, CodeInvalidRequest},
+		{"heartbeat unknown session", "POST", "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: wallet, SessionID: newRewardID()}, nil, 404, CodeNotFound},
+		{"heartbeat someone else's session", "POST", "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: other, SessionID: sess.ID}, nil, 404, CodeNotFound},
+		{"malformed reward ID", "GET", "/api/v1/reward/missing", nil, nil, 400, CodeInvalidRequest},
+		{"unknown reward", "GET", "/api/v1/reward/" + newRewardID(), nil, nil, 404, CodeNotFound},
+		{"balance bad address", "GET", "/api/v1/balance/nope", nil, nil, 400, CodeInvalidAddress},
+		{"treasury unknown chain", "GET", "/api/v1/treasury?chain_id=999", nil, nil, 400, CodeUnknownChain},
+		{"earnings malformed chain", "GET", "/api/v1/user/" + wallet + "/earnings?chain_id=abc", nil, nil, 400, CodeInvalidRequest},
+		{"unknown session", "GET", "/api/v1/session/" + newRewardID(), nil, nil, 404, CodeNotFound},
+		{"session start bad wallet", "POST", "/api/v1/session/start", SessionStartRequest{WalletAddress: "0x12", AdID: "short-ad"}, nil, 400, CodeInvalidAddress},
+		{"session incomplete", "POST", "/api/v1/session/" + sess.ID + "/complete", SessionCompleteRequest{WalletAddress: wallet}, nil, 409, CodeSessionIncomplete},
+		{"session of another wallet", "POST", "/api/v1/session/" + sess.ID + "/complete", SessionCompleteRequest{WalletAddress: other}, nil, 404, CodeNotFound},
+		{"opt-out signed by another key", "POST", "/api/v1/leaderboard/opt-out", LeaderboardOptOutRequest{
+			WalletAddress: other, OptOut: true, Timestamp: ts0,
+			Signature: signText(t, key, leaderboardOptOutMessage(other, true, ts0)),
+		}, nil, 401, CodeUnauthorized},
+		{"opt-out stale timestamp", "POST", "/api/v1/leaderboard/opt-out", LeaderboardOptOutRequest{
+			WalletAddress: wallet, OptOut: true, Timestamp: ts0 - 3600,
+			Signature: signText(t, key, leaderboardOptOutMessage(wallet, true, ts0-3600)),
+		}, nil, 401, CodeUnauthorized},
+		{"referral code bad wallet", "POST", "/api/v1/referral/code", ReferralCodeRequest{WalletAddress: "0x12"}, nil, 400, CodeInvalidAddress},
+		{"referral bind unknown code", "POST", "/api/v1/referral/bind", ReferralBindRequest{
+			WalletAddress: wallet, ReferralCode: "NOSUCHCODE", Timestamp: ts0,
+			Signature: signText(t, key, referralBindMessage(wallet, "NOSUCHCODE", ts0)),
+		}, nil, 404, CodeNotFound},
+		{"referral bind malformed signature", "POST", "/api/v1/referral/bind", ReferralBindRequest{
+			WalletAddress: wallet, ReferralCode: code.Code, Timestamp: ts0, Signature: "0x00",
+		}, nil, 400, CodeInvalidRequest},
+		{"referral bind signed by another key", "POST", "/api/v1/referral/bind", ReferralBindRequest{
+			WalletAddress: other, ReferralCode: code.Code, Timestamp: ts0,
+			Signature: signText(t, key, referralBindMessage(other, code.Code, ts0)),
+		}, nil, 401, CodeUnauthorized},
+		{"advertiser without key", "GET", "/api/v1/advertiser/" + testAdvertiserID + "/report", nil, nil, 401, CodeUnauthorized},
+		{"advertiser wrong key", "GET", "/api/v1/advertiser/" + testAdvertiserID + "/report", nil,
+			http.Header{"Authorization": {"Bearer wrong"}}, 401, CodeUnauthorized},
+		{"advertiser foreign campaign", "GET", "/api/v1/advertiser/" + testAdvertiserID + "/report?campaign=short-ad", nil,
+			http.Header{"X-Api-Key": {testAdvertiserKey}}, 404, CodeNotFound},
+		{"events bad topic", "GET", "/api/v1/events?topics=nonsense", nil, nil, 400, CodeInvalidRequest},
+		{"admin without key", "GET", "/api/admin/reconciliation", nil, nil, 401, CodeUnauthorized},
+		{"admin wrong key", "GET", "/api/admin/reconciliation", nil,
+			http.Header{"Authorization": {"Bearer " + testAdvertiserKey}}, 401, CodeUnauthorized},
+		{"reconciliation bad run", "GET", "/api/admin/reconciliation?run=maybe", nil,
+			http.Header{"Authorization": {"Bearer " + testAdminKey}}, 400, CodeInvalidRequest},
+		{"audit unknown action", "GET", "/api/admin/audit?action=reward_accrued,payday", nil,
+			http.Header{"Authorization": {"Bearer " + testAdminKey}}, 400, CodeInvalidRequest},
+		{"audit bad wallet", "GET", "/api/admin/audit?wallet=0x12", nil,
+			http.Header{"Authorization": {"Bearer " + testAdminKey}}, 400, CodeInvalidAddress},
+		{"audit bad range", "GET", "/api/admin/audit?from=2026-10-02&to=2026-10-01", nil,
+			http.Header{"Authorization": {"Bearer " + testAdminKey}}, 400, CodeInvalidRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, data := call(t, ts, tc.method, tc.path, tc.body, tc.header)
+			expectError(t, resp, data, tc.status, tc.code)
+		})
+	}
+
+	t.Run("WebSocket connection limit", func(t *testing.T) {
+		dialWS(t, ts)
+		_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+		if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("second connection from one IP: %v, want 429", err)
+		}
+	})
+}
+
+func TestHeartbeatRateLimit(t *testing.T) {
+	ts := newDemoServer(t, "", func(c *Config) { c.MinHeartbeatIntervalMs = 60000 })
+	wallet := newWallet(t)
+
+	sendHeartbeat(t, ts, wallet)
+	resp, data := call(t, ts, http.MethodPost, "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: wallet, AdID: "ad-1"}, nil)
+	expectError(t, resp, data, http.StatusTooManyRequests, CodeRateLimited)
+
+	// Limits are per wallet
+	sendHeartbeat(t, ts, newWallet(t))
+}
+
+func TestSessionCompletionFlow(t *testing.T) {
+	ts := newDemoServer(t, "", withTestAds)
+	wallet := newWallet(t)
+
+	var sess AdSession
+	postJSON(t, ts, "/api/v1/session/start", SessionStartRequest{WalletAddress: wallet, AdID: "short-ad"}, &sess, http.StatusCreated)
+	if sess.AdLengthMs != testAdLength || sess.Status != SessionActive {
+		t.Fatalf("unexpected session %+v", sess)
+	}
+
+	// Watch time is credited up to the real time since the session started
+	time.Sleep(time.Duration(sess.RequiredMs+50) * time.Millisecond)
+	var hb HeartbeatResponse
+	postJSON(t, ts, "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: wallet, SessionID: sess.ID, Duration: testAdLength}, &hb, http.StatusAccepted)
+
+	var progress AdSession
+	getJSON(t, ts, "/api/v1/session/"+sess.ID, &progress)
+	if progress.Heartbeats != 1 || progress.WatchedMs < progress.RequiredMs {
+		t.Fatalf("session progress %+v", progress)
+	}
+
+	var done SessionCompleteResponse
+	postJSON(t, ts, "/api/v1/session/"+sess.ID+"/complete", SessionCompleteRequest{WalletAddress: wallet}, &done, http.StatusAccepted)
+	if done.Session.Status != SessionCompleted || done.RewardID == "" || done.RewardWei != done.Session.CompletionBonusWei {
+		t.Fatalf("unexpected completion %+v", done)
+	}
+	bonus := waitConfirmed(t, ts, done.RewardID)
+	if bonus.Kind != RewardCompletionBonus {
+		t.Errorf("bonus reward kind = %s", bonus.Kind)
+	}
+	waitConfirmed(t, ts, hb.RewardID)
+
+	// A session pays once and takes no more heartbeats
+	resp, data := call(t, ts, http.MethodPost, "/api/v1/session/"+sess.ID+"/complete", SessionCompleteRequest{WalletAddress: wallet}, nil)
+	expectError(t, resp, data, http.StatusConflict, CodeSessionClosed)
+	resp, data = call(t, ts, http.MethodPost, "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: wallet, SessionID: sess.ID}, nil)
+	expectError(t, resp, data, http.StatusConflict, CodeSessionClosed)
+}
+
+func TestReferralBonusFlow(t *testing.T) {
+	ts := newDemoServer(t, "", func(c *Config) {
+		c.ReferralBonusPercent = 50
+		c.ReferralMinPayout = 1
+	})
+	_, referrer := newKeyedWallet(t)
+	refereeKey, referee := newKeyedWallet(t)
+
+	var code ReferralCodeResponse
+	postJSON(t, ts, "/api/v1/referral/code", ReferralCodeRequest{WalletAddress: referrer}, &code, http.StatusOK)
+
+	bind := func() ReferralBindRequest {
+		now := time.Now().Unix()
+		return ReferralBindRequest{
+			WalletAddress: referee,
+			ReferralCode:  code.Code,
+			Timestamp:     now,
+			Signature:     signText(t, refereeKey, referralBindMessage(referee, code.Code, now)),
+		}
+	}
+	var binding ReferralBinding
+	postJSON(t, ts, "/api/v1/referral/bind", bind(), &binding, http.StatusCreated)
+	if !strings.EqualFold(binding.Referrer, referrer) {
+		t.Fatalf("bound to %s, want %s", binding.Referrer, referrer)
+	}
+	resp, data := call(t, ts, http.MethodPost, "/api/v1/referral/bind", bind(), nil)
+	expectError(t, resp, data, http.StatusConflict, CodeAlreadyReferred)
+
+	waitConfirmed(t, ts, sendHeartbeat(t, ts, referee))
+
+	var summary ReferralSummaryResponse
+	getJSON(t, ts, "/api/v1/referral/"+referrer, &summary)
+	if summary.PendingWei != "500" || len(summary.Referees) != 1 {
+		t.Fatalf("referrer summary %+v, want 500 wei pending from one referee", summary)
+	}
+
+	// The settler runs every minute; run it now
+	ts.server.settleReferrals(time.Now())
+
+	var payouts ReferralPayoutsResponse
+	getJSON(t, ts, "/api/v1/referral/"+referrer+"/payouts", &payouts)
+	if len(payouts.Payouts) != 1 {
+		t.Fatalf("got %d referral payouts, want 1", len(payouts.Payouts))
+	}
+	waitConfirmed(t, ts, payouts.Payouts[0].RewardID)
+
+	waitFor(t, 15*time.Second, func() error {
+		getJSON(t, ts, "/api/v1/referral/"+referrer, &summary)
+		if summary.PaidWei != "500" || summary.PendingWei != "0" {
+			return fmt.Errorf("referrer has %s wei paid, %s pending", summary.PaidWei, summary.PendingWei)
+		}
+		return nil
+	})
+
+	var balance BalanceResponse
+	getJSON(t, ts, "/api/v1/balance/"+referrer, &balance)
+	if balance.BalanceWei != "500" {
+		t.Errorf("referrer balance = %s wei, want 500", balance.BalanceWei)
+	}
+}
+
+func TestReferralsSharedAcrossReplicas(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "referrals.json")
+	config := newDemoConfig(t, "", func(c *Config) { c.ReferralFile = file })
+	chains := startDemoChain(t, config)
+	state := newMemoryState()
+	a := startReplica(t, config, chains, state)
+	b := startReplica(t, config, chains, state)
+
+	_, referrer := newKeyedWallet(t)
+	refereeKey, referee := newKeyedWallet(t)
+
+	// A code made on one replica is the wallet's code everywhere
+	var code, again ReferralCodeResponse
+	postJSON(t, a, "/api/v1/referral/code", ReferralCodeRequest{WalletAddress: referrer}, &code, http.StatusOK)
+	postJSON(t, b, "/api/v1/referral/code", ReferralCodeRequest{WalletAddress: referrer}, &again, http.StatusOK)
+	if again.Code != code.Code {
+		t.Fatalf("replicas gave %s and %s the same wallet", code.Code, again.Code)
+	}
+
+	// and binds on the other
+	now := time.Now().Unix()
+	bind := ReferralBindRequest{
+		WalletAddress: referee,
+		ReferralCode:  code.Code,
+		Timestamp:     now,
+		Signature:     signText(t, refereeKey, referralBindMessage(referee, code.Code, now)),
+	}
+	postJSON(t, b, "/api/v1/referral/bind", bind, &ReferralBinding{}, http.StatusCreated)
+	resp, data := call(t, a, http.MethodPost, "/api/v1/referral/bind", bind, nil)
+	expectError(t, resp, data, http.StatusConflict, CodeAlreadyReferred)
+
+	var summary ReferralSummaryResponse
+	getJSON(t, a, "/api/v1/referral/"+referrer, &summary)
+	if summary.Code != code.Code || len(summary.Referees) != 1 || !strings.EqualFold(summary.Referees[0].Referee, referee) {
+		t.Fatalf("summary on the other replica = %+v", summary)
+	}
+
+	// A rewarded wallet is no longer new, on any replica
+	earnerKey, earner := newKeyedWallet(t)
+	waitConfirmed(t, a, sendHeartbeat(t, a, earner))
+	bind = ReferralBindRequest{
+		WalletAddress: earner,
+		ReferralCode:  code.Code,
+		Timestamp:     now,
+		Signature:     signText(t, earnerKey, referralBindMessage(earner, code.Code, now)),
+	}
+	resp, data = call(t, b, http.MethodPost, "/api/v1/referral/bind", bind, nil)
+	expectError(t, resp, data, http.StatusConflict, CodeReferralIneligible)
+	a.server.referrals.flush()
+
+	// Without Redis the file carries referrals across restarts
+	restarted, err := newReferralStore(newMemoryState(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binding, ok, err := restarted.binding(referee)
+	if err != nil || !ok || !strings.EqualFold(binding.Referrer, referrer) {
+		t.Fatalf("binding after restart = %+v, %v, %v", binding, ok, err)
+	}
+	if c, err := restarted.code(referrer); err != nil || c != code.Code {
+		t.Errorf("code after restart = %s, %v; want %s", c, err, code.Code)
+	}
+	if seen, err := restarted.seen(earner); err != nil || !seen {
+		t.Errorf("rewarded wallet forgotten after restart: %v, %v", seen, err)
+	}
+}
+
+func TestLeaderboardOptOutSharedAcrossReplicas(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "opt-outs.json")
+	config := newDemoConfig(t, "", func(c *Config) { c.LeaderboardOptOutFile = file })
+	chains := startDemoChain(t, config)
+	state := newMemoryState()
+	a := startReplica(t, config, chains, state)
+	b := startReplica(t, config, chains, state)
+
+	// An opt-out made on one replica reaches the other without waiting for
+	// its next refresh
+	key, wallet := newKeyedWallet(t)
+	now := time.Now().Unix()
+	postJSON(t, a, "/api/v1/leaderboard/opt-out", LeaderboardOptOutRequest{
+		WalletAddress: wallet,
+		OptOut:        true,
+		Timestamp:     now,
+		Signature:     signText(t, key, leaderboardOptOutMessage(wallet, true, now)),
+	}, &map[string]interface{}{}, http.StatusOK)
+	waitFor(t, 5*time.Second, func() error {
+		if !b.server.leaderboard.isOptedOut(wallet) {
+			return fmt.Errorf("%s not opted out on the other replica", wallet)
+		}
+		return nil
+	})
+
+	// Without Redis the file carries opt-outs across restarts
+	restarted, err := newLeaderboard(newMemoryState(), file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.isOptedOut(wallet) {
+		t.Error("opt-out lost after restart")
+	}
+}
+
+func TestAdvertiserReportCountsHeartbeats(t *testing.T) {
+	ts := newDemoServer(t, "", withTestAds)
+	for i := 0; i < 2; i++ {
+		waitConfirmed(t, ts, sendHeartbeat(t, ts, newWallet(t)))
+	}
+
+	header := http.Header{"Authorization": {"Bearer " + testAdvertiserKey}}
+	resp, data := call(t, ts, http.MethodGet, "/api/v1/advertiser/"+testAdvertiserID+"/report", nil, header)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("report: status %d: %s", resp.StatusCode, data)
+	}
+	var report AdvertiserReportResponse
+	if err := json.Unmarshal(data, &report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Totals.Heartbeats != 2 || report.Totals.UniqueWallets != 2 || report.Totals.SpendWei != "2000" {
+		t.Errorf("report totals %+v, want 2 heartbeats from 2 wallets costing 2000 wei", report.Totals)
+	}
+
+	resp, data = call(t, ts, http.MethodGet, "/api/v1/advertiser/"+testAdvertiserID+"/report?format=csv", nil, header)
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/csv") {
+		t.Errorf("CSV report: status %d, content type %q: %s", resp.StatusCode, resp.Header.Get("Content-Type"), data)
+	}
+}
+
+func TestCampaignWatchTimeIsClamped(t *testing.T) {
+	cs := newCampaignStore(newMemoryState())
+	wallet := newWallet(t)
+	start := time.Now().Truncate(time.Hour)
+
+	// Each heartbeat claims an hour of watching
+	claims := []struct {
+		after time.Duration
+		want  int64
+	}{
+		{0, 5000},               // first heartbeat: one interval
+		{3 * time.Second, 3000}, // time since the previous one
+		{8 * time.Second, 8000}, // a late heartbeat, within two intervals
+		{time.Minute, 5000},     // after a long pause: a new viewing
+		{0, 0},                  // the same instant again: nothing more
+	}
+	at := start
+	var total int64
+	for _, c := range claims {
+		at = at.Add(c.after)
+		cs.recordHeartbeat(1, "ad-1", wallet, time.Hour.Milliseconds(), 5000, at)
+		total += c.want
+	}
+	rep, _, err := cs.report(1, "ad-1", time.Hour, start, start.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Totals.WatchTimeMs != total || rep.Totals.Heartbeats != int64(len(claims)) {
+		t.Errorf("watch time %dms over %d heartbeats, want %dms over %d",
+			rep.Totals.WatchTimeMs, rep.Totals.Heartbeats, total, len(claims))
+	}
+}
+
+func TestReportsSharedAcrossReplicas(t *testing.T) {
+	config := newDemoConfig(t, "", withTestAds)
+	chains := startDemoChain(t, config)
+	state := newMemoryState()
+	leader := startReplica(t, config, chains, state)
+	follower := startReplica(t, config, chains, state)
+
+	// The follower accepts the heartbeat, the leader records its spend
+	wallet := newWallet(t)
+	waitConfirmed(t, follower, sendHeartbeat(t, follower, wallet))
+
+	header := http.Header{"Authorization": {"Bearer " + testAdvertiserKey}}
+	for name, ts := range map[string]*testServer{"leader": leader, "follower": follower} {
+		waitFor(t, 5*time.Second, func() error {
+			resp, data := call(t, ts, http.MethodGet, "/api/v1/advertiser/"+testAdvertiserID+"/report", nil, header)
+			var report AdvertiserReportResponse
+			if resp.StatusCode != http.StatusOK || json.Unmarshal(data, &report) != nil {
+				return fmt.Errorf("%s report: status %d: %s", name, resp.StatusCode, data)
+			}
+			if report.Totals.Heartbeats != 1 || report.Totals.UniqueWallets != 1 || report.Totals.SpendWei != "1000" {
+				return fmt.Errorf("%s report totals %+v, want 1 heartbeat costing 1000 wei", name, report.Totals)
+			}
+			return nil
+		})
+
+		// Earnings history counts the heartbeat on both replicas too
+		waitFor(t, 5*time.Second, func() error {
+			var summary EarningsSummaryResponse
+			getJSON(t, ts, "/api/v1/user/"+wallet+"/earnings/summary", &summary)
+			if summary.Heartbeats != 1 {
+				return fmt.Errorf("%s counts %d heartbeats, want 1", name, summary.Heartbeats)
+			}
+			return nil
+		})
+	}
+}
+
+func TestEarningsHistorySurvivesRestart(t *testing.T) {
+	config := newDemoConfig(t, embeddedTreasuryArtifact)
+	chains := startDemoChain(t, config)
+	state := newMemoryState()
+	first := startReplica(t, config, chains, state)
+
+	wallet := newWallet(t)
+	waitConfirmed(t, first, sendHeartbeat(t, first, wallet))
+	var summary EarningsSummaryResponse
+	waitFor(t, 10*time.Second, func() error {
+		getJSON(t, first, "/api/v1/user/"+wallet+"/earnings/summary", &summary)
+		if summary.Payouts != 1 {
+			return fmt.Errorf("payouts = %d, want 1", summary.Payouts)
+		}
+		return nil
+	})
+	first.Close()
+	first.cancel()
+
+	bc := chains.all()[0]
+	data, ok, err := state.get(earningsCursorKey(bc.ChainID()))
+	var cursor indexCursor
+	if err != nil || !ok || json.Unmarshal(data, &cursor) != nil || cursor.Next <= summary.LastPayout.Block {
+		t.Fatalf("stored index cursor = %s, %v, %v; want it past block %d", data, ok, err, summary.LastPayout.Block)
+	}
+
+	// The restarted replica reloads heartbeats and the payout from shared
+	// state and resumes indexing after the stored blocks
+	ts := startReplica(t, config, chains, state)
+	ts.server.earnings.mu.RLock()
+	resume := ts.server.earnings.resume[bc.ChainID()]
+	ts.server.earnings.mu.RUnlock()
+	if resume < cursor.Next {
+		t.Errorf("resumed indexing at block %d, want %d or later", resume, cursor.Next)
+	}
+	getJSON(t, ts, "/api/v1/user/"+wallet+"/earnings/summary", &summary)
+	if summary.Heartbeats != 1 || summary.Payouts != 1 || summary.LastPayout == nil {
+		t.Fatalf("summary after restart = %+v, want 1 heartbeat and 1 payout", summary)
+	}
+	paidAt := summary.LastPayout.Timestamp
+	if summary.PayoutsCompleteFrom.After(paidAt) {
+		t.Errorf("payouts complete from %s, after the payout at %s", summary.PayoutsCompleteFrom, paidAt)
+	}
+
+	var history EarningsHistoryResponse
+	getJSON(t, ts, "/api/v1/user/"+wallet+"/earnings/history?interval=hour", &history)
+	var heartbeats int64
+	for _, b := range history.Buckets {
+		heartbeats += b.Heartbeats
+	}
+	if heartbeats != 1 || history.PayoutsCompleteFrom.IsZero() || history.HeartbeatsCompleteFrom.IsZero() {
+		t.Errorf("history after restart = %+v", history)
+	}
+
+	// CSV exports state the complete window in headers
+	resp, _ := call(t, ts, http.MethodGet, "/api/v1/user/"+wallet+"/earnings/payouts?format=csv", nil, nil)
+	if from, err := time.Parse(time.RFC3339, resp.Header.Get("X-Payouts-Complete-From")); err != nil || from.After(paidAt) {
+		t.Errorf("X-Payouts-Complete-From = %q, %v", resp.Header.Get("X-Payouts-Complete-From"), err)
+	}
+}
+
+func TestReconciliationMatchesChain(t *testing.T) {
+	ts := newDemoServer(t, embeddedTreasuryArtifact, withTestAds)
+	wallet := newWallet(t)
+	for i := 0; i < 2; i++ {
+		waitConfirmed(t, ts, sendHeartbeat(t, ts, wallet))
+	}
+
+	// ?run=true answers at once; the leader's report follows
+	header := http.Header{"Authorization": {"Bearer " + testAdminKey}}
+	reconcile := func() ChainReconciliation {
+		t.Helper()
+		resp, data := call(t, ts, http.MethodGet, "/api/admin/reconciliation?run=true", nil, header)
+		var requested ReconciliationRequested
+		if resp.StatusCode != http.StatusAccepted || json.Unmarshal(data, &requested) != nil {
+			t.Fatalf("reconciliation request: status %d: %s", resp.StatusCode, data)
+		}
+		var report ReconciliationReport
+		waitFor(t, 10*time.Second, func() error {
+			resp, data := call(t, ts, http.MethodGet, "/api/admin/reconciliation", nil, header)
+			if resp.StatusCode != http.StatusOK || json.Unmarshal(data, &report) != nil {
+				return fmt.Errorf("reconciliation: status %d: %s", resp.StatusCode, data)
+			}
+			if report.GeneratedAt.Before(requested.RequestedAt) {
+				return fmt.Errorf("report of %s is older than the request at %s", report.GeneratedAt, requested.RequestedAt)
+			}
+			return nil
+		})
+		if len(report.Chains) != 1 {
+			t.Fatalf("reconciliation covers %d chains, want 1", len(report.Chains))
+		}
+		return report.Chains[0]
+	}
+	// expect reconciles and checks the issue types found, in report order
+	expect := func(name string, want ...IssueType) {
+		t.Helper()
+		cr := reconcile()
+		got := make([]IssueType, len(cr.Issues))
+		for i, issue := range cr.Issues {
+			got[i] = issue.Type
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s: issues = %+v, want %v", name, cr.Issues, want)
+		}
+	}
+
+	// Both payouts match once their events are indexed
+	var cr ChainReconciliation
+	waitFor(t, 15*time.Second, func() error {
+		cr = reconcile()
+		if cr.Skipped != "" || cr.IndexedPayouts < 2 {
+			return fmt.Errorf("chain skipped (%q) or %d events indexed", cr.Skipped, cr.IndexedPayouts)
+		}
+		return nil
+	})
+	if cr.LedgerPayouts != 2 || cr.LedgerWei != "2000" || cr.OnChainWei != "2000" || len(cr.Issues) != 0 {
+		t.Fatalf("clean reconciliation = %+v", cr)
+	}
+
+	// Each case doctors the ledger, then puts it back
+	ledger := ts.server.ledger
+	entries, err := ledger.entries(cr.ChainID)
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("ledger = %+v, %v", entries, err)
+	}
+	paid := entries[0]
+	put := func(e LedgerEntry) {
+		t.Helper()
+		if err := ledger.put(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	drop := func(e LedgerEntry) {
+		t.Helper()
+		if err := ts.server.state.hdel(ledgerKey(e.ChainID), e.RewardID+"/"+strings.ToLower(e.TxHash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fakeTx := func() string { return common.BytesToHash([]byte(newRewardID())).Hex() }
+
+	// A payout the backend recorded but the chain never made
+	missing := paid
+	missing.RewardID, missing.TxHash, missing.Block = newRewardID(), fakeTx(), cr.IndexedTo
+	put(missing)
+	expect("missing", IssueEarningsMismatch, IssueMissingPayout)
+	drop(missing)
+
+	// A payout the chain made that the backend has no record of
+	drop(paid)
+	expect("unexpected", IssueUnexpectedPayout)
+	put(paid)
+
+	// One reward confirmed in a second transaction
+	again := paid
+	again.TxHash = fakeTx()
+	put(again)
+	expect("duplicate", IssueDuplicatePayout, IssueEarningsMismatch, IssueMissingPayout)
+	drop(again)
+
+	// The event paid another amount than the reward
+	doctored := paid
+	doctored.AmountWei = "999"
+	put(doctored)
+	expect("amount", IssueAmountMismatch)
+
+	// or another wallet, which then looks underpaid
+	doctored = paid
+	doctored.Wallet = newWallet(t)
+	put(doctored)
+	expect("wallet", IssueEarningsMismatch, IssueWalletMismatch)
+	put(paid)
+	expect("restored")
+
+	// Without ?run the saved report is returned
+	put(missing)
+	reconcile()
+	resp, data := call(t, ts, http.MethodGet, "/api/admin/reconciliation", nil, header)
+	var report ReconciliationReport
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(data, &report) != nil || report.OK {
+		t.Errorf("saved report: status %d: %s", resp.StatusCode, data)
+	}
+}
+
+func TestReconciliationRunsOnLeader(t *testing.T) {
+	config := newDemoConfig(t, "", withTestAds)
+	chains := startDemoChain(t, config)
+	state := newMemoryState()
+	a := startReplica(t, config, chains, state)
+	b := startReplica(t, config, chains, state)
+	follower := b
+	if b.server.isLeader() {
+		follower = a
+	}
+	if follower.server.isLeader() {
+		t.Fatal("both replicas lead")
+	}
+
+	// The follower passes the request on and shows the leader's report
+	header := http.Header{"Authorization": {"Bearer " + testAdminKey}}
+	resp, data := call(t, follower, http.MethodGet, "/api/admin/reconciliation?run=true", nil, header)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("reconciliation request: status %d: %s", resp.StatusCode, data)
+	}
+	waitFor(t, 10*time.Second, func() error {
+		resp, data := call(t, follower, http.MethodGet, "/api/admin/reconciliation", nil, header)
+		var report ReconciliationReport
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(data, &report) != nil {
+			return fmt.Errorf("reconciliation: status %d: %s", resp.StatusCode, data)
+		}
+		if len(report.Chains) != 1 || report.Chains[0].Skipped == "" {
+			return fmt.Errorf("report = %s, want the direct-transfer chain skipped", data)
+		}
+		return nil
+	})
+}
+
+func TestAuditLogChainsValueMovingActions(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	ts := newDemoServer(t, "", withTestAds, func(c *Config) { c.AuditLogFile = file })
+	wallet := newWallet(t)
+	rewardID := sendHeartbeat(t, ts, wallet)
+	waitConfirmed(t, ts, rewardID)
+
+	header := http.Header{"Authorization": {"Bearer " + testAdminKey}}
+	query := func(path string) AuditLogResponse {
+		t.Helper()
+		resp, data := call(t, ts, http.MethodGet, path, nil, header)
+		var page AuditLogResponse
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(data, &page) != nil {
+			t.Fatalf("GET %s: status %d: %s", path, resp.StatusCode, data)
+		}
+		return page
+	}
+	verify := func() AuditVerification {
+		t.Helper()
+		resp, data := call(t, ts, http.MethodGet, "/api/admin/audit/verify", nil, header)
+		var result AuditVerification
+		if resp.StatusCode != http.StatusOK || json.Unmarshal(data, &result) != nil {
+			t.Fatalf("verify: status %d: %s", resp.StatusCode, data)
+		}
+		return result
+	}
+
+	// The reward's accrual, submission and receipt, in order
+	page := query("/api/admin/audit?wallet=" + strings.ToLower(wallet))
+	var actions []AuditAction
+	for _, rec := range page.Records {
+		if rec.RewardID != rewardID {
+			t.Errorf("record %d is for reward %s, want %s", rec.Seq, rec.RewardID, rewardID)
+		}
+		actions = append(actions, rec.Action)
+	}
+	want := []AuditAction{AuditRewardAccrued, AuditTxSubmitted, AuditTxMined}
+	if fmt.Sprint(actions) != fmt.Sprint(want) {
+		t.Fatalf("audited actions %v, want %v", actions, want)
+	}
+	if accrued := page.Records[0]; accrued.Actor != "wallet:"+strings.ToLower(wallet) || accrued.Trigger != "http_heartbeat" || accrued.AmountWei != "1000" {
+		t.Errorf("accrual record %+v", accrued)
+	}
+	if submitted := page.Records[1]; submitted.TxHash == "" || !strings.HasPrefix(submitted.Actor, "replica:") {
+		t.Errorf("submission record %+v", submitted)
+	}
+
+	if page := query("/api/admin/audit?action=tx_mined&wallet=" + wallet); page.Count != 1 {
+		t.Errorf("tx_mined query returned %d records, want 1", page.Count)
+	}
+	if page := query("/api/admin/audit?wallet=" + wallet + "&from=2000-01-01&to=2000-01-02"); page.Count != 0 {
+		t.Errorf("query before the records returned %d records", page.Count)
+	}
+	if page := query("/api/admin/audit?limit=1"); page.Count != 1 || !page.Truncated {
+		t.Errorf("limit=1 returned %d records, truncated %v", page.Count, page.Truncated)
+	}
+
+	// The JSONL export is the file's records
+	resp, data := call(t, ts, http.MethodGet, "/api/admin/audit?format=jsonl", nil, header)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("export: status %d, content type %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	onDisk, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, onDisk) {
+		t.Errorf("export differs from the audit log file:\n%s\n%s", data, onDisk)
+	}
+
+	result := verify()
+	if !result.OK || result.FirstSeq != 1 || result.Records != bytes.Count(onDisk, []byte("\n")) {
+		t.Fatalf("verification of an untouched log = %+v", result)
+	}
+
+	// A reopened log continues the chain
+	reopened, err := newAuditLog(file, "other", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reopened.seq != result.LastSeq || reopened.lastHash != result.LastHash {
+		t.Errorf("reopened log continues from seq %d, want %d", reopened.seq, result.LastSeq)
+	}
+
+	// Editing any record breaks the chain there
+	tampered := bytes.Replace(onDisk, []byte(`"amount_wei":"1000"`), []byte(`"amount_wei":"9000"`), 1)
+	if err := os.WriteFile(file, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if result := verify(); result.OK || result.BrokenAt != page.Records[0].Seq {
+		t.Errorf("verification of a tampered log = %+v, want broken at seq %d", result, page.Records[0].Seq)
+	}
+}
+
+func TestAuditLogHMACKeyAndDroppedRecords(t *testing.T) {
+	const key = "an-audit-key-of-at-least-32-chars"
+	file := filepath.Join(t.TempDir(), "audit.jsonl")
+	a, err := newAuditLog(file, "r1", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		a.record(AuditRecord{Action: AuditRewardAccrued, Actor: "operator", Trigger: "test", AmountWei: "1000"})
+	}
+	if result, err := a.verify(); err != nil || !result.OK || !result.Keyed || result.Records != 3 {
+		t.Fatalf("keyed verification = %+v, %v", result, err)
+	}
+	if result, _ := verifyAuditFile(file, nil); result.OK {
+		t.Error("keyed log verified without the key")
+	}
+
+	// Rewriting a record and recomputing the plain hashes after it doesn't
+	// get past the key
+	var records []AuditRecord
+	a.each(func(rec AuditRecord) bool { records = append(records, rec); return true })
+	var forged bytes.Buffer
+	prev := auditGenesisHash
+	for i, rec := range records {
+		if i == 1 {
+			rec.AmountWei = "9000"
+		}
+		rec.PrevHash = prev
+		rec.Hash, _ = rec.computeHash(nil)
+		prev = rec.Hash
+		json.NewEncoder(&forged).Encode(rec)
+	}
+	if err := os.WriteFile(file, forged.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := a.verify(); result.OK || result.BrokenAt != 1 {
+		t.Errorf("verification of a forged log = %+v, want broken at seq 1", result)
+	}
+
+	// Records that can't be written are counted
+	dropped := func() float64 {
+		var out bytes.Buffer
+		metricAuditDropped.write(&out)
+		prefix := `chainpay_audit_records_dropped_total{action="tx_mined"} `
+		for _, line := range strings.Split(out.String(), "\n") {
+			if v, ok := strings.CutPrefix(line, prefix); ok {
+				n, _ := strconv.ParseFloat(v, 64)
+				return n
+			}
+		}
+		return 0
+	}
+	before := dropped()
+	broken, err := newAuditLog(filepath.Join(t.TempDir(), "missing", "audit.jsonl"), "r1", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	broken.record(AuditRecord{Action: AuditTxMined, Actor: "operator", Trigger: "test"})
+	if after := dropped(); after != before+1 {
+		t.Errorf("dropped records went from %g to %g, want one more", before, after)
+	}
+	if broken.seq != 0 {
+		t.Errorf("dropped record advanced the chain to seq %d", broken.seq)
+	}
+}
+
+func TestWebSocketFlows(t *testing.T) {
+	ts := newDemoServer(t, "")
+	c, welcome := dialWS(t, ts)
+
+	config, _ := welcome["config"].(map[string]interface{})
+	if config == nil || config["chain_id"] != float64(simulatedChainID) {
+		t.Fatalf("welcome config %v, want chain %d", welcome["config"], simulatedChainID)
+	}
+
+	c.send(t, map[string]interface{}{"type": "ping"})
+	c.expect(t, "pong")
+
+	// Heartbeats before register are ignored; the pong shows nothing came back
+	c.send(t, map[string]interface{}{"type": "heartbeat", "ad_id": "ad-1"})
+	c.send(t, map[string]interface{}{"type": "ping"})
+	c.expect(t, "pong")
+
+	c.send(t, map[string]interface{}{"type": "register", "wallet_address": "0x1234"})
+	if msg := c.expect(t, "error"); msg["code"] != CodeInvalidAddress {
+		t.Fatalf("register with a bad address: %v", msg)
+	}
+
+	wallet := newWallet(t)
+	c.send(t, map[string]interface{}{"type": "register", "wallet_address": wallet})
+	c.send(t, map[string]interface{}{"type": "heartbeat", "ad_id": "ad-1", "duration_ms": 5000})
+	ack := c.expect(t, "heartbeat_ack")
+	id, _ := ack["reward_id"].(string)
+	if id == "" || ack["reward_wei"] != "1000" || ack["heartbeats"] != float64(1) {
+		t.Fatalf("unexpected ack %v", ack)
+	}
+
+	// Registering subscribes to the wallet's settlement updates
+	sent := c.skipUntil(t, "reward", func(m map[string]interface{}) bool { return m["reward_id"] == id })
+	if sent["success"] != true || sent["tx_hash"] == "" {
+		t.Fatalf("reward not submitted: %v", sent)
+	}
+	confirmed := c.skipUntil(t, "reward_status", func(m map[string]interface{}) bool { return m["reward_id"] == id })
+	if confirmed["status"] != string(RewardConfirmed) || confirmed["tx_hash"] != sent["tx_hash"] {
+		t.Fatalf("reward not confirmed: %v", confirmed)
+	}
+
+	c.send(t, map[string]interface{}{"type": "heartbeat", "ad_id": "ad-1", "chain_id": 999})
+	if msg := c.skipUntil(t, "heartbeat_rejected", nil); msg["error_code"] != CodeUnknownChain {
+		t.Fatalf("heartbeat on an unknown chain: %v", msg)
+	}
+
+	// A request with any bad topic is rejected whole: treasury isn't added
+	c.send(t, map[string]interface{}{"type": "subscribe", "topics": []string{TopicTreasury, "nonsense"}})
+	if msg := c.skipUntil(t, "error", nil); msg["code"] != CodeInvalidRequest {
+		t.Fatalf("subscribe to a bad topic: %v", msg)
+	}
+	held := func() interface{} {
+		t.Helper()
+		c.send(t, map[string]interface{}{"type": "unsubscribe", "topics": []string{}})
+		return c.skipUntil(t, "subscribed", nil)["topics"]
+	}
+	if topics := held(); containsTopic(topics, TopicTreasury) {
+		t.Fatalf("subscribed topics %v after a rejected request", topics)
+	}
+
+	// So is one that would pass the topic limit
+	tooMany := []string{TopicTreasury}
+	for i := 0; i < maxTopicsPerClient; i++ {
+		tooMany = append(tooMany, campaignTopic(fmt.Sprintf("ad-%d", i)))
+	}
+	c.send(t, map[string]interface{}{"type": "subscribe", "topics": tooMany})
+	if msg := c.skipUntil(t, "error", nil); msg["code"] != CodeInvalidRequest {
+		t.Fatalf("subscribe past the limit: %v", msg)
+	}
+	if topics := held(); containsTopic(topics, TopicTreasury) {
+		t.Fatalf("subscribed topics %v after a request past the limit", topics)
+	}
+
+	c.send(t, map[string]interface{}{"type": "subscribe", "topics": []string{TopicTreasury}})
+	topics := c.skipUntil(t, "subscribed", nil)["topics"]
+	if !containsTopic(topics, TopicTreasury) {
+		t.Fatalf("subscribed topics %v, want %s", topics, TopicTreasury)
+	}
+	c.send(t, map[string]interface{}{"type": "unsubscribe", "topics": []string{TopicTreasury}})
+	topics = c.skipUntil(t, "subscribed", nil)["topics"]
+	if containsTopic(topics, TopicTreasury) {
+		t.Fatalf("subscribed topics %v after unsubscribing from %s", topics, TopicTreasury)
+	}
+}
+
+func TestWebSocketRegisterWithReferral(t *testing.T) {
+	ts := newDemoServer(t, "")
+	_, referrer := newKeyedWallet(t)
+	key, wallet := newKeyedWallet(t)
+
+	var code ReferralCodeResponse
+	postJSON(t, ts, "/api/v1/referral/code", ReferralCodeRequest{WalletAddress: referrer}, &code, http.StatusOK)
+
+	c, _ := dialWS(t, ts)
+	now := time.Now().Unix()
+	register := map[string]interface{}{
+		"type":           "register",
+		"wallet_address": wallet,
+		"referral_code":  code.Code,
+		"timestamp":      now,
+		"signature":      signText(t, key, referralBindMessage(wallet, code.Code, now)),
+	}
+	c.send(t, register)
+	bound := c.expect(t, "referral_bound")
+	if !strings.EqualFold(bound["referrer"].(string), referrer) {
+		t.Fatalf("bound to %v, want %s", bound["referrer"], referrer)
+	}
+
+	c.send(t, register)
+	if msg := c.expect(t, "error"); msg["code"] != CodeAlreadyReferred {
+		t.Fatalf("second referral register: %v", msg)
+	}
+}
+
+// sseFrame is one event read from an SSE stream
+type sseFrame struct {
+	id, event, data string
+}
+
+// openSSE streams path, sending lastID as Last-Event-ID when set, and
+// returns a function reading the next event
+func openSSE(t *testing.T, ts *testServer, path, lastID string) func() sseFrame {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+path, nil)
+	if lastID != "" {
+		req.Header.Set("Last-Event-ID", lastID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	scanner := bufio.NewScanner(resp.Body)
+	return func() sseFrame {
+		t.Helper()
+		var f sseFrame
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "" && f.event != "":
+				return f
+			case strings.HasPrefix(line, "id: "):
+				f.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				f.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				f.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+		t.Fatalf("SSE stream ended: %v", scanner.Err())
+		return f
+	}
+}
+
+func TestSSEResumesFromLastEventID(t *testing.T) {
+	ts := newDemoServer(t, "")
+	hub := ts.server.events
+	const path = "/api/v1/events?topics=campaign:ad-9"
+	publish := func(n int) Event {
+		return hub.append(campaignTopic("ad-9"), "campaign_heartbeat", []byte(fmt.Sprintf(`{"n":%d}`, n)))
+	}
+	first, second, third := publish(1), publish(2), publish(3)
+
+	// Events after the last one seen are replayed in order, then the stream goes live
+	next := openSSE(t, ts, path, hub.eventID(first))
+	for _, want := range []Event{second, third} {
+		if f := next(); f.id != hub.eventID(want) || f.data != string(want.Data) {
+			t.Fatalf("replayed %+v, want %s", f, hub.eventID(want))
+		}
+	}
+	live := publish(4)
+	if f := next(); f.id != hub.eventID(live) {
+		t.Fatalf("live event %+v, want %s", f, hub.eventID(live))
+	}
+
+	// IDs from another replica or an earlier process, or bare sequence numbers
+	// as sent before epochs, reset the client instead of replaying from a
+	// sequence that means something else here
+	for _, foreign := range []string{newEventHub().eventID(first), strconv.FormatUint(first.ID, 10), "garbage"} {
+		next := openSSE(t, ts, path, foreign)
+		if f := next(); f.event != "reset" {
+			t.Fatalf("Last-Event-ID %q: first event %+v, want reset", foreign, f)
+		}
+		live := publish(5)
+		if f := next(); f.id != hub.eventID(live) {
+			t.Fatalf("Last-Event-ID %q: replayed %+v, want only live events", foreign, f)
+		}
+	}
+
+	// An ID older than the replay buffer also resets, then replays what is left
+	for i := 0; i < eventReplaySize; i++ {
+		publish(6)
+	}
+	next = openSSE(t, ts, path, hub.eventID(first))
+	if f := next(); f.event != "reset" {
+		t.Fatalf("evicted Last-Event-ID: first event %+v, want reset", f)
+	}
+}
+
+func containsTopic(topics interface{}, topic string) bool {
+	list, _ := topics.([]interface{})
+	for _, t := range list {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// Heartbeats from many clients at once all draw nonces from one signer; each
+// must get its own nonce and be mined
+func TestClientIPTrustsOnlyConfiguredProxies(t *testing.T) {
+	tests := []struct {
+		name    string
+		proxies string
+		remote  string
+		xff     []string
+		want    string
+	}{
+		{"no proxies configured", "", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"untrusted peer", "10.0.0.0/8", "203.0.113.7:4000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.0/8", "10.1.2.3:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed leftmost hop", "10.0.0.0/8", "10.1.2.3:4000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chained trusted proxies", "10.0.0.0/8, 192.0.2.9", "10.1.2.3:4000", []string{"198.51.100.1, 192.0.2.9", "10.9.9.9"}, "198.51.100.1"},
+		{"every hop trusted", "10.0.0.0/8", "10.1.2.3:4000", []string{"10.0.0.1, 10.0.0.2"}, "10.0.0.1"},
+		{"trusted proxy without header", "10.1.2.3", "10.1.2.3:4000", nil, "10.1.2.3"},
+		{"IPv6 proxy", "fd00::/8", "[fd00::1]:4000", []string{"2001:db8::5"}, "2001:db8::5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Server{config: &Config{TrustedProxies: tt.proxies}}
+			r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := s.clientIP(r); got != tt.want {
+				t.Errorf("clientIP = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcurrentHeartbeatNonces(t *testing.T) {
+	ts := newDemoServer(t, "", func(c *Config) { c.MaxConnsPerIP = 0 })
+
+	const clients, perClient = 8, 4
+	ids := make(chan string, clients*perClient)
+	errs := make(chan error, clients*perClient)
+
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wallet := newWallet(t)
+		if i%2 == 0 {
+			// HTTP clients
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < perClient; j++ {
+					id, err := postHeartbeat(ts, wallet)
+					if err != nil {
+						errs <- err
+						continue
+					}
+					ids <- id
+				}
+			}()
+			continue
+		}
+
+		// WebSocket clients, dialled here since dialWS may fail the test
+		c, _ := dialWS(t, ts)
+		c.send(t, map[string]interface{}{"type": "register", "wallet_address": wallet})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perClient; j++ {
+				if err := c.conn.WriteJSON(map[string]interface{}{"type": "heartbeat", "ad_id": "ad-1"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			for acked := 0; acked < perClient; {
+				msg, ok := <-c.messages
+				if !ok {
+					errs <- fmt.Errorf("WebSocket closed: %v", <-c.closeErr)
+					return
+				}
+				switch msg["type"] {
+				case "heartbeat_ack":
+					ids <- msg["reward_id"].(string)
+					acked++
+				case "heartbeat_rejected":
+					errs <- fmt.Errorf("heartbeat rejected: %v", msg)
+					acked++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	bc := ts.server.chains.primary()
+	nonces := make(map[uint64]string)
+	for id := range ids {
+		rec := waitConfirmed(t, ts, id)
+		tx, _, err := bc.client.TransactionByHash(context.Background(), common.HexToHash(rec.TxHash))
+		if err != nil {
+			t.Fatalf("reward %s: %v", id, err)
+		}
+		if prev, dup := nonces[tx.Nonce()]; dup {
+			t.Fatalf("rewards %s and %s both used nonce %d", prev, id, tx.Nonce())
+		}
+		nonces[tx.Nonce()] = id
+	}
+	if len(nonces) != clients*perClient {
+		t.Fatalf("%d rewards confirmed, want %d", len(nonces), clients*perClient)
+	}
+
+	// No nonce was skipped, so nothing is stuck behind a gap
+	used := make([]uint64, 0, len(nonces))
+	for n := range nonces {
+		used = append(used, n)
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i] < used[j] })
+	if span := used[len(used)-1] - used[0] + 1; span != uint64(len(used)) {
+		t.Errorf("nonces %d..%d have gaps", used[0], used[len(used)-1])
+	}
+}
+
+func TestStuckRewardsAreRebroadcastOrFailed(t *testing.T) {
+	ts := newDemoServer(t, "")
+	bc := ts.server.chains.primary()
+	wallet := newWallet(t)
+
+	// Signed by the treasury but never sent, as if the node dropped it
+	sign := func(nonce uint64, value int64) *types.Transaction {
+		t.Helper()
+		gasPrice, err := bc.client.SuggestGasPrice(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tx := types.NewTransaction(nonce, common.HexToAddress(wallet), big.NewInt(value), 21000, gasPrice.Mul(gasPrice, big.NewInt(2)), nil)
+		signed, err := types.SignTx(tx, types.NewEIP155Signer(bc.chainID), bc.privateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	stuck := func(tx *types.Transaction) string {
+		t.Helper()
+		id := newRewardID()
+		ts.server.saveRewardTx(id, tx)
+		old := time.Now().Add(-2 * rewardStuckAfter)
+		rec := &RewardRecord{
+			ID:            id,
+			ChainID:       bc.ChainID(),
+			WalletAddress: wallet,
+			Kind:          RewardHeartbeat,
+			RewardWei:     tx.Value().String(),
+			Status:        RewardSubmitted,
+			TxHash:        tx.Hash().Hex(),
+			CreatedAt:     old,
+			UpdatedAt:     old,
+		}
+		if err := ts.server.rewards.save(*rec); err != nil {
+			t.Fatal(err)
+		}
+		ts.server.rewards.track(rec)
+		return id
+	}
+
+	// Its nonce is still free, so it is sent again and mined
+	nonce, err := bc.ConfirmedNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitConfirmed(t, ts, stuck(sign(nonce, 1000)))
+
+	// Another transaction took its nonce, so it can never be mined
+	nonce++
+	replaced, taken := sign(nonce, 2000), sign(nonce, 3000)
+	if err := bc.Rebroadcast(taken); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, 15*time.Second, func() error {
+		if confirmed, err := bc.ConfirmedNonce(); err != nil || confirmed <= nonce {
+			return fmt.Errorf("nonce %d not mined yet (%v)", nonce, err)
+		}
+		return nil
+	})
+	id := stuck(replaced)
+	var rec RewardRecord
+	waitFor(t, 15*time.Second, func() error {
+		getJSON(t, ts, "/api/v1/reward/"+id, &rec)
+		if rec.Status != RewardFailed {
+			return fmt.Errorf("reward %s is %s", id, rec.Status)
+		}
+		return nil
+	})
+	if rec.ErrorCode != CodeTxDropped {
+		t.Errorf("dropped reward failed with %q, want %s", rec.ErrorCode, CodeTxDropped)
+	}
+	if _, ok, _ := ts.server.state.get(rewardTxKeyPrefix + id); ok {
+		t.Error("dropped transaction still kept for rebroadcast")
+	}
+}
+
+func TestDrainingRejectsNewWork(t *testing.T) {
+	ts := newDemoServer(t, "", withTestAds)
+	ts.server.draining.Store(true)
+
+	resp, data := call(t, ts, http.MethodGet, "/api/v1/health", nil, nil)
+	var health HealthResponse
+	json.Unmarshal(data, &health)
+	if resp.StatusCode != http.StatusServiceUnavailable || health.Status != "draining" {
+		t.Errorf("health while draining: status %d, %+v", resp.StatusCode, health)
+	}
+
+	resp, data = call(t, ts, http.MethodPost, "/api/v1/heartbeat", HeartbeatRequest{WalletAddress: newWallet(t), AdID: "ad-1"}, nil)
+	expectError(t, resp, data, http.StatusServiceUnavailable, CodeShuttingDown)
+
+	resp, data = call(t, ts, http.MethodPost, "/api/v1/session/start", SessionStartRequest{WalletAddress: newWallet(t), AdID: "short-ad"}, nil)
+	expectError(t, resp, data, http.StatusServiceUnavailable, CodeShuttingDown)
+
+	_, wsResp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/ws", nil)
+	if err == nil || wsResp == nil || wsResp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("WebSocket while draining: %v, want 503", err)
+	}
+
+	// Reads keep working so clients can follow rewards already queued
+	var stats StatsResponse
+	getJSON(t, ts, "/api/v1/stats", &stats)
+}
+
+func TestBlockMonitorStopsWhileBroadcastIsBlocked(t *testing.T) {
+	config := newDemoConfig(t, "")
+	chains := startDemoChain(t, config)
+	server, err := newServer(config, &configLoader{demo: true}, chains, newMemoryState())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing drains the updates, as after the broadcaster stopped
+	for len(server.blockUpdates) < cap(server.blockUpdates) {
+		server.blockUpdates <- &BlockInfo{}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.blockMonitor(ctx, chains.primary())
+		close(done)
+	}()
+
+	// Let it see a block and block on sending it
+	time.Sleep(3 * time.Second)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("blockMonitor still running after its context was cancelled")
+	}
+}
+
+func TestShutdownSettlesAndClosesClients(t *testing.T) {
+	ts := newDemoServer(t, "")
+	wallet := newWallet(t)
+
+	c, _ := dialWS(t, ts)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL+"/api/v1/events?topics=blocks", nil)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Body.Close()
+
+	id := sendHeartbeat(t, ts, wallet)
+	ts.server.shutdown(ts.Config, ts.cancel)
+
+	// Shutdown waits for queued rewards to be mined
+	rec, ok, err := ts.server.rewards.lookup(id)
+	if err != nil || !ok || rec.Status != RewardConfirmed {
+		t.Fatalf("reward after shutdown: %+v (found %v, %v), want confirmed", rec, ok, err)
+	}
+
+	// WebSocket clients are told why they were disconnected
+	for range c.messages {
+	}
+	var closeErr *websocket.CloseError
+	if err := <-c.closeErr; !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseGoingAway || closeErr.Text != shutdownReason {
+		t.Errorf("WebSocket closed with %v, want going away: %s", err, shutdownReason)
+	}
+
+	// SSE clients get a final shutdown event
+	var events []string
+	scanner := bufio.NewScanner(stream.Body)
+	for scanner.Scan() {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event: "); ok {
+			events = append(events, name)
+		}
+	}
+	if len(events) == 0 || events[len(events)-1] != "shutdown" {
+		t.Errorf("SSE events %v, want a final shutdown event", events)
+	}
+}
+
+func TestShutdownSavesUnsettledRewards(t *testing.T) {
+	pending := filepath.Join(t.TempDir(), "pending-rewards.json")
+	config := newDemoConfig(t, "", func(c *Config) {
+		c.PendingRewardsFile = pending
+		c.ShutdownTimeoutMs = 0
+	})
+	chains := startDemoChain(t, config)
+
+	// Shut down before the receipt watcher sees the reward mined
+	first := startServer(t, config, chains)
+	id := sendHeartbeat(t, first, newWallet(t))
+	first.server.shutdown(first.Config, first.cancel)
+
+	data, err := os.ReadFile(pending)
+	if err != nil {
+		t.Fatalf("pending rewards not saved: %v", err)
+	}
+	var saved pendingRewards
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(saved.Queued) + len(saved.Submitted); n != 1 {
+		t.Fatalf("saved %d rewards, want 1: %s", n, data)
+	}
+
+	// The next start picks the reward up and settles it
+	second := startServer(t, config, chains)
+	waitConfirmed(t, second, id)
+}
@@ -0,0 +1,1180 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How long per-wallet history is kept; a little over a tax year
+	earningsRetention = 400 * 24 * time.Hour
+
+	// How long pricing for a confirmed reward waits for its payout to be indexed
+	earningsPricingWait = time.Hour
+
+	// How often the RewardClaimed indexer polls for new blocks
+	earningsIndexInterval = 5 * time.Second
+
+	// Blocks requested per eth_getLogs call; public RPCs cap the range
+	earningsIndexChunk = 2000
+)
+
+// Shared state keys of earnings history
+const (
+	// Hash of a chain's heartbeats and indexed payouts by UTC month, so the
+	// retention window loads in one read per month. Its fields are
+	//   h:<unix hour>:<wallet>       heartbeats counted that hour
+	//   a:<unix hour>:<wallet>:<ad>  an ad watched that hour
+	//   p:<payout key>               a storedPayout
+	earningsHistoryPrefix = "earnings-history:"
+	earningsCursorPrefix  = "earnings-indexed:" // indexCursor by chain
+)
+
+// Payout is one reward paid to a wallet, from a RewardClaimed event or, in
+// direct-transfer mode, a confirmed transfer
+type Payout struct {
+	ChainID   int64     `json:"chain_id"`
+	TxHash    string    `json:"tx_hash"`
+	ClaimID   string    `json:"claim_id,omitempty"`
+	Block     uint64    `json:"block,omitempty"`
+	Amount    string    `json:"amount"`
+	AmountWei string    `json:"amount_wei"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Pricing rules, for rewards this backend paid and saw confirmed
+	Pricing []AppliedRule `json:"pricing,omitempty"`
+
+	amount *big.Int
+}
+
+// EarningsBucket is one hour or day of a wallet's history
+type EarningsBucket struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	Earnings    string    `json:"earnings"`
+	EarningsWei string    `json:"earnings_wei"`
+	Heartbeats  int64     `json:"heartbeats"`
+	AdsWatched  int       `json:"ads_watched"`
+	Payouts     int       `json:"payouts"`
+}
+
+type EarningsHistoryResponse struct {
+	ChainID  int64            `json:"chain_id"`
+	Address  string           `json:"address"`
+	Interval string           `json:"interval"`
+	From     time.Time        `json:"from"`
+	To       time.Time        `json:"to"`
+	Buckets  []EarningsBucket `json:"buckets"`
+
+	// Earlier payouts and heartbeats may be missing from the buckets
+	PayoutsCompleteFrom    time.Time `json:"payouts_complete_from"`
+	HeartbeatsCompleteFrom time.Time `json:"heartbeats_complete_from"`
+}
+
+type EarningsSummaryResponse struct {
+	ChainID             int64      `json:"chain_id"`
+	Address             string     `json:"address"`
+	Earnings            string     `json:"earnings"`
+	EarningsWei         string     `json:"earnings_wei"`
+	Heartbeats          int64      `json:"heartbeats"`
+	AdsWatched          int        `json:"ads_watched"`
+	Payouts             int        `json:"payouts"`
+	CurrentStreakDays   int        `json:"current_streak_days"`
+	LongestStreakDays   int        `json:"longest_streak_days"`
+	FirstActivity       *time.Time `json:"first_activity,omitempty"`
+	LastActivity        *time.Time `json:"last_activity,omitempty"`
+	LastPayout          *Payout    `json:"last_payout,omitempty"`
+	IndexedThroughBlock uint64     `json:"indexed_through_block"`
+
+	// Totals leave out payouts and heartbeats before these times
+	PayoutsCompleteFrom    time.Time `json:"payouts_complete_from"`
+	HeartbeatsCompleteFrom time.Time `json:"heartbeats_complete_from"`
+}
+
+type EarningsPayoutsResponse struct {
+	ChainID int64     `json:"chain_id"`
+	Address string    `json:"address"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Payouts []Payout  `json:"payouts"`
+
+	// Earlier payouts may be missing from the list
+	CompleteFrom time.Time `json:"complete_from"`
+}
+
+// hourBucket is the unit history is stored in; days are summed on read
+type hourBucket struct {
+	earnings   *big.Int
+	heartbeats int64
+	payouts    int
+	ads        map[string]struct{}
+}
+
+// walletHistory is everything recorded for one wallet on one chain
+type walletHistory struct {
+	hours     map[int64]*hourBucket // by unix hour
+	payouts   []Payout
+	ads       map[string]struct{}
+	firstSeen time.Time
+	lastSeen  time.Time
+}
+
+type walletKey struct {
+	chainID int64
+	wallet  string // lowercase
+}
+
+// earningsLedger records heartbeats and payouts per wallet for the history
+// and analytics endpoints. It lives in memory on every replica: payouts are
+// indexed from chain events by each, heartbeats are shared over cluster
+// events. Both are also kept in shared state with how far indexing got, so
+// when it is durable a restart reloads them and resumes indexing there.
+type earningsLedger struct {
+	state      sharedState
+	started    time.Time // when this ledger began receiving heartbeats
+	mu         sync.RWMutex
+	wallets    map[walletKey]*walletHistory
+	seen       map[string]bool     // payouts already recorded, by payoutKey
+	indexed    map[int64]uint64    // last block indexed, by chain ID
+	from       map[int64]uint64    // first block with every payout retained, by chain ID
+	complete   map[int64]time.Time // time from which every payout was recorded, by chain ID
+	resume     map[int64]uint64    // block to resume indexing from, by chain ID, when stored payouts were loaded
+	chains     map[int64]bool      // chains whose stored history was loaded
+	pricing    map[string]pendingPricing
+	lastPruned time.Time
+}
+
+// pendingPricing holds a confirmed reward's pricing until its payout is indexed
+type pendingPricing struct {
+	rules []AppliedRule
+	at    time.Time
+}
+
+func newEarningsLedger(state sharedState) *earningsLedger {
+	return &earningsLedger{
+		state:    state,
+		started:  time.Now(),
+		wallets:  make(map[walletKey]*walletHistory),
+		seen:     make(map[string]bool),
+		indexed:  make(map[int64]uint64),
+		from:     make(map[int64]uint64),
+		complete: make(map[int64]time.Time),
+		resume:   make(map[int64]uint64),
+		chains:   make(map[int64]bool),
+		pricing:  make(map[string]pendingPricing),
+	}
+}
+
+// history returns the wallet's record, creating it if needed. Callers hold mu.
+func (l *earningsLedger) history(chainID int64, wallet string) *walletHistory {
+	key := walletKey{chainID, strings.ToLower(wallet)}
+	h, ok := l.wallets[key]
+	if !ok {
+		h = &walletHistory{
+			hours: make(map[int64]*hourBucket),
+			ads:   make(map[string]struct{}),
+		}
+		l.wallets[key] = h
+	}
+	return h
+}
+
+// hour returns the bucket containing t. Callers hold mu.
+func (h *walletHistory) hour(t time.Time) *hourBucket {
+	start := t.Truncate(time.Hour).Unix()
+	b, ok := h.hours[start]
+	if !ok {
+		b = &hourBucket{earnings: new(big.Int), ads: make(map[string]struct{})}
+		h.hours[start] = b
+	}
+	return b
+}
+
+// touch widens the wallet's first/last activity range. Callers hold mu.
+func (h *walletHistory) touch(t time.Time) {
+	if h.firstSeen.IsZero() || t.Before(h.firstSeen) {
+		h.firstSeen = t
+	}
+	if t.After(h.lastSeen) {
+		h.lastSeen = t
+	}
+}
+
+// recordHeartbeat counts an accepted heartbeat
+func (l *earningsLedger) recordHeartbeat(chainID int64, wallet, adID string, at time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	h := l.history(chainID, wallet)
+	b := h.hour(at)
+	b.heartbeats++
+	if adID != "" {
+		b.ads[adID] = struct{}{}
+		h.ads[adID] = struct{}{}
+	}
+	h.touch(at)
+}
+
+// heartbeatEvent is an accepted heartbeat, sent to the other replicas so
+// every ledger counts it
+type heartbeatEvent struct {
+	ChainID int64     `json:"chain_id"`
+	Wallet  string    `json:"wallet"`
+	AdID    string    `json:"ad_id,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// storedPayout is an indexed payout as kept in shared state
+type storedPayout struct {
+	Wallet   string `json:"wallet"`
+	Contract string `json:"contract"`
+	Payout
+}
+
+// indexCursor records which RewardClaimed events of a chain are in shared
+// state: every payout of Contract in blocks From to Next-1
+type indexCursor struct {
+	Contract     string    `json:"contract"`
+	From         uint64    `json:"from"`
+	CompleteFrom time.Time `json:"complete_from"` // From's block time
+	Next         uint64    `json:"next"`
+}
+
+func earningsHistoryKey(chainID int64, t time.Time) string {
+	return fmt.Sprintf("%s%d:%s", earningsHistoryPrefix, chainID, t.UTC().Format("2006-01"))
+}
+
+func earningsCursorKey(chainID int64) string {
+	return fmt.Sprintf("%s%d", earningsCursorPrefix, chainID)
+}
+
+// historyMonths returns the start of each UTC month, from the one holding from
+// to the one holding to
+func historyMonths(from, to time.Time) []time.Time {
+	var months []time.Time
+	from, to = from.UTC(), to.UTC()
+	for m := time.Date(from.Year(), from.Month(), 1, 0, 0, 0, 0, time.UTC); !m.After(to); m = m.AddDate(0, 1, 0) {
+		months = append(months, m)
+	}
+	return months
+}
+
+// saveHeartbeat stores a heartbeat this replica accepted in shared state.
+// Only the accepting replica saves it; the others count it from the cluster
+// event.
+func (l *earningsLedger) saveHeartbeat(chainID int64, wallet, adID string, at time.Time) error {
+	key, hour, wallet := earningsHistoryKey(chainID, at), at.Truncate(time.Hour).Unix(), strings.ToLower(wallet)
+	if _, err := l.state.hincr(key, fmt.Sprintf("h:%d:%s", hour, wallet), 1); err != nil {
+		return err
+	}
+	if adID == "" {
+		return nil
+	}
+	return l.state.hset(key, fmt.Sprintf("a:%d:%s:%s", hour, wallet, adID), []byte("1"))
+}
+
+// savePayout stores an indexed payout in shared state
+func (l *earningsLedger) savePayout(wallet, contract string, p Payout) error {
+	data, err := json.Marshal(storedPayout{Wallet: strings.ToLower(wallet), Contract: strings.ToLower(contract), Payout: p})
+	if err != nil {
+		return err
+	}
+	return l.state.hset(earningsHistoryKey(p.ChainID, p.Timestamp), "p:"+payoutKey(p.TxHash, p.ClaimID), data)
+}
+
+// saveCursor records that stored payouts of bc reach up to next-1, merging
+// with what another replica recorded when the ranges touch
+func (l *earningsLedger) saveCursor(bc *BlockchainClient, next uint64) error {
+	l.mu.RLock()
+	cursor := indexCursor{
+		Contract:     strings.ToLower(bc.ContractAddress()),
+		From:         l.from[bc.ChainID()],
+		CompleteFrom: l.complete[bc.ChainID()],
+		Next:         next,
+	}
+	l.mu.RUnlock()
+
+	return l.state.update(earningsCursorKey(bc.ChainID()), 0, func(old []byte) ([]byte, error) {
+		var stored indexCursor
+		if old != nil && json.Unmarshal(old, &stored) == nil && stored.Contract == cursor.Contract &&
+			stored.From <= cursor.Next && cursor.From <= stored.Next {
+			if stored.From <= cursor.From && stored.Next >= cursor.Next {
+				return nil, errNoChange
+			}
+			merged := cursor
+			if stored.From < merged.From {
+				merged.From, merged.CompleteFrom = stored.From, stored.CompleteFrom
+			}
+			if stored.Next > merged.Next {
+				merged.Next = stored.Next
+			}
+			return json.Marshal(merged)
+		}
+		return json.Marshal(cursor)
+	})
+}
+
+// loadHistory adds the retained heartbeats and payouts of chainID in shared
+// state to the ledger and returns how many there were. Payouts load only if
+// the stored cursor is for contract; indexing then resumes where it ended.
+// Run it before cluster events arrive, or heartbeats accepted meanwhile
+// count twice.
+func (l *earningsLedger) loadHistory(chainID int64, contract string, now time.Time) (heartbeats int64, payouts int, err error) {
+	l.mu.Lock()
+	l.chains[chainID] = true
+	l.mu.Unlock()
+
+	contract = strings.ToLower(contract)
+	var cursor indexCursor
+	data, ok, err := l.state.get(earningsCursorKey(chainID))
+	if err != nil {
+		return 0, 0, err
+	}
+	resume := ok && contract != "" && json.Unmarshal(data, &cursor) == nil && cursor.Contract == contract
+
+	cutoff := now.Add(-earningsRetention)
+	from := cursor.From
+	for _, month := range historyMonths(cutoff, now) {
+		fields, err := l.state.hgetall(earningsHistoryKey(chainID, month))
+		if err != nil {
+			return heartbeats, payouts, err
+		}
+
+		l.mu.Lock()
+		for field, value := range fields {
+			parts := strings.SplitN(field, ":", 4)
+			switch {
+			case parts[0] == "p" && resume:
+				var sp storedPayout
+				if json.Unmarshal(value, &sp) != nil || sp.Contract != contract || sp.Block >= cursor.Next {
+					continue
+				}
+				if sp.Timestamp.Before(cutoff) {
+					// Blocks up to an expired payout are no longer fully covered
+					if sp.Block >= from {
+						from = sp.Block + 1
+					}
+					continue
+				}
+				amount, ok := new(big.Int).SetString(sp.AmountWei, 10)
+				if !ok {
+					continue
+				}
+				sp.amount = amount
+				if l.addPayoutLocked(sp.Wallet, payoutKey(sp.TxHash, sp.ClaimID), sp.Payout) {
+					payouts++
+				}
+			case parts[0] == "h" && len(parts) == 3:
+				hour, err := strconv.ParseInt(parts[1], 10, 64)
+				n, err2 := strconv.ParseInt(string(value), 10, 64)
+				if t := time.Unix(hour, 0); err == nil && err2 == nil && !t.Before(cutoff) {
+					h := l.history(chainID, parts[2])
+					h.hour(t).heartbeats += n
+					h.touch(t)
+					heartbeats += n
+				}
+			case parts[0] == "a" && len(parts) == 4:
+				hour, err := strconv.ParseInt(parts[1], 10, 64)
+				if t := time.Unix(hour, 0); err == nil && !t.Before(cutoff) {
+					h := l.history(chainID, parts[2])
+					h.hour(t).ads[parts[3]] = struct{}{}
+					h.ads[parts[3]] = struct{}{}
+					h.touch(t)
+				}
+			}
+		}
+		l.mu.Unlock()
+	}
+
+	if resume && cursor.Next > 0 {
+		l.mu.Lock()
+		l.from[chainID] = from
+		l.indexed[chainID] = cursor.Next - 1
+		l.complete[chainID] = cursor.CompleteFrom.UTC()
+		l.resume[chainID] = cursor.Next
+		l.mu.Unlock()
+	}
+	return heartbeats, payouts, nil
+}
+
+// setCompleteFrom records the time from which every payout on chainID is in
+// the ledger: the first indexed block's, or startup in direct-transfer mode
+func (l *earningsLedger) setCompleteFrom(chainID int64, t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.complete[chainID] = t.UTC()
+}
+
+// payoutsCompleteFrom returns the time before which payouts on chainID may be
+// missing: indexing hasn't reached them, or they passed retention. Until
+// indexing starts, that is now.
+func (l *earningsLedger) payoutsCompleteFrom(chainID int64, now time.Time) time.Time {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.payoutsCompleteFromLocked(chainID, now)
+}
+
+func (l *earningsLedger) payoutsCompleteFromLocked(chainID int64, now time.Time) time.Time {
+	t, ok := l.complete[chainID]
+	if !ok {
+		return now.UTC()
+	}
+	return latest(t, now.Add(-earningsRetention)).UTC()
+}
+
+// heartbeatsCompleteFrom returns the time before which heartbeats may be
+// missing. Durable shared state keeps them across restarts; otherwise they
+// start with this process.
+func (l *earningsLedger) heartbeatsCompleteFrom(now time.Time) time.Time {
+	cutoff := now.Add(-earningsRetention)
+	if l.state.durable() {
+		return cutoff.UTC()
+	}
+	return latest(l.started, cutoff).UTC()
+}
+
+func latest(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// recordPayout adds a payout once; key identifies it across re-indexing. It
+// returns the payout as recorded, by this call or an earlier one.
+func (l *earningsLedger) recordPayout(wallet, key string, p Payout) Payout {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen[key] {
+		if h, ok := l.wallets[walletKey{p.ChainID, strings.ToLower(wallet)}]; ok {
+			for _, recorded := range h.payouts {
+				if payoutKey(recorded.TxHash, recorded.ClaimID) == key {
+					return recorded
+				}
+			}
+		}
+		return p
+	}
+
+	p.Amount = weiToEther(p.amount)
+	p.AmountWei = p.amount.String()
+	if pending, ok := l.pricing[strings.ToLower(p.TxHash)]; ok {
+		p.Pricing = pending.rules
+		delete(l.pricing, strings.ToLower(p.TxHash))
+	}
+	l.addPayoutLocked(wallet, key, p)
+	return p
+}
+
+// addPayoutLocked adds a payout unless key was seen. Callers hold mu.
+func (l *earningsLedger) addPayoutLocked(wallet, key string, p Payout) bool {
+	if l.seen[key] {
+		return false
+	}
+	l.seen[key] = true
+
+	h := l.history(p.ChainID, wallet)
+	b := h.hour(p.Timestamp)
+	b.earnings.Add(b.earnings, p.amount)
+	b.payouts++
+	h.payouts = append(h.payouts, p)
+	h.touch(p.Timestamp)
+	return true
+}
+
+// annotatePayout attaches pricing rules to the payout made by txHash from
+// contract, now or once the indexer records it
+func (l *earningsLedger) annotatePayout(chainID int64, contract, wallet, txHash string, rules []AppliedRule, now time.Time) {
+	l.mu.Lock()
+	if h, ok := l.wallets[walletKey{chainID, strings.ToLower(wallet)}]; ok {
+		for i := range h.payouts {
+			if strings.EqualFold(h.payouts[i].TxHash, txHash) {
+				h.payouts[i].Pricing = rules
+				p := h.payouts[i]
+				l.mu.Unlock()
+				if err := l.savePayout(wallet, contract, p); err != nil {
+					log.Printf("⚠️ Failed to store pricing of payout %s: %v", txHash, err)
+				}
+				return
+			}
+		}
+	}
+	l.pricing[strings.ToLower(txHash)] = pendingPricing{rules: rules, at: now}
+	l.mu.Unlock()
+}
+
+// setIndexed records how far a chain's events have been indexed
+func (l *earningsLedger) setIndexed(chainID int64, block uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.indexed[chainID] = block
+}
+
+// index records RewardClaimed events in blocks from..to inclusive, in chunks
+// public RPCs accept, and returns the next block to index
+func (l *earningsLedger) index(bc *BlockchainClient, from, to uint64) (uint64, error) {
+	l.mu.Lock()
+	if _, ok := l.from[bc.ChainID()]; !ok {
+		l.from[bc.ChainID()] = from
+	}
+	l.mu.Unlock()
+
+	for from <= to {
+		end := from + earningsIndexChunk - 1
+		if end > to {
+			end = to
+		}
+
+		claims, err := bc.FilterRewardClaims(from, end)
+		if err != nil {
+			return from, err
+		}
+		for _, c := range claims {
+			p := l.recordPayout(c.Recipient, payoutKey(c.TxHash, c.ClaimID), Payout{
+				ChainID:   bc.ChainID(),
+				TxHash:    c.TxHash,
+				ClaimID:   c.ClaimID,
+				Block:     c.BlockNumber,
+				Timestamp: c.Timestamp.UTC(),
+				amount:    c.Amount,
+			})
+			// Saved even if recorded before, in case saving failed then
+			if err := l.savePayout(c.Recipient, bc.ContractAddress(), p); err != nil {
+				return from, err
+			}
+		}
+		// Stored payouts first, so the cursor never gets ahead of them
+		if err := l.saveCursor(bc, end+1); err != nil {
+			return from, err
+		}
+		l.setIndexed(bc.ChainID(), end)
+		from = end + 1
+	}
+	return from, nil
+}
+
+// walletPayout is an indexed payout with the wallet it was paid to
+type walletPayout struct {
+	wallet string // lowercase
+	Payout
+}
+
+// indexedPayouts returns every retained payout on chainID and the block
+// range they cover; ok is false until the first blocks are indexed
+func (l *earningsLedger) indexedPayouts(chainID int64) (list []walletPayout, from, to uint64, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if to, ok = l.indexed[chainID]; !ok {
+		return nil, 0, 0, false
+	}
+	for key, h := range l.wallets {
+		if key.chainID != chainID {
+			continue
+		}
+		for _, p := range h.payouts {
+			list = append(list, walletPayout{wallet: key.wallet, Payout: p})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Block < list[j].Block })
+	return list, l.from[chainID], to, true
+}
+
+// prune drops history older than earningsRetention, at most once an hour
+func (l *earningsLedger) prune(now time.Time) {
+	if chains := l.pruneMemory(now); len(chains) > 0 {
+		// A stored month goes once all of it is past retention. Three months
+		// back covers a cluster that was down a while.
+		cutoff := now.Add(-earningsRetention)
+		months := historyMonths(cutoff.AddDate(0, -3, 0), cutoff)
+		months = months[:len(months)-1]
+		for _, chainID := range chains {
+			for _, month := range months {
+				if err := l.state.del(earningsHistoryKey(chainID, month)); err != nil {
+					log.Printf("⚠️ Failed to prune earnings history: %v", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// pruneMemory drops in-memory history older than earningsRetention and
+// returns the chains whose stored history needs pruning, nil if it ran
+// less than an hour ago
+func (l *earningsLedger) pruneMemory(now time.Time) []int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastPruned) < time.Hour {
+		return nil
+	}
+	l.lastPruned = now
+
+	for tx, pending := range l.pricing {
+		if now.Sub(pending.at) > earningsPricingWait {
+			delete(l.pricing, tx)
+		}
+	}
+
+	cutoff := now.Add(-earningsRetention)
+	for key, h := range l.wallets {
+		for start := range h.hours {
+			if time.Unix(start, 0).Before(cutoff) {
+				delete(h.hours, start)
+			}
+		}
+		kept := h.payouts[:0]
+		for _, p := range h.payouts {
+			if p.Timestamp.Before(cutoff) {
+				delete(l.seen, payoutKey(p.TxHash, p.ClaimID))
+				// Blocks up to a dropped payout are no longer fully covered
+				if p.Block >= l.from[key.chainID] {
+					l.from[key.chainID] = p.Block + 1
+				}
+				continue
+			}
+			kept = append(kept, p)
+		}
+		h.payouts = kept
+		if len(h.hours) == 0 && len(h.payouts) == 0 {
+			delete(l.wallets, key)
+		}
+	}
+
+	chains := make([]int64, 0, len(l.chains))
+	for chainID := range l.chains {
+		chains = append(chains, chainID)
+	}
+	return chains
+}
+
+// buckets sums the wallet's hours into interval-sized buckets within
+// [from, to). Empty buckets are left out.
+func (l *earningsLedger) buckets(chainID int64, wallet string, interval time.Duration, from, to time.Time) []EarningsBucket {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	h, ok := l.wallets[walletKey{chainID, strings.ToLower(wallet)}]
+	if !ok {
+		return []EarningsBucket{}
+	}
+
+	type sum struct {
+		earnings   *big.Int
+		heartbeats int64
+		payouts    int
+		ads        map[string]struct{}
+	}
+	sums := make(map[int64]*sum)
+	for start, b := range h.hours {
+		t := time.Unix(start, 0)
+		if t.Before(from) || !t.Before(to) {
+			continue
+		}
+		key := t.Truncate(interval).Unix()
+		s, ok := sums[key]
+		if !ok {
+			s = &sum{earnings: new(big.Int), ads: make(map[string]struct{})}
+			sums[key] = s
+		}
+		s.earnings.Add(s.earnings, b.earnings)
+		s.heartbeats += b.heartbeats
+		s.payouts += b.payouts
+		for ad := range b.ads {
+			s.ads[ad] = struct{}{}
+		}
+	}
+
+	list := make([]EarningsBucket, 0, len(sums))
+	for start, s := range sums {
+		t := time.Unix(start, 0).UTC()
+		list = append(list, EarningsBucket{
+			Start:       t,
+			End:         t.Add(interval),
+			Earnings:    weiToEther(s.earnings),
+			EarningsWei: s.earnings.String(),
+			Heartbeats:  s.heartbeats,
+			AdsWatched:  len(s.ads),
+			Payouts:     s.payouts,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Start.Before(list[j].Start) })
+	return list
+}
+
+// walletTotals is one wallet's activity over a leaderboard window
+type walletTotals struct {
+	wallet     string // lowercase
+	earnings   *big.Int
+	heartbeats int64
+	ads        int
+}
+
+// totalsSince sums every wallet's history on chainID from since onwards;
+// a zero since covers all retained history
+func (l *earningsLedger) totalsSince(chainID int64, since time.Time) []walletTotals {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	cutoff := since.Truncate(time.Hour).Unix()
+	var list []walletTotals
+	for key, h := range l.wallets {
+		if key.chainID != chainID {
+			continue
+		}
+
+		t := walletTotals{wallet: key.wallet, earnings: new(big.Int)}
+		ads := make(map[string]struct{})
+		for start, b := range h.hours {
+			if !since.IsZero() && start < cutoff {
+				continue
+			}
+			t.earnings.Add(t.earnings, b.earnings)
+			t.heartbeats += b.heartbeats
+			for ad := range b.ads {
+				ads[ad] = struct{}{}
+			}
+		}
+		t.ads = len(ads)
+
+		if t.heartbeats > 0 || t.earnings.Sign() > 0 {
+			list = append(list, t)
+		}
+	}
+	return list
+}
+
+// payoutsBetween returns the wallet's payouts in [from, to), oldest first
+func (l *earningsLedger) payoutsBetween(chainID int64, wallet string, from, to time.Time) []Payout {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	list := []Payout{}
+	if h, ok := l.wallets[walletKey{chainID, strings.ToLower(wallet)}]; ok {
+		for _, p := range h.payouts {
+			if !p.Timestamp.Before(from) && p.Timestamp.Before(to) {
+				list = append(list, p)
+			}
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool { return list[i].Timestamp.Before(list[j].Timestamp) })
+	return list
+}
+
+// summary computes lifetime totals and streaks for a wallet
+func (l *earningsLedger) summary(chainID int64, wallet string, now time.Time) EarningsSummaryResponse {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	resp := EarningsSummaryResponse{
+		ChainID:                chainID,
+		Address:                wallet,
+		Earnings:               weiToEther(big.NewInt(0)),
+		EarningsWei:            "0",
+		IndexedThroughBlock:    l.indexed[chainID],
+		PayoutsCompleteFrom:    l.payoutsCompleteFromLocked(chainID, now),
+		HeartbeatsCompleteFrom: l.heartbeatsCompleteFrom(now),
+	}
+
+	h, ok := l.wallets[walletKey{chainID, strings.ToLower(wallet)}]
+	if !ok {
+		return resp
+	}
+
+	total := new(big.Int)
+	activeDays := make(map[int64]bool)
+	for start, b := range h.hours {
+		total.Add(total, b.earnings)
+		resp.Heartbeats += b.heartbeats
+		resp.Payouts += b.payouts
+		if b.heartbeats > 0 {
+			activeDays[start/86400] = true
+		}
+	}
+	resp.Earnings = weiToEther(total)
+	resp.EarningsWei = total.String()
+	resp.AdsWatched = len(h.ads)
+	resp.CurrentStreakDays, resp.LongestStreakDays = streaks(activeDays, now.Unix()/86400)
+
+	if !h.firstSeen.IsZero() {
+		first, last := h.firstSeen.UTC(), h.lastSeen.UTC()
+		resp.FirstActivity, resp.LastActivity = &first, &last
+	}
+	for i := range h.payouts {
+		if resp.LastPayout == nil || h.payouts[i].Timestamp.After(resp.LastPayout.Timestamp) {
+			p := h.payouts[i]
+			resp.LastPayout = &p
+		}
+	}
+	return resp
+}
+
+// known reports whether wallet has any retained history on any chain
+func (l *earningsLedger) known(wallet string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	wallet = strings.ToLower(wallet)
+	for key := range l.wallets {
+		if key.wallet == wallet {
+			return true
+		}
+	}
+	return false
+}
+
+// streaks returns the current and longest runs of consecutive UTC days with
+// heartbeats. The current streak survives until a full day is missed.
+func streaks(days map[int64]bool, today int64) (current, longest int) {
+	sorted := make([]int64, 0, len(days))
+	for d := range days {
+		sorted = append(sorted, d)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	run := 0
+	for i, d := range sorted {
+		if i > 0 && d == sorted[i-1]+1 {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+	}
+
+	start := today
+	if !days[start] {
+		start--
+	}
+	for d := start; days[d]; d-- {
+		current++
+	}
+	return current, longest
+}
+
+func payoutKey(txHash, claimID string) string {
+	return strings.ToLower(txHash) + "/" + strings.ToLower(claimID)
+}
+
+// earningsIndexer records RewardClaimed events for one chain, starting where
+// the stored index ends or from backfillStart, and prunes the ledger
+func (s *Server) earningsIndexer(ctx context.Context, bc *BlockchainClient) {
+	ticker := time.NewTicker(earningsIndexInterval)
+	defer ticker.Stop()
+
+	if bc.ContractAddress() == "" {
+		// Direct transfers emit no events; receiptWatcher records them
+		s.earnings.setCompleteFrom(bc.ChainID(), time.Now())
+		for {
+			s.earnings.prune(time.Now())
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+
+	var next uint64
+	started := false
+
+	for {
+		head, err := bc.GetBlockNumber()
+		if err == nil && !started {
+			next, err = s.startEarningsIndex(bc, head, time.Now())
+			started = err == nil
+		}
+
+		if err == nil {
+			if next, err = s.earnings.index(bc, next, head); err != nil {
+				log.Printf("⚠️ Earnings indexer on chain %d: %v", bc.ChainID(), err)
+			}
+		}
+
+		s.earnings.prune(time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// backfillStart returns the block to index RewardClaimed events from: the
+// first block within earningsRetention, or earnings_backfill_blocks behind
+// head if that is set and later
+func backfillStart(bc *BlockchainClient, config *Config, head uint64, now time.Time) (uint64, error) {
+	from, err := bc.FirstBlockSince(now.Add(-earningsRetention), head)
+	if err != nil {
+		return 0, err
+	}
+	if backfill := uint64(config.EarningsBackfillBlocks); backfill > 0 && head > backfill && head-backfill > from {
+		from = head - backfill
+	}
+	return from, nil
+}
+
+// indexStart returns the block to index RewardClaimed events of bc from and
+// the time payouts are complete from: where the stored index loaded by
+// loadHistory ends, or backfillStart if there is none
+func (l *earningsLedger) indexStart(bc *BlockchainClient, config *Config, head uint64, now time.Time) (uint64, time.Time, error) {
+	l.mu.RLock()
+	resume, ok := l.resume[bc.ChainID()]
+	completeFrom := l.complete[bc.ChainID()]
+	l.mu.RUnlock()
+
+	if ok && resume <= head+1 {
+		return resume, completeFrom, nil
+	}
+	if ok {
+		// The chain was reset, as a local node is when restarted
+		log.Printf("⚠️ Stored earnings index of chain %d reaches block %d, past head %d; indexing it again", bc.ChainID(), resume-1, head)
+		if err := l.state.del(earningsCursorKey(bc.ChainID())); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+
+	from, err := backfillStart(bc, config, head, now)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	completeFrom = now
+	if from <= head {
+		if completeFrom, err = bc.BlockTime(from); err != nil {
+			return 0, time.Time{}, err
+		}
+	}
+	l.mu.Lock()
+	l.from[bc.ChainID()] = from
+	l.mu.Unlock()
+	return from, completeFrom, nil
+}
+
+// startEarningsIndex picks where indexing starts on bc and records the time
+// payouts are complete from
+func (s *Server) startEarningsIndex(bc *BlockchainClient, head uint64, now time.Time) (uint64, error) {
+	from, completeFrom, err := s.earnings.indexStart(bc, s.cfg(), head, now)
+	if err != nil {
+		return 0, err
+	}
+	s.earnings.setCompleteFrom(bc.ChainID(), completeFrom)
+	s.ledger.begin(bc.ChainID(), head)
+	log.Printf("📒 Indexing RewardClaimed on chain %d from block %d (%s)", bc.ChainID(), from, completeFrom.UTC().Format(time.RFC3339))
+	return from, nil
+}
+
+// recordDirectPayout records a confirmed direct transfer, which has no
+// RewardClaimed event for the indexer to find
+func (s *Server) recordDirectPayout(rec RewardRecord, block uint64) {
+	amount, ok := new(big.Int).SetString(rec.RewardWei, 10)
+	if !ok {
+		return
+	}
+	s.earnings.recordPayout(rec.WalletAddress, payoutKey(rec.TxHash, ""), Payout{
+		ChainID:   rec.ChainID,
+		TxHash:    rec.TxHash,
+		Block:     block,
+		Timestamp: rec.UpdatedAt.UTC(),
+		Pricing:   rec.Pricing,
+		amount:    amount,
+	})
+}
+
+// historyIntervals are the bucket sizes accepted by ?interval=
+var historyIntervals = map[string]time.Duration{
+	"hour": time.Hour,
+	"day":  24 * time.Hour,
+}
+
+// timeRange reads ?from= and ?to= as RFC 3339 timestamps, unix seconds or
+// YYYY-MM-DD dates. A date-only to includes that whole day.
+func timeRange(r *http.Request, defaultSpan time.Duration) (time.Time, time.Time, error) {
+	now := time.Now().UTC()
+	to, err := parseTimeParam(r.URL.Query().Get("to"), now, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("to: %w", err)
+	}
+	from, err := parseTimeParam(r.URL.Query().Get("from"), to.Add(-defaultSpan), false)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("from: %w", err)
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from must be before to")
+	}
+	return from, to, nil
+}
+
+func parseTimeParam(raw string, def time.Time, endOfDay bool) (time.Time, error) {
+	if raw == "" {
+		return def, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.UTC(), nil
+	}
+	if t, err := time.Parse(time.DateOnly, raw); err == nil {
+		if endOfDay {
+			t = t.Add(24 * time.Hour)
+		}
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return time.Unix(secs, 0).UTC(), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not an RFC 3339 time, date or unix timestamp", raw)
+}
+
+// wantsCSV reports whether the client asked for ?format=csv
+func wantsCSV(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "csv"
+}
+
+// writeCSV sends rows as a CSV attachment
+func writeCSV(w http.ResponseWriter, filename string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	cw := csv.NewWriter(w)
+	cw.WriteAll(rows)
+}
+
+// handleEarningsHistory returns a wallet's earnings, heartbeats and ads
+// watched per hour or day
+func (s *Server) handleEarningsHistory(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["address"]
+
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	intervalName := r.URL.Query().Get("interval")
+	if intervalName == "" {
+		intervalName = "day"
+	}
+	interval, ok := historyIntervals[intervalName]
+	if !ok {
+		writeError(w, newAPIError(CodeInvalidRequest, "interval must be hour or day", nil))
+		return
+	}
+
+	from, to, err := timeRange(r, 30*interval)
+	if err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, err.Error(), nil))
+		return
+	}
+
+	buckets := s.earnings.buckets(bc.ChainID(), address, interval, from, to)
+	now := time.Now()
+	payoutsFrom, heartbeatsFrom := s.earnings.payoutsCompleteFrom(bc.ChainID(), now), s.earnings.heartbeatsCompleteFrom(now)
+	w.Header().Set("X-Payouts-Complete-From", payoutsFrom.Format(time.RFC3339))
+	w.Header().Set("X-Heartbeats-Complete-From", heartbeatsFrom.Format(time.RFC3339))
+
+	if wantsCSV(r) {
+		rows := [][]string{{"period_start", "period_end", "earnings_eth", "earnings_wei", "heartbeats", "ads_watched", "payouts"}}
+		for _, b := range buckets {
+			rows = append(rows, []string{
+				b.Start.Format(time.RFC3339),
+				b.End.Format(time.RFC3339),
+				b.Earnings,
+				b.EarningsWei,
+				strconv.FormatInt(b.Heartbeats, 10),
+				strconv.Itoa(b.AdsWatched),
+				strconv.Itoa(b.Payouts),
+			})
+		}
+		writeCSV(w, fmt.Sprintf("earnings-%s-%d-%s.csv", strings.ToLower(address), bc.ChainID(), intervalName), rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EarningsHistoryResponse{
+		ChainID:  bc.ChainID(),
+		Address:  address,
+		Interval: intervalName,
+		From:     from,
+		To:       to,
+		Buckets:  buckets,
+
+		PayoutsCompleteFrom:    payoutsFrom,
+		HeartbeatsCompleteFrom: heartbeatsFrom,
+	})
+}
+
+// handleEarningsSummary returns lifetime totals, streaks and the last payout
+func (s *Server) handleEarningsSummary(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["address"]
+
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.earnings.summary(bc.ChainID(), address, time.Now()))
+}
+
+// handleEarningsPayouts lists individual payouts, one row per transaction
+// in CSV form for tax reporting
+func (s *Server) handleEarningsPayouts(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["address"]
+
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	from, to, err := timeRange(r, earningsRetention)
+	if err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, err.Error(), nil))
+		return
+	}
+
+	payouts := s.earnings.payoutsBetween(bc.ChainID(), address, from, to)
+	completeFrom := s.earnings.payoutsCompleteFrom(bc.ChainID(), time.Now())
+	w.Header().Set("X-Payouts-Complete-From", completeFrom.Format(time.RFC3339))
+
+	if wantsCSV(r) {
+		rows := [][]string{{"timestamp", "chain_id", "tx_hash", "block", "amount_eth", "amount_wei", "claim_id"}}
+		for _, p := range payouts {
+			rows = append(rows, []string{
+				p.Timestamp.Format(time.RFC3339),
+				strconv.FormatInt(p.ChainID, 10),
+				p.TxHash,
+				strconv.FormatUint(p.Block, 10),
+				p.Amount,
+				p.AmountWei,
+				p.ClaimID,
+			})
+		}
+		writeCSV(w, fmt.Sprintf("payouts-%s-%d.csv", strings.ToLower(address), bc.ChainID()), rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(EarningsPayoutsResponse{
+		ChainID: bc.ChainID(),
+		Address: address,
+		From:    from,
+		To:      to,
+		Payouts: payouts,
+
+		CompleteFrom: completeFrom,
+	})
+}
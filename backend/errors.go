@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Stable, machine-readable error codes. Clients should branch on these rather
+// than on messages, which may change.
+const (
+	// Request problems
+	CodeInvalidRequest = "invalid_request"
+	CodeInvalidAddress = "invalid_address"
+	CodeUnknownChain   = "unknown_chain"
+	CodeNotFound       = "not_found"
+	CodeUnauthorized   = "unauthorized"
+	CodeRateLimited    = "rate_limited"
+
+	// Ad sessions
+	CodeSessionExpired    = "session_expired"
+	CodeSessionClosed     = "session_closed"
+	CodeSessionIncomplete = "session_incomplete"
+
+	// Referrals
+	CodeAlreadyReferred    = "already_referred"
+	CodeReferralIneligible = "referral_ineligible"
+
+	// Server and chain availability
+	CodeQueueFull        = "queue_full"
+	CodeShuttingDown     = "shutting_down"
+	CodeStateUnavailable = "state_unavailable"
+	CodeRPCUnavailable   = "rpc_unavailable"
+	CodeInternal         = "internal"
+
+	// Reward settlement, mostly decoded from RewardTreasury reverts
+	CodeTreasuryInsufficient = "treasury_insufficient"
+	CodeNotRewardSigner      = "not_reward_signer"
+	CodeAlreadyClaimed       = "reward_already_claimed"
+	CodeInvalidRecipient     = "invalid_recipient"
+	CodeInvalidAmount        = "invalid_amount"
+	CodeTransferFailed       = "transfer_failed"
+	CodeReverted             = "reverted"
+	CodeSignerFunds          = "signer_insufficient_funds"
+	CodeNonce                = "nonce"
+	CodeTxDropped            = "tx_dropped"
+)
+
+// errorStatus is the HTTP status for each code; unlisted codes are 500
+var errorStatus = map[string]int{
+	CodeInvalidRequest:       http.StatusBadRequest,
+	CodeInvalidAddress:       http.StatusBadRequest,
+	CodeUnknownChain:         http.StatusBadRequest,
+	CodeNotFound:             http.StatusNotFound,
+	CodeUnauthorized:         http.StatusUnauthorized,
+	CodeRateLimited:          http.StatusTooManyRequests,
+	CodeSessionExpired:       http.StatusGone,
+	CodeSessionClosed:        http.StatusConflict,
+	CodeSessionIncomplete:    http.StatusConflict,
+	CodeAlreadyReferred:      http.StatusConflict,
+	CodeReferralIneligible:   http.StatusConflict,
+	CodeQueueFull:            http.StatusServiceUnavailable,
+	CodeShuttingDown:         http.StatusServiceUnavailable,
+	CodeStateUnavailable:     http.StatusServiceUnavailable,
+	CodeRPCUnavailable:       http.StatusServiceUnavailable,
+	CodeTreasuryInsufficient: http.StatusServiceUnavailable,
+	CodeNotRewardSigner:      http.StatusServiceUnavailable,
+}
+
+var (
+	errInvalidAddress = errors.New("invalid address")
+	errRateLimited    = errors.New("heartbeat rate limit exceeded")
+	errQueueFull      = errors.New("reward queue is full")
+	errShuttingDown   = errors.New("server is shutting down")
+)
+
+// sentinelCodes maps known errors to their codes, checked in order with errors.Is
+var sentinelCodes = []struct {
+	err  error
+	code string
+}{
+	{errInvalidAddress, CodeInvalidAddress},
+	{errRateLimited, CodeRateLimited},
+	{errUnknownChain, CodeUnknownChain},
+	{errBadSignature, CodeUnauthorized},
+	{errSessionNotFound, CodeNotFound},
+	{errSessionExpired, CodeSessionExpired},
+	{errSessionClosed, CodeSessionClosed},
+	{errSessionIncomplete, CodeSessionIncomplete},
+	{errReferralCodeNotFound, CodeNotFound},
+	{errAlreadyReferred, CodeAlreadyReferred},
+	{errReferralIneligible, CodeReferralIneligible},
+	{errQueueFull, CodeQueueFull},
+	{errShuttingDown, CodeShuttingDown},
+	{errStateUnavailable, CodeStateUnavailable},
+	{ErrNotRewardSigner, CodeNotRewardSigner},
+	{ErrRewardAlreadyClaimed, CodeAlreadyClaimed},
+	{ErrInsufficientTreasury, CodeTreasuryInsufficient},
+	{ErrInvalidRecipient, CodeInvalidRecipient},
+	{ErrInvalidAmount, CodeInvalidAmount},
+	{ErrTransferFailed, CodeTransferFailed},
+	{ErrReverted, CodeReverted},
+}
+
+// APIError is an error with a stable code, safe to show to clients
+type APIError struct {
+	Code    string
+	Message string
+	Err     error // underlying cause; logged, never sent to clients
+}
+
+func (e *APIError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *APIError) Unwrap() error { return e.Err }
+
+// Status returns the HTTP status code for the error's code
+func (e *APIError) Status() int {
+	if status, ok := errorStatus[e.Code]; ok {
+		return status
+	}
+	return http.StatusInternalServerError
+}
+
+// newAPIError builds an APIError with a client-facing message
+func newAPIError(code, message string, cause error) *APIError {
+	return &APIError{Code: code, Message: message, Err: cause}
+}
+
+// errorCode classifies any heartbeat or settlement error
+func errorCode(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code
+	}
+	for _, s := range sentinelCodes {
+		if errors.Is(err, s.err) {
+			return s.code
+		}
+	}
+
+	// Node errors only come back as text
+	msg := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(msg, "insufficient funds"):
+		return CodeSignerFunds
+	case strings.Contains(msg, "nonce"):
+		return CodeNonce
+	default:
+		return CodeRPCUnavailable
+	}
+}
+
+// asAPIError converts err for a response. Recognised errors keep their own
+// code and message; anything else gets fallback and a generic message, since
+// raw RPC errors can contain endpoint URLs with API keys.
+func asAPIError(err error, fallback string) *APIError {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+	// Redis errors name the host it runs on
+	if errors.Is(err, errStateUnavailable) {
+		return newAPIError(CodeStateUnavailable, errStateUnavailable.Error(), err)
+	}
+	for _, s := range sentinelCodes {
+		if errors.Is(err, s.err) {
+			return newAPIError(s.code, err.Error(), nil)
+		}
+	}
+
+	message := "internal error"
+	if fallback == CodeRPCUnavailable {
+		message = "blockchain node unavailable"
+	}
+	return newAPIError(fallback, message, err)
+}
+
+// ErrorBody is the error part of the JSON error envelope
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the JSON envelope every API error is returned in
+type ErrorResponse struct {
+	Success bool      `json:"success"` // always false; matches HeartbeatResponse
+	Error   ErrorBody `json:"error"`
+}
+
+// writeError sends err in the JSON error envelope with its mapped status
+func writeError(w http.ResponseWriter, err *APIError) {
+	status := err.Status()
+	if status >= http.StatusInternalServerError && err.Err != nil {
+		log.Printf("⚠️ %s: %v", err.Code, err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(ErrorResponse{
+		Error: ErrorBody{Code: err.Code, Message: err.Message},
+	})
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Events kept in memory for Last-Event-ID resume
+	eventReplaySize = 1024
+
+	// Events buffered per SSE subscriber before it is dropped as too slow
+	sseSendBufferSize = 64
+
+	// Comment lines sent to keep idle SSE connections open through proxies
+	sseKeepAliveInterval = 15 * time.Second
+
+	// Reconnect delay suggested to EventSource clients
+	sseRetryMs = 3000
+)
+
+// Event is a published message with a sequence number unique to the hub
+// that numbered it
+type Event struct {
+	ID    uint64
+	Topic string
+	Type  string
+	Data  []byte
+}
+
+// eventHub numbers every published event, keeps a bounded replay buffer and
+// fans events out to SSE subscribers. WebSocket delivery stays in publish.
+// Sequence numbers restart with every process and differ between replicas,
+// so SSE IDs carry the hub's random epoch to tell them apart.
+type eventHub struct {
+	epoch       string
+	mu          sync.Mutex
+	nextID      uint64
+	buffer      []Event
+	subscribers map[*sseSubscriber]bool
+
+	closed    chan struct{} // closed at shutdown to end every stream
+	closeOnce sync.Once
+}
+
+// sseSubscriber is a single /api/events stream
+type sseSubscriber struct {
+	topics map[string]bool // empty means every topic
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newEventHub() *eventHub {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &eventHub{
+		epoch:       hex.EncodeToString(b),
+		nextID:      1,
+		buffer:      make([]Event, 0, eventReplaySize),
+		subscribers: make(map[*sseSubscriber]bool),
+		closed:      make(chan struct{}),
+	}
+}
+
+// close ends every current and future stream
+func (h *eventHub) close() {
+	h.closeOnce.Do(func() { close(h.closed) })
+}
+
+// wants reports whether the subscriber asked for topic
+func (sub *sseSubscriber) wants(topic string) bool {
+	return len(sub.topics) == 0 || sub.topics[topic]
+}
+
+// drop disconnects a subscriber that cannot keep up
+func (sub *sseSubscriber) drop() {
+	sub.once.Do(func() { close(sub.done) })
+}
+
+// append records an event and delivers it to matching subscribers
+func (h *eventHub) append(topic, msgType string, data []byte) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ev := Event{ID: h.nextID, Topic: topic, Type: msgType, Data: data}
+	h.nextID++
+
+	if len(h.buffer) == eventReplaySize {
+		copy(h.buffer, h.buffer[1:])
+		h.buffer = h.buffer[:eventReplaySize-1]
+	}
+	h.buffer = append(h.buffer, ev)
+
+	for sub := range h.subscribers {
+		if !sub.wants(topic) {
+			continue
+		}
+		select {
+		case sub.events <- ev:
+		default:
+			sub.drop()
+		}
+	}
+
+	return ev
+}
+
+// eventID is the SSE id of ev: the hub's epoch and the event's sequence number
+func (h *eventHub) eventID(ev Event) string {
+	return h.epoch + "-" + strconv.FormatUint(ev.ID, 10)
+}
+
+// parseEventID returns the sequence number in an SSE id from this hub. ok is
+// false for IDs from another replica or process, or that aren't IDs at all.
+func (h *eventHub) parseEventID(id string) (seq uint64, ok bool) {
+	epoch, raw, found := strings.Cut(id, "-")
+	if !found || epoch != h.epoch {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil || seq == 0 {
+		return 0, false
+	}
+	return seq, true
+}
+
+// subscribe registers a subscriber and returns the buffered events after
+// lastID, an SSE id the client last saw ("" for a new stream). gap is true
+// when some of the requested events have already been evicted from the
+// buffer, or lastID was issued by another replica or process.
+func (h *eventHub) subscribe(sub *sseSubscriber, lastID string) (replay []Event, gap bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if lastID != "" {
+		seq, ok := h.parseEventID(lastID)
+		if !ok {
+			h.subscribers[sub] = true
+			return nil, true
+		}
+		if seq >= h.nextID {
+			gap = true
+		} else if len(h.buffer) > 0 && h.buffer[0].ID > seq+1 {
+			gap = true
+		}
+
+		for _, ev := range h.buffer {
+			if ev.ID > seq && sub.wants(ev.Topic) {
+				replay = append(replay, ev)
+			}
+		}
+	}
+
+	h.subscribers[sub] = true
+	return replay, gap
+}
+
+// hasSubscribers reports whether any SSE stream would receive topic
+func (h *eventHub) hasSubscribers(topic string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscribers {
+		if sub.wants(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// unsubscribe removes a subscriber
+func (h *eventHub) unsubscribe(sub *sseSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, sub)
+}
+
+// writeSSE writes one event in text/event-stream framing
+func (h *eventHub) writeSSE(w http.ResponseWriter, ev Event) error {
+	_, err := fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", h.eventID(ev), ev.Type, ev.Data)
+	return err
+}
+
+// handleEvents streams published events as Server-Sent Events. Clients may
+// pass ?topics=blocks,treasury,rewards:0x... to filter, and resume with the
+// Last-Event-ID header (or last_event_id query parameter).
+func (s *Server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	sub := &sseSubscriber{
+		topics: make(map[string]bool),
+		events: make(chan Event, sseSendBufferSize),
+		done:   make(chan struct{}),
+	}
+
+	if raw := r.URL.Query().Get("topics"); raw != "" {
+		for _, t := range strings.Split(raw, ",") {
+			topic, err := normalizeTopic(t)
+			if err != nil {
+				writeError(w, newAPIError(CodeInvalidRequest, err.Error(), nil))
+				return
+			}
+			sub.topics[topic] = true
+		}
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.URL.Query().Get("last_event_id")
+	}
+
+	ip := s.clientIP(r)
+	if !s.reserveIPSlot(ip) {
+		writeError(w, newAPIError(CodeRateLimited, "too many connections", nil))
+		return
+	}
+	defer s.releaseIPSlot(ip)
+
+	// Streams outlive the server's WriteTimeout, so manage deadlines per write
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	replay, gap := s.events.subscribe(sub, lastID)
+	defer s.events.unsubscribe(sub)
+
+	log.Printf("📻 SSE client connected from %s (replaying %d events)", ip, len(replay))
+
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetryMs)
+	if gap {
+		// Tell the client its history is incomplete so it can refetch state
+		fmt.Fprintf(w, "event: reset\ndata: {\"type\":\"reset\"}\n\n")
+	}
+	for _, ev := range replay {
+		if s.events.writeSSE(w, ev) != nil {
+			return
+		}
+	}
+	rc.Flush()
+
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-sub.done:
+			log.Printf("🐢 Dropping slow SSE client %s", ip)
+			return
+		case <-s.events.closed:
+			fmt.Fprintf(w, "event: shutdown\ndata: {\"type\":\"shutdown\",\"reason\":%q}\n\n", shutdownReason)
+			rc.Flush()
+			return
+		case ev := <-sub.events:
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if s.events.writeSSE(w, ev) != nil || rc.Flush() != nil {
+				return
+			}
+		case <-keepAlive.C:
+			rc.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// encodeEvent marshals a published message once for every transport
+func encodeEvent(msg map[string]interface{}) ([]byte, string, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, "", err
+	}
+	msgType, _ := msg["type"].(string)
+	return data, msgType, nil
+}
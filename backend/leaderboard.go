@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	// Entries kept per board; ?limit= can't exceed it
+	leaderboardSize = 100
+
+	// How often boards are recomputed from the earnings ledger
+	leaderboardRefreshInterval = 10 * time.Second
+)
+
+// leaderboardWindows are the rolling windows accepted by ?window=; 0 is all
+// retained history
+var leaderboardWindows = map[string]time.Duration{
+	"day":  24 * time.Hour,
+	"week": 7 * 24 * time.Hour,
+	"all":  0,
+}
+
+// leaderboardMetrics are the rankings accepted by ?by=
+var leaderboardMetrics = []string{"earnings", "heartbeats"}
+
+type LeaderboardEntry struct {
+	Rank        int    `json:"rank"`
+	Address     string `json:"address"`
+	Earnings    string `json:"earnings"`
+	EarningsWei string `json:"earnings_wei"`
+	Heartbeats  int64  `json:"heartbeats"`
+	AdsWatched  int    `json:"ads_watched"`
+}
+
+type LeaderboardResponse struct {
+	ChainID   int64              `json:"chain_id"`
+	Window    string             `json:"window"`
+	By        string             `json:"by"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	Entries   []LeaderboardEntry `json:"entries"`
+}
+
+// LeaderboardRankChange is one wallet moving on a board. PreviousRank is 0
+// for wallets entering it and Rank is 0 for wallets leaving it.
+type LeaderboardRankChange struct {
+	Address      string `json:"address"`
+	Rank         int    `json:"rank"`
+	PreviousRank int    `json:"previous_rank"`
+}
+
+type LeaderboardOptOutRequest struct {
+	WalletAddress string `json:"wallet_address"`
+	OptOut        bool   `json:"opt_out"`
+	Timestamp     int64  `json:"timestamp"` // unix seconds, part of the signed message
+	Signature     string `json:"signature"`
+}
+
+type LeaderboardOptOutResponse struct {
+	Success       bool   `json:"success"`
+	WalletAddress string `json:"wallet_address"`
+	OptOut        bool   `json:"opt_out"`
+}
+
+type leaderboardKey struct {
+	chainID int64
+	window  string
+	by      string
+}
+
+// Shared state hash of opted-out wallets, lowercase address → "1"
+const leaderboardOptOutsKey = "leaderboard:opt-outs"
+
+// leaderboard holds the latest computed boards and the wallets that asked to
+// be left off them. Opt-outs live in shared state, so every replica hides the
+// same wallets; without Redis they are also saved to optOutFile so they
+// survive restarts.
+type leaderboard struct {
+	mu      sync.RWMutex
+	boards  map[leaderboardKey]*LeaderboardResponse
+	optOuts map[string]bool // lowercase addresses, reloaded from state on refresh
+
+	state      sharedState
+	optOutFile string     // "" when state is durable or opt-outs are memory only
+	saveMux    sync.Mutex // serialises writes to optOutFile
+	refreshMux sync.Mutex // serialises refreshes from the ticker and opt-outs
+}
+
+// newLeaderboard loads optOutFile into state. With durable state the file is
+// imported once and no longer written.
+func newLeaderboard(state sharedState, optOutFile string) (*leaderboard, error) {
+	lb := &leaderboard{
+		boards:  make(map[leaderboardKey]*LeaderboardResponse),
+		optOuts: make(map[string]bool),
+		state:   state,
+	}
+	if optOutFile == "" {
+		return lb, nil
+	}
+	if !state.durable() {
+		lb.optOutFile = optOutFile
+	}
+
+	data, err := os.ReadFile(optOutFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return lb, lb.loadOptOuts()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read leaderboard opt-outs: %w", err)
+	}
+
+	var addresses []string
+	if err := json.Unmarshal(data, &addresses); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", optOutFile, err)
+	}
+	for _, addr := range addresses {
+		if err := state.hset(leaderboardOptOutsKey, strings.ToLower(addr), []byte("1")); err != nil {
+			return nil, fmt.Errorf("failed to load leaderboard opt-outs: %w", err)
+		}
+	}
+	if state.durable() && len(addresses) > 0 {
+		log.Printf("🙈 Imported %d leaderboard opt-outs from %s into shared state; the file is no longer updated", len(addresses), optOutFile)
+	}
+	return lb, lb.loadOptOuts()
+}
+
+// loadOptOuts refreshes the local copy of the shared opt-out list
+func (lb *leaderboard) loadOptOuts() error {
+	all, err := lb.state.hgetall(leaderboardOptOutsKey)
+	if err != nil {
+		return fmt.Errorf("failed to load leaderboard opt-outs: %w", err)
+	}
+	optOuts := make(map[string]bool, len(all))
+	for addr := range all {
+		optOuts[addr] = true
+	}
+
+	lb.mu.Lock()
+	lb.optOuts = optOuts
+	lb.mu.Unlock()
+	return nil
+}
+
+// isOptedOut reports whether wallet asked to be hidden
+func (lb *leaderboard) isOptedOut(wallet string) bool {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.optOuts[strings.ToLower(wallet)]
+}
+
+// setOptOut records a wallet's choice in shared state and saves the list
+func (lb *leaderboard) setOptOut(wallet string, optOut bool) error {
+	key := strings.ToLower(wallet)
+	var err error
+	if optOut {
+		err = lb.state.hset(leaderboardOptOutsKey, key, []byte("1"))
+	} else {
+		err = lb.state.hdel(leaderboardOptOutsKey, key)
+	}
+	if err != nil {
+		return err
+	}
+	if err := lb.loadOptOuts(); err != nil {
+		return err
+	}
+	return lb.save()
+}
+
+// save writes the opt-out list atomically, when there is a file
+func (lb *leaderboard) save() error {
+	if lb.optOutFile == "" {
+		return nil
+	}
+	lb.saveMux.Lock()
+	defer lb.saveMux.Unlock()
+
+	lb.mu.RLock()
+	addresses := make([]string, 0, len(lb.optOuts))
+	for addr := range lb.optOuts {
+		addresses = append(addresses, addr)
+	}
+	lb.mu.RUnlock()
+	sort.Strings(addresses)
+
+	data, err := json.MarshalIndent(addresses, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(lb.optOutFile), ".opt-outs-*")
+	if err != nil {
+		return fmt.Errorf("failed to save leaderboard opt-outs: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save leaderboard opt-outs: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save leaderboard opt-outs: %w", err)
+	}
+	return os.Rename(tmp.Name(), lb.optOutFile)
+}
+
+// board returns a computed board, or nil before the first refresh
+func (lb *leaderboard) board(key leaderboardKey) *LeaderboardResponse {
+	lb.mu.RLock()
+	defer lb.mu.RUnlock()
+	return lb.boards[key]
+}
+
+// replace stores a new board and returns the rank changes from the old one
+func (lb *leaderboard) replace(key leaderboardKey, board *LeaderboardResponse) []LeaderboardRankChange {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+
+	previous := make(map[string]int)
+	if old := lb.boards[key]; old != nil {
+		for _, e := range old.Entries {
+			previous[e.Address] = e.Rank
+		}
+	}
+	lb.boards[key] = board
+
+	var changes []LeaderboardRankChange
+	for _, e := range board.Entries {
+		if prev := previous[e.Address]; prev != e.Rank {
+			changes = append(changes, LeaderboardRankChange{Address: e.Address, Rank: e.Rank, PreviousRank: prev})
+		}
+		delete(previous, e.Address)
+	}
+	for addr, prev := range previous {
+		changes = append(changes, LeaderboardRankChange{Address: addr, PreviousRank: prev})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Address < changes[j].Address })
+	return changes
+}
+
+// rankWallets orders totals by the chosen metric, the other metric breaking
+// ties, then address so equal wallets keep a stable order
+func rankWallets(totals []walletTotals, by string) {
+	sort.Slice(totals, func(i, j int) bool {
+		a, b := totals[i], totals[j]
+		byEarnings := a.earnings.Cmp(b.earnings)
+		byHeartbeats := 0
+		if a.heartbeats != b.heartbeats {
+			byHeartbeats = 1
+			if a.heartbeats < b.heartbeats {
+				byHeartbeats = -1
+			}
+		}
+
+		first, second := byEarnings, byHeartbeats
+		if by == "heartbeats" {
+			first, second = byHeartbeats, byEarnings
+		}
+		if first != 0 {
+			return first > 0
+		}
+		if second != 0 {
+			return second > 0
+		}
+		return a.wallet < b.wallet
+	})
+}
+
+// refreshLeaderboards recomputes every board and pushes rank changes to the
+// leaderboard topic
+func (s *Server) refreshLeaderboards() {
+	s.leaderboard.refreshMux.Lock()
+	defer s.leaderboard.refreshMux.Unlock()
+
+	// Picks up opt-outs made on other replicas, even if their event was lost
+	if err := s.leaderboard.loadOptOuts(); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
+
+	now := time.Now().UTC()
+	for _, bc := range s.chains.all() {
+		for window, span := range leaderboardWindows {
+			var since time.Time
+			if span > 0 {
+				since = now.Add(-span)
+			}
+			totals := s.earnings.totalsSince(bc.ChainID(), since)
+
+			for _, by := range leaderboardMetrics {
+				rankWallets(totals, by)
+
+				board := &LeaderboardResponse{
+					ChainID:   bc.ChainID(),
+					Window:    window,
+					By:        by,
+					UpdatedAt: now,
+					Entries:   []LeaderboardEntry{},
+				}
+				for _, t := range totals {
+					if len(board.Entries) == leaderboardSize {
+						break
+					}
+					if s.leaderboard.isOptedOut(t.wallet) {
+						continue
+					}
+					board.Entries = append(board.Entries, LeaderboardEntry{
+						Rank:        len(board.Entries) + 1,
+						Address:     common.HexToAddress(t.wallet).Hex(),
+						Earnings:    weiToEther(t.earnings),
+						EarningsWei: t.earnings.String(),
+						Heartbeats:  t.heartbeats,
+						AdsWatched:  t.ads,
+					})
+				}
+
+				key := leaderboardKey{bc.ChainID(), window, by}
+				changes := s.leaderboard.replace(key, board)
+				if len(changes) > 0 && s.hasSubscribers(TopicLeaderboard) {
+					s.publish(TopicLeaderboard, map[string]interface{}{
+						"type":     "leaderboard_update",
+						"chain_id": key.chainID,
+						"window":   key.window,
+						"by":       key.by,
+						"changes":  changes,
+					})
+				}
+			}
+		}
+	}
+}
+
+// leaderboardUpdater refreshes the boards periodically
+func (s *Server) leaderboardUpdater(ctx context.Context) {
+	ticker := time.NewTicker(leaderboardRefreshInterval)
+	defer ticker.Stop()
+
+	s.refreshLeaderboards()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.refreshLeaderboards()
+		}
+	}
+}
+
+// handleLeaderboard returns the top wallets for a window and metric
+func (s *Server) handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	key := leaderboardKey{chainID: bc.ChainID(), window: q.Get("window"), by: q.Get("by")}
+	if key.window == "" {
+		key.window = "week"
+	}
+	if key.by == "" {
+		key.by = "earnings"
+	}
+
+	limit := 10
+	if raw := q.Get("limit"); raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 1 || n > leaderboardSize {
+			writeError(w, newAPIError(CodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", leaderboardSize), nil))
+			return
+		}
+		limit = n
+	}
+
+	board := s.leaderboard.board(key)
+	if board == nil {
+		writeError(w, newAPIError(CodeInvalidRequest, "unknown window or ranking", nil))
+		return
+	}
+
+	response := *board
+	if len(response.Entries) > limit {
+		response.Entries = response.Entries[:limit]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleLeaderboardOptOut hides or shows a wallet on every leaderboard. The
+// request must be signed by the wallet itself.
+func (s *Server) handleLeaderboardOptOut(w http.ResponseWriter, r *http.Request) {
+	var req LeaderboardOptOutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, "invalid request body", err))
+		return
+	}
+
+	if err := checkSignedAt(req.Timestamp, time.Now()); err != nil {
+		writeError(w, asAPIError(err, CodeUnauthorized))
+		return
+	}
+	message := leaderboardOptOutMessage(req.WalletAddress, req.OptOut, req.Timestamp)
+	if err := verifyWalletSignature(req.WalletAddress, message, req.Signature); err != nil {
+		writeError(w, asAPIError(err, CodeUnauthorized))
+		return
+	}
+
+	if err := s.leaderboard.setOptOut(req.WalletAddress, req.OptOut); err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	log.Printf("🙈 Leaderboard opt-out for %s set to %v", req.WalletAddress, req.OptOut)
+
+	// Apply at once rather than on the next tick, here and on other replicas
+	s.refreshLeaderboards()
+	s.publishCluster(clusterEvent{OptOut: strings.ToLower(req.WalletAddress)})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(LeaderboardOptOutResponse{
+		Success:       true,
+		WalletAddress: req.WalletAddress,
+		OptOut:        req.OptOut,
+	})
+}
+
+// leaderboardOptOutMessage is the text a wallet signs to change its opt-out
+func leaderboardOptOutMessage(wallet string, optOut bool, timestamp int64) string {
+	return signedMessage("ChainPay leaderboard privacy",
+		"Wallet", strings.ToLower(wallet),
+		"Opt out", strconv.FormatBool(optOut),
+		"Timestamp", strconv.FormatInt(timestamp, 10),
+	)
+}
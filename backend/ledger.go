@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LedgerEntry is one reward the backend saw confirmed on chain
+type LedgerEntry struct {
+	RewardID    string     `json:"reward_id"`
+	ChainID     int64      `json:"chain_id"`
+	Wallet      string     `json:"wallet"`
+	Kind        RewardKind `json:"kind"`
+	AmountWei   string     `json:"amount_wei"`
+	TxHash      string     `json:"tx_hash"`
+	ClaimID     string     `json:"claim_id,omitempty"`
+	Block       uint64     `json:"block"`
+	ConfirmedAt time.Time  `json:"confirmed_at"`
+}
+
+// ledgerStart marks the block from which a chain's payouts are all in the ledger
+type ledgerStart struct {
+	ChainID int64     `json:"chain_id"`
+	Block   uint64    `json:"block"`
+	At      time.Time `json:"at"`
+}
+
+// ledgerLine is one line of the payout ledger file
+type ledgerLine struct {
+	Start  *ledgerStart `json:"start,omitempty"`
+	Payout *LedgerEntry `json:"payout,omitempty"`
+}
+
+func ledgerKey(chainID int64) string      { return fmt.Sprintf("ledger:%d", chainID) }
+func ledgerStartKey(chainID int64) string { return fmt.Sprintf("ledger:%d:start", chainID) }
+
+// payoutLedger records every confirmed reward, for reconciliation against
+// the chain. Entries live in shared state; without Redis they are also
+// appended to a JSONL file so they survive restarts.
+type payoutLedger struct {
+	state sharedState
+	file  string     // "" when state is durable or the ledger is memory only
+	mu    sync.Mutex // serialises writes to file
+}
+
+// newPayoutLedger opens the ledger, loading file into state when state
+// doesn't outlive the process. Entries past earningsRetention are skipped.
+func newPayoutLedger(state sharedState, file string) (*payoutLedger, error) {
+	l := &payoutLedger{state: state}
+	if state.durable() || file == "" {
+		return l, nil
+	}
+	l.file = file
+
+	cutoff := time.Now().Add(-earningsRetention)
+	loaded := 0
+	err := readLedgerFile(file, func(line ledgerLine) error {
+		switch {
+		case line.Start != nil:
+			data, err := json.Marshal(line.Start)
+			if err != nil {
+				return err
+			}
+			_, err = state.setNX(ledgerStartKey(line.Start.ChainID), data, 0)
+			return err
+		case line.Payout != nil && !line.Payout.ConfirmedAt.Before(cutoff):
+			loaded++
+			return l.put(*line.Payout)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load payout ledger: %w", err)
+	}
+	if loaded > 0 {
+		log.Printf("🧾 Loaded %d payouts from %s", loaded, file)
+	}
+	return l, nil
+}
+
+// readLedgerFile calls fn for every line of file. A missing file is empty,
+// and a torn last line from a crash is skipped.
+func readLedgerFile(file string, fn func(ledgerLine) error) error {
+	f, err := os.Open(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var line ledgerLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			log.Printf("⚠️ Skipping corrupt line %d of %s: %v", n, file, err)
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// compact rewrites the ledger file without entries past earningsRetention.
+// Only the server calls it, so the reconcile command never races its appends.
+func (l *payoutLedger) compact(now time.Time) error {
+	if l.file == "" {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-earningsRetention)
+	var kept [][]byte
+	dropped := 0
+	err := readLedgerFile(l.file, func(line ledgerLine) error {
+		if line.Payout != nil && line.Payout.ConfirmedAt.Before(cutoff) {
+			dropped++
+			return nil
+		}
+		data, err := json.Marshal(line)
+		kept = append(kept, data)
+		return err
+	})
+	if err != nil || dropped == 0 {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(l.file), ".payout-ledger-*")
+	if err != nil {
+		return fmt.Errorf("failed to compact payout ledger: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	w := bufio.NewWriter(tmp)
+	for _, data := range kept {
+		w.Write(data)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact payout ledger: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to compact payout ledger: %w", err)
+	}
+	log.Printf("🧾 Dropped %d payouts older than %s from %s", dropped, earningsRetention, l.file)
+	return os.Rename(tmp.Name(), l.file)
+}
+
+// append writes line to the ledger file, if there is one
+func (l *payoutLedger) append(line ledgerLine) {
+	if l.file == "" {
+		return
+	}
+	data, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, err := os.OpenFile(l.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err == nil {
+		_, err = f.Write(append(data, '\n'))
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to append to payout ledger: %v", err)
+	}
+}
+
+// put stores entry in shared state. A reward confirmed in two transactions
+// keeps both entries, which reconciliation reports as a duplicate.
+func (l *payoutLedger) put(entry LedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return l.state.hset(ledgerKey(entry.ChainID), entry.RewardID+"/"+strings.ToLower(entry.TxHash), data)
+}
+
+// record adds a confirmed reward mined in block
+func (l *payoutLedger) record(rec RewardRecord, block uint64) {
+	entry := LedgerEntry{
+		RewardID:    rec.ID,
+		ChainID:     rec.ChainID,
+		Wallet:      rec.WalletAddress,
+		Kind:        rec.Kind,
+		AmountWei:   rec.RewardWei,
+		TxHash:      rec.TxHash,
+		ClaimID:     rec.ClaimID,
+		Block:       block,
+		ConfirmedAt: rec.UpdatedAt.UTC(),
+	}
+	if err := l.put(entry); err != nil {
+		log.Printf("⚠️ Failed to record payout %s in ledger: %v", rec.ID, err)
+		return
+	}
+	l.append(ledgerLine{Payout: &entry})
+}
+
+// begin marks block as where the chain's ledger starts, unless an earlier
+// run already did
+func (l *payoutLedger) begin(chainID int64, block uint64) {
+	start := ledgerStart{ChainID: chainID, Block: block, At: time.Now().UTC()}
+	data, err := json.Marshal(start)
+	if err != nil {
+		return
+	}
+	ok, err := l.state.setNX(ledgerStartKey(chainID), data, 0)
+	if err != nil {
+		log.Printf("⚠️ Failed to start payout ledger for chain %d: %v", chainID, err)
+		return
+	}
+	if ok {
+		l.append(ledgerLine{Start: &start})
+	}
+}
+
+// start returns where the chain's ledger starts; ok is false if it has none
+func (l *payoutLedger) start(chainID int64) (ledgerStart, bool, error) {
+	data, ok, err := l.state.get(ledgerStartKey(chainID))
+	if err != nil || !ok {
+		return ledgerStart{}, false, err
+	}
+	var start ledgerStart
+	if err := json.Unmarshal(data, &start); err != nil {
+		return ledgerStart{}, false, fmt.Errorf("corrupt ledger start for chain %d: %w", chainID, err)
+	}
+	return start, true, nil
+}
+
+// entries returns the chain's ledger, oldest block first
+func (l *payoutLedger) entries(chainID int64) ([]LedgerEntry, error) {
+	all, err := l.state.hgetall(ledgerKey(chainID))
+	if err != nil {
+		return nil, err
+	}
+	list := make([]LedgerEntry, 0, len(all))
+	for field, data := range all {
+		var entry LedgerEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("⚠️ Skipping corrupt ledger entry %s: %v", field, err)
+			continue
+		}
+		list = append(list, entry)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Block < list[j].Block })
+	return list, nil
+}
+
+// prune drops the chain's entries past earningsRetention from shared state
+func (l *payoutLedger) prune(chainID int64, now time.Time) error {
+	all, err := l.state.hgetall(ledgerKey(chainID))
+	if err != nil {
+		return err
+	}
+	cutoff := now.Add(-earningsRetention)
+	for field, data := range all {
+		var entry LedgerEntry
+		if json.Unmarshal(data, &entry) == nil && entry.ConfirmedAt.Before(cutoff) {
+			if err := l.state.hdel(ledgerKey(chainID), field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
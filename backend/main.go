@@ -3,42 +3,69 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"log"
 	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
 )
 
-// Config holds application configuration
-type Config struct {
-	RPCEndpoint        string `json:"rpc_endpoint"`
-	ContractAddress    string `json:"contract_address"`
-	SignerPrivateKey   string `json:"signer_private_key"`
-	HTTPPort           string `json:"http_port"`
-	RewardPerHeartbeat int64  `json:"reward_per_heartbeat"` // Wei
-}
-
 // Server is the main application server
 type Server struct {
 	config       *Config
-	blockchain   *BlockchainClient
+	configMux    sync.RWMutex
+	loader       *configLoader
+	chains       *chainRegistry
 	router       *mux.Router
 	upgrader     websocket.Upgrader
-	clients      map[*websocket.Conn]*ClientSession
+	clients      map[*wsClient]bool
+	connsPerIP   map[string]int
 	clientsMux   sync.RWMutex
 	blockUpdates chan *BlockInfo
 	rewardQueue  chan *RewardRequest
+	rewards      *rewardStore
+	earnings     *earningsLedger
+	ledger       *payoutLedger
+	audit        *auditLog
+	leaderboard  *leaderboard
+	campaigns    *campaignStore
+	sessions     *sessionStore
+	pricing      *pricingEngine
+	referrals    *referralStore
+	events       *eventHub
 	stats        *ServerStats
 	statsMux     sync.RWMutex
+	reconcileMux sync.Mutex    // one reconciliation at a time
+	reconcileNow chan struct{} // requested reconciliations, run by reconciliationLoop
+
+	// Shutdown state: draining refuses new heartbeats, queueClosed refuses
+	// new rewards, workersDone is closed when the reward workers have exited
+	draining    atomic.Bool
+	queueClosed bool
+	queueMux    sync.RWMutex
+	workersDone chan struct{}
+
+	// Cluster state: replicas share state, and only the leader pulls
+	// rewards from the shared queue and signs transactions
+	state      sharedState
+	replicaID  string
+	leaseUntil atomic.Int64 // unix nanoseconds; this replica leads until then
+	leading    bool         // whether the last cluster tick saw this replica lead
+	resigned   bool         // set by shutdown once the lease is given up
+	clusterMux sync.Mutex   // guards leading and resigned
+	pumpWake   chan struct{}
+	results    map[string]pendingResult // reward ID → connection awaiting its result
+	resultsMux sync.Mutex
 }
 
 // ClientSession tracks a connected client
@@ -47,6 +74,9 @@ type ClientSession struct {
 	Heartbeats    int64
 	TotalEarned   *big.Int
 	ConnectedAt   time.Time
+
+	// Guards Heartbeats and TotalEarned, which settlement workers update
+	mu sync.Mutex
 }
 
 // ServerStats tracks server-wide statistics
@@ -54,16 +84,21 @@ type ServerStats struct {
 	TotalHeartbeats   int64
 	TotalRewards      *big.Int
 	ActiveConnections int
-	BlockHeight       uint64
+	BlockHeight       uint64 // default chain
 	LastBlockTime     time.Time
+	LatestBlocks      map[int64]*BlockInfo // by chain ID
 }
 
-// RewardRequest represents a pending reward
+// RewardRequest represents a pending reward, as held in the shared queue
 type RewardRequest struct {
-	WalletAddress string
-	Amount        *big.Int
-	Heartbeats    int64
-	Timestamp     time.Time
+	ID            string      `json:"id"`
+	ChainID       int64       `json:"chain_id"`
+	WalletAddress string      `json:"wallet_address"`
+	AdID          string      `json:"ad_id,omitempty"`
+	Amount        *big.Int    `json:"amount"`
+	Heartbeats    int64       `json:"heartbeats"`
+	Timestamp     time.Time   `json:"timestamp"`
+	ClaimID       common.Hash `json:"claim_id"` // zero: derived from ID at submission
 }
 
 // API Response types
@@ -77,27 +112,77 @@ type HeartbeatRequest struct {
 	WalletAddress string `json:"wallet_address"`
 	AdID          string `json:"ad_id"`
 	Duration      int    `json:"duration_ms"`
+	ChainID       int64  `json:"chain_id,omitempty"` // 0 routes to the default chain
+	SessionID     string `json:"session_id,omitempty"`
 }
 
 type HeartbeatResponse struct {
-	Success    bool   `json:"success"`
-	RewardWei  string `json:"reward_wei"`
-	TxHash     string `json:"tx_hash,omitempty"`
-	Message    string `json:"message"`
-	NewBalance string `json:"new_balance,omitempty"`
+	Success    bool          `json:"success"`
+	RewardID   string        `json:"reward_id,omitempty"`
+	ChainID    int64         `json:"chain_id,omitempty"`
+	Status     RewardStatus  `json:"status,omitempty"`
+	RewardWei  string        `json:"reward_wei"`
+	TxHash     string        `json:"tx_hash,omitempty"`
+	Message    string        `json:"message"`
+	NewBalance string        `json:"new_balance,omitempty"`
+	Pricing    []AppliedRule `json:"pricing,omitempty"`
 }
 
 type StatsResponse struct {
-	TreasuryBalance    string `json:"treasury_balance"`
-	TreasuryBalanceWei string `json:"treasury_balance_wei"`
-	TotalDistributed   string `json:"total_distributed"`
+	TreasuryBalance    string       `json:"treasury_balance"`
+	TreasuryBalanceWei string       `json:"treasury_balance_wei"`
+	TotalDistributed   string       `json:"total_distributed"`
+	TotalClaims        int64        `json:"total_claims"`
+	CurrentBlockHeight uint64       `json:"current_block_height"`
+	ActiveConnections  int          `json:"active_connections"` // across all replicas
+	RewardPerHeartbeat string       `json:"reward_per_heartbeat"`
+	Chains             []ChainStats `json:"chains"`
+	Cluster            ClusterStats `json:"cluster"`
+}
+
+// ChainStats is the per-chain part of /api/stats
+type ChainStats struct {
+	ChainID            int64  `json:"chain_id"`
+	Network            string `json:"network"`
+	ContractAddress    string `json:"contract_address,omitempty"`
+	Connected          bool   `json:"connected"`
+	TreasuryBalance    string `json:"treasury_balance,omitempty"`
+	TreasuryBalanceWei string `json:"treasury_balance_wei,omitempty"`
+	TotalDistributed   string `json:"total_distributed,omitempty"`
 	TotalClaims        int64  `json:"total_claims"`
 	CurrentBlockHeight uint64 `json:"current_block_height"`
-	ActiveConnections  int    `json:"active_connections"`
+	Error              string `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status     string          `json:"status"` // "ok", "degraded" or "draining"
+	Blockchain bool            `json:"blockchain"`
+	Chains     map[string]bool `json:"chains"` // connectivity by chain ID
+	ReplicaID  string          `json:"replica_id"`
+	Leader     bool            `json:"leader"` // whether this replica signs settlement transactions
+	Timestamp  int64           `json:"timestamp"`
+}
+
+type TreasuryResponse struct {
+	ChainID            int64  `json:"chain_id"`
+	Network            string `json:"network"`
+	ContractAddress    string `json:"contract_address"`
+	Balance            string `json:"balance"`
+	BalanceWei         string `json:"balance_wei"`
+	TotalDistributed   string `json:"total_distributed"`
+	TotalClaims        int64  `json:"total_claims"`
 	RewardPerHeartbeat string `json:"reward_per_heartbeat"`
 }
 
+type EarningsResponse struct {
+	ChainID     int64  `json:"chain_id"`
+	Address     string `json:"address"`
+	Earnings    string `json:"earnings"`
+	EarningsWei string `json:"earnings_wei"`
+}
+
 type BlockInfo struct {
+	ChainID   int64     `json:"chain_id"`
 	Number    uint64    `json:"number"`
 	Hash      string    `json:"hash"`
 	Timestamp time.Time `json:"timestamp"`
@@ -108,41 +193,63 @@ func main() {
 	log.Println("🚀 Starting ChainPay Watch-to-Earn Backend...")
 
 	// Load configuration
-	config := loadConfig()
+	opts, err := parseFlags(os.Args[1:])
+	if err != nil {
+		os.Exit(2)
+	}
 
-	// Initialize blockchain client
-	blockchain, err := NewBlockchainClient(config)
+	config, err := opts.loader.load()
+	if err != nil {
+		log.Fatalf("❌ Invalid configuration: %v", err)
+	}
+
+	if opts.printConfig {
+		if err := printConfig(os.Stdout, config); err != nil {
+			log.Fatalf("❌ Failed to print configuration: %v", err)
+		}
+		return
+	}
+
+	if err := config.makeDataDir(); err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+
+	if opts.reconcile {
+		ok, err := runReconcile(config, os.Stdout, opts.jsonOutput)
+		if err != nil {
+			log.Fatalf("❌ Reconciliation failed: %v", err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Connect to every configured chain
+	chains, err := connectChains(config)
 	if err != nil {
 		log.Fatalf("❌ Failed to connect to blockchain: %v", err)
 	}
-	defer blockchain.Close()
+	defer chains.Close()
 
-	// Create server
-	server := &Server{
-		config:     config,
-		blockchain: blockchain,
-		router:     mux.NewRouter(),
-		upgrader: websocket.Upgrader{
-			CheckOrigin: func(r *http.Request) bool { return true },
-		},
-		clients:      make(map[*websocket.Conn]*ClientSession),
-		blockUpdates: make(chan *BlockInfo, 100),
-		rewardQueue:  make(chan *RewardRequest, 1000),
-		stats: &ServerStats{
-			TotalRewards: big.NewInt(0),
-		},
+	state, err := openSharedState(config)
+	if err != nil {
+		log.Fatalf("❌ Failed to connect to shared state: %v", err)
 	}
+	defer state.close()
 
-	// Setup routes
-	server.setupRoutes()
+	server, err := newServer(config, opts.loader, chains, state)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	if state.durable() {
+		log.Printf("🔗 Replica %s sharing state through Redis (leader: %v)", server.replicaID, server.isLeader())
+	}
 
 	// Start background workers
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-
-	go server.blockMonitor(ctx)
-	go server.rewardProcessor(ctx)
-	go server.broadcastUpdates(ctx)
+	server.start(ctx)
 
 	// Setup HTTP server with CORS
 	c := cors.New(cors.Options{
@@ -168,123 +275,194 @@ func main() {
 		}
 	}()
 
+	// Reload non-critical settings on SIGHUP
+	server.reloadOnSIGHUP(ctx)
+
 	// Wait for shutdown signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	<-sigChan
 
-	log.Println("🛑 Shutting down server...")
-	cancel()
+	server.shutdown(httpServer, cancel)
+	log.Println("👋 Server stopped")
+}
 
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
-	defer shutdownCancel()
+// newServer builds a server on connected chains and shared state, resumes
+// rewards saved at the last shutdown and joins the cluster
+func newServer(config *Config, loader *configLoader, chains *chainRegistry, state sharedState) (*Server, error) {
+	leaderboard, err := newLeaderboard(state, config.LeaderboardOptOutFile)
+	if err != nil {
+		return nil, err
+	}
+	referrals, err := newReferralStore(state, config.ReferralFile)
+	if err != nil {
+		return nil, err
+	}
+	ledger, err := newPayoutLedger(state, config.PayoutLedgerFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := ledger.compact(time.Now()); err != nil {
+		log.Printf("⚠️ %v", err)
+	}
 
-	if err := httpServer.Shutdown(shutdownCtx); err != nil {
-		log.Printf("⚠️ HTTP shutdown error: %v", err)
+	replicaID := config.ReplicaID
+	if replicaID == "" {
+		replicaID = newReplicaID()
+	}
+	audit, err := newAuditLog(config.AuditLogFile, replicaID, config.AuditHMACKey)
+	if err != nil {
+		return nil, err
 	}
 
-	log.Println("👋 Server stopped")
-}
+	server := &Server{
+		config: config,
+		loader: loader,
+		chains: chains,
+		router: mux.NewRouter(),
+		upgrader: websocket.Upgrader{
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+		clients:      make(map[*wsClient]bool),
+		connsPerIP:   make(map[string]int),
+		blockUpdates: make(chan *BlockInfo, 100),
+		rewardQueue:  make(chan *RewardRequest, 1000),
+		workersDone:  make(chan struct{}),
+		reconcileNow: make(chan struct{}, 1),
+		rewards:      newRewardStore(state),
+		earnings:     newEarningsLedger(state),
+		ledger:       ledger,
+		audit:        audit,
+		leaderboard:  leaderboard,
+		campaigns:    newCampaignStore(state),
+		sessions:     newSessionStore(state),
+		pricing:      newPricingEngine(state),
+		referrals:    referrals,
+		events:       newEventHub(),
+		stats: &ServerStats{
+			TotalRewards: big.NewInt(0),
+			LatestBlocks: make(map[int64]*BlockInfo),
+		},
+		state:     state,
+		replicaID: replicaID,
+		pumpWake:  make(chan struct{}, 1),
+		results:   make(map[string]pendingResult),
+	}
+
+	for _, bc := range chains.all() {
+		for _, call := range bc.ownerCalls {
+			audit.record(AuditRecord{
+				Time:      call.at,
+				Action:    AuditContractCall,
+				Actor:     "replica:" + replicaID,
+				Trigger:   "startup",
+				ChainID:   bc.ChainID(),
+				TxHash:    call.txHash,
+				AmountWei: call.value.String(),
+				Detail:    call.detail,
+			})
+		}
+	}
 
-func loadConfig() *Config {
-	// Default configuration for local development
-	config := &Config{
-		RPCEndpoint:        "http://127.0.0.1:8545",
-		ContractAddress:    "",                                                                   // Will be loaded from deployment
-		SignerPrivateKey:   "0x59c6995e998f97a5a0044966f0945389dc9e86dae88c7a8412f4603b6b78690d", // Hardhat account #1
-		HTTPPort:           "8080",
-		RewardPerHeartbeat: 1000, // 1000 wei per heartbeat
-	}
-
-	// Try to load contract address from deployment file
-	deploymentFile := "../blockchain/deployments/localhost.json"
-	if data, err := os.ReadFile(deploymentFile); err == nil {
-		var deployment struct {
-			Contracts struct {
-				RewardTreasury struct {
-					Address string `json:"address"`
-				} `json:"RewardTreasury"`
-			} `json:"contracts"`
-			Accounts struct {
-				RewardSignerPrivateKey string `json:"rewardSignerPrivateKey"`
-			} `json:"accounts"`
+	// Before start subscribes to cluster events, so none are counted twice
+	for _, bc := range chains.all() {
+		heartbeats, payouts, err := server.earnings.loadHistory(bc.ChainID(), bc.ContractAddress(), time.Now())
+		if err != nil {
+			return nil, err
 		}
-		if err := json.Unmarshal(data, &deployment); err == nil {
-			if deployment.Contracts.RewardTreasury.Address != "" {
-				config.ContractAddress = deployment.Contracts.RewardTreasury.Address
-				log.Printf("📄 Loaded contract address: %s", config.ContractAddress)
-			}
-			if deployment.Accounts.RewardSignerPrivateKey != "" {
-				config.SignerPrivateKey = deployment.Accounts.RewardSignerPrivateKey
-			}
+		if heartbeats > 0 || payouts > 0 {
+			log.Printf("📒 Loaded %d heartbeats and %d payouts of chain %d from shared state", heartbeats, payouts, bc.ChainID())
 		}
 	}
 
-	// Override with environment variables if set
-	if rpc := os.Getenv("RPC_ENDPOINT"); rpc != "" {
-		config.RPCEndpoint = rpc
-	}
-	if addr := os.Getenv("CONTRACT_ADDRESS"); addr != "" {
-		config.ContractAddress = addr
-	}
-	if key := os.Getenv("SIGNER_PRIVATE_KEY"); key != "" {
-		config.SignerPrivateKey = key
-	}
-	if port := os.Getenv("HTTP_PORT"); port != "" {
-		config.HTTPPort = port
+	if err := server.resumePendingRewards(config.PendingRewardsFile); err != nil {
+		return nil, err
 	}
 
-	return config
+	// Join the cluster, leading at once if no other replica does
+	server.clusterTick()
+
+	// Setup routes
+	server.setupRoutes()
+	server.registerServerMetrics()
+
+	return server, nil
+}
+
+// start runs the background workers until ctx is cancelled
+func (s *Server) start(ctx context.Context) {
+	for _, bc := range s.chains.all() {
+		go s.blockMonitor(ctx, bc)
+		go s.earningsIndexer(ctx, bc)
+	}
+	go s.rewardProcessor(ctx)
+	go s.rewardPump(ctx)
+	go s.clusterLoop(ctx)
+	go s.subscribeCluster(ctx)
+	go s.receiptWatcher(ctx)
+	go s.broadcastUpdates(ctx)
+	go s.leaderboardUpdater(ctx)
+	go s.referralSettler(ctx)
+	go s.reconciliationLoop(ctx)
 }
 
 func (s *Server) setupRoutes() {
-	// API routes
-	api := s.router.PathPrefix("/api").Subrouter()
+	// Operator endpoints, ahead of the /api aliases that would swallow them
+	s.mountAdmin()
 
-	api.HandleFunc("/health", s.handleHealth).Methods("GET")
-	api.HandleFunc("/stats", s.handleStats).Methods("GET")
-	api.HandleFunc("/balance/{address}", s.handleBalance).Methods("GET")
-	api.HandleFunc("/heartbeat", s.handleHeartbeat).Methods("POST")
-	api.HandleFunc("/treasury", s.handleTreasury).Methods("GET")
-	api.HandleFunc("/block/latest", s.handleLatestBlock).Methods("GET")
-	api.HandleFunc("/user/{address}/earnings", s.handleUserEarnings).Methods("GET")
+	// REST API, one subrouter per version
+	s.mountAPI()
 
 	// WebSocket for real-time updates
 	s.router.HandleFunc("/ws", s.handleWebSocket)
 
+	// Prometheus scrape endpoint
+	s.router.HandleFunc("/metrics", s.handleMetrics).Methods("GET")
+
 	log.Println("📍 API routes configured")
 }
 
 // handleHealth returns server health status
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
-	connected := s.blockchain.IsConnected()
-	status := map[string]interface{}{
-		"status":     "ok",
-		"blockchain": connected,
-		"timestamp":  time.Now().Unix(),
+	status := HealthResponse{
+		Status:     "ok",
+		Blockchain: true,
+		Chains:     make(map[string]bool),
+		ReplicaID:  s.replicaID,
+		Leader:     s.isLeader(),
+		Timestamp:  time.Now().Unix(),
+	}
+	for _, bc := range s.chains.all() {
+		ok := bc.IsConnected()
+		status.Chains[strconv.FormatInt(bc.ChainID(), 10)] = ok
+		status.Blockchain = status.Blockchain && ok
 	}
 
-	if !connected {
-		status["status"] = "degraded"
+	if !status.Blockchain {
+		status.Status = "degraded"
 	}
 
 	w.Header().Set("Content-Type", "application/json")
+	if s.draining.Load() {
+		// Tell load balancers to stop routing here while rewards drain
+		status.Status = "draining"
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
 	json.NewEncoder(w).Encode(status)
 }
 
-// handleStats returns server and blockchain statistics
+// handleStats returns server and blockchain statistics. Top-level treasury
+// figures are for the default chain; chains lists every chain served.
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
-	stats, err := s.blockchain.GetContractStats()
+	primary := s.chains.primary()
+	stats, err := primary.GetContractStats()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get stats: %v", err), http.StatusInternalServerError)
+		writeError(w, asAPIError(err, CodeRPCUnavailable))
 		return
 	}
 
-	s.clientsMux.RLock()
-	activeConns := len(s.clients)
-	s.clientsMux.RUnlock()
-
-	blockNum, _ := s.blockchain.GetBlockNumber()
+	activeConns, _, _ := s.clusterTotals()
+	blockNum, _ := primary.GetBlockNumber()
 
 	response := StatsResponse{
 		TreasuryBalance:    weiToEther(stats.Balance),
@@ -293,21 +471,60 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		TotalClaims:        stats.TotalClaims,
 		CurrentBlockHeight: blockNum,
 		ActiveConnections:  activeConns,
-		RewardPerHeartbeat: big.NewInt(s.config.RewardPerHeartbeat).String(),
+		RewardPerHeartbeat: big.NewInt(s.cfg().RewardPerHeartbeat).String(),
+		Cluster:            s.clusterStats(),
+	}
+
+	for _, bc := range s.chains.all() {
+		response.Chains = append(response.Chains, s.chainStats(bc))
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
+// chainStats collects treasury figures for one chain; errors are reported
+// inline so one unreachable chain doesn't fail the whole response
+func (s *Server) chainStats(bc *BlockchainClient) ChainStats {
+	cs := ChainStats{
+		ChainID:         bc.ChainID(),
+		Network:         bc.Network(),
+		ContractAddress: bc.ContractAddress(),
+	}
+
+	s.statsMux.RLock()
+	if block := s.stats.LatestBlocks[cs.ChainID]; block != nil {
+		cs.CurrentBlockHeight = block.Number
+	}
+	s.statsMux.RUnlock()
+
+	stats, err := bc.GetContractStats()
+	if err != nil {
+		cs.Error = err.Error()
+		return cs
+	}
+
+	cs.Connected = true
+	cs.TreasuryBalance = weiToEther(stats.Balance)
+	cs.TreasuryBalanceWei = stats.Balance.String()
+	cs.TotalDistributed = weiToEther(stats.TotalDistributed)
+	cs.TotalClaims = stats.TotalClaims
+	return cs
+}
+
 // handleBalance returns the ETH balance of an address
 func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	address := vars["address"]
 
-	balance, err := s.blockchain.GetBalance(address)
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	balance, err := bc.GetBalance(address)
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get balance: %v", err), http.StatusBadRequest)
+		writeError(w, asAPIError(err, CodeRPCUnavailable))
 		return
 	}
 
@@ -321,79 +538,70 @@ func (s *Server) handleBalance(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
-// handleHeartbeat processes an ad-view heartbeat and triggers reward
+// handleHeartbeat accepts an ad-view heartbeat and queues its reward.
+// Settlement happens in the background; poll /api/v1/reward/{id} or listen on
+// the rewards:{address} WebSocket topic for the outcome.
 func (s *Server) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
 	var req HeartbeatRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		writeError(w, newAPIError(CodeInvalidRequest, "invalid request body", err))
 		return
 	}
 
 	if req.WalletAddress == "" {
-		http.Error(w, "Wallet address required", http.StatusBadRequest)
+		writeError(w, newAPIError(CodeInvalidAddress, "wallet address required", nil))
 		return
 	}
 
-	// Calculate reward
-	rewardWei := big.NewInt(s.config.RewardPerHeartbeat)
-
-	// Process reward on blockchain
-	txHash, err := s.blockchain.ProcessReward(req.WalletAddress, rewardWei)
+	rec, err := s.acceptHeartbeat(heartbeat{
+		wallet:     req.WalletAddress,
+		adID:       req.AdID,
+		chainID:    req.ChainID,
+		durationMs: int64(req.Duration),
+		sessionID:  req.SessionID,
+	})
 	if err != nil {
-		log.Printf("⚠️ Failed to process reward for %s: %v", req.WalletAddress, err)
-
-		response := HeartbeatResponse{
-			Success:   false,
-			RewardWei: rewardWei.String(),
-			Message:   fmt.Sprintf("Reward queued but transaction failed: %v", err),
-		}
-		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(response)
+		writeError(w, asAPIError(err, CodeInternal))
 		return
 	}
 
-	// Get new balance
-	newBalance, _ := s.blockchain.GetBalance(req.WalletAddress)
-	newBalanceStr := ""
-	if newBalance != nil {
-		newBalanceStr = weiToEther(newBalance)
-	}
-
-	// Update stats
-	s.statsMux.Lock()
-	s.stats.TotalHeartbeats++
-	s.stats.TotalRewards.Add(s.stats.TotalRewards, rewardWei)
-	s.statsMux.Unlock()
-
 	response := HeartbeatResponse{
-		Success:    true,
-		RewardWei:  rewardWei.String(),
-		TxHash:     txHash,
-		Message:    "Reward processed successfully",
-		NewBalance: newBalanceStr,
+		Success:   true,
+		RewardID:  rec.ID,
+		ChainID:   rec.ChainID,
+		Status:    rec.Status,
+		RewardWei: rec.RewardWei,
+		Message:   "Heartbeat accepted, reward queued for settlement",
+		Pricing:   rec.Pricing,
 	}
 
-	log.Printf("💰 Reward sent: %s wei to %s (tx: %s)", rewardWei.String(), req.WalletAddress[:10]+"...", txHash[:16]+"...")
-
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(response)
 }
 
 // handleTreasury returns treasury contract info
 func (s *Server) handleTreasury(w http.ResponseWriter, r *http.Request) {
-	stats, err := s.blockchain.GetContractStats()
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	stats, err := bc.GetContractStats()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get treasury info: %v", err), http.StatusInternalServerError)
+		writeError(w, asAPIError(err, CodeRPCUnavailable))
 		return
 	}
 
-	response := map[string]interface{}{
-		"contract_address":     s.config.ContractAddress,
-		"balance":              weiToEther(stats.Balance),
-		"balance_wei":          stats.Balance.String(),
-		"total_distributed":    weiToEther(stats.TotalDistributed),
-		"total_claims":         stats.TotalClaims,
-		"reward_per_heartbeat": stats.RewardRate.String(),
+	response := TreasuryResponse{
+		ChainID:            bc.ChainID(),
+		Network:            bc.Network(),
+		ContractAddress:    bc.ContractAddress(),
+		Balance:            weiToEther(stats.Balance),
+		BalanceWei:         stats.Balance.String(),
+		TotalDistributed:   weiToEther(stats.TotalDistributed),
+		TotalClaims:        stats.TotalClaims,
+		RewardPerHeartbeat: stats.RewardRate.String(),
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -402,9 +610,14 @@ func (s *Server) handleTreasury(w http.ResponseWriter, r *http.Request) {
 
 // handleLatestBlock returns the latest block info
 func (s *Server) handleLatestBlock(w http.ResponseWriter, r *http.Request) {
-	block, err := s.blockchain.GetLatestBlock()
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	block, err := bc.GetLatestBlock()
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get block: %v", err), http.StatusInternalServerError)
+		writeError(w, asAPIError(err, CodeRPCUnavailable))
 		return
 	}
 
@@ -417,185 +630,80 @@ func (s *Server) handleUserEarnings(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	address := vars["address"]
 
-	earnings, err := s.blockchain.GetUserEarnings(address)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to get earnings: %v", err), http.StatusInternalServerError)
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
 		return
 	}
 
-	response := map[string]interface{}{
-		"address":      address,
-		"earnings":     weiToEther(earnings),
-		"earnings_wei": earnings.String(),
-	}
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
-}
-
-// handleWebSocket handles WebSocket connections for real-time updates
-func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
-	conn, err := s.upgrader.Upgrade(w, r, nil)
+	earnings, err := bc.GetUserEarnings(address)
 	if err != nil {
-		log.Printf("❌ WebSocket upgrade failed: %v", err)
+		writeError(w, asAPIError(err, CodeRPCUnavailable))
 		return
 	}
 
-	session := &ClientSession{
-		TotalEarned: big.NewInt(0),
-		ConnectedAt: time.Now(),
-	}
-
-	s.clientsMux.Lock()
-	s.clients[conn] = session
-	s.clientsMux.Unlock()
-
-	log.Printf("🔗 New WebSocket connection (total: %d)", len(s.clients))
-
-	// Send welcome message
-	welcome := map[string]interface{}{
-		"type":    "connected",
-		"message": "Connected to ChainPay Watch-to-Earn",
-		"config": map[string]interface{}{
-			"reward_per_heartbeat": s.config.RewardPerHeartbeat,
-			"contract_address":     s.config.ContractAddress,
-		},
+	response := EarningsResponse{
+		ChainID:     bc.ChainID(),
+		Address:     address,
+		Earnings:    weiToEther(earnings),
+		EarningsWei: earnings.String(),
 	}
-	conn.WriteJSON(welcome)
 
-	// Handle incoming messages
-	go s.handleWSMessages(conn, session)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-func (s *Server) handleWSMessages(conn *websocket.Conn, session *ClientSession) {
-	defer func() {
-		s.clientsMux.Lock()
-		delete(s.clients, conn)
-		s.clientsMux.Unlock()
-		conn.Close()
-		log.Printf("🔌 WebSocket disconnected (remaining: %d)", len(s.clients))
-	}()
-
-	for {
-		var msg map[string]interface{}
-		err := conn.ReadJSON(&msg)
-		if err != nil {
-			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("⚠️ WebSocket error: %v", err)
-			}
-			break
-		}
-
-		// Handle different message types
-		switch msg["type"] {
-		case "register":
-			if addr, ok := msg["wallet_address"].(string); ok {
-				session.WalletAddress = addr
-				log.Printf("📝 Registered wallet: %s", addr[:10]+"...")
-			}
-
-		case "heartbeat":
-			if session.WalletAddress != "" {
-				session.Heartbeats++
-				rewardWei := big.NewInt(s.config.RewardPerHeartbeat)
-
-				txHash, err := s.blockchain.ProcessReward(session.WalletAddress, rewardWei)
-
-				response := map[string]interface{}{
-					"type":       "reward",
-					"success":    err == nil,
-					"reward_wei": rewardWei.String(),
-					"tx_hash":    txHash,
-					"heartbeats": session.Heartbeats,
-				}
-
-				if err == nil {
-					session.TotalEarned.Add(session.TotalEarned, rewardWei)
-					response["total_earned"] = session.TotalEarned.String()
-
-					// Get updated balance
-					if balance, err := s.blockchain.GetBalance(session.WalletAddress); err == nil {
-						response["balance"] = weiToEther(balance)
-						response["balance_wei"] = balance.String()
-					}
-				} else {
-					response["error"] = err.Error()
-				}
-
-				conn.WriteJSON(response)
-			}
-
-		case "ping":
-			conn.WriteJSON(map[string]string{"type": "pong"})
-		}
-	}
-}
+// blockMonitor watches for new blocks on one chain
+func (s *Server) blockMonitor(ctx context.Context, bc *BlockchainClient) {
+	chainLabel := strconv.FormatInt(bc.ChainID(), 10)
+	isPrimary := bc == s.chains.primary()
 
-// blockMonitor watches for new blocks
-func (s *Server) blockMonitor(ctx context.Context) {
 	ticker := time.NewTicker(2 * time.Second)
 	defer ticker.Stop()
 
 	var lastBlock uint64
+	var lastBlockTime time.Time
+	var lastBalanceCheck time.Time
 
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			block, err := s.blockchain.GetLatestBlock()
+			// Lag keeps growing while the node is unreachable
+			if !lastBlockTime.IsZero() {
+				metricBlockLag.Set(time.Since(lastBlockTime).Seconds(), chainLabel)
+			}
+
+			block, err := bc.GetLatestBlock()
 			if err != nil {
 				continue
 			}
 
 			if block.Number > lastBlock {
 				lastBlock = block.Number
-				s.blockUpdates <- block
+				lastBlockTime = block.Timestamp
+				// The broadcaster stops with ctx, so don't wait on it after
+				select {
+				case s.blockUpdates <- block:
+				case <-ctx.Done():
+					return
+				}
 
 				s.statsMux.Lock()
-				s.stats.BlockHeight = block.Number
-				s.stats.LastBlockTime = block.Timestamp
+				s.stats.LatestBlocks[block.ChainID] = block
+				if isPrimary {
+					s.stats.BlockHeight = block.Number
+					s.stats.LastBlockTime = block.Timestamp
+				}
 				s.statsMux.Unlock()
-			}
-		}
-	}
-}
-
-// rewardProcessor handles queued rewards
-func (s *Server) rewardProcessor(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case req := <-s.rewardQueue:
-			_, err := s.blockchain.ProcessReward(req.WalletAddress, req.Amount)
-			if err != nil {
-				log.Printf("⚠️ Failed to process queued reward: %v", err)
-			}
-		}
-	}
-}
 
-// broadcastUpdates sends block updates to all WebSocket clients
-func (s *Server) broadcastUpdates(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case block := <-s.blockUpdates:
-			msg := map[string]interface{}{
-				"type":      "block",
-				"number":    block.Number,
-				"hash":      block.Hash,
-				"timestamp": block.Timestamp.Unix(),
-				"tx_count":  block.TxCount,
+				metricBlockHeight.Set(float64(block.Number), chainLabel)
 			}
 
-			s.clientsMux.RLock()
-			for conn := range s.clients {
-				conn.WriteJSON(msg)
+			if time.Since(lastBalanceCheck) >= balanceMetricsInterval {
+				lastBalanceCheck = time.Now()
+				s.refreshBalanceMetrics(bc)
 			}
-			s.clientsMux.RUnlock()
 		}
 	}
 }
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A deliberately small Prometheus text-format implementation: counters,
+// gauges and histograms with labels, which is all /metrics needs.
+
+// How often treasury and signer balances are sampled for /metrics
+const balanceMetricsInterval = 15 * time.Second
+
+// Default latency buckets in seconds, from fast RPC reads to slow tx submission
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metric is anything the registry can render
+type metric interface {
+	name() string
+	write(w io.Writer)
+}
+
+// metricsRegistry holds every exported metric in registration order
+type metricsRegistry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// metrics is the process-wide registry served on /metrics
+var metrics = &metricsRegistry{}
+
+// register adds m, replacing any metric previously registered under the same name
+func (r *metricsRegistry) register(m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i, existing := range r.metrics {
+		if existing.name() == m.name() {
+			r.metrics[i] = m
+			return
+		}
+	}
+	r.metrics = append(r.metrics, m)
+}
+
+// writeTo renders every metric in Prometheus text exposition format
+func (r *metricsRegistry) writeTo(w io.Writer) {
+	r.mu.Lock()
+	list := make([]metric, len(r.metrics))
+	copy(list, r.metrics)
+	r.mu.Unlock()
+
+	for _, m := range list {
+		m.write(w)
+	}
+}
+
+// labelSet is the ordered label values of one series
+type labelSet []string
+
+func (l labelSet) key() string {
+	return strings.Join(l, "\xff")
+}
+
+// formatLabels renders {name="value",...} for a series
+func formatLabels(names []string, values labelSet, extra ...string) string {
+	if len(names) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(names)+len(extra)/2)
+	for i, n := range names {
+		parts = append(parts, n+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		parts = append(parts, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// Escaping of the text format: label values escape backslash, double quote
+// and newline, HELP text only backslash and newline. Go's %q escapes more,
+// and Prometheus rejects those escapes.
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// formatValue renders a sample value the way Prometheus expects
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return fmt.Sprintf("%g", v)
+}
+
+// sortedKeys returns series keys in a stable order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// scalarVec is a labelled counter or gauge
+type scalarVec struct {
+	metricName string
+	help       string
+	kind       string
+	labels     []string
+
+	mu     sync.Mutex
+	series map[string]*scalarSeries
+}
+
+type scalarSeries struct {
+	values labelSet
+	value  float64
+}
+
+// newCounter registers a counter; pass label names for a labelled counter
+func newCounter(name, help string, labels ...string) *scalarVec {
+	return newScalar(name, help, "counter", labels)
+}
+
+// newGauge registers a gauge; pass label names for a labelled gauge
+func newGauge(name, help string, labels ...string) *scalarVec {
+	return newScalar(name, help, "gauge", labels)
+}
+
+func newScalar(name, help, kind string, labels []string) *scalarVec {
+	v := &scalarVec{
+		metricName: name,
+		help:       help,
+		kind:       kind,
+		labels:     labels,
+		series:     make(map[string]*scalarSeries),
+	}
+	metrics.register(v)
+	return v
+}
+
+func (v *scalarVec) name() string { return v.metricName }
+
+// get returns the series for the label values, creating it on first use
+func (v *scalarVec) get(values []string) *scalarSeries {
+	ls := labelSet(values)
+	key := ls.key()
+
+	s, ok := v.series[key]
+	if !ok {
+		s = &scalarSeries{values: append(labelSet(nil), ls...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+// Inc adds one to the series identified by label values
+func (v *scalarVec) Inc(values ...string) {
+	v.Add(1, values...)
+}
+
+// Add adds delta to the series identified by label values
+func (v *scalarVec) Add(delta float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).value += delta
+}
+
+// Set overwrites a gauge series
+func (v *scalarVec) Set(value float64, values ...string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.get(values).value = value
+}
+
+func (v *scalarVec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.metricName, helpEscaper.Replace(v.help), v.metricName, v.kind)
+	if len(v.labels) == 0 && len(v.series) == 0 {
+		fmt.Fprintf(w, "%s 0\n", v.metricName)
+		return
+	}
+	for _, key := range sortedKeys(v.series) {
+		s := v.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.metricName, formatLabels(v.labels, s.values), formatValue(s.value))
+	}
+}
+
+// gaugeFunc is a gauge computed at scrape time
+type gaugeFunc struct {
+	metricName string
+	help       string
+	fn         func() float64
+}
+
+// newGaugeFunc registers a gauge whose value is read from fn on every scrape
+func newGaugeFunc(name, help string, fn func() float64) {
+	metrics.register(&gaugeFunc{metricName: name, help: help, fn: fn})
+}
+
+func (g *gaugeFunc) name() string { return g.metricName }
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.metricName, helpEscaper.Replace(g.help), g.metricName, g.metricName, formatValue(g.fn()))
+}
+
+// histogramVec is a labelled histogram with fixed buckets
+type histogramVec struct {
+	metricName string
+	help       string
+	labels     []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	values labelSet
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// newHistogram registers a histogram using defaultBuckets
+func newHistogram(name, help string, labels ...string) *histogramVec {
+	h := &histogramVec{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		buckets:    defaultBuckets,
+		series:     make(map[string]*histogramSeries),
+	}
+	metrics.register(h)
+	return h
+}
+
+func (h *histogramVec) name() string { return h.metricName }
+
+// Observe records a value for the series identified by label values
+func (h *histogramVec) Observe(value float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ls := labelSet(values)
+	key := ls.key()
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			values: append(labelSet(nil), ls...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += value
+	s.count++
+}
+
+// ObserveSince records the seconds elapsed since start
+func (h *histogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.metricName, helpEscaper.Replace(h.help), h.metricName)
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.values, "le", formatValue(upper)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, formatLabels(h.labels, s.values), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, formatLabels(h.labels, s.values), s.count)
+	}
+}
+
+// Application metrics
+var (
+	metricHeartbeatsAccepted = newCounter("chainpay_heartbeats_accepted_total",
+		"Heartbeats accepted and queued for settlement.")
+	metricHeartbeatsRejected = newCounter("chainpay_heartbeats_rejected_total",
+		"Heartbeats rejected before queueing, by reason.", "reason")
+	metricSessionsStarted = newCounter("chainpay_ad_sessions_started_total",
+		"Ad-view sessions started.")
+	metricSessionsEnded = newCounter("chainpay_ad_sessions_ended_total",
+		"Ad-view sessions finished, by outcome.", "outcome")
+
+	metricRewardsSent = newCounter("chainpay_rewards_sent_total",
+		"Reward transactions accepted by the node.")
+	metricRewardsFailed = newCounter("chainpay_rewards_failed_total",
+		"Rewards that failed to settle, by reason.", "reason")
+	metricRewardsConfirmed = newCounter("chainpay_rewards_confirmed_total",
+		"Reward transactions mined, by receipt status.", "status")
+	metricRewardWei = newCounter("chainpay_rewards_wei_total",
+		"Wei submitted as rewards.")
+
+	metricTxSubmission = newHistogram("chainpay_tx_submission_seconds",
+		"Time to build, sign and broadcast a reward transaction.")
+	metricGasUsed = newCounter("chainpay_gas_used_total",
+		"Gas used by mined reward transactions.")
+	metricGasSpentWei = newCounter("chainpay_gas_spent_wei_total",
+		"Wei paid in fees by mined reward transactions.")
+
+	metricRPCDuration = newHistogram("chainpay_rpc_duration_seconds",
+		"Latency of JSON-RPC calls to the Ethereum node, by method.", "method")
+	metricRPCErrors = newCounter("chainpay_rpc_errors_total",
+		"Failed JSON-RPC calls to the Ethereum node, by method.", "method")
+
+	metricBlockHeight = newGauge("chainpay_block_height",
+		"Latest block number seen by the block monitor, by chain.", "chain_id")
+	metricBlockLag = newGauge("chainpay_block_lag_seconds",
+		"Seconds since the timestamp of the latest block seen, by chain.", "chain_id")
+	metricTreasuryBalance = newGauge("chainpay_treasury_balance_wei",
+		"RewardTreasury contract balance in wei, by chain.", "chain_id")
+	metricSignerBalance = newGauge("chainpay_signer_balance_wei",
+		"Reward signer account balance in wei, by chain.", "chain_id")
+
+	metricReconciliationIssues = newGauge("chainpay_reconciliation_issues",
+		"Payout discrepancies found by the last reconciliation, by type.", "type")
+	metricReconciliationRun = newGauge("chainpay_reconciliation_last_run_timestamp_seconds",
+		"Unix time of the last payout reconciliation.")
+
+	metricAuditRecords = newCounter("chainpay_audit_records_total",
+		"Records appended to the audit log, by action.", "action")
+	metricAuditDropped = newCounter("chainpay_audit_records_dropped_total",
+		"Audit records that could not be written, by action.", "action")
+)
+
+// observeRPC times a JSON-RPC call; use as defer observeRPC("eth_call", &err)()
+func observeRPC(method string, err *error) func() {
+	start := time.Now()
+	return func() {
+		metricRPCDuration.ObserveSince(start, method)
+		if err != nil && *err != nil {
+			metricRPCErrors.Inc(method)
+		}
+	}
+}
+
+// registerServerMetrics exposes gauges derived from live server state
+func (s *Server) registerServerMetrics() {
+	newGaugeFunc("chainpay_websocket_sessions", "Open WebSocket connections.", func() float64 {
+		s.clientsMux.RLock()
+		defer s.clientsMux.RUnlock()
+		return float64(len(s.clients))
+	})
+	newGaugeFunc("chainpay_sse_streams", "Open Server-Sent Events streams.", func() float64 {
+		s.events.mu.Lock()
+		defer s.events.mu.Unlock()
+		return float64(len(s.events.subscribers))
+	})
+	newGaugeFunc("chainpay_reward_queue_depth", "Rewards waiting for a settlement worker.", func() float64 {
+		return float64(len(s.rewardQueue))
+	})
+	newGaugeFunc("chainpay_leader", "1 if this replica holds the leader lease and signs settlement transactions.", func() float64 {
+		if s.isLeader() {
+			return 1
+		}
+		return 0
+	})
+}
+
+// refreshBalanceMetrics updates the treasury and signer balance gauges of one chain
+func (s *Server) refreshBalanceMetrics(bc *BlockchainClient) {
+	chainLabel := strconv.FormatInt(bc.ChainID(), 10)
+	if stats, err := bc.GetContractStats(); err == nil && stats.Balance != nil {
+		f, _ := new(big.Float).SetInt(stats.Balance).Float64()
+		metricTreasuryBalance.Set(f, chainLabel)
+		if bc.ContractAddress() != "" {
+			s.pricing.setFunds(bc.ChainID(), stats.Balance)
+		}
+	}
+	if balance, err := bc.GetBalance(bc.SignerAddress()); err == nil {
+		f, _ := new(big.Float).SetInt(balance).Float64()
+		metricSignerBalance.Set(f, chainLabel)
+		if bc.ContractAddress() == "" {
+			s.pricing.setFunds(bc.ChainID(), balance)
+		}
+	}
+}
+
+// handleMetrics serves all metrics in Prometheus text format
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.writeTo(w)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// parseMetrics parses Prometheus text exposition with the reference parser
+func parseMetrics(t *testing.T, r io.Reader) map[string]*dto.MetricFamily {
+	t.Helper()
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(r)
+	if err != nil {
+		t.Fatalf("invalid exposition: %v", err)
+	}
+	return families
+}
+
+func TestMetricsExposition(t *testing.T) {
+	ts := newDemoServer(t, "", withTestAds)
+	waitConfirmed(t, ts, sendHeartbeat(t, ts, newWallet(t)))
+
+	resp, err := http.Get(ts.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	families := parseMetrics(t, resp.Body)
+
+	for name, want := range map[string]dto.MetricType{
+		"chainpay_heartbeats_accepted_total": dto.MetricType_COUNTER,
+		"chainpay_rewards_confirmed_total":   dto.MetricType_COUNTER,
+		"chainpay_block_height":              dto.MetricType_GAUGE,
+		"chainpay_websocket_sessions":        dto.MetricType_GAUGE,
+		"chainpay_tx_submission_seconds":     dto.MetricType_HISTOGRAM,
+		"chainpay_rpc_duration_seconds":      dto.MetricType_HISTOGRAM,
+	} {
+		mf, ok := families[name]
+		if !ok {
+			t.Errorf("%s missing", name)
+			continue
+		}
+		if mf.GetType() != want {
+			t.Errorf("%s is a %s, want %s", name, mf.GetType(), want)
+		}
+		if mf.GetHelp() == "" {
+			t.Errorf("%s has no help", name)
+		}
+	}
+	if v := families["chainpay_heartbeats_accepted_total"].GetMetric()[0].GetCounter().GetValue(); v < 1 {
+		t.Errorf("accepted heartbeats = %g, want at least 1", v)
+	}
+
+	// Histograms are cumulative and end at the count
+	for _, m := range families["chainpay_rpc_duration_seconds"].GetMetric() {
+		h := m.GetHistogram()
+		var prev uint64
+		for _, b := range h.GetBucket() {
+			if b.GetCumulativeCount() < prev {
+				t.Fatalf("rpc duration %v: buckets not cumulative", m.GetLabel())
+			}
+			prev = b.GetCumulativeCount()
+		}
+		if prev != h.GetSampleCount() || len(h.GetBucket()) != len(defaultBuckets)+1 {
+			t.Errorf("rpc duration %v: %d buckets up to %d, count %d", m.GetLabel(), len(h.GetBucket()), prev, h.GetSampleCount())
+		}
+	}
+}
+
+func TestMetricsEscaping(t *testing.T) {
+	// Built directly so the test series stay out of the process registry
+	counter := &scalarVec{metricName: "test_total", help: `Help with a \ and` + "\nnewline.", kind: "counter", labels: []string{"reason"}, series: make(map[string]*scalarSeries)}
+	hist := &histogramVec{metricName: "test_seconds", help: "Latency.", labels: []string{"method"}, buckets: defaultBuckets, series: make(map[string]*histogramSeries)}
+	tricky := "quote \" backslash \\ newline \n tab \t unicode é"
+	counter.Inc(tricky)
+	hist.Observe(0.2, tricky)
+	hist.Observe(20, tricky)
+
+	var out bytes.Buffer
+	counter.write(&out)
+	hist.write(&out)
+	families := parseMetrics(t, &out)
+
+	mf := families["test_total"]
+	if mf.GetHelp() != counter.help {
+		t.Errorf("help = %q, want %q", mf.GetHelp(), counter.help)
+	}
+	if got := mf.GetMetric()[0].GetLabel()[0].GetValue(); got != tricky {
+		t.Errorf("label = %q, want %q", got, tricky)
+	}
+	h := families["test_seconds"].GetMetric()[0].GetHistogram()
+	if h.GetSampleCount() != 2 || h.GetSampleSum() != 20.2 {
+		t.Errorf("histogram count %d sum %g, want 2 and 20.2", h.GetSampleCount(), h.GetSampleSum())
+	}
+	for _, b := range h.GetBucket() {
+		want := uint64(0)
+		switch {
+		case math.IsInf(b.GetUpperBound(), 1):
+			want = 2
+		case b.GetUpperBound() >= 0.2:
+			want = 1
+		}
+		if b.GetCumulativeCount() != want {
+			t.Errorf("bucket le=%g has %d, want %d", b.GetUpperBound(), b.GetCumulativeCount(), want)
+		}
+	}
+}
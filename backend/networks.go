@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Directory the Hardhat deploy scripts write <network>.json files to
+const deploymentsDir = "../blockchain/deployments"
+
+// Chain IDs of the networks declared in blockchain/hardhat.config.js, used when
+// a deployment file does not record one (or has not been written yet)
+var knownChainIDs = map[string]int64{
+	"hardhat":   1337,
+	"localhost": 1337,
+	"sepolia":   11155111,
+}
+
+// networksForChainID lists the known networks on chainID, sorted
+func networksForChainID(chainID int64) []string {
+	var names []string
+	for name, id := range knownChainIDs {
+		if id == chainID {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// networkProfile is everything a Hardhat deployment file tells us about a network
+type networkProfile struct {
+	Name             string
+	File             string
+	ChainID          int64 // 0 when unknown
+	RPCEndpoint      string
+	ContractAddress  string
+	RewardSigner     string // address the contract accepts rewards from
+	SignerPrivateKey string // only written for local networks
+}
+
+// deploymentPath returns the default deployment file for a network
+func deploymentPath(network string) string {
+	return filepath.Join(deploymentsDir, network+".json")
+}
+
+// loadNetworkProfile reads the deployment file for network. A missing file is
+// fine for networks in knownChainIDs, whose settings can come from env instead.
+func loadNetworkProfile(network, path string) (*networkProfile, error) {
+	profile := &networkProfile{
+		Name:    network,
+		File:    path,
+		ChainID: knownChainIDs[network],
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if _, known := knownChainIDs[network]; !known {
+			return nil, fmt.Errorf("network: unknown network %q and no deployment file at %s", network, path)
+		}
+		log.Printf("📄 No deployment file for %s at %s", network, path)
+		return profile, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("network: failed to read deployment file: %w", err)
+	}
+
+	var deployment struct {
+		Network   string `json:"network"`
+		ChainID   int64  `json:"chainId"`
+		RPCURL    string `json:"rpcUrl"`
+		Contracts struct {
+			RewardTreasury struct {
+				Address      string `json:"address"`
+				RewardSigner string `json:"rewardSigner"`
+			} `json:"RewardTreasury"`
+		} `json:"contracts"`
+		Accounts struct {
+			RewardSignerPrivateKey string `json:"rewardSignerPrivateKey"`
+		} `json:"accounts"`
+	}
+	if err := json.Unmarshal(data, &deployment); err != nil {
+		return nil, fmt.Errorf("network: invalid deployment file %s: %w", path, err)
+	}
+
+	// deploy.js records hre.network.name, so "hardhat" may land in localhost.json
+	if deployment.Network != "" && deployment.Network != network && knownChainIDs[deployment.Network] != knownChainIDs[network] {
+		return nil, fmt.Errorf("network: deployment file %s is for %q, not %q", path, deployment.Network, network)
+	}
+
+	if deployment.ChainID != 0 {
+		profile.ChainID = deployment.ChainID
+	}
+	profile.RPCEndpoint = deployment.RPCURL
+	profile.ContractAddress = deployment.Contracts.RewardTreasury.Address
+	profile.RewardSigner = deployment.Contracts.RewardTreasury.RewardSigner
+	profile.SignerPrivateKey = deployment.Accounts.RewardSignerPrivateKey
+
+	log.Printf("📄 Loaded %s deployment from %s (contract %s)", network, path, profile.ContractAddress)
+	return profile, nil
+}
+
+// apply copies the profile onto config as the deployment layer
+func (p *networkProfile) apply(config *Config) {
+	config.ChainID = p.ChainID
+	if p.RPCEndpoint != "" {
+		config.RPCEndpoint = p.RPCEndpoint
+	}
+	if p.ContractAddress != "" {
+		config.ContractAddress = p.ContractAddress
+	}
+	if p.RewardSigner != "" {
+		config.RewardSigner = p.RewardSigner
+	}
+	if p.SignerPrivateKey != "" {
+		config.SignerPrivateKey = p.SignerPrivateKey
+	}
+}
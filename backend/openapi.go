@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// openAPIDocument is the OpenAPI 3 description of the REST API. Request
+// validation reads the same document, so it cannot drift from what we enforce.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+// Largest JSON request body accepted by validation
+const maxRequestBodyBytes = 64 << 10
+
+// openAPI is the parsed document used by validateRequest
+var openAPI = mustParseOpenAPI(openAPIDocument)
+
+// openAPISpec is the subset of an OpenAPI 3 document needed for validation
+type openAPISpec struct {
+	Paths      map[string]map[string]*openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas    map[string]*jsonSchema       `json:"schemas"`
+		Parameters map[string]*openAPIParameter `json:"parameters"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Parameters  []*openAPIParameter `json:"parameters"`
+	RequestBody *struct {
+		Required bool `json:"required"`
+		Content  map[string]struct {
+			Schema *jsonSchema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+}
+
+type openAPIParameter struct {
+	Ref      string      `json:"$ref"`
+	Name     string      `json:"name"`
+	In       string      `json:"in"`
+	Required bool        `json:"required"`
+	Schema   *jsonSchema `json:"schema"`
+}
+
+// jsonSchema supports the keywords openapi.json uses
+type jsonSchema struct {
+	Ref                  string                 `json:"$ref"`
+	Type                 string                 `json:"type"`
+	Properties           map[string]*jsonSchema `json:"properties"`
+	Required             []string               `json:"required"`
+	AdditionalProperties *bool                  `json:"-"`
+	Items                *jsonSchema            `json:"items"`
+	Enum                 []interface{}          `json:"enum"`
+	Pattern              string                 `json:"pattern"`
+	MinLength            *int                   `json:"minLength"`
+	MaxLength            *int                   `json:"maxLength"`
+	Minimum              *float64               `json:"minimum"`
+	Maximum              *float64               `json:"maximum"`
+	ErrorCode            string                 `json:"x-error-code"` // code reported when this schema fails
+
+	pattern *regexp.Regexp
+}
+
+// UnmarshalJSON keeps additionalProperties only in its boolean form
+func (s *jsonSchema) UnmarshalJSON(data []byte) error {
+	type plain jsonSchema
+	var raw struct {
+		plain
+		AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*s = jsonSchema(raw.plain)
+
+	var allowed bool
+	if json.Unmarshal(raw.AdditionalProperties, &allowed) == nil {
+		s.AdditionalProperties = &allowed
+	}
+	return nil
+}
+
+// mustParseOpenAPI parses the embedded document and resolves its $refs. The
+// document ships with the binary, so a broken one is a programming error.
+func mustParseOpenAPI(doc []byte) *openAPISpec {
+	var spec openAPISpec
+	if err := json.Unmarshal(doc, &spec); err != nil {
+		panic(fmt.Sprintf("openapi.json: %v", err))
+	}
+	if err := spec.resolve(); err != nil {
+		panic(fmt.Sprintf("openapi.json: %v", err))
+	}
+	return &spec
+}
+
+// resolve replaces $ref parameters and schemas with their targets and
+// compiles patterns
+func (spec *openAPISpec) resolve() error {
+	visited := make(map[*jsonSchema]bool)
+	var resolveSchema func(s *jsonSchema) (*jsonSchema, error)
+	resolveSchema = func(s *jsonSchema) (*jsonSchema, error) {
+		if s == nil {
+			return nil, nil
+		}
+		if s.Ref != "" {
+			target, ok := spec.Components.Schemas[strings.TrimPrefix(s.Ref, "#/components/schemas/")]
+			if !ok {
+				return nil, fmt.Errorf("unknown schema %s", s.Ref)
+			}
+			s = target
+		}
+		if visited[s] {
+			return s, nil
+		}
+		visited[s] = true
+
+		if s.Pattern != "" {
+			re, err := regexp.Compile(s.Pattern)
+			if err != nil {
+				return nil, err
+			}
+			s.pattern = re
+		}
+		for name, prop := range s.Properties {
+			resolved, err := resolveSchema(prop)
+			if err != nil {
+				return nil, err
+			}
+			s.Properties[name] = resolved
+		}
+		var err error
+		s.Items, err = resolveSchema(s.Items)
+		return s, err
+	}
+
+	for path, methods := range spec.Paths {
+		for method, op := range methods {
+			for i, p := range op.Parameters {
+				if p.Ref != "" {
+					target, ok := spec.Components.Parameters[strings.TrimPrefix(p.Ref, "#/components/parameters/")]
+					if !ok {
+						return fmt.Errorf("%s %s: unknown parameter %s", method, path, p.Ref)
+					}
+					p = target
+					op.Parameters[i] = p
+				}
+				schema, err := resolveSchema(p.Schema)
+				if err != nil {
+					return fmt.Errorf("%s %s: %w", method, path, err)
+				}
+				p.Schema = schema
+			}
+			if op.RequestBody != nil {
+				for mediaType, content := range op.RequestBody.Content {
+					schema, err := resolveSchema(content.Schema)
+					if err != nil {
+						return fmt.Errorf("%s %s: %w", method, path, err)
+					}
+					content.Schema = schema
+					op.RequestBody.Content[mediaType] = content
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// operation returns the spec for a route template and method, if documented
+func (spec *openAPISpec) operation(path, method string) *openAPIOperation {
+	// Unversioned aliases share their target version's description
+	return spec.Paths[versionedPath(path)][strings.ToLower(method)]
+}
+
+// validationError is a request that does not match the document
+type validationError struct {
+	code    string
+	message string
+}
+
+func (e *validationError) Error() string { return e.message }
+
+func invalid(schema *jsonSchema, format string, args ...interface{}) *validationError {
+	code := CodeInvalidRequest
+	if schema != nil && schema.ErrorCode != "" {
+		code = schema.ErrorCode
+	}
+	return &validationError{code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// validateValue checks a decoded JSON value against a schema. Numbers must be
+// decoded as json.Number so integers can be told apart.
+func validateValue(s *jsonSchema, v interface{}, at string) *validationError {
+	if s == nil {
+		return nil
+	}
+
+	switch s.Type {
+	case "object":
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return invalid(s, "%s must be an object", at)
+		}
+		for _, name := range s.Required {
+			if _, ok := obj[name]; !ok {
+				return invalid(s.Properties[name], "%s is required", joinPath(at, name))
+			}
+		}
+		// Report problems in a stable order
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			prop, known := s.Properties[name]
+			if !known {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return invalid(s, "%s is not an allowed field", joinPath(at, name))
+				}
+				continue
+			}
+			if err := validateValue(prop, obj[name], joinPath(at, name)); err != nil {
+				return err
+			}
+		}
+
+	case "array":
+		arr, ok := v.([]interface{})
+		if !ok {
+			return invalid(s, "%s must be an array", at)
+		}
+		for i, item := range arr {
+			if err := validateValue(s.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return invalid(s, "%s must be a string", at)
+		}
+		if s.MinLength != nil && len(str) < *s.MinLength {
+			return invalid(s, "%s must be at least %d characters", at, *s.MinLength)
+		}
+		if s.MaxLength != nil && len(str) > *s.MaxLength {
+			return invalid(s, "%s must be at most %d characters", at, *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			return invalid(s, "%s does not match %s", at, s.Pattern)
+		}
+
+	case "integer", "number":
+		num, ok := v.(json.Number)
+		if !ok {
+			return invalid(s, "%s must be %s", at, typeName(s.Type))
+		}
+		f, err := num.Float64()
+		if err != nil {
+			return invalid(s, "%s must be %s", at, typeName(s.Type))
+		}
+		if s.Type == "integer" {
+			if _, err := num.Int64(); err != nil {
+				return invalid(s, "%s must be an integer", at)
+			}
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			return invalid(s, "%s must be at least %v", at, *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			return invalid(s, "%s must be at most %v", at, *s.Maximum)
+		}
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return invalid(s, "%s must be a boolean", at)
+		}
+	}
+
+	if len(s.Enum) > 0 {
+		for _, allowed := range s.Enum {
+			if fmt.Sprint(allowed) == fmt.Sprint(v) {
+				return nil
+			}
+		}
+		return invalid(s, "%s must be one of %v", at, s.Enum)
+	}
+	return nil
+}
+
+func typeName(t string) string {
+	if t == "integer" || t == "object" || t == "array" {
+		return "an " + t
+	}
+	return "a " + t
+}
+
+func joinPath(at, name string) string {
+	if at == "" {
+		return name
+	}
+	return at + "." + name
+}
+
+// validateParameter checks a raw path or query value, converting it to the
+// schema's type first
+func validateParameter(p *openAPIParameter, raw string) *validationError {
+	var v interface{} = raw
+	if p.Schema != nil && (p.Schema.Type == "integer" || p.Schema.Type == "number") {
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			return invalid(p.Schema, "%s parameter %s must be %s", p.In, p.Name, typeName(p.Schema.Type))
+		}
+		v = json.Number(raw)
+	}
+	if err := validateValue(p.Schema, v, p.Name); err != nil {
+		err.message = p.In + " parameter " + err.message
+		return err
+	}
+	return nil
+}
+
+// validate checks path and query parameters and the JSON body of r
+func (op *openAPIOperation) validate(r *http.Request) *validationError {
+	vars := mux.Vars(r)
+	query := r.URL.Query()
+
+	for _, p := range op.Parameters {
+		var raw string
+		var present bool
+		switch p.In {
+		case "path":
+			raw, present = vars[p.Name]
+		case "query":
+			present = query.Has(p.Name)
+			raw = query.Get(p.Name)
+		default:
+			continue
+		}
+
+		if !present {
+			if p.Required {
+				return invalid(p.Schema, "%s parameter %s is required", p.In, p.Name)
+			}
+			continue
+		}
+		if err := validateParameter(p, raw); err != nil {
+			return err
+		}
+	}
+
+	if op.RequestBody == nil {
+		return nil
+	}
+	content, ok := op.RequestBody.Content["application/json"]
+	if !ok {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodyBytes+1))
+	if err != nil {
+		return invalid(nil, "failed to read request body")
+	}
+	if len(body) > maxRequestBodyBytes {
+		return invalid(nil, "request body exceeds %d bytes", maxRequestBodyBytes)
+	}
+	// Handlers decode the body again after validation
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if len(bytes.TrimSpace(body)) == 0 {
+		if op.RequestBody.Required {
+			return invalid(nil, "request body is required")
+		}
+		return nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return invalid(nil, "request body is not valid JSON")
+	}
+	if dec.More() {
+		return invalid(nil, "request body must be a single JSON value")
+	}
+
+	return validateValue(content.Schema, value, "")
+}
+
+// validateRequest rejects requests to documented routes whose parameters or
+// body don't match openapi.json. Undocumented routes pass through.
+func validateRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := mux.CurrentRoute(r)
+		if route == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		op := openAPI.operation(path, r.Method)
+		if op == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if err := op.validate(r); err != nil {
+			writeError(w, newAPIError(err.code, err.message, nil))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleOpenAPI serves the OpenAPI document
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Multipliers are applied as integer parts per million so results are exact
+const pricingScale = 1_000_000
+
+// PricingConfig holds the rules that turn the base rate into the reward for
+// one heartbeat. Every rule is off unless configured.
+type PricingConfig struct {
+	Tiers     []PricingTier   `json:"tiers,omitempty" yaml:"tiers,omitempty"`
+	TimeOfDay []TimeOfDayRule `json:"time_of_day,omitempty" yaml:"time_of_day,omitempty"`
+
+	// Heartbeats per wallet per UTC day paid in full; each further block of
+	// DailyViews is multiplied by DailyDecay once more (0 = no limit)
+	DailyViews int64   `json:"daily_views,omitempty" yaml:"daily_views,omitempty"`
+	DailyDecay float64 `json:"daily_decay,omitempty" yaml:"daily_decay,omitempty"`
+
+	// Scale rewards down when funds would last fewer than RunwayDays at the
+	// last 24 hours' payout rate, but never below RunwayFloor (0 = off)
+	RunwayDays  float64 `json:"runway_days,omitempty" yaml:"runway_days,omitempty"`
+	RunwayFloor float64 `json:"runway_floor,omitempty" yaml:"runway_floor,omitempty"`
+}
+
+// PricingTier rewards loyal wallets; the highest tier reached applies
+type PricingTier struct {
+	Name          string  `json:"name" yaml:"name"`
+	MinHeartbeats int64   `json:"min_heartbeats" yaml:"min_heartbeats"` // lifetime heartbeats on the chain
+	Multiplier    float64 `json:"multiplier" yaml:"multiplier"`
+}
+
+// TimeOfDayRule applies during [FromHour, ToHour) UTC, wrapping past midnight
+// when FromHour > ToHour; the first matching rule wins
+type TimeOfDayRule struct {
+	FromHour   int     `json:"from_hour" yaml:"from_hour"`
+	ToHour     int     `json:"to_hour" yaml:"to_hour"`
+	Multiplier float64 `json:"multiplier" yaml:"multiplier"`
+}
+
+func (r TimeOfDayRule) matches(hour int) bool {
+	if r.FromHour <= r.ToHour {
+		return hour >= r.FromHour && hour < r.ToHour
+	}
+	return hour >= r.FromHour || hour < r.ToHour
+}
+
+// validatePricing checks the pricing block for Config.Validate
+func validatePricing(p PricingConfig) []error {
+	var errs []error
+	for i, t := range p.Tiers {
+		if t.Name == "" {
+			errs = append(errs, fmt.Errorf("pricing.tiers[%d].name: required", i))
+		}
+		if t.MinHeartbeats < 0 {
+			errs = append(errs, fmt.Errorf("pricing.tiers[%d].min_heartbeats: must not be negative, got %d", i, t.MinHeartbeats))
+		}
+		if t.Multiplier <= 0 {
+			errs = append(errs, fmt.Errorf("pricing.tiers[%d].multiplier: must be positive, got %g", i, t.Multiplier))
+		}
+	}
+	for i, r := range p.TimeOfDay {
+		if r.FromHour < 0 || r.FromHour > 23 || r.ToHour < 0 || r.ToHour > 24 || r.FromHour == r.ToHour {
+			errs = append(errs, fmt.Errorf("pricing.time_of_day[%d]: hours must be 0-24 UTC and differ, got %d-%d", i, r.FromHour, r.ToHour))
+		}
+		if r.Multiplier <= 0 {
+			errs = append(errs, fmt.Errorf("pricing.time_of_day[%d].multiplier: must be positive, got %g", i, r.Multiplier))
+		}
+	}
+	if p.DailyViews < 0 {
+		errs = append(errs, fmt.Errorf("pricing.daily_views: must not be negative, got %d", p.DailyViews))
+	}
+	if p.DailyViews > 0 && (p.DailyDecay <= 0 || p.DailyDecay > 1) {
+		errs = append(errs, fmt.Errorf("pricing.daily_decay: must be in (0, 1] when daily_views is set, got %g", p.DailyDecay))
+	}
+	if p.RunwayDays < 0 {
+		errs = append(errs, fmt.Errorf("pricing.runway_days: must not be negative, got %g", p.RunwayDays))
+	}
+	if p.RunwayFloor < 0 || p.RunwayFloor > 1 {
+		errs = append(errs, fmt.Errorf("pricing.runway_floor: must be between 0 and 1, got %g", p.RunwayFloor))
+	}
+	return errs
+}
+
+// AppliedRule is one step of a reward's price, kept with the reward for audit
+type AppliedRule struct {
+	Rule       string  `json:"rule"`
+	Detail     string  `json:"detail,omitempty"`
+	Multiplier float64 `json:"multiplier,omitempty"`
+	AmountWei  string  `json:"amount_wei"` // reward after this rule
+}
+
+// quote is a priced reward and how the price was reached
+type quote struct {
+	amount *big.Int
+	rules  []AppliedRule
+}
+
+func newQuote(rule, detail string, amount *big.Int) *quote {
+	q := &quote{amount: new(big.Int).Set(amount)}
+	q.rules = append(q.rules, AppliedRule{Rule: rule, Detail: detail, AmountWei: q.amount.String()})
+	return q
+}
+
+// apply multiplies the amount, recording the rule
+func (q *quote) apply(rule, detail string, multiplier float64) {
+	ppm := big.NewInt(int64(math.Round(multiplier * pricingScale)))
+	q.amount.Mul(q.amount, ppm)
+	q.amount.Quo(q.amount, big.NewInt(pricingScale))
+	q.rules = append(q.rules, AppliedRule{Rule: rule, Detail: detail, Multiplier: multiplier, AmountWei: q.amount.String()})
+}
+
+// pricingSummary renders applied rules on one line for logs
+func pricingSummary(rules []AppliedRule) string {
+	parts := make([]string, len(rules))
+	for i, r := range rules {
+		parts[i] = r.Rule
+		if r.Multiplier != 0 {
+			parts[i] += " ×" + strconv.FormatFloat(r.Multiplier, 'g', 4, 64)
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// pricingEngine prices heartbeats. Funds are sampled by the block monitor
+// rather than read per heartbeat, which must not touch the chain. Heartbeat
+// counts for tiers and daily decay live in shared state, so a wallet is
+// priced the same on every replica and across restarts with Redis.
+type pricingEngine struct {
+	mu    sync.RWMutex
+	funds map[int64]*big.Int // treasury (or signer, in direct mode) balance by chain ID
+	state sharedState
+}
+
+func newPricingEngine(state sharedState) *pricingEngine {
+	return &pricingEngine{funds: make(map[int64]*big.Int), state: state}
+}
+
+// heartbeatDays counts a wallet's accepted heartbeats on one chain by UTC
+// day (unix seconds / 86400), for days within earningsRetention
+type heartbeatDays map[int64]int64
+
+func pricingCountsKey(chainID int64, wallet string) string {
+	return fmt.Sprintf("pricing:heartbeats:%d:%s", chainID, strings.ToLower(wallet))
+}
+
+// countHeartbeat adds an accepted heartbeat to wallet's counts
+func (pe *pricingEngine) countHeartbeat(chainID int64, wallet string, now time.Time) error {
+	return pe.state.update(pricingCountsKey(chainID, wallet), earningsRetention, func(old []byte) ([]byte, error) {
+		days := make(heartbeatDays)
+		if old != nil {
+			if err := json.Unmarshal(old, &days); err != nil {
+				return nil, err
+			}
+		}
+		oldest := now.Add(-earningsRetention).Unix() / 86400
+		for day := range days {
+			if day < oldest {
+				delete(days, day)
+			}
+		}
+		days[now.Unix()/86400]++
+		return json.Marshal(days)
+	})
+}
+
+// heartbeatCounts returns wallet's retained heartbeats on chainID in total
+// and on now's UTC day
+func (pe *pricingEngine) heartbeatCounts(chainID int64, wallet string, now time.Time) (lifetime, today int64, err error) {
+	data, ok, err := pe.state.get(pricingCountsKey(chainID, wallet))
+	if err != nil || !ok {
+		return 0, 0, err
+	}
+	var days heartbeatDays
+	if err := json.Unmarshal(data, &days); err != nil {
+		return 0, 0, fmt.Errorf("pricing counts for %s: %w", wallet, err)
+	}
+
+	oldest := now.Add(-earningsRetention).Unix() / 86400
+	for day, n := range days {
+		if day < oldest {
+			continue
+		}
+		lifetime += n
+		if day == now.Unix()/86400 {
+			today += n
+		}
+	}
+	return lifetime, today, nil
+}
+
+// setFunds records the balance rewards on chainID are paid from
+func (pe *pricingEngine) setFunds(chainID int64, balance *big.Int) {
+	pe.mu.Lock()
+	defer pe.mu.Unlock()
+	pe.funds[chainID] = balance
+}
+
+// fundsOf returns the last sampled balance for chainID, nil if unknown
+func (pe *pricingEngine) fundsOf(chainID int64) *big.Int {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+	return pe.funds[chainID]
+}
+
+// priceHeartbeat computes the reward for wallet's heartbeat on adID. Rules
+// apply in order: base rate or campaign bid, loyalty tier, time of day,
+// daily diminishing returns, then treasury runway.
+func (s *Server) priceHeartbeat(cfg *Config, chainID int64, wallet, adID string, now time.Time) (*quote, error) {
+	p := cfg.Pricing
+
+	q := newQuote("base", "", big.NewInt(cfg.RewardPerHeartbeat))
+	if bid := cfg.adBid(adID); bid > 0 {
+		q = newQuote("campaign_bid", adID, big.NewInt(bid))
+	}
+
+	lifetime, today, err := s.pricing.heartbeatCounts(chainID, wallet, now)
+	if err != nil {
+		return nil, err
+	}
+
+	var tier *PricingTier
+	for i, t := range p.Tiers {
+		if lifetime >= t.MinHeartbeats && (tier == nil || t.MinHeartbeats > tier.MinHeartbeats) {
+			tier = &p.Tiers[i]
+		}
+	}
+	if tier != nil && tier.Multiplier != 1 {
+		q.apply("tier", tier.Name, tier.Multiplier)
+	}
+
+	hour := now.UTC().Hour()
+	for _, r := range p.TimeOfDay {
+		if r.matches(hour) {
+			q.apply("time_of_day", fmt.Sprintf("%02d-%02d UTC", r.FromHour, r.ToHour), r.Multiplier)
+			break
+		}
+	}
+
+	if p.DailyViews > 0 && today >= p.DailyViews {
+		blocks := today / p.DailyViews
+		q.apply("daily_views", fmt.Sprintf("%d heartbeats today", today), math.Pow(p.DailyDecay, float64(blocks)))
+	}
+
+	if p.RunwayDays > 0 {
+		if m, detail, ok := s.runwayMultiplier(chainID, p, now); ok {
+			q.apply("runway", detail, m)
+		}
+	}
+
+	// A zero-value reward would revert; pay the smallest unit instead
+	if q.amount.Sign() <= 0 {
+		q.amount.SetInt64(1)
+		q.rules = append(q.rules, AppliedRule{Rule: "minimum", AmountWei: "1"})
+	}
+	return q, nil
+}
+
+// runwayMultiplier scales rewards by the days funds would last at the last
+// 24 hours' payouts relative to p.RunwayDays. ok is false when runway is
+// long enough or can't be estimated yet.
+func (s *Server) runwayMultiplier(chainID int64, p PricingConfig, now time.Time) (float64, string, bool) {
+	funds := s.pricing.fundsOf(chainID)
+	if funds == nil {
+		return 0, "", false
+	}
+
+	spent := new(big.Int)
+	for _, t := range s.earnings.totalsSince(chainID, now.Add(-24*time.Hour)) {
+		spent.Add(spent, t.earnings)
+	}
+	if spent.Sign() == 0 {
+		return 0, "", false
+	}
+
+	days, _ := new(big.Rat).SetFrac(funds, spent).Float64()
+	if days >= p.RunwayDays {
+		return 0, "", false
+	}
+	m := math.Max(days/p.RunwayDays, p.RunwayFloor)
+	if m <= 0 {
+		// Treasury empty and no floor: payouts are halted elsewhere anyway
+		m = 1.0 / pricingScale
+	}
+	return m, fmt.Sprintf("%.3g days of funds", days), true
+}
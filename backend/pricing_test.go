@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestPriceHeartbeat(t *testing.T) {
+	const wallet = "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"
+	noon := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tiers := []PricingTier{
+		{Name: "silver", MinHeartbeats: 5, Multiplier: 1.1},
+		{Name: "gold", MinHeartbeats: 10, Multiplier: 1.5},
+	}
+
+	tests := []struct {
+		name      string
+		pricing   PricingConfig
+		bid       int64
+		base      int64
+		at        time.Time
+		yesterday int64 // heartbeats counted the day before at
+		today     int64 // heartbeats counted earlier on at's day
+		funds     int64 // sampled balance, 0 = unknown
+		spent     int64 // payouts in the 24 hours before at
+		want      string
+		rules     []string
+	}{
+		{name: "base rate", base: 1000, at: noon, want: "1000", rules: []string{"base"}},
+		{name: "campaign bid", base: 1000, bid: 2500, at: noon, want: "2500", rules: []string{"campaign_bid"}},
+		{
+			name: "below every tier", pricing: PricingConfig{Tiers: tiers}, base: 1000, at: noon,
+			yesterday: 4, want: "1000", rules: []string{"base"},
+		},
+		{
+			name: "highest tier reached", pricing: PricingConfig{Tiers: tiers}, base: 1000, at: noon,
+			yesterday: 6, today: 4, want: "1500", rules: []string{"base", "tier"},
+		},
+		{
+			name: "time of day wrapping midnight", base: 1000, at: noon.Add(11 * time.Hour),
+			pricing: PricingConfig{TimeOfDay: []TimeOfDayRule{{FromHour: 22, ToHour: 6, Multiplier: 0.5}}},
+			want:    "500", rules: []string{"base", "time_of_day"},
+		},
+		{
+			name: "outside time of day", base: 1000, at: noon,
+			pricing: PricingConfig{TimeOfDay: []TimeOfDayRule{{FromHour: 22, ToHour: 6, Multiplier: 0.5}}},
+			want:    "1000", rules: []string{"base"},
+		},
+		{
+			name: "first matching time of day wins", base: 1000, at: noon,
+			pricing: PricingConfig{TimeOfDay: []TimeOfDayRule{
+				{FromHour: 12, ToHour: 13, Multiplier: 2},
+				{FromHour: 0, ToHour: 24, Multiplier: 3},
+			}},
+			want: "2000", rules: []string{"base", "time_of_day"},
+		},
+		{
+			name: "daily views not yet used up", base: 1000, at: noon,
+			pricing: PricingConfig{DailyViews: 3, DailyDecay: 0.5},
+			today:   2, want: "1000", rules: []string{"base"},
+		},
+		{
+			name: "daily decay per block of views", base: 1000, at: noon,
+			pricing: PricingConfig{DailyViews: 3, DailyDecay: 0.5},
+			today:   7, yesterday: 50, want: "250", rules: []string{"base", "daily_views"},
+		},
+		{
+			name: "runway scales down", base: 1000, at: noon,
+			pricing: PricingConfig{RunwayDays: 20},
+			funds:   10_000, spent: 1000, want: "500", rules: []string{"base", "runway"},
+		},
+		{
+			name: "runway floor", base: 1000, at: noon,
+			pricing: PricingConfig{RunwayDays: 20, RunwayFloor: 0.8},
+			funds:   10_000, spent: 1000, want: "800", rules: []string{"base", "runway"},
+		},
+		{
+			name: "runway long enough", base: 1000, at: noon,
+			pricing: PricingConfig{RunwayDays: 5},
+			funds:   10_000, spent: 1000, want: "1000", rules: []string{"base"},
+		},
+		{
+			name: "runway unknown without payouts", base: 1000, at: noon,
+			pricing: PricingConfig{RunwayDays: 20},
+			funds:   10_000, want: "1000", rules: []string{"base"},
+		},
+		{
+			name: "multipliers round to ppm and amounts down", base: 1000, at: noon,
+			pricing: PricingConfig{TimeOfDay: []TimeOfDayRule{{FromHour: 0, ToHour: 24, Multiplier: 1.0 / 3}}},
+			want:    "333", rules: []string{"base", "time_of_day"},
+		},
+		{
+			name: "never below one wei", base: 1, at: noon,
+			pricing: PricingConfig{TimeOfDay: []TimeOfDayRule{{FromHour: 0, ToHour: 24, Multiplier: 0.5}}},
+			want:    "1", rules: []string{"base", "time_of_day", "minimum"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := newMemoryState()
+			s := &Server{earnings: newEarningsLedger(state), pricing: newPricingEngine(state)}
+			for i := int64(0); i < tt.yesterday; i++ {
+				if err := s.pricing.countHeartbeat(1, wallet, tt.at.Add(-24*time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for i := int64(0); i < tt.today; i++ {
+				if err := s.pricing.countHeartbeat(1, wallet, tt.at.Truncate(24*time.Hour)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.funds > 0 {
+				s.pricing.setFunds(1, big.NewInt(tt.funds))
+			}
+			if tt.spent > 0 {
+				s.earnings.recordPayout(wallet, "payout", Payout{ChainID: 1, Timestamp: tt.at.Add(-time.Hour), amount: big.NewInt(tt.spent)})
+			}
+
+			cfg := &Config{RewardPerHeartbeat: tt.base, Pricing: tt.pricing}
+			if tt.bid > 0 {
+				cfg.Ads = []AdConfig{{ID: "ad-1", Bid: tt.bid}}
+			}
+			q, err := s.priceHeartbeat(cfg, 1, wallet, "ad-1", tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rules []string
+			for _, r := range q.rules {
+				rules = append(rules, r.Rule)
+			}
+			if q.amount.String() != tt.want || len(rules) != len(tt.rules) {
+				t.Fatalf("priced %s with %v, want %s with %v", q.amount, rules, tt.want, tt.rules)
+			}
+			for i := range rules {
+				if rules[i] != tt.rules[i] {
+					t.Fatalf("rules %v, want %v", rules, tt.rules)
+				}
+			}
+		})
+	}
+}
+
+func TestHeartbeatCountsAreShared(t *testing.T) {
+	const wallet = "0x70997970C51812dc3A010C7d01b50e0d17dc79C8"
+	state := newMemoryState()
+	a, b := newPricingEngine(state), newPricingEngine(state)
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	// Counted on one replica, priced on another; days past retention drop out
+	for _, at := range []time.Time{now.Add(-earningsRetention - 48*time.Hour), now.Add(-24 * time.Hour), now, now} {
+		if err := a.countHeartbeat(1, wallet, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lifetime, today, err := b.heartbeatCounts(1, wallet, now)
+	if err != nil || lifetime != 3 || today != 2 {
+		t.Errorf("counts = %d lifetime, %d today, %v; want 3 and 2", lifetime, today, err)
+	}
+	if lifetime, _, _ := b.heartbeatCounts(2, wallet, now); lifetime != 0 {
+		t.Errorf("counted %d heartbeats on another chain", lifetime)
+	}
+}
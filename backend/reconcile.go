@@ -0,0 +1,632 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// IssueType is a kind of discrepancy between the backend and the chain
+type IssueType string
+
+const (
+	// A reward the backend saw confirmed has no RewardClaimed event
+	IssueMissingPayout IssueType = "missing_payout"
+	// A RewardClaimed event matches no reward the backend sent
+	IssueUnexpectedPayout IssueType = "unexpected_payout"
+	// A reward was paid more than once
+	IssueDuplicatePayout IssueType = "duplicate_payout"
+	// The event paid a different amount than the backend recorded
+	IssueAmountMismatch IssueType = "amount_mismatch"
+	// The event paid a different wallet than the backend recorded
+	IssueWalletMismatch IssueType = "wallet_mismatch"
+	// getUserEarnings disagrees with the recorded payouts
+	IssueEarningsMismatch IssueType = "earnings_mismatch"
+)
+
+var issueTypes = []IssueType{
+	IssueMissingPayout,
+	IssueUnexpectedPayout,
+	IssueDuplicatePayout,
+	IssueAmountMismatch,
+	IssueWalletMismatch,
+	IssueEarningsMismatch,
+}
+
+const (
+	// How often the reconciliation loop checks whether a run is due
+	reconcileCheckInterval = 10 * time.Second
+
+	// Shared state key of the last reconciliation report
+	reconciliationKey = "reconciliation:last"
+)
+
+// ReconciliationIssue is one discrepancy found by reconciliation
+type ReconciliationIssue struct {
+	Type        IssueType `json:"type"`
+	ChainID     int64     `json:"chain_id"`
+	Wallet      string    `json:"wallet,omitempty"`
+	RewardID    string    `json:"reward_id,omitempty"`
+	TxHash      string    `json:"tx_hash,omitempty"`
+	ClaimID     string    `json:"claim_id,omitempty"`
+	ExpectedWei string    `json:"expected_wei,omitempty"`
+	ActualWei   string    `json:"actual_wei,omitempty"`
+	Detail      string    `json:"detail"`
+}
+
+// ChainReconciliation is the outcome for one chain
+type ChainReconciliation struct {
+	ChainID         int64                 `json:"chain_id"`
+	Network         string                `json:"network"`
+	ContractAddress string                `json:"contract_address,omitempty"`
+	Skipped         string                `json:"skipped,omitempty"` // why the chain wasn't checked
+	Error           string                `json:"error,omitempty"`
+	LedgerFrom      uint64                `json:"ledger_from_block"`  // payouts from here on are all in the ledger
+	IndexedFrom     uint64                `json:"indexed_from_block"` // RewardClaimed events indexed from here...
+	IndexedTo       uint64                `json:"indexed_to_block"`   // ...to here
+	Wallets         int                   `json:"wallets"`
+	LedgerPayouts   int                   `json:"ledger_payouts"`
+	IndexedPayouts  int                   `json:"indexed_payouts"`
+	InFlight        int                   `json:"in_flight"` // events of rewards still awaiting their receipt
+	LedgerWei       string                `json:"ledger_wei"`
+	IndexedWei      string                `json:"indexed_wei"`
+	OnChainWei      string                `json:"on_chain_wei"` // sum of getUserEarnings over the wallets
+	Issues          []ReconciliationIssue `json:"issues"`
+}
+
+// ReconciliationReport compares what the backend paid with the chain
+type ReconciliationReport struct {
+	GeneratedAt time.Time             `json:"generated_at"`
+	DurationMs  int64                 `json:"duration_ms"`
+	OK          bool                  `json:"ok"` // no issues and no chain failed
+	IssueCounts map[IssueType]int     `json:"issue_counts"`
+	Chains      []ChainReconciliation `json:"chains"`
+}
+
+// reconciler checks the payout ledger against indexed RewardClaimed events
+// and the contract's getUserEarnings. It holds no server state, so the
+// reconcile command can run it with its own index.
+type reconciler struct {
+	chains   []*BlockchainClient
+	earnings *earningsLedger
+	ledger   *payoutLedger
+	rewards  *rewardStore
+}
+
+// walletTally sums one wallet's payouts as each source sees them
+type walletTally struct {
+	ledger  *big.Int
+	indexed *big.Int
+	pending *big.Int // confirmed after the index ends, or still awaiting a receipt
+}
+
+func (rc *reconciler) run(now time.Time) *ReconciliationReport {
+	report := &ReconciliationReport{
+		GeneratedAt: now.UTC(),
+		OK:          true,
+		IssueCounts: make(map[IssueType]int),
+	}
+	for _, t := range issueTypes {
+		report.IssueCounts[t] = 0
+	}
+
+	// Transactions of rewards still settling, whose events may be indexed
+	// before the receipt watcher confirms them
+	settling, err := rc.rewards.settling()
+	if err != nil {
+		log.Printf("⚠️ Reconciliation can't read settling rewards: %v", err)
+	}
+
+	for _, bc := range rc.chains {
+		cr := rc.reconcileChain(bc, settling, now)
+		for _, issue := range cr.Issues {
+			report.IssueCounts[issue.Type]++
+		}
+		if len(cr.Issues) > 0 || cr.Error != "" {
+			report.OK = false
+		}
+		report.Chains = append(report.Chains, cr)
+	}
+	report.DurationMs = time.Since(now).Milliseconds()
+	return report
+}
+
+// reconcileChain matches one chain's ledger entries to its indexed events
+// by transaction, then checks every wallet's on-chain total
+func (rc *reconciler) reconcileChain(bc *BlockchainClient, settling []RewardRecord, now time.Time) ChainReconciliation {
+	chainID := bc.ChainID()
+	cr := ChainReconciliation{
+		ChainID:         chainID,
+		Network:         bc.Network(),
+		ContractAddress: bc.ContractAddress(),
+		Issues:          []ReconciliationIssue{},
+	}
+	if bc.ContractAddress() == "" {
+		cr.Skipped = "direct transfers emit no RewardClaimed events"
+		return cr
+	}
+
+	start, ok, err := rc.ledger.start(chainID)
+	if err != nil {
+		cr.Error = err.Error()
+		return cr
+	}
+	if !ok {
+		cr.Skipped = "no payout ledger for this chain"
+		return cr
+	}
+	events, from, to, ok := rc.earnings.indexedPayouts(chainID)
+	if !ok {
+		cr.Skipped = "RewardClaimed events not indexed yet"
+		return cr
+	}
+	entries, err := rc.ledger.entries(chainID)
+	if err != nil {
+		cr.Error = err.Error()
+		return cr
+	}
+	cr.LedgerFrom, cr.IndexedFrom, cr.IndexedTo = start.Block, from, to
+
+	issue := func(i ReconciliationIssue) {
+		i.ChainID = chainID
+		cr.Issues = append(cr.Issues, i)
+	}
+	wallets := make(map[string]*walletTally)
+	tally := func(wallet string) *walletTally {
+		wallet = strings.ToLower(wallet)
+		t, ok := wallets[wallet]
+		if !ok {
+			t = &walletTally{ledger: new(big.Int), indexed: new(big.Int), pending: new(big.Int)}
+			wallets[wallet] = t
+		}
+		return t
+	}
+
+	inFlight := make(map[string]bool)
+	for _, rec := range settling {
+		if rec.ChainID == chainID && rec.Status == RewardSubmitted && rec.TxHash != "" {
+			inFlight[strings.ToLower(rec.TxHash)] = true
+			if amount, ok := new(big.Int).SetString(rec.RewardWei, 10); ok {
+				t := tally(rec.WalletAddress)
+				t.pending.Add(t.pending, amount)
+			}
+		}
+	}
+
+	// The ledger side
+	cutoff := now.Add(-earningsRetention)
+	ledgerWei := new(big.Int)
+	byTx := make(map[string]LedgerEntry)
+	byReward := make(map[string][]LedgerEntry)
+	for _, e := range entries {
+		if e.ConfirmedAt.Before(cutoff) {
+			continue
+		}
+		amount, ok := new(big.Int).SetString(e.AmountWei, 10)
+		if !ok {
+			amount = new(big.Int)
+		}
+		cr.LedgerPayouts++
+		ledgerWei.Add(ledgerWei, amount)
+		t := tally(e.Wallet)
+		t.ledger.Add(t.ledger, amount)
+		if e.Block > to {
+			t.pending.Add(t.pending, amount)
+		}
+		byTx[strings.ToLower(e.TxHash)] = e
+		byReward[e.RewardID] = append(byReward[e.RewardID], e)
+	}
+	for id, list := range byReward {
+		if len(list) < 2 {
+			continue
+		}
+		txs := make([]string, len(list))
+		for i, e := range list {
+			txs[i] = e.TxHash
+		}
+		issue(ReconciliationIssue{
+			Type:        IssueDuplicatePayout,
+			Wallet:      list[0].Wallet,
+			RewardID:    id,
+			TxHash:      list[1].TxHash,
+			ExpectedWei: list[0].AmountWei,
+			Detail:      fmt.Sprintf("reward confirmed in %d transactions: %s", len(list), strings.Join(txs, ", ")),
+		})
+	}
+
+	// The chain side
+	indexedWei := new(big.Int)
+	matched := make(map[string]int)
+	for _, ev := range events {
+		cr.IndexedPayouts++
+		amount, _ := new(big.Int).SetString(ev.AmountWei, 10)
+		if amount == nil {
+			amount = new(big.Int)
+		}
+		indexedWei.Add(indexedWei, amount)
+		t := tally(ev.wallet)
+		t.indexed.Add(t.indexed, amount)
+
+		tx := strings.ToLower(ev.TxHash)
+		e, ok := byTx[tx]
+		if !ok {
+			switch {
+			case inFlight[tx]:
+				cr.InFlight++
+			case ev.Block >= start.Block:
+				issue(ReconciliationIssue{
+					Type:      IssueUnexpectedPayout,
+					Wallet:    ev.wallet,
+					TxHash:    ev.TxHash,
+					ClaimID:   ev.ClaimID,
+					ActualWei: ev.AmountWei,
+					Detail:    fmt.Sprintf("RewardClaimed in block %d matches no reward the backend sent", ev.Block),
+				})
+			}
+			continue
+		}
+
+		if matched[tx]++; matched[tx] > 1 {
+			issue(ReconciliationIssue{
+				Type:      IssueDuplicatePayout,
+				Wallet:    ev.wallet,
+				RewardID:  e.RewardID,
+				TxHash:    ev.TxHash,
+				ClaimID:   ev.ClaimID,
+				ActualWei: ev.AmountWei,
+				Detail:    "transaction emitted more than one RewardClaimed",
+			})
+			continue
+		}
+		if !strings.EqualFold(e.Wallet, ev.wallet) {
+			issue(ReconciliationIssue{
+				Type:     IssueWalletMismatch,
+				Wallet:   e.Wallet,
+				RewardID: e.RewardID,
+				TxHash:   ev.TxHash,
+				ClaimID:  ev.ClaimID,
+				Detail:   "RewardClaimed paid " + ev.wallet,
+			})
+		}
+		if e.AmountWei != ev.AmountWei {
+			issue(ReconciliationIssue{
+				Type:        IssueAmountMismatch,
+				Wallet:      e.Wallet,
+				RewardID:    e.RewardID,
+				TxHash:      ev.TxHash,
+				ClaimID:     ev.ClaimID,
+				ExpectedWei: e.AmountWei,
+				ActualWei:   ev.AmountWei,
+				Detail:      "RewardClaimed amount differs from the reward",
+			})
+		}
+	}
+
+	// Entries outside the indexed range can't be checked yet, or any more
+	for _, e := range entries {
+		if e.ConfirmedAt.Before(cutoff) || e.Block < from || e.Block > to || matched[strings.ToLower(e.TxHash)] > 0 {
+			continue
+		}
+		issue(ReconciliationIssue{
+			Type:        IssueMissingPayout,
+			Wallet:      e.Wallet,
+			RewardID:    e.RewardID,
+			TxHash:      e.TxHash,
+			ClaimID:     e.ClaimID,
+			ExpectedWei: e.AmountWei,
+			Detail:      fmt.Sprintf("confirmed in block %d but no RewardClaimed event was indexed", e.Block),
+		})
+	}
+
+	// getUserEarnings is a lifetime total, so it can only be compared
+	// exactly when the index reaches back to the first block
+	onChainWei := new(big.Int)
+	addrs := make([]string, 0, len(wallets))
+	for wallet := range wallets {
+		addrs = append(addrs, wallet)
+	}
+	sort.Strings(addrs)
+	for _, wallet := range addrs {
+		t := wallets[wallet]
+		onChain, err := bc.GetUserEarnings(wallet)
+		if err != nil {
+			cr.Error = fmt.Sprintf("getUserEarnings(%s): %v", wallet, err)
+			break
+		}
+		onChainWei.Add(onChainWei, onChain)
+
+		upper := new(big.Int).Add(t.indexed, t.pending)
+		switch {
+		case onChain.Cmp(t.ledger) < 0:
+			issue(ReconciliationIssue{
+				Type:        IssueEarningsMismatch,
+				Wallet:      wallet,
+				ExpectedWei: t.ledger.String(),
+				ActualWei:   onChain.String(),
+				Detail:      "getUserEarnings is less than the backend saw confirmed",
+			})
+		case from == 0 && (onChain.Cmp(t.indexed) < 0 || onChain.Cmp(upper) > 0):
+			issue(ReconciliationIssue{
+				Type:        IssueEarningsMismatch,
+				Wallet:      wallet,
+				ExpectedWei: t.indexed.String(),
+				ActualWei:   onChain.String(),
+				Detail:      "getUserEarnings differs from the sum of the wallet's RewardClaimed events",
+			})
+		}
+	}
+
+	sort.SliceStable(cr.Issues, func(i, j int) bool {
+		a, b := cr.Issues[i], cr.Issues[j]
+		if a.Type != b.Type {
+			return a.Type < b.Type
+		}
+		if a.Wallet != b.Wallet {
+			return a.Wallet < b.Wallet
+		}
+		return a.TxHash < b.TxHash
+	})
+	cr.Wallets = len(wallets)
+	cr.LedgerWei = ledgerWei.String()
+	cr.IndexedWei = indexedWei.String()
+	cr.OnChainWei = onChainWei.String()
+	return cr
+}
+
+// reconcile runs a reconciliation, exports its issue counts and saves the
+// report for the admin API on every replica
+func (s *Server) reconcile() *ReconciliationReport {
+	s.reconcileMux.Lock()
+	defer s.reconcileMux.Unlock()
+
+	now := time.Now()
+	for _, bc := range s.chains.all() {
+		if err := s.ledger.prune(bc.ChainID(), now); err != nil {
+			log.Printf("⚠️ Failed to prune payout ledger of chain %d: %v", bc.ChainID(), err)
+		}
+	}
+
+	report := (&reconciler{
+		chains:   s.chains.all(),
+		earnings: s.earnings,
+		ledger:   s.ledger,
+		rewards:  s.rewards,
+	}).run(now)
+
+	for _, t := range issueTypes {
+		metricReconciliationIssues.Set(float64(report.IssueCounts[t]), string(t))
+	}
+	metricReconciliationRun.Set(float64(report.GeneratedAt.Unix()))
+
+	if data, err := json.Marshal(report); err == nil {
+		if err := s.state.set(reconciliationKey, data, 0); err != nil {
+			log.Printf("⚠️ Failed to save reconciliation report: %v", err)
+		}
+	}
+
+	if report.OK {
+		log.Printf("🧾 Reconciliation clean across %d chains (%d ms)", len(report.Chains), report.DurationMs)
+	} else {
+		log.Printf("🧾 Reconciliation found problems: %s", issueSummary(report))
+	}
+	return report
+}
+
+// issueSummary lists the non-zero issue counts and failed chains
+func issueSummary(report *ReconciliationReport) string {
+	var parts []string
+	for _, t := range issueTypes {
+		if n := report.IssueCounts[t]; n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, t))
+		}
+	}
+	for _, cr := range report.Chains {
+		if cr.Error != "" {
+			parts = append(parts, fmt.Sprintf("chain %d failed: %s", cr.ChainID, cr.Error))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// lastReconciliation returns the newest saved report from any replica
+func (s *Server) lastReconciliation() (*ReconciliationReport, bool, error) {
+	data, ok, err := s.state.get(reconciliationKey)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+	var report ReconciliationReport
+	if err := json.Unmarshal(data, &report); err != nil {
+		return nil, false, fmt.Errorf("corrupt reconciliation report: %w", err)
+	}
+	return &report, true, nil
+}
+
+// reconciliationLoop reconciles every reconcile_interval_ms on the leader,
+// and when asked
+func (s *Server) reconciliationLoop(ctx context.Context) {
+	ticker := time.NewTicker(reconcileCheckInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			interval := time.Duration(s.cfg().ReconcileIntervalMs) * time.Millisecond
+			if interval <= 0 || now.Sub(last) < interval || !s.isLeader() || s.draining.Load() {
+				continue
+			}
+			last = now
+			s.reconcile()
+		case <-s.reconcileNow:
+			if !s.isLeader() || s.draining.Load() {
+				continue
+			}
+			last = time.Now()
+			s.reconcile()
+		}
+	}
+}
+
+// ReconciliationRequested answers a request for a new reconciliation. The
+// leader runs it in the background; its report replaces the last one once
+// generated_at passes requested_at.
+type ReconciliationRequested struct {
+	RequestedAt time.Time             `json:"requested_at"`
+	Last        *ReconciliationReport `json:"last,omitempty"`
+}
+
+// requestReconcile has the leader reconcile in the background: this replica
+// if it leads, otherwise whichever does through the cluster channel
+func (s *Server) requestReconcile() {
+	if s.isLeader() {
+		s.queueReconcile()
+		return
+	}
+	s.publishCluster(clusterEvent{Reconcile: true})
+}
+
+// queueReconcile asks reconciliationLoop for a run. Requests made during a
+// run share the one after it.
+func (s *Server) queueReconcile() {
+	select {
+	case s.reconcileNow <- struct{}{}:
+	default:
+	}
+}
+
+// handleReconciliation returns the last reconciliation report. With
+// ?run=true, or before the first, it asks the leader for a new one and
+// answers 202; its getUserEarnings calls never hold up a request.
+func (s *Server) handleReconciliation(w http.ResponseWriter, r *http.Request) {
+	run := false
+	if raw := r.URL.Query().Get("run"); raw != "" {
+		var err error
+		if run, err = strconv.ParseBool(raw); err != nil {
+			writeError(w, newAPIError(CodeInvalidRequest, "run must be true or false", nil))
+			return
+		}
+	}
+
+	last, ok, err := s.lastReconciliation()
+	if err != nil {
+		writeError(w, asAPIError(err, CodeStateUnavailable))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if ok && !run {
+		json.NewEncoder(w).Encode(last)
+		return
+	}
+
+	requested := ReconciliationRequested{RequestedAt: time.Now().UTC(), Last: last}
+	s.requestReconcile()
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(requested)
+}
+
+// runReconcile is the reconcile command: it indexes RewardClaimed events of
+// every chain from where the stored index ends, or backfillStart without one,
+// reconciles them with the payout ledger and prints the report. It reports
+// whether all was well.
+func runReconcile(config *Config, out io.Writer, asJSON bool) (bool, error) {
+	chains, err := connectChains(config)
+	if err != nil {
+		return false, err
+	}
+	defer chains.Close()
+
+	state, err := openSharedState(config)
+	if err != nil {
+		return false, err
+	}
+	defer state.close()
+
+	ledger, err := newPayoutLedger(state, config.PayoutLedgerFile)
+	if err != nil {
+		return false, err
+	}
+
+	earnings := newEarningsLedger(state)
+	for _, bc := range chains.all() {
+		if bc.ContractAddress() == "" {
+			continue
+		}
+		head, err := bc.GetBlockNumber()
+		if err != nil {
+			return false, fmt.Errorf("chain %d: %w", bc.ChainID(), err)
+		}
+		if _, _, err := earnings.loadHistory(bc.ChainID(), bc.ContractAddress(), time.Now()); err != nil {
+			return false, fmt.Errorf("chain %d: %w", bc.ChainID(), err)
+		}
+		from, completeFrom, err := earnings.indexStart(bc, config, head, time.Now())
+		if err != nil {
+			return false, fmt.Errorf("chain %d: %w", bc.ChainID(), err)
+		}
+		earnings.setCompleteFrom(bc.ChainID(), completeFrom)
+		log.Printf("📒 Indexing RewardClaimed on chain %d, blocks %d to %d", bc.ChainID(), from, head)
+		if _, err := earnings.index(bc, from, head); err != nil {
+			return false, fmt.Errorf("chain %d: %w", bc.ChainID(), err)
+		}
+	}
+
+	report := (&reconciler{
+		chains:   chains.all(),
+		earnings: earnings,
+		ledger:   ledger,
+		rewards:  newRewardStore(state),
+	}).run(time.Now())
+
+	if asJSON {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		return report.OK, enc.Encode(report)
+	}
+	report.print(out)
+	return report.OK, nil
+}
+
+// print writes the report as aligned text
+func (report *ReconciliationReport) print(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	status := "OK"
+	if !report.OK {
+		status = issueSummary(report)
+	}
+	fmt.Fprintf(w, "Reconciliation at %s: %s\n", report.GeneratedAt.Format(time.RFC3339), status)
+
+	for _, cr := range report.Chains {
+		fmt.Fprintf(w, "\nChain %d (%s)\n", cr.ChainID, cr.Network)
+		switch {
+		case cr.Skipped != "":
+			fmt.Fprintf(w, "  skipped\t%s\n", cr.Skipped)
+			continue
+		case cr.Error != "":
+			fmt.Fprintf(w, "  error\t%s\n", cr.Error)
+		}
+		fmt.Fprintf(w, "  blocks\tledger from %d, indexed %d to %d\n", cr.LedgerFrom, cr.IndexedFrom, cr.IndexedTo)
+		fmt.Fprintf(w, "  ledger\t%d payouts, %s wei\n", cr.LedgerPayouts, cr.LedgerWei)
+		fmt.Fprintf(w, "  indexed\t%d payouts, %s wei (%d in flight)\n", cr.IndexedPayouts, cr.IndexedWei, cr.InFlight)
+		fmt.Fprintf(w, "  on chain\t%s wei over %d wallets\n", cr.OnChainWei, cr.Wallets)
+		for _, i := range cr.Issues {
+			ref := i.TxHash
+			if ref == "" {
+				ref = i.RewardID
+			}
+			fmt.Fprintf(w, "  %s\t%s %s: %s\n", i.Type, i.Wallet, ref, i.Detail)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// Deadline for dialing and for a single command round trip
+	redisCommandTimeout = 5 * time.Second
+
+	// Connections kept for reuse
+	redisPoolSize = 16
+
+	// Optimistic update attempts before giving up under contention, with a
+	// random pause of up to attempt × redisUpdateBackoff between them so
+	// competing writers spread out instead of colliding again
+	redisUpdateRetries = 16
+	redisUpdateBackoff = time.Millisecond
+
+	// Prefix on every key and channel, so one server can host other data
+	redisKeyPrefix = "chainpay:"
+)
+
+// pushScript appends ARGV[1] to the list at KEYS[1] unless it already holds
+// ARGV[2] entries, in one step so replicas can't overshoot the limit together
+var pushScript = redis.NewScript(`
+if redis.call('LLEN', KEYS[1]) >= tonumber(ARGV[2]) then return -1 end
+return redis.call('RPUSH', KEYS[1], ARGV[1])`)
+
+// redisState is sharedState over go-redis. It needs only core commands
+// (strings, hashes, lists, WATCH/MULTI/EXEC, EVAL and pub/sub), so it runs
+// against Redis, Valkey, KeyDB or an in-process stand-in.
+type redisState struct {
+	client *redis.Client
+
+	// Subscriptions stop when closed is closed
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newRedisState connects to a redis:// or rediss:// URL, with an optional
+// password and database number: redis://:password@host:6379/0
+func newRedisState(rawURL string) (*redisState, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("invalid redis URL: scheme must be redis or rediss, got %q", u.Scheme)
+	}
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL: %w", err)
+	}
+	opts.DialTimeout = redisCommandTimeout
+	opts.ReadTimeout = redisCommandTimeout
+	opts.WriteTimeout = redisCommandTimeout
+	opts.PoolSize = redisPoolSize
+	// A command that timed out may still have run; retrying an RPUSH or
+	// PUBLISH would repeat it, so failures go to the caller instead
+	opts.MaxRetries = -1
+
+	rs := &redisState{client: redis.NewClient(opts), closed: make(chan struct{})}
+
+	// Fail at startup rather than on the first heartbeat
+	ctx, cancel := context.WithTimeout(context.Background(), redisCommandTimeout)
+	defer cancel()
+	if err := rs.client.Ping(ctx).Err(); err != nil {
+		rs.client.Close()
+		return nil, fmt.Errorf("redis ping failed: %w", stateError(err))
+	}
+	return rs, nil
+}
+
+// stateError wraps transport failures in errStateUnavailable; error replies
+// from the server are returned as they are
+func stateError(err error) error {
+	var reply redis.Error
+	if err == nil || errors.As(err, &reply) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", errStateUnavailable, err)
+}
+
+// getBytes returns a string reply, with ok false for a missing key
+func getBytes(cmd *redis.StringCmd) ([]byte, bool, error) {
+	value, err := cmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, stateError(err)
+	}
+	return value, true, nil
+}
+
+func (rs *redisState) get(key string) ([]byte, bool, error) {
+	return getBytes(rs.client.Get(context.Background(), redisKeyPrefix+key))
+}
+
+func (rs *redisState) set(key string, value []byte, ttl time.Duration) error {
+	return stateError(rs.client.Set(context.Background(), redisKeyPrefix+key, value, ttl).Err())
+}
+
+func (rs *redisState) setNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	ok, err := rs.client.SetNX(context.Background(), redisKeyPrefix+key, value, ttl).Result()
+	return ok, stateError(err)
+}
+
+// update runs fn between WATCH and MULTI/EXEC, retrying when another client
+// changed the key in between. An error from fn ends the transaction with
+// UNWATCH and leaves the connection in the pool.
+func (rs *redisState) update(key string, ttl time.Duration, fn func([]byte) ([]byte, error)) error {
+	ctx := context.Background()
+	key = redisKeyPrefix + key
+	for attempt := 0; attempt < redisUpdateRetries; attempt++ {
+		var fnErr error
+		err := rs.client.Watch(ctx, func(tx *redis.Tx) error {
+			old, _, err := getBytes(tx.Get(ctx, key))
+			if err != nil {
+				return err
+			}
+			var next []byte
+			if next, fnErr = fn(old); fnErr != nil {
+				return fnErr
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				if next == nil {
+					pipe.Del(ctx, key)
+				} else {
+					pipe.Set(ctx, key, next, ttl)
+				}
+				return nil
+			})
+			return err
+		}, key)
+
+		switch {
+		case fnErr != nil:
+			if errors.Is(fnErr, errNoChange) {
+				return nil
+			}
+			return fnErr
+		case errors.Is(err, redis.TxFailedErr):
+			// The watched key changed, try again
+			time.Sleep(time.Duration(rand.Int63n(int64(attempt+1) * int64(redisUpdateBackoff))))
+		default:
+			return stateError(err)
+		}
+	}
+	return fmt.Errorf("%w: too much contention updating %s", errStateUnavailable, key)
+}
+
+func (rs *redisState) del(key string) error {
+	return stateError(rs.client.Del(context.Background(), redisKeyPrefix+key).Err())
+}
+
+func (rs *redisState) hset(key, field string, value []byte) error {
+	return stateError(rs.client.HSet(context.Background(), redisKeyPrefix+key, field, value).Err())
+}
+
+func (rs *redisState) hget(key, field string) ([]byte, bool, error) {
+	return getBytes(rs.client.HGet(context.Background(), redisKeyPrefix+key, field))
+}
+
+func (rs *redisState) hdel(key, field string) error {
+	return stateError(rs.client.HDel(context.Background(), redisKeyPrefix+key, field).Err())
+}
+
+func (rs *redisState) hgetall(key string) (map[string][]byte, error) {
+	values, err := rs.client.HGetAll(context.Background(), redisKeyPrefix+key).Result()
+	if err != nil {
+		return nil, stateError(err)
+	}
+	all := make(map[string][]byte, len(values))
+	for field, value := range values {
+		all[field] = []byte(value)
+	}
+	return all, nil
+}
+
+func (rs *redisState) hincr(key, field string, n int64) (int64, error) {
+	v, err := rs.client.HIncrBy(context.Background(), redisKeyPrefix+key, field, n).Result()
+	return v, stateError(err)
+}
+
+func (rs *redisState) push(key string, value []byte, max int) error {
+	ctx := context.Background()
+	if max <= 0 {
+		return stateError(rs.client.RPush(ctx, redisKeyPrefix+key, value).Err())
+	}
+	n, err := pushScript.Run(ctx, rs.client, []string{redisKeyPrefix + key}, value, max).Int64()
+	if err != nil {
+		return stateError(err)
+	}
+	if n < 0 {
+		return errQueueFull
+	}
+	return nil
+}
+
+func (rs *redisState) pushFront(key string, value []byte) error {
+	return stateError(rs.client.LPush(context.Background(), redisKeyPrefix+key, value).Err())
+}
+
+func (rs *redisState) pop(key string) ([]byte, bool, error) {
+	return getBytes(rs.client.LPop(context.Background(), redisKeyPrefix+key))
+}
+
+func (rs *redisState) list(key string) ([][]byte, error) {
+	values, err := rs.client.LRange(context.Background(), redisKeyPrefix+key, 0, -1).Result()
+	if err != nil {
+		return nil, stateError(err)
+	}
+	l := make([][]byte, len(values))
+	for i, v := range values {
+		l[i] = []byte(v)
+	}
+	return l, nil
+}
+
+func (rs *redisState) publish(channel string, msg []byte) error {
+	return stateError(rs.client.Publish(context.Background(), redisKeyPrefix+channel, msg).Err())
+}
+
+// subscribe delivers messages until ctx is done or the state is closed;
+// go-redis reconnects a dropped subscription by itself. Messages published
+// while disconnected are lost, as with any Redis pub/sub.
+func (rs *redisState) subscribe(ctx context.Context, channel string, fn func([]byte)) {
+	sub := rs.client.Subscribe(ctx, redisKeyPrefix+channel)
+	defer sub.Close()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-rs.closed:
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			fn([]byte(msg.Payload))
+		}
+	}
+}
+
+func (rs *redisState) durable() bool { return true }
+
+func (rs *redisState) close() error {
+	var err error
+	rs.closeOnce.Do(func() {
+		close(rs.closed)
+		err = rs.client.Close()
+	})
+	return err
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestRedis starts an in-process Redis and returns it with a client
+func newTestRedis(t *testing.T) (*miniredis.Miniredis, *redisState) {
+	t.Helper()
+	m := miniredis.RunT(t)
+	return m, dialTestRedis(t, m)
+}
+
+// dialTestRedis opens another client on m, as a second replica would
+func dialTestRedis(t *testing.T, m *miniredis.Miniredis) *redisState {
+	t.Helper()
+	rs, err := newRedisState("redis://" + m.Addr())
+	if err != nil {
+		t.Fatalf("connect to redis: %v", err)
+	}
+	t.Cleanup(func() { rs.close() })
+	return rs
+}
+
+func TestRedisStateURL(t *testing.T) {
+	m := miniredis.RunT(t)
+	m.RequireAuth("hunter2")
+
+	if _, err := newRedisState("redis://" + m.Addr()); err == nil {
+		t.Error("connected without the password")
+	}
+	rs, err := newRedisState("redis://:hunter2@" + m.Addr() + "/3")
+	if err != nil {
+		t.Fatalf("connect with password and database: %v", err)
+	}
+	defer rs.close()
+	if err := rs.set("k", []byte("v"), 0); err != nil {
+		t.Fatal(err)
+	}
+	m.Select(3)
+	if got, _ := m.Get(redisKeyPrefix + "k"); got != "v" {
+		t.Errorf("database 3 has %q, want the key written there", got)
+	}
+
+	for _, bad := range []string{"http://" + m.Addr(), "redis://" + m.Addr() + "/zero"} {
+		if _, err := newRedisState(bad); err == nil {
+			t.Errorf("newRedisState(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestRedisStateKeysAndTTL(t *testing.T) {
+	m, rs := newTestRedis(t)
+
+	if err := rs.set("a", []byte("1"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if v, ok, err := rs.get("a"); err != nil || !ok || string(v) != "1" {
+		t.Fatalf("get = %q, %v, %v", v, ok, err)
+	}
+	if ok, err := rs.setNX("a", []byte("2"), 0); err != nil || ok {
+		t.Fatalf("setNX on an existing key = %v, %v", ok, err)
+	}
+
+	m.FastForward(time.Minute)
+	if _, ok, _ := rs.get("a"); ok {
+		t.Error("key outlived its TTL")
+	}
+	if ok, err := rs.setNX("a", []byte("2"), 0); err != nil || !ok {
+		t.Fatalf("setNX after expiry = %v, %v", ok, err)
+	}
+
+	if err := rs.hset("h", "f", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	all, err := rs.hgetall("h")
+	if err != nil || len(all) != 1 || string(all["f"]) != "x" {
+		t.Fatalf("hgetall = %v, %v", all, err)
+	}
+	rs.hdel("h", "f")
+	if _, ok, _ := rs.hget("h", "f"); ok {
+		t.Error("hget found a deleted field")
+	}
+
+	rs.hincr("h", "n", 2)
+	if n, err := rs.hincr("h", "n", 3); err != nil || n != 5 {
+		t.Fatalf("hincr = %d, %v, want 5", n, err)
+	}
+}
+
+func TestRedisStateUpdateConflicts(t *testing.T) {
+	m, rs := newTestRedis(t)
+	other := dialTestRedis(t, m)
+
+	// Another client writes between WATCH and EXEC: the first attempt is
+	// discarded and fn runs again on the new value
+	calls := 0
+	err := rs.update("counter", 0, func(old []byte) ([]byte, error) {
+		calls++
+		if calls == 1 {
+			if err := other.set("counter", []byte("10"), 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+		n, _ := strconv.Atoi(string(old))
+		return []byte(strconv.Itoa(n + 1)), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _, _ := rs.get("counter"); string(v) != "11" || calls != 2 {
+		t.Fatalf("counter = %s after %d attempts, want 11 after 2", v, calls)
+	}
+
+	// Concurrent updates from two clients are never lost
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		client := rs
+		if i%2 == 1 {
+			client = other
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := client.update("counter", 0, func(old []byte) ([]byte, error) {
+				n, _ := strconv.Atoi(string(old))
+				return []byte(strconv.Itoa(n + 1)), nil
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if v, _, _ := rs.get("counter"); string(v) != "31" {
+		t.Errorf("counter = %s after 20 concurrent increments, want 31", v)
+	}
+
+	// errNoChange leaves the key alone, other errors are returned, nil deletes
+	if err := rs.update("counter", 0, func([]byte) ([]byte, error) { return nil, errNoChange }); err != nil {
+		t.Errorf("errNoChange returned %v", err)
+	}
+	boom := errors.New("boom")
+	if err := rs.update("counter", 0, func([]byte) ([]byte, error) { return nil, boom }); !errors.Is(err, boom) {
+		t.Errorf("fn error returned %v, want boom", err)
+	}
+	if v, _, _ := rs.get("counter"); string(v) != "31" {
+		t.Errorf("counter = %s after aborted updates", v)
+	}
+
+	// fn's errors end the transaction, not the connection
+	dialed := rs.client.PoolStats().Misses
+	for i := 0; i < 20; i++ {
+		rs.update("counter", 0, func([]byte) ([]byte, error) { return nil, errQueueFull })
+	}
+	if stats := rs.client.PoolStats(); stats.Misses != dialed || stats.TotalConns != stats.IdleConns {
+		t.Errorf("rejected updates dialed %d connections (pool %+v), want the pooled one reused", stats.Misses-dialed, stats)
+	}
+	if err := rs.update("counter", 0, func([]byte) ([]byte, error) { return nil, nil }); err != nil {
+		t.Fatal(err)
+	}
+	if m.Exists(redisKeyPrefix + "counter") {
+		t.Error("update returning nil kept the key")
+	}
+
+	// Contention that never settles gives up with errStateUnavailable
+	attempts := 0
+	err = rs.update("contended", 0, func([]byte) ([]byte, error) {
+		attempts++
+		other.set("contended", []byte(strconv.Itoa(attempts)), 0)
+		return []byte("mine"), nil
+	})
+	if !errors.Is(err, errStateUnavailable) || attempts != redisUpdateRetries {
+		t.Errorf("endless contention: %v after %d attempts", err, attempts)
+	}
+}
+
+func TestRedisStateQueue(t *testing.T) {
+	m, rs := newTestRedis(t)
+
+	for i := 1; i <= 3; i++ {
+		if err := rs.push("q", []byte(strconv.Itoa(i)), 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rs.push("q", []byte("4"), 3); !errors.Is(err, errQueueFull) {
+		t.Fatalf("push past max = %v, want errQueueFull", err)
+	}
+	if err := rs.pushFront("q", []byte("0")); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := rs.list("q")
+	if err != nil || len(items) != 4 {
+		t.Fatalf("list = %q, %v", items, err)
+	}
+	for want := 0; want <= 3; want++ {
+		v, ok, err := rs.pop("q")
+		if err != nil || !ok || string(v) != strconv.Itoa(want) {
+			t.Fatalf("pop = %q, %v, %v; want %d", v, ok, err, want)
+		}
+	}
+	if _, ok, err := rs.pop("q"); ok || err != nil {
+		t.Errorf("pop on an empty queue = %v, %v", ok, err)
+	}
+
+	// Replicas pushing at once never take the queue past max
+	other := dialTestRedis(t, m)
+	var wg sync.WaitGroup
+	var accepted atomic.Int32
+	for i := 0; i < 40; i++ {
+		client := rs
+		if i%2 == 1 {
+			client = other
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			switch err := client.push("shared", []byte("x"), 10); {
+			case err == nil:
+				accepted.Add(1)
+			case !errors.Is(err, errQueueFull):
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n, _ := rs.client.LLen(context.Background(), redisKeyPrefix+"shared").Result(); n != 10 || accepted.Load() != 10 {
+		t.Errorf("queue holds %d after %d accepted pushes, want 10", n, accepted.Load())
+	}
+}
+
+func TestRedisStateBroadcastAndResubscribe(t *testing.T) {
+	m, publisher := newTestRedis(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Two replicas subscribe; both get every message
+	received := make([]chan string, 2)
+	for i := range received {
+		ch := make(chan string, 16)
+		received[i] = ch
+		go dialTestRedis(t, m).subscribe(ctx, "events", func(msg []byte) { ch <- string(msg) })
+	}
+	expectEverywhere := func(msg string) {
+		t.Helper()
+		for i, ch := range received {
+			deadline := time.After(10 * time.Second)
+			for got := ""; got != msg; {
+				select {
+				case got = <-ch:
+				case <-time.After(100 * time.Millisecond):
+					// Still subscribing or reconnecting: publish again
+					publisher.publish("events", []byte(msg))
+				case <-deadline:
+					t.Fatalf("replica %d never got %q", i, msg)
+				}
+			}
+		}
+	}
+	publisher.publish("events", []byte("hello"))
+	expectEverywhere("hello")
+
+	// A restarted server drops the subscriptions; they come back by themselves
+	m.Close()
+	if err := m.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	expectEverywhere("again")
+
+	// Cancelling stops the subscription
+	cancel()
+	waitFor(t, 5*time.Second, func() error {
+		if n := m.PubSubNumSub(redisKeyPrefix + "events")[redisKeyPrefix+"events"]; n != 0 {
+			return fmt.Errorf("%d subscribers left", n)
+		}
+		return nil
+	})
+}
+
+func TestLeaderLeaseTakeoverAndExpiry(t *testing.T) {
+	m, rs := newTestRedis(t)
+	a := &Server{replicaID: "replica-a", state: rs}
+	b := &Server{replicaID: "replica-b", state: dialTestRedis(t, m)}
+
+	a.renewLease()
+	b.renewLease()
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("first replica to renew should lead: a=%v b=%v", a.isLeader(), b.isLeader())
+	}
+	if ttl := m.TTL(redisKeyPrefix + leaderKey); ttl != leaderLeaseTTL {
+		t.Errorf("lease TTL = %s, want %s", ttl, leaderLeaseTTL)
+	}
+
+	// Renewing extends the lease
+	m.FastForward(clusterTickInterval)
+	a.renewLease()
+	if ttl := m.TTL(redisKeyPrefix + leaderKey); ttl != leaderLeaseTTL {
+		t.Errorf("renewed lease TTL = %s, want %s", ttl, leaderLeaseTTL)
+	}
+
+	// A leader that stops renewing loses the lease when it expires
+	m.FastForward(leaderLeaseTTL)
+	b.renewLease()
+	if !b.isLeader() {
+		t.Fatal("second replica did not take an expired lease")
+	}
+	a.renewLease()
+	if got, _ := m.Get(redisKeyPrefix + leaderKey); got != b.replicaID {
+		t.Fatalf("lease held by %q after the old leader renewed, want %q", got, b.replicaID)
+	}
+
+	// Resigning frees the lease at once
+	b.leading = true
+	b.resignLeadership()
+	if b.isLeader() || m.Exists(redisKeyPrefix+leaderKey) {
+		t.Fatal("resigned leader kept the lease")
+	}
+	a.leaseUntil.Store(0)
+	a.renewLease()
+	if !a.isLeader() {
+		t.Error("replica did not take the lease a resigned leader freed")
+	}
+}
+
+func TestReplicasShareRewardsThroughRedis(t *testing.T) {
+	m := miniredis.RunT(t)
+	config := newDemoConfig(t, "")
+	chains := startDemoChain(t, config)
+
+	leader := startReplica(t, config, chains, dialTestRedis(t, m))
+	follower := startReplica(t, config, chains, dialTestRedis(t, m))
+	if !leader.server.isLeader() || follower.server.isLeader() {
+		t.Fatalf("want exactly the first replica leading: %v %v", leader.server.isLeader(), follower.server.isLeader())
+	}
+
+	var stats StatsResponse
+	getJSON(t, follower, "/api/v1/stats", &stats)
+	if !stats.Cluster.Shared || stats.Cluster.Leader != leader.server.replicaID || len(stats.Cluster.Replicas) != 2 {
+		t.Fatalf("cluster stats = %+v", stats.Cluster)
+	}
+
+	// A heartbeat on the follower is queued in Redis and settled by the
+	// leader; the result reaches the follower's socket over pub/sub
+	c, _ := dialWS(t, follower)
+	wallet := newWallet(t)
+	c.send(t, map[string]interface{}{"type": "register", "wallet_address": wallet})
+	c.send(t, map[string]interface{}{"type": "heartbeat", "ad_id": "ad-1", "duration_ms": 5000})
+	id, _ := c.expect(t, "heartbeat_ack")["reward_id"].(string)
+	sent := c.skipUntil(t, "reward", func(m map[string]interface{}) bool { return m["reward_id"] == id })
+	if sent["success"] != true {
+		t.Fatalf("reward not submitted: %v", sent)
+	}
+	c.skipUntil(t, "reward_status", func(m map[string]interface{}) bool {
+		return m["reward_id"] == id && m["status"] == string(RewardConfirmed)
+	})
+
+	// Both replicas read the same reward record
+	var rec RewardRecord
+	getJSON(t, leader, "/api/v1/reward/"+id, &rec)
+	if rec.Status != RewardConfirmed || rec.WalletAddress == "" {
+		t.Errorf("leader sees reward %s as %+v", id, rec)
+	}
+}
@@ -0,0 +1,1095 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// How often accrued referral bonuses are sent
+	referralSettleInterval = time.Minute
+
+	// How often accruals are written to the referral file
+	referralFlushInterval = 5 * time.Second
+
+	// Referral codes avoid 0/O, 1/I/L so they can be read out loud
+	referralCodeAlphabet = "23456789ABCDEFGHJKMNPQRSTUVWXYZ"
+	referralCodeLength   = 8
+)
+
+var (
+	errReferralCodeNotFound = errors.New("referral code not found")
+	errAlreadyReferred      = errors.New("wallet already has a referrer")
+	errReferralIneligible   = errors.New("wallet can't be referred")
+)
+
+// ReferralBinding ties a referee to the referrer whose code it registered with
+type ReferralBinding struct {
+	Referee  string    `json:"referee"`
+	Referrer string    `json:"referrer"`
+	Code     string    `json:"code"`
+	BoundAt  time.Time `json:"bound_at"`
+	BonusWei string    `json:"bonus_wei"` // accrued for the referrer so far, all chains
+}
+
+// ReferralPayout is one bonus transaction to a referrer
+type ReferralPayout struct {
+	RewardID  string       `json:"reward_id"`
+	ChainID   int64        `json:"chain_id"`
+	Referrer  string       `json:"referrer"`
+	AmountWei string       `json:"amount_wei"`
+	ClaimID   string       `json:"claim_id"`
+	Status    RewardStatus `json:"status"`
+	TxHash    string       `json:"tx_hash,omitempty"`
+	ErrorCode string       `json:"error_code,omitempty"`
+	CreatedAt time.Time    `json:"created_at"`
+	UpdatedAt time.Time    `json:"updated_at"`
+}
+
+type referralKey struct {
+	chainID  int64
+	referrer string // lowercase
+}
+
+func (k referralKey) String() string { return fmt.Sprintf("%d:%s", k.chainID, k.referrer) }
+
+// parseReferralKey reverses referralKey.String
+func parseReferralKey(s string) (referralKey, bool) {
+	chain, referrer, ok := strings.Cut(s, ":")
+	chainID, err := strconv.ParseInt(chain, 10, 64)
+	if !ok || err != nil {
+		return referralKey{}, false
+	}
+	return referralKey{chainID, referrer}, true
+}
+
+// pendingReferral is an accrued, unsent bonus as saved to the referral file
+type pendingReferral struct {
+	ChainID   int64  `json:"chain_id"`
+	Referrer  string `json:"referrer"`
+	AmountWei string `json:"amount_wei"`
+}
+
+// referralFile is the on-disk form of a referralStore
+type referralFile struct {
+	Codes    map[string]string           `json:"codes"`    // code → referrer
+	Bindings map[string]*ReferralBinding `json:"bindings"` // by referee
+	Pending  []pendingReferral           `json:"pending"`
+	Payouts  []*ReferralPayout           `json:"payouts"`
+
+	// When each wallet was first rewarded; such wallets can't be referred
+	FirstSeen map[string]time.Time `json:"first_seen,omitempty"`
+}
+
+// referralAccruals are the bonuses accrued and not yet sent, and each
+// referee's lifetime contribution, kept together so they change atomically
+type referralAccruals struct {
+	Pending map[string]string `json:"pending"` // referralKey → wei
+	Bonus   map[string]string `json:"bonus"`   // lowercase referee → wei, all chains
+}
+
+// Shared state keys of the referral store
+const (
+	referralCodesKey       = "referral:codes"        // hash: code → lowercase referrer
+	referralWalletCodesKey = "referral:wallet-codes" // hash: lowercase referrer → code
+	referralBindingsKey    = "referral:bindings"     // hash: lowercase referee → ReferralBinding
+	referralAccrualsKey    = "referral:accruals"     // referralAccruals
+	referralPayoutsKey     = "referral:payouts"      // hash: reward ID → ReferralPayout
+	referralFirstSeenKey   = "referral:first-seen"   // hash: lowercase wallet → RFC 3339 time
+	referralLockPrefix     = "referral:lock:"
+)
+
+const (
+	// How long a referral lock is held at most, should its holder die
+	referralLockTTL = 10 * time.Second
+
+	// How long to wait for another replica's referral lock
+	referralLockWait = 2 * time.Second
+)
+
+// referralStore holds referral codes, bindings, accrued bonuses and bonus
+// payouts in shared state, so every replica sees the same referrals. Without
+// Redis the store is also saved to file: codes, bindings and payouts at
+// once, accruals every referralFlushInterval.
+type referralStore struct {
+	state sharedState
+	file  string      // "" when state is durable or referrals are memory only
+	mu    sync.Mutex  // serialises writes to file
+	dirty atomic.Bool // accruals changed since the last save
+}
+
+// newReferralStore opens the store, loading file into state. With durable
+// state the file is imported once, without overwriting anything already
+// shared, and no longer written.
+func newReferralStore(state sharedState, file string) (*referralStore, error) {
+	rs := &referralStore{state: state}
+	if file == "" {
+		return rs, nil
+	}
+	if !state.durable() {
+		rs.file = file
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return rs, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read referrals: %w", err)
+	}
+
+	var saved referralFile
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	if err := rs.load(saved); err != nil {
+		return nil, fmt.Errorf("failed to load %s: %w", file, err)
+	}
+	if state.durable() {
+		log.Printf("🤝 Imported referrals from %s into shared state; the file is no longer updated", file)
+	}
+	return rs, nil
+}
+
+// load copies saved into state, keeping entries state already has
+func (rs *referralStore) load(saved referralFile) error {
+	hsetNew := func(key, field string, value []byte) error {
+		if _, ok, err := rs.state.hget(key, field); ok || err != nil {
+			return err
+		}
+		return rs.state.hset(key, field, value)
+	}
+
+	for code, wallet := range saved.Codes {
+		if err := hsetNew(referralCodesKey, code, []byte(wallet)); err != nil {
+			return err
+		}
+		if err := hsetNew(referralWalletCodesKey, wallet, []byte(code)); err != nil {
+			return err
+		}
+	}
+	accruals := referralAccruals{Pending: make(map[string]string), Bonus: make(map[string]string)}
+	for referee, b := range saved.Bindings {
+		accruals.Bonus[referee] = b.BonusWei
+		data, err := json.Marshal(b)
+		if err != nil {
+			return err
+		}
+		if err := hsetNew(referralBindingsKey, referee, data); err != nil {
+			return err
+		}
+	}
+	for _, p := range saved.Pending {
+		if _, ok := new(big.Int).SetString(p.AmountWei, 10); !ok {
+			return fmt.Errorf("bad pending amount %q", p.AmountWei)
+		}
+		accruals.Pending[referralKey{p.ChainID, p.Referrer}.String()] = p.AmountWei
+	}
+	data, err := json.Marshal(accruals)
+	if err != nil {
+		return err
+	}
+	if _, err := rs.state.setNX(referralAccrualsKey, data, 0); err != nil {
+		return err
+	}
+	for _, p := range saved.Payouts {
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if err := hsetNew(referralPayoutsKey, p.RewardID, data); err != nil {
+			return err
+		}
+	}
+	for wallet, at := range saved.FirstSeen {
+		if err := hsetNew(referralFirstSeenKey, wallet, []byte(at.Format(time.RFC3339))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot reads the whole store back from state, in its file form
+func (rs *referralStore) snapshot() (referralFile, error) {
+	saved := referralFile{Codes: make(map[string]string), Bindings: make(map[string]*ReferralBinding)}
+
+	codes, err := rs.state.hgetall(referralCodesKey)
+	if err != nil {
+		return saved, err
+	}
+	for code, wallet := range codes {
+		saved.Codes[code] = string(wallet)
+	}
+	bindings, err := rs.bindings()
+	if err != nil {
+		return saved, err
+	}
+	for _, b := range bindings {
+		b := b
+		saved.Bindings[b.Referee] = &b
+	}
+	accruals, err := rs.accruals()
+	if err != nil {
+		return saved, err
+	}
+	saved.Pending = make([]pendingReferral, 0, len(accruals.Pending))
+	for k, amount := range accruals.Pending {
+		if key, ok := parseReferralKey(k); ok {
+			saved.Pending = append(saved.Pending, pendingReferral{key.chainID, key.referrer, amount})
+		}
+	}
+	sort.Slice(saved.Pending, func(i, j int) bool {
+		a, b := saved.Pending[i], saved.Pending[j]
+		return a.ChainID < b.ChainID || (a.ChainID == b.ChainID && a.Referrer < b.Referrer)
+	})
+	payouts, err := rs.payouts()
+	if err != nil {
+		return saved, err
+	}
+	for i := range payouts {
+		saved.Payouts = append(saved.Payouts, &payouts[i])
+	}
+	seen, err := rs.state.hgetall(referralFirstSeenKey)
+	if err != nil {
+		return saved, err
+	}
+	saved.FirstSeen = make(map[string]time.Time, len(seen))
+	for wallet, raw := range seen {
+		if at, err := time.Parse(time.RFC3339, string(raw)); err == nil {
+			saved.FirstSeen[wallet] = at
+		}
+	}
+	return saved, nil
+}
+
+// markSeen records wallet's first reward, once
+func (rs *referralStore) markSeen(wallet string, at time.Time) error {
+	key := strings.ToLower(wallet)
+	if _, ok, err := rs.state.hget(referralFirstSeenKey, key); ok || err != nil {
+		return err
+	}
+	if err := rs.state.hset(referralFirstSeenKey, key, []byte(at.UTC().Format(time.RFC3339))); err != nil {
+		return err
+	}
+	rs.dirty.Store(true)
+	return nil
+}
+
+// seen reports whether wallet has ever been rewarded
+func (rs *referralStore) seen(wallet string) (bool, error) {
+	_, ok, err := rs.state.hget(referralFirstSeenKey, strings.ToLower(wallet))
+	return ok, err
+}
+
+// save writes the store to file atomically, when there is one
+func (rs *referralStore) save() error {
+	if rs.file == "" {
+		return nil
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.dirty.Store(false)
+
+	saved, err := rs.snapshot()
+	if err != nil {
+		rs.dirty.Store(true)
+		return fmt.Errorf("failed to save referrals: %w", err)
+	}
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(rs.file), ".referrals-*")
+	if err != nil {
+		return fmt.Errorf("failed to save referrals: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save referrals: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save referrals: %w", err)
+	}
+	return os.Rename(tmp.Name(), rs.file)
+}
+
+// flush saves accruals recorded since the last save
+func (rs *referralStore) flush() {
+	if !rs.dirty.Load() {
+		return
+	}
+	if err := rs.save(); err != nil {
+		rs.dirty.Store(true)
+		log.Printf("⚠️ %v", err)
+	}
+}
+
+// lock takes a short-lived lock on name shared by every replica, so a
+// check and the write that depends on it can't interleave with another's
+func (rs *referralStore) lock(name string) (unlock func(), err error) {
+	key := referralLockPrefix + name
+	token := newRewardID()
+	deadline := time.Now().Add(referralLockWait)
+	for {
+		ok, err := rs.state.setNX(key, []byte(token), referralLockTTL)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w: referral lock %s is busy", errStateUnavailable, name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return func() {
+		err := rs.state.update(key, referralLockTTL, func(old []byte) ([]byte, error) {
+			if string(old) != token {
+				return nil, errNoChange // expired and taken by someone else
+			}
+			return nil, nil
+		})
+		if err != nil {
+			log.Printf("⚠️ Failed to release referral lock %s: %v", name, err)
+		}
+	}, nil
+}
+
+// newReferralCode returns a random code from referralCodeAlphabet
+func newReferralCode() (string, error) {
+	b := make([]byte, referralCodeLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(referralCodeAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = referralCodeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// code returns wallet's referral code, creating one on first use
+func (rs *referralStore) code(wallet string) (string, error) {
+	key := strings.ToLower(wallet)
+	if code, ok, err := rs.state.hget(referralWalletCodesKey, key); ok || err != nil {
+		return string(code), err
+	}
+
+	unlock, err := rs.lock("wallet:" + key)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	if code, ok, err := rs.state.hget(referralWalletCodesKey, key); ok || err != nil {
+		return string(code), err
+	}
+
+	for {
+		code, err := newReferralCode()
+		if err != nil {
+			return "", err
+		}
+		unlockCode, err := rs.lock("code:" + code)
+		if err != nil {
+			return "", err
+		}
+		_, taken, err := rs.state.hget(referralCodesKey, code)
+		if err == nil && !taken {
+			err = rs.state.hset(referralCodesKey, code, []byte(key))
+		}
+		unlockCode()
+		if err != nil {
+			return "", err
+		}
+		if taken {
+			continue
+		}
+		if err := rs.state.hset(referralWalletCodesKey, key, []byte(code)); err != nil {
+			return "", err
+		}
+		return code, rs.save()
+	}
+}
+
+// bind makes the owner of code referee's referrer. Only wallets new to the
+// backend may be referred, so nobody can claim existing users.
+func (rs *referralStore) bind(referee, code string, isNew bool, now time.Time) (ReferralBinding, error) {
+	key := strings.ToLower(referee)
+	code = strings.ToUpper(code)
+
+	owner, ok, err := rs.state.hget(referralCodesKey, code)
+	if err != nil {
+		return ReferralBinding{}, err
+	}
+	if !ok {
+		return ReferralBinding{}, errReferralCodeNotFound
+	}
+	referrer := string(owner)
+
+	unlock, err := rs.lock("referee:" + key)
+	if err != nil {
+		return ReferralBinding{}, err
+	}
+	defer unlock()
+
+	if _, bound, err := rs.binding(key); err != nil {
+		return ReferralBinding{}, err
+	} else if bound {
+		return ReferralBinding{}, errAlreadyReferred
+	}
+	if referrer == key {
+		return ReferralBinding{}, fmt.Errorf("%w: can't use your own code", errReferralIneligible)
+	}
+	if b, ok, err := rs.binding(referrer); err != nil {
+		return ReferralBinding{}, err
+	} else if ok && b.Referrer == key {
+		return ReferralBinding{}, fmt.Errorf("%w: referrer was referred by this wallet", errReferralIneligible)
+	}
+	if !isNew {
+		return ReferralBinding{}, fmt.Errorf("%w: only new wallets can be referred", errReferralIneligible)
+	}
+
+	b := ReferralBinding{Referee: key, Referrer: referrer, Code: code, BoundAt: now.UTC(), BonusWei: "0"}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return ReferralBinding{}, err
+	}
+	if err := rs.state.hset(referralBindingsKey, key, data); err != nil {
+		return ReferralBinding{}, err
+	}
+	return b, rs.save()
+}
+
+// binding returns who referred wallet, if anyone
+func (rs *referralStore) binding(wallet string) (ReferralBinding, bool, error) {
+	data, ok, err := rs.state.hget(referralBindingsKey, strings.ToLower(wallet))
+	if !ok || err != nil {
+		return ReferralBinding{}, false, err
+	}
+	var b ReferralBinding
+	if err := json.Unmarshal(data, &b); err != nil {
+		return ReferralBinding{}, false, fmt.Errorf("corrupt referral binding for %s: %w", wallet, err)
+	}
+	accruals, err := rs.accruals()
+	if err != nil {
+		return ReferralBinding{}, false, err
+	}
+	b.withBonus(accruals)
+	return b, true, nil
+}
+
+// bindings returns every binding, with its accrued bonus
+func (rs *referralStore) bindings() ([]ReferralBinding, error) {
+	all, err := rs.state.hgetall(referralBindingsKey)
+	if err != nil {
+		return nil, err
+	}
+	accruals, err := rs.accruals()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ReferralBinding, 0, len(all))
+	for referee, data := range all {
+		var b ReferralBinding
+		if err := json.Unmarshal(data, &b); err != nil {
+			log.Printf("⚠️ Skipping corrupt referral binding for %s: %v", referee, err)
+			continue
+		}
+		b.withBonus(accruals)
+		list = append(list, b)
+	}
+	return list, nil
+}
+
+// withBonus fills in the bonus accrued through b so far
+func (b *ReferralBinding) withBonus(accruals referralAccruals) {
+	if bonus, ok := accruals.Bonus[b.Referee]; ok {
+		b.BonusWei = bonus
+	}
+}
+
+// accruals reads the shared accruals
+func (rs *referralStore) accruals() (referralAccruals, error) {
+	a := referralAccruals{Pending: make(map[string]string), Bonus: make(map[string]string)}
+	data, ok, err := rs.state.get(referralAccrualsKey)
+	if !ok || err != nil {
+		return a, err
+	}
+	if err := json.Unmarshal(data, &a); err != nil {
+		return a, fmt.Errorf("corrupt referral accruals: %w", err)
+	}
+	if a.Pending == nil {
+		a.Pending = make(map[string]string)
+	}
+	if a.Bonus == nil {
+		a.Bonus = make(map[string]string)
+	}
+	return a, nil
+}
+
+// modifyAccruals applies fn to the shared accruals atomically
+func (rs *referralStore) modifyAccruals(fn func(*referralAccruals) error) error {
+	err := rs.state.update(referralAccrualsKey, 0, func(old []byte) ([]byte, error) {
+		a := referralAccruals{Pending: make(map[string]string), Bonus: make(map[string]string)}
+		if old != nil {
+			if err := json.Unmarshal(old, &a); err != nil {
+				return nil, fmt.Errorf("corrupt referral accruals: %w", err)
+			}
+		}
+		if a.Pending == nil {
+			a.Pending = make(map[string]string)
+		}
+		if a.Bonus == nil {
+			a.Bonus = make(map[string]string)
+		}
+		if err := fn(&a); err != nil {
+			return nil, err
+		}
+		return json.Marshal(a)
+	})
+	if err == nil {
+		rs.dirty.Store(true)
+	}
+	return err
+}
+
+// addWei adds amount to the decimal wei string at m[key]
+func addWei(m map[string]string, key string, amount *big.Int) {
+	total, ok := new(big.Int).SetString(m[key], 10)
+	if !ok {
+		total = new(big.Int)
+	}
+	m[key] = total.Add(total, amount).String()
+}
+
+// accrue credits referee's referrer with percent of a confirmed reward
+func (rs *referralStore) accrue(chainID int64, referee string, reward *big.Int, percent int) error {
+	if percent <= 0 {
+		return nil
+	}
+	bonus := new(big.Int).Mul(reward, big.NewInt(int64(percent)))
+	bonus.Quo(bonus, big.NewInt(100))
+	if bonus.Sign() == 0 {
+		return nil
+	}
+
+	b, ok, err := rs.binding(referee)
+	if !ok || err != nil {
+		return err
+	}
+	return rs.modifyAccruals(func(a *referralAccruals) error {
+		addWei(a.Bonus, b.Referee, bonus)
+		addWei(a.Pending, referralKey{chainID, b.Referrer}.String(), bonus)
+		return nil
+	})
+}
+
+// takeDue removes and returns accruals of at least minPayout wei
+func (rs *referralStore) takeDue(minPayout int64) (map[referralKey]*big.Int, error) {
+	var due map[referralKey]*big.Int
+	err := rs.modifyAccruals(func(a *referralAccruals) error {
+		due = make(map[referralKey]*big.Int)
+		for k, v := range a.Pending {
+			amount, ok := new(big.Int).SetString(v, 10)
+			key, valid := parseReferralKey(k)
+			if ok && valid && amount.Cmp(big.NewInt(minPayout)) >= 0 {
+				due[key] = amount
+				delete(a.Pending, k)
+			}
+		}
+		if len(due) == 0 {
+			return errNoChange
+		}
+		return nil
+	})
+	return due, err
+}
+
+// refund returns an unsent bonus to the referrer's accrual
+func (rs *referralStore) refund(key referralKey, amount *big.Int) error {
+	return rs.modifyAccruals(func(a *referralAccruals) error {
+		addWei(a.Pending, key.String(), amount)
+		return nil
+	})
+}
+
+// payouts returns every recorded bonus payout
+func (rs *referralStore) payouts() ([]ReferralPayout, error) {
+	all, err := rs.state.hgetall(referralPayoutsKey)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]ReferralPayout, 0, len(all))
+	for id, data := range all {
+		var p ReferralPayout
+		if err := json.Unmarshal(data, &p); err != nil {
+			log.Printf("⚠️ Skipping corrupt referral payout %s: %v", id, err)
+			continue
+		}
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.Before(list[j].CreatedAt) })
+	return list, nil
+}
+
+func (rs *referralStore) putPayout(p ReferralPayout) error {
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return rs.state.hset(referralPayoutsKey, p.RewardID, data)
+}
+
+// addPayout records a queued bonus
+func (rs *referralStore) addPayout(rec RewardRecord) error {
+	err := rs.putPayout(ReferralPayout{
+		RewardID:  rec.ID,
+		ChainID:   rec.ChainID,
+		Referrer:  strings.ToLower(rec.WalletAddress),
+		AmountWei: rec.RewardWei,
+		ClaimID:   rec.ClaimID,
+		Status:    rec.Status,
+		CreatedAt: rec.CreatedAt,
+		UpdatedAt: rec.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+	return rs.save()
+}
+
+// updatePayout mirrors a bonus reward's settlement state. Failed bonuses go
+// back to the accrual to be retried, unless the contract says the claim ID
+// was already paid.
+func (rs *referralStore) updatePayout(rec RewardRecord) error {
+	unlock, err := rs.lock("payout:" + rec.ID)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, ok, err := rs.state.hget(referralPayoutsKey, rec.ID)
+	if !ok || err != nil {
+		return err
+	}
+	var p ReferralPayout
+	if err := json.Unmarshal(data, &p); err != nil {
+		return fmt.Errorf("corrupt referral payout %s: %w", rec.ID, err)
+	}
+	if p.Status == rec.Status {
+		return nil
+	}
+
+	p.Status, p.TxHash, p.ErrorCode, p.UpdatedAt = rec.Status, rec.TxHash, rec.ErrorCode, rec.UpdatedAt
+	if err := rs.putPayout(p); err != nil {
+		return err
+	}
+	if rec.Status == RewardFailed && rec.ErrorCode != CodeAlreadyClaimed {
+		if amount, ok := new(big.Int).SetString(p.AmountWei, 10); ok {
+			if err := rs.refund(referralKey{p.ChainID, p.Referrer}, amount); err != nil {
+				return err
+			}
+		}
+	}
+	return rs.save()
+}
+
+// prune drops payouts older than earningsRetention
+func (rs *referralStore) prune(now time.Time) error {
+	payouts, err := rs.payouts()
+	if err != nil {
+		return err
+	}
+	for _, p := range payouts {
+		if now.Sub(p.CreatedAt) > earningsRetention {
+			if err := rs.state.hdel(referralPayoutsKey, p.RewardID); err != nil {
+				return err
+			}
+			rs.dirty.Store(true)
+		}
+	}
+	return nil
+}
+
+// stats returns wallet's code, referees, and pending and paid bonuses on chainID
+func (rs *referralStore) stats(wallet string, chainID int64) (code string, referees []ReferralBinding, pending, paid *big.Int, err error) {
+	key := strings.ToLower(wallet)
+	data, _, err := rs.state.hget(referralWalletCodesKey, key)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	code = string(data)
+
+	bindings, err := rs.bindings()
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	referees = []ReferralBinding{}
+	for _, b := range bindings {
+		if b.Referrer == key {
+			referees = append(referees, b)
+		}
+	}
+	sort.Slice(referees, func(i, j int) bool { return referees[i].BoundAt.Before(referees[j].BoundAt) })
+
+	accruals, err := rs.accruals()
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	pending, paid = new(big.Int), new(big.Int)
+	if p, ok := new(big.Int).SetString(accruals.Pending[referralKey{chainID, key}.String()], 10); ok {
+		pending.Set(p)
+	}
+
+	payouts, err := rs.payouts()
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	for _, p := range payouts {
+		if p.Referrer == key && p.ChainID == chainID && p.Status == RewardConfirmed {
+			if amount, ok := new(big.Int).SetString(p.AmountWei, 10); ok {
+				paid.Add(paid, amount)
+			}
+		}
+	}
+	return code, referees, pending, paid, nil
+}
+
+// payoutsBetween returns wallet's bonus payouts on chainID created in [from, to), newest first
+func (rs *referralStore) payoutsBetween(wallet string, chainID int64, from, to time.Time) ([]ReferralPayout, error) {
+	payouts, err := rs.payouts()
+	if err != nil {
+		return nil, err
+	}
+	key := strings.ToLower(wallet)
+	list := []ReferralPayout{}
+	for _, p := range payouts {
+		if p.Referrer == key && p.ChainID == chainID && !p.CreatedAt.Before(from) && p.CreatedAt.Before(to) {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CreatedAt.After(list[j].CreatedAt) })
+	return list, nil
+}
+
+// accrueReferral credits the referrer of a confirmed reward's wallet.
+// Referral bonuses themselves earn nothing, so bonuses never compound.
+func (s *Server) accrueReferral(rec RewardRecord) {
+	if rec.Kind == RewardReferralBonus {
+		return
+	}
+	amount, ok := new(big.Int).SetString(rec.RewardWei, 10)
+	if !ok {
+		return
+	}
+	if err := s.referrals.accrue(rec.ChainID, rec.WalletAddress, amount, s.cfg().ReferralBonusPercent); err != nil {
+		log.Printf("⚠️ Failed to accrue referral bonus for reward %s: %v", rec.ID, err)
+	}
+}
+
+// updateReferralPayout mirrors a referral bonus's status change into its
+// payout record
+func (s *Server) updateReferralPayout(rec RewardRecord) {
+	if rec.Kind != RewardReferralBonus {
+		return
+	}
+	if err := s.referrals.updatePayout(rec); err != nil {
+		log.Printf("⚠️ Failed to update referral payout %s: %v", rec.ID, err)
+	}
+}
+
+// referralClaimID derives a bonus's claim ID from its reward ID, in its own
+// namespace so it can't collide with heartbeat claims
+func referralClaimID(rewardID string) common.Hash {
+	return crypto.Keccak256Hash([]byte("chainpay-referral:" + rewardID))
+}
+
+// settleReferrals queues a bonus for every referrer whose accrual has reached
+// the minimum payout
+func (s *Server) settleReferrals(now time.Time) {
+	if s.draining.Load() {
+		return
+	}
+	cfg := s.cfg()
+	due, err := s.referrals.takeDue(cfg.ReferralMinPayout)
+	if err != nil {
+		log.Printf("⚠️ Failed to load due referral bonuses: %v", err)
+		return
+	}
+	for key, amount := range due {
+		bc, err := s.chains.get(key.chainID)
+		if err == nil {
+			err = bc.payoutsHalted()
+		}
+		var rec *RewardRecord
+		if err == nil {
+			id := newRewardID()
+			rec, err = s.queueReward(bc, rewardSpec{
+				id:      id,
+				kind:    RewardReferralBonus,
+				wallet:  common.HexToAddress(key.referrer).Hex(),
+				quote:   newQuote("referral", fmt.Sprintf("%d%% of referees' rewards", cfg.ReferralBonusPercent), amount),
+				claimID: referralClaimID(id),
+				trigger: "referral_settlement",
+			}, now)
+		}
+		if err != nil {
+			log.Printf("⚠️ Referral bonus for %s deferred: %v", key.referrer[:10]+"...", err)
+			if err := s.referrals.refund(key, amount); err != nil {
+				log.Printf("⚠️ Failed to return %s wei to %s's referral accrual: %v", amount, key.referrer[:10]+"...", err)
+			}
+			continue
+		}
+		if err := s.referrals.addPayout(*rec); err != nil {
+			log.Printf("⚠️ Failed to record referral payout %s: %v", rec.ID, err)
+		}
+		log.Printf("🤝 Referral bonus queued: %s wei to %s", amount.String(), key.referrer[:10]+"...")
+	}
+}
+
+// referralSettler sends due referral bonuses and saves accruals
+func (s *Server) referralSettler(ctx context.Context) {
+	settle := time.NewTicker(referralSettleInterval)
+	defer settle.Stop()
+	flush := time.NewTicker(referralFlushInterval)
+	defer flush.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.referrals.flush()
+			return
+		case now := <-settle.C:
+			s.settleReferrals(now)
+			if err := s.referrals.prune(now); err != nil {
+				log.Printf("⚠️ Failed to prune referral payouts: %v", err)
+			}
+			s.referrals.flush()
+		case <-flush.C:
+			s.referrals.flush()
+		}
+	}
+}
+
+// referralBindMessage is the text a referee signs to accept a referral code
+func referralBindMessage(wallet, code string, timestamp int64) string {
+	return signedMessage("ChainPay referral",
+		"Wallet", strings.ToLower(wallet),
+		"Referral code", strings.ToUpper(code),
+		"Timestamp", strconv.FormatInt(timestamp, 10))
+}
+
+// bindReferral checks a referee's signature and binds it to code's owner
+func (s *Server) bindReferral(wallet, code string, timestamp int64, signature string) (ReferralBinding, error) {
+	now := time.Now()
+	if !common.IsHexAddress(wallet) {
+		return ReferralBinding{}, errInvalidAddress
+	}
+	if err := checkSignedAt(timestamp, now); err != nil {
+		return ReferralBinding{}, err
+	}
+	if err := verifyWalletSignature(wallet, referralBindMessage(wallet, code, timestamp), signature); err != nil {
+		return ReferralBinding{}, err
+	}
+
+	// Rewards this backend queued, or payouts found on chain, make a wallet known
+	seen, err := s.referrals.seen(wallet)
+	if err != nil {
+		return ReferralBinding{}, err
+	}
+	b, err := s.referrals.bind(wallet, code, !seen && !s.earnings.known(wallet), now)
+	if err != nil {
+		return ReferralBinding{}, err
+	}
+	log.Printf("🤝 Referral: %s referred by %s", wallet[:10]+"...", b.Referrer[:10]+"...")
+	return b, nil
+}
+
+type ReferralCodeRequest struct {
+	WalletAddress string `json:"wallet_address"`
+}
+
+type ReferralCodeResponse struct {
+	WalletAddress string `json:"wallet_address"`
+	Code          string `json:"code"`
+	BonusPercent  int    `json:"bonus_percent"`
+}
+
+type ReferralBindRequest struct {
+	WalletAddress string `json:"wallet_address"`
+	ReferralCode  string `json:"referral_code"`
+	Timestamp     int64  `json:"timestamp"`
+	Signature     string `json:"signature"`
+}
+
+type ReferralSummaryResponse struct {
+	WalletAddress string            `json:"wallet_address"`
+	ChainID       int64             `json:"chain_id"`
+	Code          string            `json:"code,omitempty"`
+	ReferredBy    *ReferralBinding  `json:"referred_by,omitempty"`
+	BonusPercent  int               `json:"bonus_percent"`
+	PendingWei    string            `json:"pending_wei"` // accrued, not yet sent
+	PaidWei       string            `json:"paid_wei"`    // confirmed bonuses
+	Referees      []ReferralBinding `json:"referees"`
+}
+
+type ReferralPayoutsResponse struct {
+	WalletAddress string           `json:"wallet_address"`
+	ChainID       int64            `json:"chain_id"`
+	From          time.Time        `json:"from"`
+	To            time.Time        `json:"to"`
+	Payouts       []ReferralPayout `json:"payouts"`
+}
+
+// handleReferralCode returns the wallet's referral code, creating it if needed
+func (s *Server) handleReferralCode(w http.ResponseWriter, r *http.Request) {
+	var req ReferralCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, "invalid request body", err))
+		return
+	}
+	if !common.IsHexAddress(req.WalletAddress) {
+		writeError(w, newAPIError(CodeInvalidAddress, "invalid wallet address", nil))
+		return
+	}
+
+	code, err := s.referrals.code(req.WalletAddress)
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReferralCodeResponse{
+		WalletAddress: req.WalletAddress,
+		Code:          code,
+		BonusPercent:  s.cfg().ReferralBonusPercent,
+	})
+}
+
+// handleReferralBind binds a new wallet to a referrer, signed by the new wallet
+func (s *Server) handleReferralBind(w http.ResponseWriter, r *http.Request) {
+	var req ReferralBindRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, "invalid request body", err))
+		return
+	}
+
+	b, err := s.bindReferral(req.WalletAddress, req.ReferralCode, req.Timestamp, req.Signature)
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+// handleReferralSummary returns a wallet's code, referrer, referees and bonuses
+func (s *Server) handleReferralSummary(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["address"]
+
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	code, referees, pending, paid, err := s.referrals.stats(address, bc.ChainID())
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	response := ReferralSummaryResponse{
+		WalletAddress: address,
+		ChainID:       bc.ChainID(),
+		Code:          code,
+		BonusPercent:  s.cfg().ReferralBonusPercent,
+		PendingWei:    pending.String(),
+		PaidWei:       paid.String(),
+		Referees:      referees,
+	}
+	b, ok, err := s.referrals.binding(address)
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	if ok {
+		response.ReferredBy = &b
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleReferralPayouts lists the referral bonuses sent to a wallet
+func (s *Server) handleReferralPayouts(w http.ResponseWriter, r *http.Request) {
+	address := mux.Vars(r)["address"]
+
+	bc := s.chainFromRequest(w, r)
+	if bc == nil {
+		return
+	}
+
+	from, to, err := timeRange(r, earningsRetention)
+	if err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, err.Error(), nil))
+		return
+	}
+
+	payouts, err := s.referrals.payoutsBetween(address, bc.ChainID(), from, to)
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+
+	if wantsCSV(r) {
+		rows := [][]string{{"created_at", "chain_id", "reward_id", "amount_wei", "status", "tx_hash", "claim_id"}}
+		for _, p := range payouts {
+			rows = append(rows, []string{
+				p.CreatedAt.Format(time.RFC3339),
+				strconv.FormatInt(p.ChainID, 10),
+				p.RewardID,
+				p.AmountWei,
+				string(p.Status),
+				p.TxHash,
+				p.ClaimID,
+			})
+		}
+		writeCSV(w, fmt.Sprintf("referral-payouts-%s-%d.csv", strings.ToLower(address), bc.ChainID()), rows)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(ReferralPayoutsResponse{
+		WalletAddress: address,
+		ChainID:       bc.ChainID(),
+		From:          from,
+		To:            to,
+		Payouts:       payouts,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// Reward settlement failures decoded from RewardTreasury reverts
+var (
+	ErrNotRewardSigner      = errors.New("caller is not reward signer")
+	ErrRewardAlreadyClaimed = errors.New("reward already claimed")
+	ErrInsufficientTreasury = errors.New("insufficient treasury balance")
+	ErrInvalidRecipient     = errors.New("invalid recipient")
+	ErrInvalidAmount        = errors.New("amount must be positive")
+	ErrTransferFailed       = errors.New("transfer failed")
+	ErrReverted             = errors.New("execution reverted") // reason missing or not one of ours
+)
+
+// revertReasons maps the contract's require() messages to typed errors
+var revertReasons = map[string]error{
+	"RewardTreasury: caller is not reward signer":   ErrNotRewardSigner,
+	"RewardTreasury: reward already claimed":        ErrRewardAlreadyClaimed,
+	"RewardTreasury: insufficient treasury balance": ErrInsufficientTreasury,
+	"RewardTreasury: invalid recipient":             ErrInvalidRecipient,
+	"RewardTreasury: amount must be positive":       ErrInvalidAmount,
+	"RewardTreasury: transfer failed":               ErrTransferFailed,
+}
+
+// RevertError is a contract call that reverted, with the decoded reason
+type RevertError struct {
+	Reason string // Error(string) message or Panic(uint256) description, empty if the node returned none
+	Err    error  // one of the Err* sentinels above
+}
+
+func (e *RevertError) Error() string {
+	if e.Reason == "" {
+		return "execution reverted"
+	}
+	return "execution reverted: " + e.Reason
+}
+
+func (e *RevertError) Unwrap() error { return e.Err }
+
+// decodeRevert converts an eth_call or eth_estimateGas error carrying revert
+// data into a *RevertError. Other errors are returned unchanged.
+func decodeRevert(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var dataErr rpc.DataError
+	if errors.As(err, &dataErr) {
+		if hexData, ok := dataErr.ErrorData().(string); ok {
+			if data, decodeErr := hexutil.Decode(hexData); decodeErr == nil {
+				return revertFromData(data)
+			}
+		}
+	}
+
+	// Some nodes drop the data but keep the message
+	if strings.Contains(err.Error(), "execution reverted") || strings.Contains(err.Error(), "reverted with reason") {
+		for reason, sentinel := range revertReasons {
+			if strings.Contains(err.Error(), reason) {
+				return &RevertError{Reason: reason, Err: sentinel}
+			}
+		}
+		return &RevertError{Err: ErrReverted}
+	}
+
+	return err
+}
+
+// revertFromData decodes ABI-encoded Error(string) or Panic(uint256) revert data
+func revertFromData(data []byte) *RevertError {
+	reason, err := abi.UnpackRevert(data)
+	if err != nil {
+		// A custom error or no data at all
+		return &RevertError{Err: ErrReverted}
+	}
+
+	if sentinel, ok := revertReasons[reason]; ok {
+		return &RevertError{Reason: reason, Err: sentinel}
+	}
+	return &RevertError{Reason: reason, Err: ErrReverted}
+}
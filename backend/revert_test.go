@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// dataError is a JSON-RPC error carrying revert data, as rpc.Client returns
+type dataError struct {
+	msg  string
+	data interface{}
+}
+
+func (e *dataError) Error() string          { return e.msg }
+func (e *dataError) ErrorCode() int         { return 3 }
+func (e *dataError) ErrorData() interface{} { return e.data }
+
+// encodeRevert ABI-encodes a call to the given error signature, as Solidity
+// does for reverts
+func encodeRevert(t *testing.T, signature, typ string, value interface{}) string {
+	t.Helper()
+	argType, err := abi.NewType(typ, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, err := abi.Arguments{{Type: argType}}.Pack(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	selector := abi.NewMethod(signature, signature, abi.Function, "", false, false, abi.Arguments{{Type: argType}}, nil).ID
+	return hexutil.Encode(append(selector, args...))
+}
+
+func TestDecodeRevert(t *testing.T) {
+	errorString := func(reason string) string { return encodeRevert(t, "Error", "string", reason) }
+	connRefused := errors.New("dial tcp 127.0.0.1:8545: connect: connection refused")
+
+	tests := []struct {
+		name   string
+		err    error
+		want   error  // sentinel the result wraps
+		reason string // RevertError.Reason
+		code   string
+	}{
+		{
+			name: "already claimed data",
+			err:  &dataError{msg: "execution reverted", data: errorString("RewardTreasury: reward already claimed")},
+			want: ErrRewardAlreadyClaimed, reason: "RewardTreasury: reward already claimed", code: CodeAlreadyClaimed,
+		},
+		{
+			name: "insufficient treasury data",
+			err:  &dataError{msg: "execution reverted", data: errorString("RewardTreasury: insufficient treasury balance")},
+			want: ErrInsufficientTreasury, reason: "RewardTreasury: insufficient treasury balance", code: CodeTreasuryInsufficient,
+		},
+		{
+			name: "not reward signer data",
+			err:  &dataError{msg: "execution reverted", data: errorString("RewardTreasury: caller is not reward signer")},
+			want: ErrNotRewardSigner, reason: "RewardTreasury: caller is not reward signer", code: CodeNotRewardSigner,
+		},
+		{
+			name: "data error wrapped by the caller",
+			err:  fmt.Errorf("estimate gas: %w", &dataError{msg: "execution reverted", data: errorString("RewardTreasury: invalid recipient")}),
+			want: ErrInvalidRecipient, reason: "RewardTreasury: invalid recipient", code: CodeInvalidRecipient,
+		},
+		{
+			name: "someone else's reason is kept",
+			err:  &dataError{msg: "execution reverted", data: errorString("Ownable: caller is not the owner")},
+			want: ErrReverted, reason: "Ownable: caller is not the owner", code: CodeReverted,
+		},
+		{
+			name: "Panic(uint256) data is described",
+			err:  &dataError{msg: "execution reverted", data: encodeRevert(t, "Panic", "uint256", big.NewInt(0x11))},
+			want: ErrReverted, reason: "arithmetic underflow or overflow", code: CodeReverted,
+		},
+		{
+			name: "empty revert data",
+			err:  &dataError{msg: "execution reverted", data: "0x"},
+			want: ErrReverted, code: CodeReverted,
+		},
+		{
+			name: "undecodable data falls back to the message",
+			err:  &dataError{msg: "execution reverted: RewardTreasury: amount must be positive", data: "not hex"},
+			want: ErrInvalidAmount, reason: "RewardTreasury: amount must be positive", code: CodeInvalidAmount,
+		},
+		{
+			name: "message only, already claimed",
+			err:  errors.New("execution reverted: RewardTreasury: reward already claimed"),
+			want: ErrRewardAlreadyClaimed, reason: "RewardTreasury: reward already claimed", code: CodeAlreadyClaimed,
+		},
+		{
+			name: "message only, Hardhat wording",
+			err:  errors.New("VM Exception while processing transaction: reverted with reason string 'RewardTreasury: transfer failed'"),
+			want: ErrTransferFailed, reason: "RewardTreasury: transfer failed", code: CodeTransferFailed,
+		},
+		{
+			name: "message only, no reason",
+			err:  errors.New("execution reverted"),
+			want: ErrReverted, code: CodeReverted,
+		},
+		{
+			name: "not a revert",
+			err:  connRefused,
+			want: connRefused, code: CodeRPCUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := decodeRevert(tt.err)
+			if !errors.Is(got, tt.want) {
+				t.Fatalf("decodeRevert = %v, want %v", got, tt.want)
+			}
+			var revert *RevertError
+			if isRevert := errors.As(got, &revert); isRevert != (tt.want != connRefused) {
+				t.Fatalf("decodeRevert = %T, revert %v", got, isRevert)
+			}
+			if revert != nil && revert.Reason != tt.reason {
+				t.Errorf("reason = %q, want %q", revert.Reason, tt.reason)
+			}
+			if code := errorCode(got); code != tt.code {
+				t.Errorf("code = %s, want %s", code, tt.code)
+			}
+		})
+	}
+
+	if decodeRevert(nil) != nil {
+		t.Error("decodeRevert(nil) != nil")
+	}
+}
@@ -0,0 +1,796 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+)
+
+// RewardKind is what a reward pays for
+type RewardKind string
+
+const (
+	RewardHeartbeat       RewardKind = "heartbeat"
+	RewardCompletionBonus RewardKind = "completion_bonus"
+	RewardReferralBonus   RewardKind = "referral_bonus"
+)
+
+// RewardStatus is the settlement state of a queued reward
+type RewardStatus string
+
+const (
+	RewardQueued    RewardStatus = "queued"
+	RewardSubmitted RewardStatus = "submitted"
+	RewardConfirmed RewardStatus = "confirmed"
+	RewardFailed    RewardStatus = "failed"
+)
+
+const (
+	// How long finished reward records stay pollable
+	rewardRetention = time.Hour
+
+	// How often submitted transactions are checked for receipts
+	receiptPollInterval = 2 * time.Second
+
+	// How long a submitted transaction may go without a receipt before the
+	// signer's nonce is rechecked and it is rebroadcast or failed
+	rewardStuckAfter = 3 * time.Minute
+
+	// How long signed transactions are kept for rebroadcast at most
+	rewardTxRetention = 24 * time.Hour
+)
+
+// RewardRecord is the pollable status of a single heartbeat reward
+type RewardRecord struct {
+	ID            string        `json:"id"`
+	ChainID       int64         `json:"chain_id"`
+	WalletAddress string        `json:"wallet_address"`
+	AdID          string        `json:"ad_id,omitempty"`
+	Kind          RewardKind    `json:"kind"`
+	ClaimID       string        `json:"claim_id,omitempty"` // set in advance for referral bonuses, at submission otherwise
+	RewardWei     string        `json:"reward_wei"`
+	Pricing       []AppliedRule `json:"pricing,omitempty"` // how RewardWei was reached
+	Status        RewardStatus  `json:"status"`
+	TxHash        string        `json:"tx_hash,omitempty"`
+	Error         string        `json:"error,omitempty"`
+	ErrorCode     string        `json:"error_code,omitempty"`
+	CreatedAt     time.Time     `json:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+}
+
+// Shared state keys of reward settlement
+const (
+	rewardQueueKey    = "rewards:queue"    // list of RewardRequest waiting for the leader
+	rewardSettlingKey = "rewards:settling" // hash of queued and submitted records by ID
+	rewardKeyPrefix   = "reward:"          // finished records, kept for rewardRetention
+	rewardTxKeyPrefix = "reward-tx:"       // signed transactions awaiting a receipt
+
+	// Upper bound on rewards waiting in the shared queue
+	rewardQueueLimit = 1000
+)
+
+// rewardStore tracks the rewards this replica is settling. Every change is
+// written to shared state, where any replica can look a reward up.
+type rewardStore struct {
+	mu      sync.RWMutex
+	records map[string]*RewardRecord
+	state   sharedState
+}
+
+func newRewardStore(state sharedState) *rewardStore {
+	return &rewardStore{records: make(map[string]*RewardRecord), state: state}
+}
+
+// track starts settling rec on this replica
+func (rs *rewardStore) track(rec *RewardRecord) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.records[rec.ID] = rec
+}
+
+// untrack stops settling the record with id on this replica, leaving it in
+// shared state for the next leader
+func (rs *rewardStore) untrack(id string) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	delete(rs.records, id)
+}
+
+// save writes rec to shared state: unsettled records go to the settling
+// hash, finished ones to their own key until the retention window passes
+func (rs *rewardStore) save(rec RewardRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if rec.Status == RewardQueued || rec.Status == RewardSubmitted {
+		return rs.state.hset(rewardSettlingKey, rec.ID, data)
+	}
+	if err := rs.state.set(rewardKeyPrefix+rec.ID, data, rewardRetention); err != nil {
+		return err
+	}
+	return rs.state.hdel(rewardSettlingKey, rec.ID)
+}
+
+// lookup returns the record with the given ID from shared state
+func (rs *rewardStore) lookup(id string) (RewardRecord, bool, error) {
+	data, ok, err := rs.state.hget(rewardSettlingKey, id)
+	if err == nil && !ok {
+		data, ok, err = rs.state.get(rewardKeyPrefix + id)
+	}
+	if err != nil || !ok {
+		return RewardRecord{}, false, err
+	}
+
+	var rec RewardRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return RewardRecord{}, false, fmt.Errorf("corrupt reward %s: %w", id, err)
+	}
+	return rec, true, nil
+}
+
+// settling returns every queued or submitted record in shared state
+func (rs *rewardStore) settling() ([]RewardRecord, error) {
+	all, err := rs.state.hgetall(rewardSettlingKey)
+	if err != nil {
+		return nil, err
+	}
+	records := make([]RewardRecord, 0, len(all))
+	for id, data := range all {
+		var rec RewardRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			log.Printf("⚠️ Skipping corrupt reward %s: %v", id, err)
+			continue
+		}
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].CreatedAt.Before(records[j].CreatedAt) })
+	return records, nil
+}
+
+// update applies fn to a tracked record under the store lock, saves it and
+// returns a copy. Finished records are no longer tracked.
+func (rs *rewardStore) update(id string, fn func(*RewardRecord)) (RewardRecord, bool) {
+	rs.mu.Lock()
+	rec, ok := rs.records[id]
+	if !ok {
+		rs.mu.Unlock()
+		return RewardRecord{}, false
+	}
+	fn(rec)
+	rec.UpdatedAt = time.Now()
+	copied := *rec
+	if rec.Status == RewardConfirmed || rec.Status == RewardFailed {
+		delete(rs.records, id)
+	}
+	rs.mu.Unlock()
+
+	if err := rs.save(copied); err != nil {
+		log.Printf("⚠️ Failed to save reward %s: %v", id, err)
+	}
+	return copied, true
+}
+
+// submitted returns records whose transactions are awaiting a receipt
+func (rs *rewardStore) submitted() []RewardRecord {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	var pending []RewardRecord
+	for _, rec := range rs.records {
+		if rec.Status == RewardSubmitted {
+			pending = append(pending, *rec)
+		}
+	}
+	return pending
+}
+
+// unsettled returns tracked records still queued or awaiting a receipt, oldest first
+func (rs *rewardStore) unsettled() []RewardRecord {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	var pending []RewardRecord
+	for _, rec := range rs.records {
+		if rec.Status == RewardQueued || rec.Status == RewardSubmitted {
+			pending = append(pending, *rec)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].CreatedAt.Before(pending[j].CreatedAt) })
+	return pending
+}
+
+// newRewardID returns a random identifier for a reward record
+func newRewardID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return big.NewInt(time.Now().UnixNano()).Text(16)
+	}
+	return hex.EncodeToString(b)
+}
+
+// rewardClaimID derives the claim ID a reward is sent with from its ID
+func rewardClaimID(rewardID string) common.Hash {
+	return crypto.Keccak256Hash([]byte("chainpay-reward:" + rewardID))
+}
+
+// allowHeartbeat enforces the minimum interval between heartbeats per
+// wallet, across all replicas
+func (s *Server) allowHeartbeat(wallet string, now time.Time) (bool, error) {
+	interval := time.Duration(s.cfg().MinHeartbeatIntervalMs) * time.Millisecond
+	if interval <= 0 {
+		return true, nil
+	}
+	return s.state.setNX("throttle:"+strings.ToLower(wallet), []byte(strconv.FormatInt(now.UnixMilli(), 10)), interval)
+}
+
+// heartbeat is one ad-view heartbeat, received over HTTP or WebSocket
+type heartbeat struct {
+	wallet     string
+	adID       string
+	chainID    int64     // 0 for the default chain
+	durationMs int64     // watch time the client reports for this heartbeat
+	sessionID  string    // ad session the heartbeat belongs to, if any
+	client     *wsClient // connection that sent it, if any
+}
+
+// acceptHeartbeat validates a heartbeat, accrues it and queues the reward for
+// settlement. It never touches the chain, so callers can acknowledge at once.
+func (s *Server) acceptHeartbeat(hb heartbeat) (_ *RewardRecord, err error) {
+	now := time.Now()
+
+	defer func() {
+		if err != nil {
+			metricHeartbeatsRejected.Inc(errorCode(err))
+			s.campaigns.recordRejection(s.campaignChain(hb.chainID), hb.adID, errorCode(err), now)
+		}
+	}()
+
+	if s.draining.Load() {
+		return nil, errShuttingDown
+	}
+	if !common.IsHexAddress(hb.wallet) {
+		return nil, errInvalidAddress
+	}
+
+	// Session heartbeats take their ad and chain from the session
+	if hb.sessionID != "" {
+		sess, err := s.sessions.active(hb.sessionID, hb.wallet, now)
+		if err != nil {
+			return nil, err
+		}
+		if (hb.adID != "" && hb.adID != sess.AdID) || (hb.chainID != 0 && hb.chainID != sess.ChainID) {
+			return nil, newAPIError(CodeInvalidRequest, "ad_id and chain_id must match the session", nil)
+		}
+		hb.adID, hb.chainID = sess.AdID, sess.ChainID
+	}
+
+	bc, err := s.chains.get(hb.chainID)
+	if err != nil {
+		return nil, err
+	}
+
+	// Don't queue rewards that the contract is known to reject right now
+	if err := bc.payoutsHalted(); err != nil {
+		return nil, err
+	}
+
+	allowed, err := s.allowHeartbeat(hb.wallet, now)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		return nil, errRateLimited
+	}
+
+	trigger := "http_heartbeat"
+	if hb.client != nil {
+		trigger = "websocket_heartbeat"
+	}
+	q, err := s.priceHeartbeat(s.cfg(), bc.ChainID(), hb.wallet, hb.adID, now)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := s.queueReward(bc, rewardSpec{
+		kind:       RewardHeartbeat,
+		wallet:     hb.wallet,
+		adID:       hb.adID,
+		quote:      q,
+		heartbeats: 1,
+		client:     hb.client,
+		trigger:    trigger,
+	}, now)
+	if err != nil {
+		return nil, err
+	}
+
+	metricHeartbeatsAccepted.Inc()
+	if err := s.pricing.countHeartbeat(rec.ChainID, hb.wallet, now); err != nil {
+		log.Printf("⚠️ Failed to count heartbeat for pricing: %v", err)
+	}
+	s.earnings.recordHeartbeat(rec.ChainID, hb.wallet, hb.adID, now)
+	if err := s.earnings.saveHeartbeat(rec.ChainID, hb.wallet, hb.adID, now); err != nil {
+		log.Printf("⚠️ Failed to save heartbeat history: %v", err)
+	}
+	s.publishCluster(clusterEvent{Heartbeat: &heartbeatEvent{ChainID: rec.ChainID, Wallet: hb.wallet, AdID: hb.adID, At: now}})
+	s.campaigns.recordHeartbeat(rec.ChainID, hb.adID, hb.wallet, hb.durationMs, heartbeatIntervalMs(s.cfg()), now)
+	if hb.sessionID != "" {
+		s.sessions.credit(hb.sessionID, hb.durationMs, now)
+	}
+
+	s.statsMux.Lock()
+	s.stats.TotalHeartbeats++
+	s.statsMux.Unlock()
+
+	return rec, nil
+}
+
+// rewardSpec describes a reward to queue
+type rewardSpec struct {
+	id         string // empty: generated
+	kind       RewardKind
+	wallet     string
+	adID       string
+	quote      *quote
+	claimID    common.Hash // zero: derived from id at submission
+	heartbeats int64       // heartbeats the reward pays for, 0 for bonuses
+	client     *wsClient   // connection to report the result to, if any
+	trigger    string      // what asked for the reward, for the audit log
+}
+
+// queueReward records the reward described by spec and puts it on the shared
+// queue, from which the leader's settlement workers take it
+func (s *Server) queueReward(bc *BlockchainClient, spec rewardSpec, now time.Time) (*RewardRecord, error) {
+	if spec.id == "" {
+		spec.id = newRewardID()
+	}
+	amount := spec.quote.amount
+	rec := &RewardRecord{
+		ID:            spec.id,
+		ChainID:       bc.ChainID(),
+		WalletAddress: spec.wallet,
+		AdID:          spec.adID,
+		Kind:          spec.kind,
+		RewardWei:     amount.String(),
+		Pricing:       spec.quote.rules,
+		Status:        RewardQueued,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if spec.claimID != (common.Hash{}) {
+		rec.ClaimID = spec.claimID.Hex()
+	}
+
+	req := &RewardRequest{
+		ID:            rec.ID,
+		ChainID:       rec.ChainID,
+		WalletAddress: spec.wallet,
+		AdID:          spec.adID,
+		Amount:        amount,
+		Heartbeats:    spec.heartbeats,
+		Timestamp:     now,
+		ClaimID:       spec.claimID,
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shutdown closes the queue once it has collected what is left in it
+	s.queueMux.RLock()
+	defer s.queueMux.RUnlock()
+	if s.queueClosed {
+		return nil, errShuttingDown
+	}
+
+	// Record before queueing so the leader always finds it, and wait for
+	// the result before the leader can send it
+	if err := s.rewards.save(*rec); err != nil {
+		return nil, err
+	}
+	if spec.client != nil {
+		s.awaitResult(rec.ID, spec.client, now)
+	}
+	if err := s.state.push(rewardQueueKey, data, rewardQueueLimit); err != nil {
+		s.takeResultClient(rec.ID)
+		if delErr := s.state.hdel(rewardSettlingKey, rec.ID); delErr != nil {
+			log.Printf("⚠️ Failed to remove unqueued reward %s: %v", rec.ID, delErr)
+		}
+		return nil, err
+	}
+	s.wakeRewardPump()
+
+	// A wallet that has earned can no longer be referred, even after restarts
+	if err := s.referrals.markSeen(spec.wallet, now); err != nil {
+		log.Printf("⚠️ Failed to record first activity of %s: %v", spec.wallet, err)
+	}
+
+	// Bonuses are paid by the server; everything else at a wallet's request
+	actor := "wallet:" + strings.ToLower(spec.wallet)
+	if spec.kind == RewardReferralBonus {
+		actor = "replica:" + s.replicaID
+	}
+	s.audit.record(AuditRecord{
+		Time:      now,
+		Action:    AuditRewardAccrued,
+		Actor:     actor,
+		Trigger:   spec.trigger,
+		ChainID:   rec.ChainID,
+		Wallet:    rec.WalletAddress,
+		RewardID:  rec.ID,
+		AmountWei: rec.RewardWei,
+		Detail:    fmt.Sprintf("%s, pricing: %s", rec.Kind, pricingSummary(rec.Pricing)),
+	})
+
+	return rec, nil
+}
+
+// rewardProcessor settles queued rewards using a pool of workers
+func (s *Server) rewardProcessor(ctx context.Context) {
+	workers := s.cfg().RewardWorkers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case req := <-s.rewardQueue:
+					s.settleReward(req)
+				}
+			}
+		}()
+	}
+
+	log.Printf("⚙️ Reward processor started with %d workers", workers)
+	wg.Wait()
+	close(s.workersDone)
+}
+
+// settleReward submits a single reward transaction and reports the outcome
+func (s *Server) settleReward(req *RewardRequest) {
+	bc, err := s.chains.get(req.ChainID)
+	if err != nil {
+		// Only possible if a request was built by hand with a bad chain
+		log.Printf("⚠️ Dropping reward %s: %v", req.ID, err)
+		return
+	}
+
+	// A replica that lost leadership hands the reward back unsent
+	if !s.isLeader() {
+		s.requeueReward(req)
+		return
+	}
+
+	// Claim IDs follow from reward IDs, so RewardClaimed events can be
+	// matched to rewards and the contract rejects a reward sent twice
+	claimID := req.ClaimID
+	if claimID == (common.Hash{}) && bc.ContractAddress() != "" {
+		claimID = rewardClaimID(req.ID)
+	}
+
+	start := time.Now()
+	tx, err := bc.ProcessReward(req.WalletAddress, req.Amount, claimID)
+	metricTxSubmission.ObserveSince(start)
+
+	var txHash string
+	if tx != nil {
+		txHash = tx.Hash().Hex()
+		s.saveRewardTx(req.ID, tx)
+	}
+
+	submission := AuditRecord{
+		Action:    AuditTxSubmitted,
+		Actor:     "replica:" + s.replicaID,
+		Trigger:   "reward_worker",
+		ChainID:   req.ChainID,
+		Wallet:    req.WalletAddress,
+		RewardID:  req.ID,
+		TxHash:    txHash,
+		AmountWei: req.Amount.String(),
+		Detail:    "direct transfer",
+	}
+	if claimID != (common.Hash{}) {
+		submission.Detail = "processReward, claim " + claimID.Hex()
+	}
+	if err != nil {
+		submission.Error = err.Error()
+	}
+	s.audit.record(submission)
+
+	rec, _ := s.rewards.update(req.ID, func(rec *RewardRecord) {
+		if err != nil {
+			rec.Status = RewardFailed
+			rec.Error = err.Error()
+			rec.ErrorCode = errorCode(err)
+			return
+		}
+		rec.Status = RewardSubmitted
+		rec.TxHash = txHash
+		if claimID != (common.Hash{}) {
+			rec.ClaimID = claimID.Hex()
+		}
+	})
+	s.updateReferralPayout(rec)
+
+	response := map[string]interface{}{
+		"type":       "reward",
+		"reward_id":  req.ID,
+		"chain_id":   req.ChainID,
+		"status":     rec.Status,
+		"success":    err == nil,
+		"reward_wei": req.Amount.String(),
+		"tx_hash":    txHash,
+	}
+
+	if err != nil {
+		log.Printf("⚠️ Failed to process reward for %s: %v", req.WalletAddress, err)
+		metricRewardsFailed.Inc(errorCode(err))
+		if errors.Is(err, ErrInsufficientTreasury) || errors.Is(err, ErrNotRewardSigner) {
+			bc.haltPayouts(err)
+		}
+		response["error"] = err.Error()
+		response["error_code"] = errorCode(err)
+	} else {
+		metricRewardsSent.Inc()
+		f, _ := new(big.Float).SetInt(req.Amount).Float64()
+		metricRewardWei.Add(f)
+
+		s.statsMux.Lock()
+		s.stats.TotalRewards.Add(s.stats.TotalRewards, req.Amount)
+		s.statsMux.Unlock()
+
+		log.Printf("💰 Reward sent: %s wei to %s (tx: %s, pricing: %s)", req.Amount.String(), req.WalletAddress[:10]+"...", txHash[:16]+"...", pricingSummary(rec.Pricing))
+	}
+
+	s.broadcastRewardResult(rewardResult{
+		RewardID: req.ID,
+		ChainID:  req.ChainID,
+		Wallet:   req.WalletAddress,
+		AdID:     req.AdID,
+		Amount:   req.Amount.String(),
+		Success:  err == nil,
+		Message:  response,
+	})
+}
+
+// receiptWatcher moves submitted rewards to confirmed or failed once mined
+func (s *Server) receiptWatcher(ctx context.Context) {
+	ticker := time.NewTicker(receiptPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for _, rec := range s.rewards.submitted() {
+				bc, err := s.chains.get(rec.ChainID)
+				if err != nil {
+					continue
+				}
+				receipt, err := bc.GetReceipt(rec.TxHash)
+				if err != nil {
+					continue
+				}
+				if receipt == nil {
+					if now.Sub(rec.UpdatedAt) >= rewardStuckAfter {
+						s.recheckStuckReward(bc, rec, now)
+					}
+					continue
+				}
+				s.state.del(rewardTxKeyPrefix + rec.ID)
+
+				updated, _ := s.rewards.update(rec.ID, func(r *RewardRecord) {
+					if receipt.Status == types.ReceiptStatusSuccessful {
+						r.Status = RewardConfirmed
+					} else {
+						r.Status = RewardFailed
+						r.Error = "transaction reverted"
+						r.ErrorCode = CodeReverted
+					}
+				})
+				observeReceipt(receipt)
+				s.updateReferralPayout(updated)
+				s.audit.record(AuditRecord{
+					Time:      now,
+					Action:    AuditTxMined,
+					Actor:     "replica:" + s.replicaID,
+					Trigger:   "receipt_watcher",
+					ChainID:   updated.ChainID,
+					Wallet:    updated.WalletAddress,
+					RewardID:  updated.ID,
+					TxHash:    updated.TxHash,
+					AmountWei: updated.RewardWei,
+					Detail:    fmt.Sprintf("%s in block %d", updated.Status, receipt.BlockNumber.Uint64()),
+					Error:     updated.Error,
+				})
+				if updated.Status == RewardConfirmed {
+					s.ledger.record(updated, receipt.BlockNumber.Uint64())
+					s.accrueReferral(updated)
+					if amount, ok := new(big.Int).SetString(updated.RewardWei, 10); ok {
+						s.campaigns.recordSpend(updated.ChainID, updated.AdID, amount, now)
+					}
+					if bc.ContractAddress() == "" {
+						s.recordDirectPayout(updated, receipt.BlockNumber.Uint64())
+					} else {
+						s.earnings.annotatePayout(updated.ChainID, bc.ContractAddress(), updated.WalletAddress, updated.TxHash, updated.Pricing, now)
+					}
+				}
+
+				msg := map[string]interface{}{
+					"type":      "reward_status",
+					"reward_id": updated.ID,
+					"chain_id":  updated.ChainID,
+					"status":    updated.Status,
+					"tx_hash":   updated.TxHash,
+					"block":     receipt.BlockNumber.Uint64(),
+				}
+				if updated.ErrorCode != "" {
+					msg["error_code"] = updated.ErrorCode
+				}
+				s.broadcast(rewardsTopic(updated.WalletAddress), msg)
+			}
+			s.sessions.prune(now)
+			s.pruneResultClients(now)
+		}
+	}
+}
+
+// saveRewardTx keeps a reward's signed transaction in shared state, so any
+// leader can rebroadcast it
+func (s *Server) saveRewardTx(id string, tx *types.Transaction) {
+	raw, err := tx.MarshalBinary()
+	if err == nil {
+		err = s.state.set(rewardTxKeyPrefix+id, raw, rewardTxRetention)
+	}
+	if err != nil {
+		log.Printf("⚠️ Failed to save transaction of reward %s: %v", id, err)
+	}
+}
+
+// rewardTx returns a reward's signed transaction from shared state or the
+// node, nil if neither has it
+func (s *Server) rewardTx(bc *BlockchainClient, rec RewardRecord) (*types.Transaction, error) {
+	raw, ok, err := s.state.get(rewardTxKeyPrefix + rec.ID)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		tx := new(types.Transaction)
+		if err := tx.UnmarshalBinary(raw); err != nil {
+			return nil, fmt.Errorf("corrupt transaction of reward %s: %w", rec.ID, err)
+		}
+		return tx, nil
+	}
+	return bc.GetTransaction(rec.TxHash)
+}
+
+// recheckStuckReward handles a transaction with no receipt after
+// rewardStuckAfter. If the signer's nonce has moved past it, another
+// transaction took its nonce and it can never be mined, so the reward
+// fails. Otherwise the node may have dropped it from its pool, and it is
+// sent again. Either way the clock restarts.
+func (s *Server) recheckStuckReward(bc *BlockchainClient, rec RewardRecord, now time.Time) {
+	tx, err := s.rewardTx(bc, rec)
+	if err != nil {
+		log.Printf("⚠️ Failed to recheck reward %s: %v", rec.ID, err)
+		return
+	}
+	if tx == nil {
+		log.Printf("⚠️ Reward %s has had no receipt since %s and its transaction %s is unknown", rec.ID, rec.UpdatedAt.Format(time.RFC3339), rec.TxHash)
+		s.rewards.update(rec.ID, func(*RewardRecord) {})
+		return
+	}
+
+	confirmed, err := bc.ConfirmedNonce()
+	if err != nil {
+		log.Printf("⚠️ Failed to recheck reward %s: %v", rec.ID, err)
+		return
+	}
+	if confirmed <= tx.Nonce() {
+		if err := bc.Rebroadcast(tx); err != nil {
+			log.Printf("⚠️ Failed to rebroadcast reward %s: %v", rec.ID, err)
+		} else {
+			log.Printf("🔁 Rebroadcast reward %s (tx: %s, nonce: %d)", rec.ID, rec.TxHash[:16]+"...", tx.Nonce())
+		}
+		s.rewards.update(rec.ID, func(*RewardRecord) {})
+		return
+	}
+
+	// The nonce is used; make sure it wasn't by this transaction
+	if receipt, err := bc.GetReceipt(rec.TxHash); err != nil || receipt != nil {
+		return
+	}
+	msg := fmt.Sprintf("transaction dropped: nonce %d was used by another transaction", tx.Nonce())
+	updated, ok := s.rewards.update(rec.ID, func(r *RewardRecord) {
+		r.Status = RewardFailed
+		r.Error = msg
+		r.ErrorCode = CodeTxDropped
+	})
+	if !ok {
+		return
+	}
+	s.state.del(rewardTxKeyPrefix + rec.ID)
+	log.Printf("⚠️ Reward %s failed: %s", rec.ID, msg)
+	metricRewardsFailed.Inc(CodeTxDropped)
+	s.updateReferralPayout(updated)
+	s.audit.record(AuditRecord{
+		Time:      now,
+		Action:    AuditTxSubmitted,
+		Actor:     "replica:" + s.replicaID,
+		Trigger:   "receipt_watcher",
+		ChainID:   updated.ChainID,
+		Wallet:    updated.WalletAddress,
+		RewardID:  updated.ID,
+		TxHash:    updated.TxHash,
+		AmountWei: updated.RewardWei,
+		Detail:    "dropped without a receipt",
+		Error:     msg,
+	})
+	s.broadcast(rewardsTopic(updated.WalletAddress), map[string]interface{}{
+		"type":       "reward_status",
+		"reward_id":  updated.ID,
+		"chain_id":   updated.ChainID,
+		"status":     updated.Status,
+		"tx_hash":    updated.TxHash,
+		"error_code": updated.ErrorCode,
+	})
+}
+
+// observeReceipt records gas and outcome metrics for a mined reward transaction
+func observeReceipt(receipt *types.Receipt) {
+	if receipt.Status == types.ReceiptStatusSuccessful {
+		metricRewardsConfirmed.Inc("success")
+	} else {
+		metricRewardsConfirmed.Inc("reverted")
+		metricRewardsFailed.Inc(CodeReverted)
+	}
+
+	metricGasUsed.Add(float64(receipt.GasUsed))
+	if receipt.EffectiveGasPrice != nil {
+		fee := new(big.Int).Mul(receipt.EffectiveGasPrice, new(big.Int).SetUint64(receipt.GasUsed))
+		f, _ := new(big.Float).SetInt(fee).Float64()
+		metricGasSpentWei.Add(f)
+	}
+}
+
+// handleRewardStatus returns the settlement status of a queued reward
+func (s *Server) handleRewardStatus(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	rec, ok, err := s.rewards.lookup(id)
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	if !ok {
+		writeError(w, newAPIError(CodeNotFound, "reward not found", nil))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rec)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// chainBackend is the part of an Ethereum node the backend uses. It is
+// satisfied by *ethclient.Client for a real RPC endpoint and by the client of
+// an in-process simulated.Backend in demo mode and tests.
+type chainBackend interface {
+	ethereum.ChainIDReader
+	ethereum.BlockNumberReader
+	ethereum.ChainReader
+	ethereum.ChainStateReader
+	ethereum.PendingStateReader
+	ethereum.GasPricer
+	ethereum.GasEstimator
+	ethereum.ContractCaller
+	ethereum.TransactionReader
+	ethereum.TransactionSender
+	ethereum.LogFilterer
+}
+
+// instrumentedClient wraps a chainBackend so every JSON-RPC call the backend
+// makes is timed in chainpay_rpc_duration_seconds.
+type instrumentedClient struct {
+	chainBackend
+}
+
+func (c instrumentedClient) ChainID(ctx context.Context) (id *big.Int, err error) {
+	defer observeRPC("eth_chainId", &err)()
+	return c.chainBackend.ChainID(ctx)
+}
+
+func (c instrumentedClient) BlockNumber(ctx context.Context) (n uint64, err error) {
+	defer observeRPC("eth_blockNumber", &err)()
+	return c.chainBackend.BlockNumber(ctx)
+}
+
+func (c instrumentedClient) BlockByNumber(ctx context.Context, number *big.Int) (b *types.Block, err error) {
+	defer observeRPC("eth_getBlockByNumber", &err)()
+	return c.chainBackend.BlockByNumber(ctx, number)
+}
+
+func (c instrumentedClient) BalanceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (b *big.Int, err error) {
+	defer observeRPC("eth_getBalance", &err)()
+	return c.chainBackend.BalanceAt(ctx, account, blockNumber)
+}
+
+func (c instrumentedClient) PendingNonceAt(ctx context.Context, account common.Address) (n uint64, err error) {
+	defer observeRPC("eth_getTransactionCount", &err)()
+	return c.chainBackend.PendingNonceAt(ctx, account)
+}
+
+func (c instrumentedClient) SuggestGasPrice(ctx context.Context) (p *big.Int, err error) {
+	defer observeRPC("eth_gasPrice", &err)()
+	return c.chainBackend.SuggestGasPrice(ctx)
+}
+
+func (c instrumentedClient) EstimateGas(ctx context.Context, msg ethereum.CallMsg) (gas uint64, err error) {
+	defer observeRPC("eth_estimateGas", &err)()
+	return c.chainBackend.EstimateGas(ctx, msg)
+}
+
+func (c instrumentedClient) CallContract(ctx context.Context, msg ethereum.CallMsg, blockNumber *big.Int) (out []byte, err error) {
+	defer observeRPC("eth_call", &err)()
+	return c.chainBackend.CallContract(ctx, msg, blockNumber)
+}
+
+func (c instrumentedClient) SendTransaction(ctx context.Context, tx *types.Transaction) (err error) {
+	defer observeRPC("eth_sendRawTransaction", &err)()
+	return c.chainBackend.SendTransaction(ctx, tx)
+}
+
+func (c instrumentedClient) TransactionReceipt(ctx context.Context, txHash common.Hash) (r *types.Receipt, err error) {
+	defer observeRPC("eth_getTransactionReceipt", &err)()
+	return c.chainBackend.TransactionReceipt(ctx, txHash)
+}
+
+func (c instrumentedClient) TransactionByHash(ctx context.Context, txHash common.Hash) (tx *types.Transaction, pending bool, err error) {
+	defer observeRPC("eth_getTransactionByHash", &err)()
+	return c.chainBackend.TransactionByHash(ctx, txHash)
+}
+
+func (c instrumentedClient) NonceAt(ctx context.Context, account common.Address, blockNumber *big.Int) (n uint64, err error) {
+	defer observeRPC("eth_getTransactionCount", &err)()
+	return c.chainBackend.NonceAt(ctx, account, blockNumber)
+}
+
+func (c instrumentedClient) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	defer observeRPC("eth_getLogs", &err)()
+	return c.chainBackend.FilterLogs(ctx, q)
+}
+
+func (c instrumentedClient) HeaderByNumber(ctx context.Context, number *big.Int) (h *types.Header, err error) {
+	defer observeRPC("eth_getBlockByNumber", &err)()
+	return c.chainBackend.HeaderByNumber(ctx, number)
+}
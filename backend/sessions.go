@@ -0,0 +1,563 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// Heartbeat schedule sessions ask clients to follow
+	sessionHeartbeatInterval = 5 * time.Second
+
+	// Sessions with no heartbeat for this long are abandoned
+	sessionIdleTimeout = 30 * time.Second
+
+	// How long finished sessions stay pollable
+	sessionRetention = 10 * time.Minute
+)
+
+var (
+	errSessionNotFound   = errors.New("session not found")
+	errSessionExpired    = errors.New("session expired")
+	errSessionClosed     = errors.New("session already completed")
+	errSessionIncomplete = errors.New("ad not watched long enough")
+)
+
+// AdConfig overrides the length, completion bonus or heartbeat rate of one ad
+type AdConfig struct {
+	ID              string `json:"id" yaml:"id"`
+	LengthMs        int64  `json:"length_ms" yaml:"length_ms"`
+	CompletionBonus *int64 `json:"completion_bonus,omitempty" yaml:"completion_bonus,omitempty"` // Wei (default: completion_bonus setting)
+	Bid             int64  `json:"bid,omitempty" yaml:"bid,omitempty"`                           // Wei per heartbeat, replacing reward_per_heartbeat (0 = no bid)
+}
+
+// validateAds checks the ads list for Config.Validate
+func validateAds(ads []AdConfig) []error {
+	var errs []error
+	seen := make(map[string]bool)
+	for i, ad := range ads {
+		if ad.ID == "" || len(ad.ID) > 128 {
+			errs = append(errs, fmt.Errorf("ads[%d].id: must be 1-128 characters", i))
+		} else if seen[ad.ID] {
+			errs = append(errs, fmt.Errorf("ads[%d].id: duplicate ad %q", i, ad.ID))
+		}
+		seen[ad.ID] = true
+
+		if ad.LengthMs <= 0 {
+			errs = append(errs, fmt.Errorf("ads[%d].length_ms: must be positive, got %d", i, ad.LengthMs))
+		}
+		if ad.CompletionBonus != nil && *ad.CompletionBonus < 0 {
+			errs = append(errs, fmt.Errorf("ads[%d].completion_bonus: must not be negative, got %d", i, *ad.CompletionBonus))
+		}
+		if ad.Bid < 0 {
+			errs = append(errs, fmt.Errorf("ads[%d].bid: must not be negative, got %d", i, ad.Bid))
+		}
+	}
+	return errs
+}
+
+// adTerms returns the length and completion bonus for adID
+func (c *Config) adTerms(adID string) (lengthMs, bonus int64) {
+	for _, ad := range c.Ads {
+		if ad.ID == adID {
+			bonus = c.CompletionBonus
+			if ad.CompletionBonus != nil {
+				bonus = *ad.CompletionBonus
+			}
+			return ad.LengthMs, bonus
+		}
+	}
+	return c.AdLengthMs, c.CompletionBonus
+}
+
+// adBid returns the advertiser's bid per heartbeat on adID, 0 if none
+func (c *Config) adBid(adID string) int64 {
+	for _, ad := range c.Ads {
+		if ad.ID == adID {
+			return ad.Bid
+		}
+	}
+	return 0
+}
+
+// SessionStatus is the state of an ad-view session
+type SessionStatus string
+
+const (
+	SessionActive    SessionStatus = "active"
+	SessionCompleted SessionStatus = "completed"
+	SessionExpired   SessionStatus = "expired"
+)
+
+// AdSession is one wallet watching one ad from start to completion. Its
+// terms are fixed when it starts, so config reloads don't affect it.
+type AdSession struct {
+	ID                  string        `json:"session_id"`
+	WalletAddress       string        `json:"wallet_address"`
+	AdID                string        `json:"ad_id"`
+	ChainID             int64         `json:"chain_id"`
+	Status              SessionStatus `json:"status"`
+	AdLengthMs          int64         `json:"ad_length_ms"`
+	RequiredMs          int64         `json:"required_watch_ms"` // watch time needed to complete
+	HeartbeatIntervalMs int64         `json:"heartbeat_interval_ms"`
+	ExpectedHeartbeats  int64         `json:"expected_heartbeats"`
+	Heartbeats          int64         `json:"heartbeats"`
+	WatchedMs           int64         `json:"watched_ms"`
+	CompletionBonusWei  string        `json:"completion_bonus_wei"`
+	BonusRewardID       string        `json:"bonus_reward_id,omitempty"`
+	StartedAt           time.Time     `json:"started_at"`
+	ExpiresAt           time.Time     `json:"expires_at"` // unless another heartbeat arrives
+	EndedAt             *time.Time    `json:"ended_at,omitempty"`
+}
+
+// heartbeatIntervalMs is how often clients are told to send heartbeats
+func heartbeatIntervalMs(cfg *Config) int64 {
+	interval := sessionHeartbeatInterval.Milliseconds()
+	if cfg.MinHeartbeatIntervalMs > interval {
+		interval = cfg.MinHeartbeatIntervalMs
+	}
+	return interval
+}
+
+// newAdSession sets up a session for wallet on adID under the current config
+func newAdSession(cfg *Config, wallet, adID string, chainID int64, now time.Time) *AdSession {
+	lengthMs, bonus := cfg.adTerms(adID)
+
+	interval := heartbeatIntervalMs(cfg)
+
+	// The last heartbeat may not land before the client reports the end of
+	// the ad, so one interval of slack is allowed, but never half the ad
+	required := lengthMs - interval
+	if required < lengthMs/2 {
+		required = lengthMs / 2
+	}
+
+	return &AdSession{
+		ID:                  newRewardID(),
+		WalletAddress:       wallet,
+		AdID:                adID,
+		ChainID:             chainID,
+		Status:              SessionActive,
+		AdLengthMs:          lengthMs,
+		RequiredMs:          required,
+		HeartbeatIntervalMs: interval,
+		ExpectedHeartbeats:  (lengthMs + interval - 1) / interval,
+		CompletionBonusWei:  big.NewInt(bonus).String(),
+		StartedAt:           now,
+		ExpiresAt:           now.Add(sessionIdleTimeout),
+	}
+}
+
+// bonus returns the completion bonus the session pays
+func (sess *AdSession) bonus() *big.Int {
+	bonus, ok := new(big.Int).SetString(sess.CompletionBonusWei, 10)
+	if !ok {
+		return new(big.Int)
+	}
+	return bonus
+}
+
+// end moves an active session to status
+func (sess *AdSession) end(status SessionStatus, now time.Time) {
+	sess.Status = status
+	sess.EndedAt = &now
+}
+
+// expireIdle ends sess if it has gone quiet, reporting whether it did
+func (sess *AdSession) expireIdle(now time.Time) bool {
+	if sess.Status == SessionActive && now.After(sess.ExpiresAt) {
+		sess.end(SessionExpired, now)
+		return true
+	}
+	return false
+}
+
+// checkActive returns an error unless sess belongs to wallet and can still
+// take heartbeats
+func (sess *AdSession) checkActive(wallet string) error {
+	// Someone else's session is reported as missing rather than forbidden
+	if !strings.EqualFold(sess.WalletAddress, wallet) {
+		return errSessionNotFound
+	}
+	switch sess.Status {
+	case SessionExpired:
+		return errSessionExpired
+	case SessionCompleted:
+		return errSessionClosed
+	}
+	return nil
+}
+
+// storedSession is an AdSession as kept in shared state
+type storedSession struct {
+	AdSession
+	LastCredit time.Time `json:"last_credit"`
+}
+
+// Shared state keys of sessions and of each wallet's latest session
+const (
+	sessionKeyPrefix    = "session:"
+	sessionWalletPrefix = "session:wallet:"
+
+	// Sessions outlive their last change by the idle timeout plus retention
+	sessionTTL = sessionIdleTimeout + sessionRetention
+)
+
+// sessionStore keeps ad sessions in shared state, so any replica can take a
+// session's heartbeats. A wallet has at most one active session; starting
+// another abandons the previous one.
+type sessionStore struct {
+	state sharedState
+
+	// Sessions started here, which this replica expires when they go quiet
+	mu    sync.Mutex
+	local map[string]bool
+}
+
+func newSessionStore(state sharedState) *sessionStore {
+	return &sessionStore{state: state, local: make(map[string]bool)}
+}
+
+// load returns the session with id as of now
+func (ss *sessionStore) load(id string, now time.Time) (AdSession, error) {
+	data, ok, err := ss.state.get(sessionKeyPrefix + id)
+	if err != nil {
+		return AdSession{}, err
+	}
+	if !ok {
+		return AdSession{}, errSessionNotFound
+	}
+	var sess storedSession
+	if err := json.Unmarshal(data, &sess); err != nil {
+		return AdSession{}, fmt.Errorf("corrupt session %s: %w", id, err)
+	}
+	sess.expireIdle(now)
+	return sess.AdSession, nil
+}
+
+// modify applies fn to the session with id atomically and returns the result.
+// A session found idle is saved as expired even if fn fails; fn returning
+// errNoChange leaves the session as it is without failing.
+func (ss *sessionStore) modify(id string, now time.Time, fn func(*storedSession) error) (AdSession, error) {
+	var result AdSession
+	var fnErr error
+	var expired bool
+	err := ss.state.update(sessionKeyPrefix+id, sessionTTL, func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, errSessionNotFound
+		}
+		var sess storedSession
+		if err := json.Unmarshal(old, &sess); err != nil {
+			return nil, fmt.Errorf("corrupt session %s: %w", id, err)
+		}
+		expired = sess.expireIdle(now)
+		fnErr = fn(&sess)
+		result = sess.AdSession
+		if fnErr != nil && !expired {
+			return nil, errNoChange
+		}
+		return json.Marshal(sess)
+	})
+	if err != nil {
+		return result, err
+	}
+	if expired {
+		metricSessionsEnded.Inc(string(SessionExpired))
+	}
+	if errors.Is(fnErr, errNoChange) {
+		return result, nil
+	}
+	return result, fnErr
+}
+
+// start adds sess, abandoning the wallet's previous active session
+func (ss *sessionStore) start(sess *AdSession) error {
+	data, err := json.Marshal(storedSession{AdSession: *sess, LastCredit: sess.StartedAt})
+	if err != nil {
+		return err
+	}
+	if err := ss.state.set(sessionKeyPrefix+sess.ID, data, sessionTTL); err != nil {
+		return err
+	}
+
+	var prev string
+	err = ss.state.update(sessionWalletPrefix+strings.ToLower(sess.WalletAddress), sessionTTL, func(old []byte) ([]byte, error) {
+		prev = string(old)
+		return []byte(sess.ID), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ss.mu.Lock()
+	ss.local[sess.ID] = true
+	ss.mu.Unlock()
+	metricSessionsStarted.Inc()
+
+	if prev == "" {
+		return nil
+	}
+	abandoned := false
+	_, err = ss.modify(prev, sess.StartedAt, func(p *storedSession) error {
+		abandoned = p.Status == SessionActive
+		if !abandoned {
+			return errNoChange
+		}
+		p.end(SessionExpired, sess.StartedAt)
+		return nil
+	})
+	if abandoned && err == nil {
+		metricSessionsEnded.Inc(string(SessionExpired))
+	}
+	if err != nil && !errors.Is(err, errSessionNotFound) {
+		log.Printf("⚠️ Failed to abandon session %s: %v", prev, err)
+	}
+	return nil
+}
+
+// get returns the session with the given ID
+func (ss *sessionStore) get(id string, now time.Time) (AdSession, error) {
+	return ss.load(id, now)
+}
+
+// active returns wallet's session id if it can take heartbeats
+func (ss *sessionStore) active(id, wallet string, now time.Time) (AdSession, error) {
+	sess, err := ss.load(id, now)
+	if err != nil {
+		return AdSession{}, err
+	}
+	if err := sess.checkActive(wallet); err != nil {
+		return AdSession{}, err
+	}
+	return sess, nil
+}
+
+// credit adds an accepted heartbeat's watch time. Clients can't claim more
+// than the wall-clock time since their previous heartbeat.
+func (ss *sessionStore) credit(id string, durationMs int64, now time.Time) {
+	_, err := ss.modify(id, now, func(sess *storedSession) error {
+		if sess.Status != SessionActive {
+			return errNoChange
+		}
+
+		credited := durationMs
+		if credited <= 0 {
+			credited = sess.HeartbeatIntervalMs
+		}
+		if elapsed := now.Sub(sess.LastCredit).Milliseconds(); credited > elapsed {
+			credited = elapsed
+		}
+		sess.LastCredit = now
+
+		sess.Heartbeats++
+		sess.WatchedMs += credited
+		if sess.WatchedMs > sess.AdLengthMs {
+			sess.WatchedMs = sess.AdLengthMs
+		}
+		sess.ExpiresAt = now.Add(sessionIdleTimeout)
+		return nil
+	})
+	if err != nil {
+		log.Printf("⚠️ Failed to credit session %s: %v", id, err)
+	}
+}
+
+// complete closes wallet's session id if enough of the ad was watched, then
+// calls pay to queue the completion bonus under the session's BonusRewardID.
+// The session is closed first so it can only ever pay once, on any replica;
+// if pay fails it is reopened.
+func (ss *sessionStore) complete(id, wallet string, now time.Time, pay func(AdSession) (*RewardRecord, error)) (AdSession, *RewardRecord, error) {
+	rewardID := newRewardID()
+	sess, err := ss.modify(id, now, func(sess *storedSession) error {
+		if err := sess.checkActive(wallet); err != nil {
+			return err
+		}
+		if sess.WatchedMs < sess.RequiredMs {
+			return fmt.Errorf("%w: watched %dms of %dms required", errSessionIncomplete, sess.WatchedMs, sess.RequiredMs)
+		}
+		if sess.bonus().Sign() > 0 {
+			sess.BonusRewardID = rewardID
+		}
+		sess.end(SessionCompleted, now)
+		return nil
+	})
+	if err != nil {
+		return sess, nil, err
+	}
+
+	rec, err := pay(sess)
+	if err != nil {
+		_, reopenErr := ss.modify(id, now, func(s *storedSession) error {
+			if s.Status != SessionCompleted || s.BonusRewardID != sess.BonusRewardID {
+				return errNoChange
+			}
+			s.Status, s.EndedAt, s.BonusRewardID = SessionActive, nil, ""
+			return nil
+		})
+		if reopenErr != nil {
+			log.Printf("⚠️ Failed to reopen session %s: %v", id, reopenErr)
+		}
+		return sess, nil, err
+	}
+	metricSessionsEnded.Inc(string(SessionCompleted))
+	return sess, rec, nil
+}
+
+// prune expires idle sessions started on this replica. Finished sessions
+// leave shared state on their own once sessionTTL passes.
+func (ss *sessionStore) prune(now time.Time) {
+	ss.mu.Lock()
+	ids := make([]string, 0, len(ss.local))
+	for id := range ss.local {
+		ids = append(ids, id)
+	}
+	ss.mu.Unlock()
+
+	for _, id := range ids {
+		sess, err := ss.modify(id, now, func(*storedSession) error { return errNoChange })
+		if err != nil && !errors.Is(err, errSessionNotFound) {
+			continue
+		}
+		if err != nil || sess.Status != SessionActive {
+			ss.mu.Lock()
+			delete(ss.local, id)
+			ss.mu.Unlock()
+		}
+	}
+}
+
+type SessionStartRequest struct {
+	WalletAddress string `json:"wallet_address"`
+	AdID          string `json:"ad_id"`
+	ChainID       int64  `json:"chain_id,omitempty"` // 0 routes to the default chain
+}
+
+type SessionCompleteRequest struct {
+	WalletAddress string `json:"wallet_address"`
+}
+
+type SessionCompleteResponse struct {
+	Success   bool         `json:"success"`
+	Session   AdSession    `json:"session"`
+	RewardID  string       `json:"reward_id,omitempty"`
+	Status    RewardStatus `json:"status,omitempty"`
+	RewardWei string       `json:"reward_wei"`
+	Message   string       `json:"message"`
+}
+
+// handleSessionStart opens an ad-view session and returns its heartbeat schedule
+func (s *Server) handleSessionStart(w http.ResponseWriter, r *http.Request) {
+	var req SessionStartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, "invalid request body", err))
+		return
+	}
+
+	if !common.IsHexAddress(req.WalletAddress) {
+		writeError(w, newAPIError(CodeInvalidAddress, "invalid wallet address", nil))
+		return
+	}
+	if req.AdID == "" {
+		writeError(w, newAPIError(CodeInvalidRequest, "ad_id required", nil))
+		return
+	}
+
+	if s.draining.Load() {
+		writeError(w, asAPIError(errShuttingDown, CodeInternal))
+		return
+	}
+
+	bc, err := s.chains.get(req.ChainID)
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+
+	sess := newAdSession(s.cfg(), req.WalletAddress, req.AdID, bc.ChainID(), time.Now())
+	if err := s.sessions.start(sess); err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	log.Printf("🎬 Session %s started: %s watching %s", sess.ID[:8], req.WalletAddress[:10]+"...", req.AdID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sess)
+}
+
+// handleSession returns a session's progress
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	sess, err := s.sessions.get(mux.Vars(r)["id"], time.Now())
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sess)
+}
+
+// handleSessionComplete closes a session and queues its completion bonus
+func (s *Server) handleSessionComplete(w http.ResponseWriter, r *http.Request) {
+	var req SessionCompleteRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, newAPIError(CodeInvalidRequest, "invalid request body", err))
+		return
+	}
+
+	now := time.Now()
+	sess, rec, err := s.sessions.complete(mux.Vars(r)["id"], req.WalletAddress, now, func(sess AdSession) (*RewardRecord, error) {
+		if sess.BonusRewardID == "" {
+			return nil, nil
+		}
+		bc, err := s.chains.get(sess.ChainID)
+		if err != nil {
+			return nil, err
+		}
+		if err := bc.payoutsHalted(); err != nil {
+			return nil, err
+		}
+		return s.queueReward(bc, rewardSpec{
+			id:      sess.BonusRewardID,
+			kind:    RewardCompletionBonus,
+			wallet:  sess.WalletAddress,
+			adID:    sess.AdID,
+			quote:   newQuote("completion_bonus", sess.ID, sess.bonus()),
+			trigger: "session_complete",
+		}, now)
+	})
+	if err != nil {
+		writeError(w, asAPIError(err, CodeInternal))
+		return
+	}
+	log.Printf("🏁 Session %s completed: %dms watched, bonus %s wei", sess.ID[:8], sess.WatchedMs, sess.CompletionBonusWei)
+
+	response := SessionCompleteResponse{
+		Success:   true,
+		Session:   sess,
+		RewardWei: "0",
+		Message:   "Session completed",
+	}
+	status := http.StatusOK
+	if rec != nil {
+		response.RewardID = rec.ID
+		response.Status = rec.Status
+		response.RewardWei = rec.RewardWei
+		response.Message = "Session completed, bonus queued for settlement"
+		status = http.StatusAccepted
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// How often shutdown checks whether settlement has drained
+	drainPollInterval = 250 * time.Millisecond
+
+	// How long workers get to finish the submission they are in the middle of
+	workerStopTimeout = 10 * time.Second
+
+	// How long connections get to take their close frames before HTTP shutdown
+	clientCloseTimeout = 2 * time.Second
+
+	// HTTP shutdown budget once streams are closed
+	httpShutdownTimeout = 5 * time.Second
+
+	shutdownReason = "server shutting down"
+)
+
+// pendingRewards is what shutdown leaves for the next start
+type pendingRewards struct {
+	SavedAt   time.Time      `json:"saved_at"`
+	Queued    []RewardRecord `json:"queued"`    // never submitted; queued again at startup
+	Submitted []RewardRecord `json:"submitted"` // sent but not mined; receipts checked again at startup
+}
+
+// shutdown stops the server in order: refuse heartbeats, let the workers
+// empty the queue and submitted transactions get mined until
+// ShutdownTimeoutMs, hand over or save what is left, close WebSocket and SSE
+// clients with a reason, then stop HTTP. cancel stops the background workers.
+//
+// With Redis, unsettled rewards stay in shared state for the next leader;
+// otherwise they are saved to PendingRewardsFile for the next start.
+func (s *Server) shutdown(httpServer *http.Server, cancel context.CancelFunc) {
+	start := time.Now()
+	cfg := s.cfg()
+	timeout := time.Duration(cfg.ShutdownTimeoutMs) * time.Millisecond
+
+	s.draining.Store(true)
+	log.Printf("🛑 Shutting down: refusing heartbeats, draining rewards for up to %s", timeout)
+
+	s.waitForSettlement(start.Add(timeout))
+
+	// Nothing can be queued from here on; workers stop between rewards
+	s.queueMux.Lock()
+	s.queueClosed = true
+	s.queueMux.Unlock()
+	cancel()
+
+	select {
+	case <-s.workersDone:
+	case <-time.After(workerStopTimeout):
+		log.Printf("⚠️ Reward workers still submitting after %s", workerStopTimeout)
+	}
+
+	// Rewards the workers never got go back to the shared queue, in order
+	var leftover []*RewardRequest
+collect:
+	for {
+		select {
+		case req := <-s.rewardQueue:
+			leftover = append(leftover, req)
+		default:
+			break collect
+		}
+	}
+	for i := len(leftover) - 1; i >= 0; i-- {
+		s.requeueReward(leftover[i])
+	}
+
+	var queued, submitted, inFlight []RewardRecord
+	kept := ""
+	if s.state.durable() {
+		queued, submitted, inFlight = s.handOverRewards(leftover)
+		kept = "left for the next leader"
+	} else {
+		queued, submitted, inFlight = s.unsettledRewards()
+		if len(queued)+len(submitted) > 0 && cfg.PendingRewardsFile != "" {
+			if err := savePendingRewards(cfg.PendingRewardsFile, queued, submitted); err != nil {
+				log.Printf("⚠️ %v", err)
+			} else {
+				kept = "saved to " + cfg.PendingRewardsFile
+			}
+		}
+		if kept == "" {
+			for _, rec := range queued {
+				s.dropReward(rec)
+			}
+		}
+	}
+	s.resignLeadership()
+	s.referrals.flush()
+
+	s.closeClients()
+
+	httpCtx, httpCancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer httpCancel()
+	if err := httpServer.Shutdown(httpCtx); err != nil {
+		log.Printf("⚠️ HTTP shutdown error: %v", err)
+	}
+
+	s.reportUnsettled(queued, submitted, inFlight, kept, time.Since(start))
+}
+
+// waitForSettlement blocks until no reward is queued or awaiting a receipt,
+// or until deadline. With Redis only this replica's own work counts, since
+// the queue passes to the next leader; otherwise the queue must empty too.
+func (s *Server) waitForSettlement(deadline time.Time) {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+
+	for {
+		pending := len(s.rewards.unsettled())
+		if !s.state.durable() {
+			if ids, err := s.queuedRewardIDs(); err == nil {
+				pending += len(ids)
+			}
+		}
+		if pending == 0 {
+			log.Println("✅ All rewards settled")
+			return
+		}
+		if !time.Now().Before(deadline) {
+			log.Printf("⏱️ Shutdown timeout reached with %d rewards unsettled", pending)
+			return
+		}
+		<-ticker.C
+	}
+}
+
+// handOverRewards stops tracking this replica's rewards, leaving them in
+// shared state, and classifies them for the shutdown report. requeued are
+// the rewards shutdown put back on the shared queue.
+func (s *Server) handOverRewards(requeued []*RewardRequest) (queued, submitted, inFlight []RewardRecord) {
+	queued, submitted = []RewardRecord{}, []RewardRecord{}
+
+	for _, req := range requeued {
+		if rec, ok, err := s.rewards.lookup(req.ID); err == nil && ok {
+			queued = append(queued, rec)
+		}
+	}
+	for _, rec := range s.rewards.unsettled() {
+		s.rewards.untrack(rec.ID)
+		if rec.Status == RewardSubmitted {
+			submitted = append(submitted, rec)
+		} else {
+			inFlight = append(inFlight, rec)
+		}
+	}
+	return queued, submitted, inFlight
+}
+
+// unsettledRewards classifies every reward left in process-local state
+func (s *Server) unsettledRewards() (queued, submitted, inFlight []RewardRecord) {
+	queued, submitted = []RewardRecord{}, []RewardRecord{}
+
+	records, err := s.rewards.settling()
+	if err != nil {
+		log.Printf("⚠️ %v", err)
+		return
+	}
+	inQueue, err := s.queuedRewardIDs()
+	if err != nil {
+		log.Printf("⚠️ %v", err)
+		return
+	}
+	for _, rec := range records {
+		switch {
+		case rec.Status == RewardSubmitted:
+			submitted = append(submitted, rec)
+		case inQueue[rec.ID]:
+			queued = append(queued, rec)
+		default:
+			// A worker is still inside ProcessReward: the transaction may or
+			// may not have gone out, so resending it could pay twice
+			inFlight = append(inFlight, rec)
+		}
+	}
+	return queued, submitted, inFlight
+}
+
+// dropReward fails a queued reward that shutdown could not send or save.
+// Referral bonuses go back to the referrer's pending balance.
+func (s *Server) dropReward(rec RewardRecord) {
+	copied := rec
+	s.rewards.track(&copied)
+	updated, _ := s.rewards.update(rec.ID, func(r *RewardRecord) {
+		r.Status = RewardFailed
+		r.Error = errShuttingDown.Error()
+		r.ErrorCode = CodeShuttingDown
+	})
+	s.updateReferralPayout(updated)
+}
+
+// closeClients sends every WebSocket a going-away close frame, ends SSE
+// streams and waits briefly for the connections to go
+func (s *Server) closeClients() {
+	s.events.close()
+
+	s.clientsMux.RLock()
+	count := len(s.clients)
+	for client := range s.clients {
+		client.close(websocket.CloseGoingAway, shutdownReason)
+	}
+	s.clientsMux.RUnlock()
+
+	if count > 0 {
+		log.Printf("🔌 Closing %d WebSocket connections", count)
+	}
+
+	deadline := time.Now().Add(clientCloseTimeout)
+	for time.Now().Before(deadline) {
+		s.clientsMux.RLock()
+		remaining := len(s.clients)
+		s.clientsMux.RUnlock()
+		if remaining == 0 {
+			return
+		}
+		time.Sleep(drainPollInterval)
+	}
+}
+
+// reportUnsettled logs every reward shutdown could not settle. kept says
+// where queued and submitted rewards went; empty means they were dropped.
+func (s *Server) reportUnsettled(queued, submitted, inFlight []RewardRecord, kept string, elapsed time.Duration) {
+	total := len(queued) + len(submitted) + len(inFlight)
+	if total == 0 {
+		log.Printf("📋 Shutdown took %s; nothing left unsettled", elapsed.Round(time.Millisecond))
+		return
+	}
+
+	log.Printf("📋 Shutdown took %s; %d rewards left unsettled:", elapsed.Round(time.Millisecond), total)
+	for _, rec := range queued {
+		outcome := kept
+		if outcome == "" {
+			outcome = "dropped"
+		}
+		log.Printf("   ⏸️ queued %s: %s wei to %s (%s, %s)", rec.ID, rec.RewardWei, rec.WalletAddress, rec.Kind, outcome)
+	}
+	for _, rec := range submitted {
+		outcome := kept
+		if outcome == "" {
+			outcome = "receipt not tracked"
+		}
+		log.Printf("   ⏳ submitted %s: %s wei to %s (tx %s, %s)", rec.ID, rec.RewardWei, rec.WalletAddress, rec.TxHash, outcome)
+	}
+	for _, rec := range inFlight {
+		log.Printf("   ❓ in flight %s: %s wei to %s (%s, check the signer's pending transactions)", rec.ID, rec.RewardWei, rec.WalletAddress, rec.Kind)
+	}
+}
+
+// savePendingRewards writes unsettled rewards atomically for the next start
+func savePendingRewards(file string, queued, submitted []RewardRecord) error {
+	data, err := json.MarshalIndent(pendingRewards{
+		SavedAt:   time.Now().UTC(),
+		Queued:    queued,
+		Submitted: submitted,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".pending-rewards-*")
+	if err != nil {
+		return fmt.Errorf("failed to save pending rewards: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to save pending rewards: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to save pending rewards: %w", err)
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// resumePendingRewards picks up rewards the previous shutdown saved: queued
+// ones go back on the shared queue and submitted ones to the leader's
+// receipt watcher. The file is removed so a crash can't replay it.
+func (s *Server) resumePendingRewards(file string) error {
+	if file == "" {
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read pending rewards: %w", err)
+	}
+
+	var saved pendingRewards
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+
+	resumed := 0
+	for _, rec := range saved.Submitted {
+		if _, err := s.chains.get(rec.ChainID); err != nil {
+			log.Printf("⚠️ Not resuming reward %s: %v", rec.ID, err)
+			continue
+		}
+		if err := s.rewards.save(rec); err != nil {
+			return fmt.Errorf("failed to resume reward %s: %w", rec.ID, err)
+		}
+		resumed++
+	}
+	for _, rec := range saved.Queued {
+		amount, ok := new(big.Int).SetString(rec.RewardWei, 10)
+		if _, err := s.chains.get(rec.ChainID); err != nil || !ok {
+			log.Printf("⚠️ Not resuming reward %s: unknown chain or bad amount", rec.ID)
+			continue
+		}
+		req := &RewardRequest{
+			ID:            rec.ID,
+			ChainID:       rec.ChainID,
+			WalletAddress: rec.WalletAddress,
+			AdID:          rec.AdID,
+			Amount:        amount,
+			Timestamp:     rec.CreatedAt,
+		}
+		if rec.ClaimID != "" {
+			req.ClaimID = common.HexToHash(rec.ClaimID)
+		}
+
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		if err := s.rewards.save(rec); err != nil {
+			return fmt.Errorf("failed to resume reward %s: %w", rec.ID, err)
+		}
+		if err := s.state.push(rewardQueueKey, data, 0); err != nil {
+			return fmt.Errorf("failed to resume reward %s: %w", rec.ID, err)
+		}
+		resumed++
+	}
+
+	if err := os.Remove(file); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", file, err)
+	}
+	log.Printf("♻️ Resumed %d of %d rewards left unsettled at %s", resumed, len(saved.Queued)+len(saved.Submitted), saved.SavedAt.Format(time.RFC3339))
+	return nil
+}
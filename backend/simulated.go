@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Demo mode runs against an in-process go-ethereum chain instead of an RPC
+// node, with RewardTreasury deployed on it at startup
+const (
+	demoNetwork      = "demo"
+	simulatedChainID = 1337 // simulated.Backend always uses the dev chain ID
+	demoBlockPeriod  = time.Second
+
+	// Selects the RewardTreasury build embedded from testdata rather than a
+	// file; `npm run compile` in blockchain/ writes the Hardhat build to
+	// ../blockchain/artifacts/contracts/RewardTreasury.sol/RewardTreasury.json
+	embeddedTreasuryArtifact = "embedded"
+)
+
+// embeddedTreasury is the Hardhat build of RewardTreasury.sol, copied by
+// `npm run export:backend` in blockchain/, so demo mode and the tests need no
+// Solidity toolchain
+//
+//go:embed testdata/RewardTreasury.json
+var embeddedTreasury []byte
+
+var (
+	demoSignerFunds   = new(big.Int).Mul(big.NewInt(10000), big.NewInt(params.Ether))
+	demoTreasuryFunds = new(big.Int).Mul(big.NewInt(100), big.NewInt(params.Ether))
+)
+
+// applyDemo points config at the simulated chain. Nothing that refers to
+// chain state is persisted, since the chain starts from genesis every time.
+func (c *Config) applyDemo() {
+	c.demo = true
+	c.Network = demoNetwork
+	c.ChainID = simulatedChainID
+	c.DeploymentFile = ""
+	c.ContractAddress = "" // deployed by newSimulatedChain
+	c.RewardSigner = ""
+	c.ReferralFile = ""
+	c.PendingRewardsFile = ""
+	c.PayoutLedgerFile = ""
+	c.AuditLogFile = ""
+
+	if len(c.Chains) > 0 {
+		log.Printf("⚠️ Demo mode serves only the simulated chain, ignoring %d extra chains", len(c.Chains))
+		c.Chains = nil
+	}
+}
+
+// treasuryArtifact is the part of a Hardhat compile artifact needed to deploy
+type treasuryArtifact struct {
+	ABI      json.RawMessage `json:"abi"`
+	Bytecode string          `json:"bytecode"`
+}
+
+// loadTreasuryArtifact reads the compiled RewardTreasury from path, or the
+// embedded build for embeddedTreasuryArtifact
+func loadTreasuryArtifact(path string) (abi.ABI, []byte, error) {
+	data := embeddedTreasury
+	if path != embeddedTreasuryArtifact {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return abi.ABI{}, nil, err
+		}
+	}
+
+	var artifact treasuryArtifact
+	if err := json.Unmarshal(data, &artifact); err != nil {
+		return abi.ABI{}, nil, fmt.Errorf("invalid artifact %s: %w", path, err)
+	}
+	parsed, err := abi.JSON(bytes.NewReader(artifact.ABI))
+	if err != nil {
+		return abi.ABI{}, nil, fmt.Errorf("invalid ABI in %s: %w", path, err)
+	}
+	bytecode, err := hexutil.Decode(artifact.Bytecode)
+	if err != nil || len(bytecode) == 0 {
+		return abi.ABI{}, nil, fmt.Errorf("no bytecode in %s", path)
+	}
+	return parsed, bytecode, nil
+}
+
+// simulatedChain is an in-process chain sealing a block every period, like
+// the Hardhat node's interval mining
+type simulatedChain struct {
+	backend *simulated.Backend
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// newSimulatedChain starts a chain with the signer funded and RewardTreasury
+// deployed from config.TreasuryArtifact. Without an artifact, rewards
+// are paid by direct transfer as on a chain without a deployment.
+func newSimulatedChain(config *Config, period time.Duration) (*BlockchainClient, error) {
+	key, err := crypto.HexToECDSA(strings.TrimPrefix(config.SignerPrivateKey, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	sim := &simulatedChain{
+		backend: simulated.NewBackend(types.GenesisAlloc{signer: {Balance: demoSignerFunds}}),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	chainConfig := *config
+	chainConfig.ChainID = simulatedChainID
+
+	var calls []ownerCall
+	if config.TreasuryArtifact != "" {
+		contractABI, bytecode, err := loadTreasuryArtifact(config.TreasuryArtifact)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			log.Printf("⚠️ No RewardTreasury artifact at %s (run `npm run compile` in blockchain/), paying rewards by direct transfer", config.TreasuryArtifact)
+		case err != nil:
+			sim.backend.Close()
+			return nil, err
+		default:
+			address, txHash, err := sim.deployTreasury(key, contractABI, bytecode)
+			if err != nil {
+				sim.backend.Close()
+				return nil, err
+			}
+			calls = append(calls, ownerCall{
+				detail: "deploy RewardTreasury at " + address.Hex(),
+				txHash: txHash.Hex(),
+				value:  demoTreasuryFunds,
+				at:     time.Now(),
+			})
+			chainConfig.ContractAddress = address.Hex()
+			chainConfig.RewardSigner = signer.Hex()
+			log.Printf("📜 RewardTreasury deployed at %s with %s ETH", address.Hex(), weiToEther(demoTreasuryFunds))
+		}
+	}
+
+	go sim.sealBlocks(period)
+
+	bc, err := newBlockchainClient(&chainConfig, sim.backend.Client(), sim.close)
+	if err != nil {
+		sim.close()
+		return nil, err
+	}
+	bc.ownerCalls = calls
+	log.Printf("🧪 Simulated chain %d running, sealing a block every %s", simulatedChainID, period)
+	return bc, nil
+}
+
+// deployTreasury deploys RewardTreasury with the signer as owner and reward
+// signer, funded with demoTreasuryFunds, returning its address and the
+// deployment transaction
+func (sim *simulatedChain) deployTreasury(key *ecdsa.PrivateKey, contractABI abi.ABI, bytecode []byte) (common.Address, common.Hash, error) {
+	client := sim.backend.Client()
+	signer := crypto.PubkeyToAddress(key.PublicKey)
+
+	opts, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(simulatedChainID))
+	if err != nil {
+		return common.Address{}, common.Hash{}, err
+	}
+	opts.Value = demoTreasuryFunds
+
+	address, tx, _, err := bind.DeployContract(opts, contractABI, bytecode, client, signer)
+	if err != nil {
+		return common.Address{}, common.Hash{}, fmt.Errorf("failed to deploy RewardTreasury: %w", err)
+	}
+	sim.backend.Commit()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := bind.WaitDeployed(ctx, client, tx); err != nil {
+		return common.Address{}, common.Hash{}, fmt.Errorf("RewardTreasury deployment failed: %w", err)
+	}
+	return address, tx.Hash(), nil
+}
+
+// sealBlocks commits pending transactions into a new block every period
+func (sim *simulatedChain) sealBlocks(period time.Duration) {
+	defer close(sim.done)
+
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sim.stop:
+			return
+		case <-ticker.C:
+			sim.backend.Commit()
+		}
+	}
+}
+
+// close stops block production and shuts the chain down
+func (sim *simulatedChain) close() {
+	close(sim.stop)
+	<-sim.done
+	sim.backend.Close()
+}
@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+)
+
+// Blocks are sealed quickly so settlement is bounded by receiptPollInterval
+const testBlockPeriod = 50 * time.Millisecond
+
+// testServer is a started server on a simulated chain, served over HTTP
+type testServer struct {
+	*httptest.Server
+	server *Server
+	cancel context.CancelFunc
+}
+
+// newDemoConfig returns the demo config with RewardTreasury deployed from
+// artifact ("" pays by direct transfer), adjusted by configure
+func newDemoConfig(t *testing.T, artifact string, configure ...func(*Config)) *Config {
+	t.Helper()
+
+	config := defaultConfig()
+	config.TreasuryArtifact = artifact
+	config.LeaderboardOptOutFile = ""
+	config.MinHeartbeatIntervalMs = 0
+	config.applyDemo()
+	for _, fn := range configure {
+		fn(config)
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid demo config: %v", err)
+	}
+	return config
+}
+
+// startDemoChain starts a simulated chain for config, closed when t ends
+func startDemoChain(t *testing.T, config *Config) *chainRegistry {
+	t.Helper()
+
+	bc, err := newSimulatedChain(config, testBlockPeriod)
+	if err != nil {
+		t.Fatalf("failed to start simulated chain: %v", err)
+	}
+	chains := newChainRegistry()
+	chains.add(bc)
+	t.Cleanup(chains.Close)
+	return chains
+}
+
+// startServer runs a server against chains, stopped when t ends
+func startServer(t *testing.T, config *Config, chains *chainRegistry) *testServer {
+	t.Helper()
+	return startReplica(t, config, chains, newMemoryState())
+}
+
+// startReplica runs a server keeping its shared state in state
+func startReplica(t *testing.T, config *Config, chains *chainRegistry, state sharedState) *testServer {
+	t.Helper()
+
+	server, err := newServer(config, &configLoader{demo: true}, chains, state)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server.start(ctx)
+	ts := &testServer{Server: httptest.NewServer(server.router), server: server, cancel: cancel}
+
+	t.Cleanup(func() {
+		ts.Close()
+		cancel()
+	})
+	return ts
+}
+
+// newDemoServer runs a server on a fresh simulated chain
+func newDemoServer(t *testing.T, artifact string, configure ...func(*Config)) *testServer {
+	t.Helper()
+	config := newDemoConfig(t, artifact, configure...)
+	return startServer(t, config, startDemoChain(t, config))
+}
+
+func newWallet(t *testing.T) string {
+	t.Helper()
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.PubkeyToAddress(key.PublicKey).Hex()
+}
+
+// getJSON decodes a GET response into v, failing on any status but 200
+func getJSON(t *testing.T, ts *testServer, path string, v interface{}) {
+	t.Helper()
+	resp, err := http.Get(ts.URL + path)
+	if err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status %d", path, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+// postHeartbeat posts a heartbeat for wallet and returns its reward ID
+func postHeartbeat(ts *testServer, wallet string) (string, error) {
+	body, _ := json.Marshal(HeartbeatRequest{WalletAddress: wallet, AdID: "ad-1", Duration: 5000})
+	resp, err := http.Post(ts.URL+"/api/v1/heartbeat", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var hb HeartbeatResponse
+	if err := json.NewDecoder(resp.Body).Decode(&hb); err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusAccepted || !hb.Success || hb.RewardID == "" {
+		return "", fmt.Errorf("status %d, response %+v", resp.StatusCode, hb)
+	}
+	return hb.RewardID, nil
+}
+
+func sendHeartbeat(t *testing.T, ts *testServer, wallet string) string {
+	t.Helper()
+	id, err := postHeartbeat(ts, wallet)
+	if err != nil {
+		t.Fatalf("heartbeat: %v", err)
+	}
+	return id
+}
+
+// waitFor polls cond until it returns nil or timeout passes
+func waitFor(t *testing.T, timeout time.Duration, cond func() error) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := cond()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out after %s: %v", timeout, err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// waitConfirmed waits until reward id is mined
+func waitConfirmed(t *testing.T, ts *testServer, id string) RewardRecord {
+	t.Helper()
+	var rec RewardRecord
+	waitFor(t, 15*time.Second, func() error {
+		getJSON(t, ts, "/api/v1/reward/"+id, &rec)
+		switch rec.Status {
+		case RewardConfirmed:
+			return nil
+		case RewardFailed:
+			t.Fatalf("reward %s failed: %s (%s)", id, rec.Error, rec.ErrorCode)
+		}
+		return fmt.Errorf("reward %s is %s", id, rec.Status)
+	})
+	return rec
+}
+
+func TestDemoTreasuryHeartbeatToStats(t *testing.T) {
+	ts := newDemoServer(t, embeddedTreasuryArtifact)
+	wallet := newWallet(t)
+
+	var treasury TreasuryResponse
+	getJSON(t, ts, "/api/v1/treasury", &treasury)
+	if treasury.ContractAddress == "" || treasury.BalanceWei != demoTreasuryFunds.String() {
+		t.Fatalf("treasury not deployed and funded: %+v", treasury)
+	}
+
+	for i := 0; i < 3; i++ {
+		rec := waitConfirmed(t, ts, sendHeartbeat(t, ts, wallet))
+		if rec.TxHash == "" {
+			t.Fatalf("confirmed reward without a transaction: %+v", rec)
+		}
+	}
+
+	var balance BalanceResponse
+	getJSON(t, ts, "/api/v1/balance/"+wallet, &balance)
+	if balance.BalanceWei != "3000" {
+		t.Errorf("wallet balance = %s wei, want 3000", balance.BalanceWei)
+	}
+
+	var earnings EarningsResponse
+	getJSON(t, ts, "/api/v1/user/"+wallet+"/earnings", &earnings)
+	if earnings.EarningsWei != "3000" {
+		t.Errorf("contract earnings = %s wei, want 3000", earnings.EarningsWei)
+	}
+
+	var stats StatsResponse
+	getJSON(t, ts, "/api/v1/stats", &stats)
+	if stats.TotalClaims != 3 {
+		t.Errorf("total_claims = %d, want 3", stats.TotalClaims)
+	}
+	if len(stats.Chains) != 1 || stats.Chains[0].Network != demoNetwork || stats.Chains[0].ChainID != simulatedChainID {
+		t.Errorf("chains = %+v, want only the demo chain", stats.Chains)
+	}
+
+	// RewardClaimed events reach the earnings index
+	waitFor(t, 15*time.Second, func() error {
+		var summary EarningsSummaryResponse
+		getJSON(t, ts, "/api/v1/user/"+wallet+"/earnings/summary", &summary)
+		if summary.Payouts != 3 || summary.EarningsWei != "3000" {
+			return fmt.Errorf("summary has %d payouts, %s wei", summary.Payouts, summary.EarningsWei)
+		}
+		return nil
+	})
+}
+
+func TestDemoDirectTransferHeartbeatToStats(t *testing.T) {
+	ts := newDemoServer(t, "")
+	wallet := newWallet(t)
+
+	waitConfirmed(t, ts, sendHeartbeat(t, ts, wallet))
+
+	var balance BalanceResponse
+	getJSON(t, ts, "/api/v1/balance/"+wallet, &balance)
+	if balance.BalanceWei != "1000" {
+		t.Errorf("wallet balance = %s wei, want 1000", balance.BalanceWei)
+	}
+
+	var stats StatsResponse
+	getJSON(t, ts, "/api/v1/stats", &stats)
+	if len(stats.Chains) != 1 || stats.Chains[0].ContractAddress != "" {
+		t.Errorf("chains = %+v, want the demo chain without a contract", stats.Chains)
+	}
+	if stats.TotalClaims != 0 {
+		t.Errorf("total_claims = %d, want 0 without a contract", stats.TotalClaims)
+	}
+
+	var summary EarningsSummaryResponse
+	getJSON(t, ts, "/api/v1/user/"+wallet+"/earnings/summary", &summary)
+	if summary.Payouts != 1 || summary.EarningsWei != "1000" {
+		t.Errorf("summary has %d payouts, %s wei; want 1 payout of 1000 wei", summary.Payouts, summary.EarningsWei)
+	}
+}
+
+func TestDemoConfigIgnoresDeployment(t *testing.T) {
+	t.Setenv("CONTRACT_ADDRESS", "0x5FbDB2315678afecb367f032d93F642f64180aa3")
+	t.Setenv("PENDING_REWARDS_FILE", "pending.json")
+
+	config, err := (&configLoader{flags: map[string]string{}, demo: true}).load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Network != demoNetwork || config.ChainID != simulatedChainID {
+		t.Errorf("network %s chain %d, want %s chain %d", config.Network, config.ChainID, demoNetwork, simulatedChainID)
+	}
+	if config.ContractAddress != "" || config.PendingRewardsFile != "" || config.ReferralFile != "" {
+		t.Errorf("demo config keeps chain-specific settings: %+v", config.Redacted())
+	}
+}
+
+// treasuryHarness is the embedded RewardTreasury on a bare simulated chain,
+// for exercising the contract without the server
+type treasuryHarness struct {
+	backend  *simulated.Backend
+	contract *bind.BoundContract
+	abi      abi.ABI
+	address  common.Address
+	owner    *ecdsa.PrivateKey
+	signer   *ecdsa.PrivateKey
+}
+
+func newTreasuryHarness(t *testing.T, funds *big.Int) *treasuryHarness {
+	t.Helper()
+	owner, _ := crypto.GenerateKey()
+	signer, _ := crypto.GenerateKey()
+	backend := simulated.NewBackend(types.GenesisAlloc{
+		crypto.PubkeyToAddress(owner.PublicKey):  {Balance: demoSignerFunds},
+		crypto.PubkeyToAddress(signer.PublicKey): {Balance: demoSignerFunds},
+	})
+	t.Cleanup(func() { backend.Close() })
+
+	contractABI, bytecode, err := loadTreasuryArtifact(embeddedTreasuryArtifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &treasuryHarness{backend: backend, abi: contractABI, owner: owner, signer: signer}
+	opts := h.opts(t, owner)
+	opts.Value = funds
+	address, _, contract, err := bind.DeployContract(opts, contractABI, bytecode, backend.Client(), crypto.PubkeyToAddress(signer.PublicKey))
+	if err != nil {
+		t.Fatalf("deploy: %v", err)
+	}
+	backend.Commit()
+	h.address, h.contract = address, contract
+	return h
+}
+
+func (h *treasuryHarness) opts(t *testing.T, key *ecdsa.PrivateKey) *bind.TransactOpts {
+	t.Helper()
+	opts, err := bind.NewKeyedTransactorWithChainID(key, big.NewInt(simulatedChainID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return opts
+}
+
+// transact sends method from key and mines it, returning the decoded revert
+// if gas estimation fails
+func (h *treasuryHarness) transact(t *testing.T, key *ecdsa.PrivateKey, method string, args ...interface{}) (*types.Receipt, error) {
+	t.Helper()
+	tx, err := h.contract.Transact(h.opts(t, key), method, args...)
+	if err != nil {
+		return nil, decodeRevert(err)
+	}
+	h.backend.Commit()
+	receipt, err := h.backend.Client().TransactionReceipt(context.Background(), tx.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if receipt.Status != types.ReceiptStatusSuccessful {
+		t.Fatalf("%s mined but failed", method)
+	}
+	return receipt, nil
+}
+
+func (h *treasuryHarness) call(t *testing.T, method string, args ...interface{}) []interface{} {
+	t.Helper()
+	var out []interface{}
+	if err := h.contract.Call(nil, &out, method, args...); err != nil {
+		t.Fatalf("%s: %v", method, err)
+	}
+	return out
+}
+
+func TestEmbeddedTreasuryABIMatchesClient(t *testing.T) {
+	embedded, _, err := loadTreasuryArtifact(embeddedTreasuryArtifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := abi.JSON(strings.NewReader(RewardTreasuryABI))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, method := range client.Methods {
+		if got, ok := embedded.Methods[name]; !ok || got.Sig != method.Sig || len(got.Outputs) != len(method.Outputs) {
+			t.Errorf("embedded ABI method %s does not match %s", name, method.Sig)
+		}
+	}
+	for name, event := range client.Events {
+		if got, ok := embedded.Events[name]; !ok || got.ID != event.ID {
+			t.Errorf("embedded ABI event %s does not match %s", name, event.Sig)
+		}
+	}
+}
+
+// The embedded build must be of the current RewardTreasury.sol; a stale one
+// would test and demo a contract that is no longer deployed
+func TestEmbeddedTreasuryMatchesSource(t *testing.T) {
+	source, err := os.ReadFile("../blockchain/contracts/RewardTreasury.sol")
+	if err != nil {
+		t.Skipf("contract source not available: %v", err)
+	}
+	recorded, err := os.ReadFile("testdata/RewardTreasury.sol.sha256")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum := sha256.Sum256(source); hex.EncodeToString(sum[:]) != strings.TrimSpace(string(recorded)) {
+		t.Fatal("testdata/RewardTreasury.json was built from another RewardTreasury.sol; run `npm run export:backend` in blockchain/")
+	}
+
+	var artifact struct {
+		Format     string `json:"_format"`
+		SourceName string `json:"sourceName"`
+	}
+	if err := json.Unmarshal(embeddedTreasury, &artifact); err != nil {
+		t.Fatal(err)
+	}
+	if artifact.Format != "hh-sol-artifact-1" || artifact.SourceName != "contracts/RewardTreasury.sol" {
+		t.Errorf("embedded artifact is %s of %s, want the Hardhat build of contracts/RewardTreasury.sol", artifact.Format, artifact.SourceName)
+	}
+}
+
+func TestEmbeddedTreasuryBehaviour(t *testing.T) {
+	h := newTreasuryHarness(t, big.NewInt(10000))
+	ownerAddr := crypto.PubkeyToAddress(h.owner.PublicKey)
+	signerAddr := crypto.PubkeyToAddress(h.signer.PublicKey)
+	recipient := common.HexToAddress(newWallet(t))
+	claim := rewardClaimID("reward-1")
+
+	if got := h.call(t, "owner")[0].(common.Address); got != ownerAddr {
+		t.Errorf("owner = %s, want %s", got.Hex(), ownerAddr.Hex())
+	}
+	if got := h.call(t, "rewardSigner")[0].(common.Address); got != signerAddr {
+		t.Errorf("rewardSigner = %s, want %s", got.Hex(), signerAddr.Hex())
+	}
+	if got := h.call(t, "rewardPerHeartbeat")[0].(*big.Int); got.Int64() != 1000 {
+		t.Errorf("rewardPerHeartbeat = %s, want 1000", got)
+	}
+
+	receipt, err := h.transact(t, h.signer, "processReward", recipient, big.NewInt(1500), claim)
+	if err != nil {
+		t.Fatalf("processReward: %v", err)
+	}
+	event := h.abi.Events["RewardClaimed"]
+	if len(receipt.Logs) != 1 || receipt.Logs[0].Topics[0] != event.ID ||
+		common.BytesToAddress(receipt.Logs[0].Topics[1].Bytes()) != recipient || receipt.Logs[0].Topics[2] != claim {
+		t.Errorf("processReward logs = %+v, want one RewardClaimed", receipt.Logs)
+	}
+	balance, err := h.backend.Client().BalanceAt(context.Background(), recipient, nil)
+	if err != nil || balance.Int64() != 1500 {
+		t.Errorf("recipient balance = %v (%v), want 1500", balance, err)
+	}
+	if got := h.call(t, "getUserEarnings", recipient)[0].(*big.Int); got.Int64() != 1500 {
+		t.Errorf("getUserEarnings = %s, want 1500", got)
+	}
+	if got := h.call(t, "isClaimProcessed", claim)[0].(bool); !got {
+		t.Error("isClaimProcessed = false after processReward")
+	}
+
+	tests := []struct {
+		name   string
+		key    *ecdsa.PrivateKey
+		method string
+		args   []interface{}
+		want   error
+		reason string
+	}{
+		{"duplicate claim", h.signer, "processReward", []interface{}{recipient, big.NewInt(1), claim}, ErrRewardAlreadyClaimed, ""},
+		{"not the signer", h.owner, "processReward", []interface{}{recipient, big.NewInt(1), rewardClaimID("reward-2")}, ErrNotRewardSigner, ""},
+		{"zero recipient", h.signer, "processReward", []interface{}{common.Address{}, big.NewInt(1), rewardClaimID("reward-3")}, ErrInvalidRecipient, ""},
+		{"zero amount", h.signer, "processReward", []interface{}{recipient, big.NewInt(0), rewardClaimID("reward-4")}, ErrInvalidAmount, ""},
+		{"over balance", h.signer, "processReward", []interface{}{recipient, big.NewInt(8501), rewardClaimID("reward-5")}, ErrInsufficientTreasury, ""},
+		{"batch length mismatch", h.signer, "batchProcessRewards", []interface{}{[]common.Address{recipient}, []*big.Int{}, [][32]byte{}}, ErrReverted, "RewardTreasury: array length mismatch"},
+		{"rate by non-owner", h.signer, "setRewardRate", []interface{}{big.NewInt(5)}, ErrReverted, "RewardTreasury: caller is not owner"},
+		{"zero rate", h.owner, "setRewardRate", []interface{}{big.NewInt(0)}, ErrReverted, "RewardTreasury: rate must be positive"},
+		{"withdraw too much", h.owner, "emergencyWithdraw", []interface{}{ownerAddr, big.NewInt(8501)}, ErrReverted, "RewardTreasury: insufficient balance"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := h.transact(t, tt.key, tt.method, tt.args...)
+			var revert *RevertError
+			if !errors.As(err, &revert) || !errors.Is(err, tt.want) {
+				t.Fatalf("%s error = %v, want a revert wrapping %v", tt.method, err, tt.want)
+			}
+			if tt.reason != "" && revert.Reason != tt.reason {
+				t.Errorf("reason = %q, want %q", revert.Reason, tt.reason)
+			}
+		})
+	}
+
+	// A batch pays every entry and the totals add up
+	second, third := common.HexToAddress(newWallet(t)), common.HexToAddress(newWallet(t))
+	receipt, err = h.transact(t, h.signer, "batchProcessRewards",
+		[]common.Address{second, third},
+		[]*big.Int{big.NewInt(100), big.NewInt(200)},
+		[][32]byte{rewardClaimID("batch-1"), rewardClaimID("batch-2")})
+	if err != nil {
+		t.Fatalf("batchProcessRewards: %v", err)
+	}
+	if len(receipt.Logs) != 2 {
+		t.Errorf("batch emitted %d logs, want 2", len(receipt.Logs))
+	}
+	stats := h.call(t, "getStats")
+	if stats[0].(*big.Int).Int64() != 8200 || stats[1].(*big.Int).Int64() != 1800 || stats[2].(*big.Int).Int64() != 3 {
+		t.Errorf("getStats = %v, want balance 8200, distributed 1800, 3 claims", stats)
+	}
+
+	// Owner functions
+	receipt, err = h.transact(t, h.owner, "setRewardRate", big.NewInt(2000))
+	if err != nil {
+		t.Fatalf("setRewardRate: %v", err)
+	}
+	if got := h.call(t, "rewardPerHeartbeat")[0].(*big.Int); got.Int64() != 2000 || len(receipt.Logs) != 1 {
+		t.Errorf("rewardPerHeartbeat = %s with %d logs, want 2000 and RewardRateUpdated", got, len(receipt.Logs))
+	}
+	if _, err := h.transact(t, h.owner, "emergencyWithdraw", ownerAddr, big.NewInt(200)); err != nil {
+		t.Fatalf("emergencyWithdraw: %v", err)
+	}
+	if got := h.call(t, "getTreasuryBalance")[0].(*big.Int); got.Int64() != 8000 {
+		t.Errorf("balance after withdrawal = %s, want 8000", got)
+	}
+	if _, err := h.transact(t, h.owner, "transferOwnership", signerAddr); err != nil {
+		t.Fatalf("transferOwnership: %v", err)
+	}
+	if got := h.call(t, "owner")[0].(common.Address); got != signerAddr {
+		t.Errorf("owner after transfer = %s, want %s", got.Hex(), signerAddr.Hex())
+	}
+
+	// Plain transfers fund the treasury through receive()
+	opts := h.opts(t, h.owner)
+	opts.Value = big.NewInt(500)
+	if _, err := h.contract.RawTransact(opts, nil); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	h.backend.Commit()
+	if got := h.call(t, "getTreasuryBalance")[0].(*big.Int); got.Int64() != 8500 {
+		t.Errorf("balance after plain transfer = %s, want 8500", got)
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// errNoChange tells sharedState.update to leave the value as it is
+var errNoChange = errors.New("no change")
+
+// errStateUnavailable wraps failures of the shared state backend
+var errStateUnavailable = errors.New("shared state unavailable")
+
+// sharedState is the state replicas must agree on: ad sessions, heartbeat
+// throttles, the reward queue and status, leadership and cross-replica
+// events. memoryState serves a single process; redisState shares it between
+// replicas through any server speaking the Redis protocol.
+type sharedState interface {
+	// get returns the value at key; ok is false if it is missing or expired
+	get(key string) (value []byte, ok bool, err error)
+	// set stores value at key, expiring after ttl (0 = never)
+	set(key string, value []byte, ttl time.Duration) error
+	// setNX stores value only if key is missing, reporting whether it did
+	setNX(key string, value []byte, ttl time.Duration) (bool, error)
+	// update atomically replaces the value at key with fn's result. fn sees
+	// nil for a missing key and may run more than once; returning nil
+	// deletes the key and errNoChange leaves it as it is.
+	update(key string, ttl time.Duration, fn func(old []byte) ([]byte, error)) error
+	del(key string) error
+
+	hset(key, field string, value []byte) error
+	hget(key, field string) (value []byte, ok bool, err error)
+	hdel(key, field string) error
+	hgetall(key string) (map[string][]byte, error)
+	// hincr adds n to the integer at field, which starts from 0
+	hincr(key, field string, n int64) (int64, error)
+
+	// push appends to the list at key, failing with errQueueFull once it
+	// holds max entries (0 = no limit); pushFront prepends
+	push(key string, value []byte, max int) error
+	pushFront(key string, value []byte) error
+	// pop removes the first entry of the list at key
+	pop(key string) (value []byte, ok bool, err error)
+	list(key string) ([][]byte, error)
+
+	// publish sends msg to every subscriber of channel, in any replica
+	publish(channel string, msg []byte) error
+	// subscribe calls fn for each message on channel until ctx is done
+	subscribe(ctx context.Context, channel string, fn func(msg []byte))
+
+	// durable reports whether the state outlives this process
+	durable() bool
+	close() error
+}
+
+// How often memoryState drops expired keys
+const memorySweepInterval = 10 * time.Second
+
+// memoryState is sharedState for a single replica. Servers in the same
+// process may share one, which behaves like replicas sharing Redis.
+type memoryState struct {
+	mu        sync.Mutex
+	values    map[string]memoryValue
+	hashes    map[string]map[string][]byte
+	lists     map[string][][]byte
+	subs      map[string]map[*memorySub]bool
+	lastSweep time.Time
+}
+
+type memoryValue struct {
+	data    []byte
+	expires time.Time // zero: never
+}
+
+type memorySub struct {
+	fn func([]byte)
+}
+
+func newMemoryState() *memoryState {
+	return &memoryState{
+		values:    make(map[string]memoryValue),
+		hashes:    make(map[string]map[string][]byte),
+		lists:     make(map[string][][]byte),
+		subs:      make(map[string]map[*memorySub]bool),
+		lastSweep: time.Now(),
+	}
+}
+
+// lookup returns the live value at key. Callers hold mu.
+func (m *memoryState) lookup(key string, now time.Time) ([]byte, bool) {
+	v, ok := m.values[key]
+	if !ok {
+		return nil, false
+	}
+	if !v.expires.IsZero() && !now.Before(v.expires) {
+		delete(m.values, key)
+		return nil, false
+	}
+	return v.data, true
+}
+
+// store writes key and occasionally sweeps expired keys. Callers hold mu.
+func (m *memoryState) store(key string, value []byte, ttl time.Duration, now time.Time) {
+	v := memoryValue{data: append([]byte(nil), value...)}
+	if ttl > 0 {
+		v.expires = now.Add(ttl)
+	}
+	m.values[key] = v
+
+	if now.Sub(m.lastSweep) >= memorySweepInterval {
+		m.lastSweep = now
+		for k, v := range m.values {
+			if !v.expires.IsZero() && !now.Before(v.expires) {
+				delete(m.values, k)
+			}
+		}
+	}
+}
+
+func (m *memoryState) get(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.lookup(key, time.Now())
+	return append([]byte(nil), v...), ok, nil
+}
+
+func (m *memoryState) set(key string, value []byte, ttl time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.store(key, value, ttl, time.Now())
+	return nil
+}
+
+func (m *memoryState) setNX(key string, value []byte, ttl time.Duration) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	if _, ok := m.lookup(key, now); ok {
+		return false, nil
+	}
+	m.store(key, value, ttl, now)
+	return true, nil
+}
+
+func (m *memoryState) update(key string, ttl time.Duration, fn func([]byte) ([]byte, error)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	old, _ := m.lookup(key, now)
+	next, err := fn(append([]byte(nil), old...))
+	if errors.Is(err, errNoChange) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if next == nil {
+		delete(m.values, key)
+		return nil
+	}
+	m.store(key, next, ttl, now)
+	return nil
+}
+
+func (m *memoryState) del(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.values, key)
+	return nil
+}
+
+func (m *memoryState) hset(key, field string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.hashes[key]
+	if !ok {
+		h = make(map[string][]byte)
+		m.hashes[key] = h
+	}
+	h[field] = append([]byte(nil), value...)
+	return nil
+}
+
+func (m *memoryState) hget(key, field string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	v, ok := m.hashes[key][field]
+	return append([]byte(nil), v...), ok, nil
+}
+
+func (m *memoryState) hdel(key, field string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.hashes[key], field)
+	return nil
+}
+
+func (m *memoryState) hgetall(key string) (map[string][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	all := make(map[string][]byte, len(m.hashes[key]))
+	for field, v := range m.hashes[key] {
+		all[field] = append([]byte(nil), v...)
+	}
+	return all, nil
+}
+
+func (m *memoryState) hincr(key, field string, n int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.hashes[key]
+	if !ok {
+		h = make(map[string][]byte)
+		m.hashes[key] = h
+	}
+	var v int64
+	if old, ok := h[field]; ok {
+		var err error
+		if v, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+			return 0, fmt.Errorf("hash value is not an integer: %w", err)
+		}
+	}
+	v += n
+	h[field] = []byte(strconv.FormatInt(v, 10))
+	return v, nil
+}
+
+func (m *memoryState) push(key string, value []byte, max int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if max > 0 && len(m.lists[key]) >= max {
+		return errQueueFull
+	}
+	m.lists[key] = append(m.lists[key], append([]byte(nil), value...))
+	return nil
+}
+
+func (m *memoryState) pushFront(key string, value []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lists[key] = append([][]byte{append([]byte(nil), value...)}, m.lists[key]...)
+	return nil
+}
+
+func (m *memoryState) pop(key string) ([]byte, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l := m.lists[key]
+	if len(l) == 0 {
+		return nil, false, nil
+	}
+	m.lists[key] = l[1:]
+	return l[0], true, nil
+}
+
+func (m *memoryState) list(key string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	l := make([][]byte, len(m.lists[key]))
+	for i, v := range m.lists[key] {
+		l[i] = append([]byte(nil), v...)
+	}
+	return l, nil
+}
+
+func (m *memoryState) publish(channel string, msg []byte) error {
+	m.mu.Lock()
+	subs := make([]*memorySub, 0, len(m.subs[channel]))
+	for sub := range m.subs[channel] {
+		subs = append(subs, sub)
+	}
+	m.mu.Unlock()
+
+	// Delivered outside the lock so subscribers may use the state
+	for _, sub := range subs {
+		sub.fn(msg)
+	}
+	return nil
+}
+
+func (m *memoryState) subscribe(ctx context.Context, channel string, fn func([]byte)) {
+	sub := &memorySub{fn: fn}
+
+	m.mu.Lock()
+	if m.subs[channel] == nil {
+		m.subs[channel] = make(map[*memorySub]bool)
+	}
+	m.subs[channel][sub] = true
+	m.mu.Unlock()
+
+	<-ctx.Done()
+
+	m.mu.Lock()
+	delete(m.subs[channel], sub)
+	m.mu.Unlock()
+}
+
+func (m *memoryState) durable() bool { return false }
+
+func (m *memoryState) close() error { return nil }
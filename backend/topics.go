@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// WebSocket topics clients can subscribe to
+const (
+	TopicBlocks   = "blocks"
+	TopicTreasury = "treasury"
+	TopicStats    = "stats"
+
+	TopicLeaderboard = "leaderboard"
+
+	// Parameterised topics, e.g. "rewards:0xabc..." or "campaign:ad_3"
+	topicRewardsPrefix  = "rewards:"
+	topicCampaignPrefix = "campaign:"
+
+	// Upper bound on subscriptions held by a single connection
+	maxTopicsPerClient = 32
+
+	// How often the stats topic is refreshed
+	statsPublishInterval = 5 * time.Second
+)
+
+// defaultTopics are subscribed on connect so existing clients keep receiving blocks
+var defaultTopics = []string{TopicBlocks}
+
+// normalizeTopic validates a topic name and returns its canonical form
+func normalizeTopic(topic string) (string, error) {
+	topic = strings.TrimSpace(topic)
+
+	switch topic {
+	case TopicBlocks, TopicTreasury, TopicStats, TopicLeaderboard:
+		return topic, nil
+	}
+
+	if addr, ok := strings.CutPrefix(topic, topicRewardsPrefix); ok {
+		if !common.IsHexAddress(addr) {
+			return "", fmt.Errorf("invalid address in topic %q", topic)
+		}
+		return rewardsTopic(addr), nil
+	}
+
+	if adID, ok := strings.CutPrefix(topic, topicCampaignPrefix); ok {
+		if adID == "" || len(adID) > 128 {
+			return "", fmt.Errorf("invalid campaign in topic %q", topic)
+		}
+		return campaignTopic(adID), nil
+	}
+
+	return "", fmt.Errorf("unknown topic %q", topic)
+}
+
+// rewardsTopic returns the per-wallet reward topic
+func rewardsTopic(address string) string {
+	return topicRewardsPrefix + strings.ToLower(address)
+}
+
+// campaignTopic returns the per-ad campaign topic
+func campaignTopic(adID string) string {
+	return topicCampaignPrefix + adID
+}
+
+// publish sends a message to every client of this replica subscribed to
+// topic; broadcast reaches the subscribers of every replica
+func (s *Server) publish(topic string, msg map[string]interface{}) {
+	s.publishExcept(topic, msg, nil)
+}
+
+// publishExcept is publish skipping one client that was already answered directly
+func (s *Server) publishExcept(topic string, msg map[string]interface{}, except *wsClient) {
+	msg["topic"] = topic
+
+	data, msgType, err := encodeEvent(msg)
+	if err != nil {
+		log.Printf("⚠️ Failed to encode %s event: %v", topic, err)
+		return
+	}
+	s.deliver(topic, msgType, data, except)
+}
+
+// deliver sends an encoded message to local subscribers of topic. Every
+// delivered message is also recorded for SSE streaming and replay.
+func (s *Server) deliver(topic, msgType string, data []byte, except *wsClient) {
+	s.events.append(topic, msgType, data)
+
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	for client := range s.clients {
+		if client != except && client.isSubscribed(topic) {
+			client.sendRaw(data)
+		}
+	}
+}
+
+// hasSubscribers reports whether any client listens on topic, so producers
+// can skip RPC calls nobody will see.
+func (s *Server) hasSubscribers(topic string) bool {
+	if s.events.hasSubscribers(topic) {
+		return true
+	}
+
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+
+	for client := range s.clients {
+		if client.isSubscribed(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// publishTreasury pushes current treasury figures of one chain to the treasury topic
+func (s *Server) publishTreasury(bc *BlockchainClient) {
+	if !s.hasSubscribers(TopicTreasury) {
+		return
+	}
+
+	stats, err := bc.GetContractStats()
+	if err != nil {
+		return
+	}
+
+	s.publish(TopicTreasury, map[string]interface{}{
+		"type":                 "treasury",
+		"chain_id":             bc.ChainID(),
+		"network":              bc.Network(),
+		"balance":              weiToEther(stats.Balance),
+		"balance_wei":          stats.Balance.String(),
+		"total_distributed":    weiToEther(stats.TotalDistributed),
+		"total_claims":         stats.TotalClaims,
+		"reward_per_heartbeat": stats.RewardRate.String(),
+	})
+}
+
+// publishStats pushes cluster-wide counters to the stats topic
+func (s *Server) publishStats() {
+	if !s.hasSubscribers(TopicStats) {
+		return
+	}
+
+	activeConns, heartbeats, rewards := s.clusterTotals()
+
+	s.statsMux.RLock()
+	msg := map[string]interface{}{
+		"type":               "stats",
+		"total_heartbeats":   heartbeats,
+		"total_rewards_wei":  rewards.String(),
+		"active_connections": activeConns,
+		"block_height":       s.stats.BlockHeight,
+		"block_heights":      blockHeights(s.stats.LatestBlocks),
+	}
+	s.statsMux.RUnlock()
+
+	s.publish(TopicStats, msg)
+}
+
+// publishRewardResult notifies local reward and campaign subscribers about a
+// heartbeat payout. origin, if set, is the connection that already received
+// the result.
+func (s *Server) publishRewardResult(wallet, adID string, result map[string]interface{}, origin *wsClient) {
+	msg := make(map[string]interface{}, len(result)+1)
+	for k, v := range result {
+		msg[k] = v
+	}
+	msg["wallet_address"] = wallet
+	s.publishExcept(rewardsTopic(wallet), msg, origin)
+
+	if adID != "" {
+		s.publish(campaignTopic(adID), map[string]interface{}{
+			"type":           "campaign_heartbeat",
+			"ad_id":          adID,
+			"wallet_address": wallet,
+			"success":        result["success"],
+			"reward_wei":     result["reward_wei"],
+		})
+	}
+}
+
+// blockHeights maps chain ID to latest block number for JSON output
+func blockHeights(latest map[int64]*BlockInfo) map[string]uint64 {
+	heights := make(map[string]uint64, len(latest))
+	for id, block := range latest {
+		heights[strconv.FormatInt(id, 10)] = block.Number
+	}
+	return heights
+}
+
+// broadcastUpdates fans block, treasury and stats events out to subscribers
+func (s *Server) broadcastUpdates(ctx context.Context) {
+	statsTicker := time.NewTicker(statsPublishInterval)
+	defer statsTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case block := <-s.blockUpdates:
+			s.publish(TopicBlocks, map[string]interface{}{
+				"type":      "block",
+				"chain_id":  block.ChainID,
+				"number":    block.Number,
+				"hash":      block.Hash,
+				"timestamp": block.Timestamp.Unix(),
+				"tx_count":  block.TxCount,
+			})
+			if bc, err := s.chains.get(block.ChainID); err == nil {
+				s.publishTreasury(bc)
+			}
+		case <-statsTicker.C:
+			s.publishStats()
+		}
+	}
+}
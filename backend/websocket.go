@@ -0,0 +1,507 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Time allowed to write a single message to the peer
+	wsWriteWait = 10 * time.Second
+
+	// Time allowed to read the next pong message from the peer
+	wsPongWait = 60 * time.Second
+
+	// Send pings at this interval; must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+
+	// Maximum inbound message size
+	wsMaxMessageSize = 4096
+
+	// Outbound messages buffered per client before it is considered too slow
+	wsSendBufferSize = 64
+)
+
+// wsClient is a WebSocket connection with a dedicated writer goroutine.
+// All writes go through send so the connection only ever has one writer.
+type wsClient struct {
+	conn    *websocket.Conn
+	session *ClientSession
+	ip      string
+	send    chan []byte
+
+	topics    map[string]bool
+	topicsMux sync.RWMutex
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+}
+
+func newWSClient(conn *websocket.Conn, ip string) *wsClient {
+	return &wsClient{
+		conn: conn,
+		session: &ClientSession{
+			TotalEarned: big.NewInt(0),
+			ConnectedAt: time.Now(),
+		},
+		ip:     ip,
+		send:   make(chan []byte, wsSendBufferSize),
+		topics: make(map[string]bool),
+		done:   make(chan struct{}),
+	}
+}
+
+// isSubscribed reports whether the client listens on topic
+func (c *wsClient) isSubscribed(topic string) bool {
+	c.topicsMux.RLock()
+	defer c.topicsMux.RUnlock()
+	return c.topics[topic]
+}
+
+// subscribe adds topics, already-held ones being ignored. Every topic is
+// validated first: if any is invalid or the limit would be exceeded, none
+// are added.
+func (c *wsClient) subscribe(topics []string) error {
+	normalized := make([]string, 0, len(topics))
+	for _, t := range topics {
+		topic, err := normalizeTopic(t)
+		if err != nil {
+			return err
+		}
+		normalized = append(normalized, topic)
+	}
+
+	c.topicsMux.Lock()
+	defer c.topicsMux.Unlock()
+
+	added := make(map[string]bool)
+	for _, topic := range normalized {
+		if !c.topics[topic] {
+			added[topic] = true
+		}
+	}
+	if len(c.topics)+len(added) > maxTopicsPerClient {
+		return fmt.Errorf("subscription limit of %d topics reached", maxTopicsPerClient)
+	}
+	for topic := range added {
+		c.topics[topic] = true
+	}
+	return nil
+}
+
+// unsubscribe drops topics; unknown or unheld topics are ignored
+func (c *wsClient) unsubscribe(topics []string) {
+	c.topicsMux.Lock()
+	defer c.topicsMux.Unlock()
+
+	for _, t := range topics {
+		if topic, err := normalizeTopic(t); err == nil {
+			delete(c.topics, topic)
+		}
+	}
+}
+
+// subscriptions returns the client's topics in sorted order
+func (c *wsClient) subscriptions() []string {
+	c.topicsMux.RLock()
+	defer c.topicsMux.RUnlock()
+
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return topics
+}
+
+// topicsFromMessage reads "topics" (array) or "topic" (string) from a client message
+func topicsFromMessage(msg map[string]interface{}) []string {
+	var topics []string
+	if list, ok := msg["topics"].([]interface{}); ok {
+		for _, t := range list {
+			// Non-strings become "", an invalid topic, so subscribe rejects them
+			topic, _ := t.(string)
+			topics = append(topics, topic)
+		}
+	}
+	if topic, ok := msg["topic"].(string); ok {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+// sendJSON queues a message for the writer goroutine without blocking.
+// A client whose buffer is full is evicted rather than stalling the caller.
+func (c *wsClient) sendJSON(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("⚠️ Failed to encode WebSocket message: %v", err)
+		return false
+	}
+	return c.sendRaw(data)
+}
+
+// sendRaw queues an already-encoded message; see sendJSON
+func (c *wsClient) sendRaw(data []byte) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- data:
+		return true
+	default:
+		log.Printf("🐢 Evicting slow WebSocket client %s (send buffer full)", c.ip)
+		c.close(websocket.ClosePolicyViolation, "send buffer overflow")
+		return false
+	}
+}
+
+// close asks the writer goroutine to send a close frame and drop the connection
+func (c *wsClient) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		close(c.done)
+	})
+}
+
+// writePump owns all writes to the connection, including keepalive pings
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+
+		case <-c.done:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			c.conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(c.closeCode, c.closeReason))
+			return
+		}
+	}
+}
+
+// clientIP returns the originating IP. X-Forwarded-For is only honoured
+// when the connection comes from a trusted proxy; hops are then read from
+// the right, skipping trusted proxies, since clients can prepend anything.
+func (s *Server) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	proxies, _ := parseTrustedProxies(s.cfg().TrustedProxies) // checked by Validate
+	if !isTrustedProxy(proxies, host) {
+		return host
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !isTrustedProxy(proxies, hop) {
+			return hop
+		}
+		host = hop
+	}
+	return host
+}
+
+// parseTrustedProxies parses a comma-separated list of IPs and CIDRs
+func parseTrustedProxies(list string) ([]netip.Prefix, error) {
+	var proxies []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			proxies = append(proxies, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", entry)
+		}
+		proxies = append(proxies, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return proxies, nil
+}
+
+// isTrustedProxy reports whether ip falls in one of proxies
+func isTrustedProxy(proxies []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reserveIPSlot counts a connection against the per-IP limit
+func (s *Server) reserveIPSlot(ip string) bool {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	if limit := s.cfg().MaxConnsPerIP; limit > 0 && s.connsPerIP[ip] >= limit {
+		return false
+	}
+	s.connsPerIP[ip]++
+	return true
+}
+
+// releaseIPSlot returns a connection slot reserved by reserveIPSlot
+func (s *Server) releaseIPSlot(ip string) {
+	s.clientsMux.Lock()
+	defer s.clientsMux.Unlock()
+
+	s.connsPerIP[ip]--
+	if s.connsPerIP[ip] <= 0 {
+		delete(s.connsPerIP, ip)
+	}
+}
+
+// handleWebSocket handles WebSocket connections for real-time updates
+func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	if s.draining.Load() {
+		writeError(w, asAPIError(errShuttingDown, CodeInternal))
+		return
+	}
+
+	ip := s.clientIP(r)
+	if !s.reserveIPSlot(ip) {
+		log.Printf("🚫 Rejecting WebSocket from %s: connection limit reached", ip)
+		writeError(w, newAPIError(CodeRateLimited, "too many connections", nil))
+		return
+	}
+
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.releaseIPSlot(ip)
+		log.Printf("❌ WebSocket upgrade failed: %v", err)
+		return
+	}
+
+	client := newWSClient(conn, ip)
+	client.subscribe(defaultTopics)
+
+	s.clientsMux.Lock()
+	s.clients[client] = true
+	total := len(s.clients)
+	s.clientsMux.Unlock()
+
+	log.Printf("🔗 New WebSocket connection (total: %d)", total)
+
+	go client.writePump()
+
+	// Send welcome message
+	config := s.cfg()
+	chains := make([]map[string]interface{}, 0)
+	for _, bc := range s.chains.all() {
+		chains = append(chains, map[string]interface{}{
+			"chain_id":         bc.ChainID(),
+			"network":          bc.Network(),
+			"contract_address": bc.ContractAddress(),
+		})
+	}
+	welcome := map[string]interface{}{
+		"type":    "connected",
+		"message": "Connected to ChainPay Watch-to-Earn",
+		"topics":  client.subscriptions(),
+		"config": map[string]interface{}{
+			"reward_per_heartbeat": config.RewardPerHeartbeat,
+			"contract_address":     s.chains.primary().ContractAddress(),
+			"chain_id":             s.chains.primary().ChainID(),
+			"chains":               chains,
+		},
+	}
+	client.sendJSON(welcome)
+
+	// Handle incoming messages
+	go s.handleWSMessages(client)
+}
+
+func (s *Server) handleWSMessages(client *wsClient) {
+	conn := client.conn
+	session := client.session
+
+	defer func() {
+		s.clientsMux.Lock()
+		delete(s.clients, client)
+		remaining := len(s.clients)
+		s.clientsMux.Unlock()
+		s.releaseIPSlot(client.ip)
+
+		client.close(websocket.CloseNormalClosure, "")
+		log.Printf("🔌 WebSocket disconnected (remaining: %d)", remaining)
+	}()
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var msg map[string]interface{}
+		err := conn.ReadJSON(&msg)
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("⚠️ WebSocket error: %v", err)
+			}
+			break
+		}
+
+		// Handle different message types
+		switch msg["type"] {
+		case "register":
+			addr, _ := msg["wallet_address"].(string)
+			if !common.IsHexAddress(addr) {
+				client.sendJSON(map[string]interface{}{
+					"type":    "error",
+					"code":    CodeInvalidAddress,
+					"message": errInvalidAddress.Error(),
+				})
+				continue
+			}
+
+			session.mu.Lock()
+			previous := session.WalletAddress
+			session.WalletAddress = addr
+			session.mu.Unlock()
+
+			// Follow the wallet's settlement updates, including confirmations
+			if previous != "" {
+				client.unsubscribe([]string{rewardsTopic(previous)})
+			}
+			client.subscribe([]string{rewardsTopic(addr)})
+			log.Printf("📝 Registered wallet: %s", addr[:10]+"...")
+
+			// A new wallet may register with a signed referral code
+			if code, _ := msg["referral_code"].(string); code != "" {
+				timestamp, _ := msg["timestamp"].(float64)
+				signature, _ := msg["signature"].(string)
+				b, err := s.bindReferral(addr, code, int64(timestamp), signature)
+				if err != nil {
+					apiErr := asAPIError(err, CodeInternal)
+					client.sendJSON(map[string]interface{}{
+						"type":    "error",
+						"code":    apiErr.Code,
+						"message": apiErr.Message,
+					})
+					continue
+				}
+				client.sendJSON(map[string]interface{}{
+					"type":     "referral_bound",
+					"referrer": b.Referrer,
+					"code":     b.Code,
+				})
+			}
+
+		case "heartbeat":
+			session.mu.Lock()
+			wallet := session.WalletAddress
+			session.mu.Unlock()
+			if wallet == "" {
+				continue
+			}
+
+			adID, _ := msg["ad_id"].(string)
+			chainID, _ := msg["chain_id"].(float64) // JSON numbers decode as float64
+			duration, _ := msg["duration_ms"].(float64)
+			sessionID, _ := msg["session_id"].(string)
+			rec, err := s.acceptHeartbeat(heartbeat{
+				wallet:     wallet,
+				adID:       adID,
+				chainID:    int64(chainID),
+				durationMs: int64(duration),
+				sessionID:  sessionID,
+				client:     client,
+			})
+			if err != nil {
+				client.sendJSON(map[string]interface{}{
+					"type":       "heartbeat_rejected",
+					"success":    false,
+					"error":      err.Error(),
+					"error_code": errorCode(err),
+				})
+				continue
+			}
+
+			session.mu.Lock()
+			session.Heartbeats++
+			heartbeats := session.Heartbeats
+			session.mu.Unlock()
+
+			client.sendJSON(map[string]interface{}{
+				"type":       "heartbeat_ack",
+				"reward_id":  rec.ID,
+				"chain_id":   rec.ChainID,
+				"status":     rec.Status,
+				"reward_wei": rec.RewardWei,
+				"heartbeats": heartbeats,
+			})
+
+		case "subscribe":
+			if err := client.subscribe(topicsFromMessage(msg)); err != nil {
+				client.sendJSON(map[string]interface{}{
+					"type":    "error",
+					"code":    CodeInvalidRequest,
+					"message": err.Error(),
+				})
+				continue
+			}
+			client.sendJSON(map[string]interface{}{
+				"type":   "subscribed",
+				"topics": client.subscriptions(),
+			})
+
+		case "unsubscribe":
+			client.unsubscribe(topicsFromMessage(msg))
+			client.sendJSON(map[string]interface{}{
+				"type":   "subscribed",
+				"topics": client.subscriptions(),
+			})
+
+		case "ping":
+			client.sendJSON(map[string]string{"type": "pong"})
+		}
+	}
+}
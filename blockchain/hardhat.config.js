@@ -4,12 +4,15 @@ require("dotenv").config();
 /** @type import('hardhat/config').HardhatUserConfig */
 module.exports = {
   solidity: {
-    version: "0.8.20",
+    version: "0.8.21",
     settings: {
       optimizer: {
         enabled: true,
         runs: 200
-      }
+      },
+      // No PUSH0, so the build the Go backend embeds also deploys on its
+      // simulated chain and on L2s without Shanghai
+      evmVersion: "paris"
     }
   },
   networks: {
@@ -0,0 +1,26 @@
+const hre = require("hardhat");
+const crypto = require("crypto");
+const fs = require("fs");
+const path = require("path");
+
+// Copies the compiled RewardTreasury into the Go backend, which embeds it for
+// demo mode and its tests, with the hash of the source it was compiled from
+async function main() {
+  const artifact = await hre.artifacts.readArtifact("RewardTreasury");
+  const source = fs.readFileSync(path.join(hre.config.paths.root, artifact.sourceName));
+  const testdata = path.join(hre.config.paths.root, "..", "backend", "testdata");
+
+  fs.writeFileSync(path.join(testdata, "RewardTreasury.json"), JSON.stringify(artifact, null, 2) + "\n");
+  fs.writeFileSync(
+    path.join(testdata, "RewardTreasury.sol.sha256"),
+    crypto.createHash("sha256").update(source).digest("hex") + "\n"
+  );
+  console.log("📦 Exported", artifact.sourceName, "to", path.relative(process.cwd(), testdata));
+}
+
+main()
+  .then(() => process.exit(0))
+  .catch((error) => {
+    console.error(error);
+    process.exit(1);
+  });
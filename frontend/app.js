@@ -217,6 +217,7 @@ class ChainPayApp {
                 console.log('📡 Received welcome message:', data);
                 if (data.config) {
                     this.rewardPerHeartbeat = BigInt(data.config.reward_per_heartbeat || 1000);
+                    this.chainId = data.config.chain_id;
                     this.elements.rewardRate.textContent = this.rewardPerHeartbeat.toString();
                     if (data.config.contract_address) {
                         this.elements.contractAddress.textContent = data.config.contract_address;
@@ -229,10 +230,26 @@ class ChainPayApp {
                 break;
 
             case 'block':
+                // Multi-chain backends publish blocks for every chain; show the default one
+                if (this.chainId && data.chain_id && data.chain_id !== this.chainId) {
+                    break;
+                }
                 this.elements.currentBlock.textContent = data.number;
                 this.updateBlockchainStatus('connected');
                 break;
 
+            case 'heartbeat_ack':
+                // Heartbeat accepted; the reward message follows once settled
+                break;
+
+            case 'heartbeat_rejected':
+                this.log('error', `Heartbeat rejected: ${data.error}`);
+                break;
+
+            case 'reward_status':
+                console.log(`📦 Reward ${data.reward_id} ${data.status}`, data.tx_hash);
+                break;
+
             case 'pong':
                 // Heartbeat response
                 break;
@@ -330,7 +347,7 @@ class ChainPayApp {
         }
 
         try {
-            const response = await fetch(`${this.config.backendUrl}/api/balance/${this.wallet.getAddress()}`);
+            const response = await fetch(`${this.config.backendUrl}/api/v1/balance/${this.wallet.getAddress()}`);
             if (response.ok) {
                 const data = await response.json();
                 this.wallet.updateBalance(data.balance_wei);
@@ -504,7 +521,7 @@ class ChainPayApp {
     async sendHeartbeatHttp() {
         console.log('📤 Sending heartbeat via HTTP to:', this.config.backendUrl);
         try {
-            const response = await fetch(`${this.config.backendUrl}/api/heartbeat`, {
+            const response = await fetch(`${this.config.backendUrl}/api/v1/heartbeat`, {
                 method: 'POST',
                 headers: { 'Content-Type': 'application/json' },
                 body: JSON.stringify({
@@ -582,7 +599,7 @@ class ChainPayApp {
             const backendUrl = this.config.backendUrl || window.ChainPayConfig?.deployedBackendUrl;
             if (!backendUrl) return;
             
-            const response = await fetch(`${backendUrl}/api/stats`);
+            const response = await fetch(`${backendUrl}/api/v1/stats`);
             if (response.ok) {
                 const data = await response.json();
                 console.log('📊 Treasury stats:', data);
@@ -615,7 +632,7 @@ class ChainPayApp {
      */
     async checkBackendHealth() {
         try {
-            const response = await fetch(`${this.config.backendUrl}/api/health`);
+            const response = await fetch(`${this.config.backendUrl}/api/v1/health`);
             if (response.ok) {
                 const data = await response.json();
                 this.updateBlockchainStatus(data.blockchain ? 'connected' : 'disconnected');